@@ -0,0 +1,76 @@
+package kludge
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// admin makes a request to one of the datastore's admin endpoints,
+// returning the JSON it answers with, whether with a 200 or a 201.
+func (ds *DataStore) admin(ctx context.Context, method, path string) (json.RawMessage, error) {
+	resp, err := ds.do(ctx, method, path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	body, ok, err := readValue(resp)
+	if err != nil {
+		return nil, err
+	} else if !ok && resp.StatusCode != http.StatusCreated {
+		return nil, &StatusError{resp.StatusCode, string(body)}
+	}
+	return json.RawMessage(body), nil
+}
+
+// Stats returns the counters of the frontend answering and of every
+// node, as the JSON object described in the specification.
+func (ds *DataStore) Stats() (json.RawMessage, error) {
+	return ds.StatsContext(context.Background())
+}
+
+// StatsContext is like Stats, but aborts the request if the context is
+// cancelled.
+func (ds *DataStore) StatsContext(ctx context.Context) (json.RawMessage, error) {
+	return ds.admin(ctx, "GET", "/admin/stats")
+}
+
+// Cluster returns the members of the cluster as a JSON list.
+func (ds *DataStore) Cluster() (json.RawMessage, error) {
+	return ds.ClusterContext(context.Background())
+}
+
+// ClusterContext is like Cluster, but aborts the request if the
+// context is cancelled.
+func (ds *DataStore) ClusterContext(ctx context.Context) (json.RawMessage, error) {
+	return ds.admin(ctx, "GET", "/admin/cluster")
+}
+
+// RebalanceStatus returns the rebalancing progress of every node as a
+// JSON object.
+func (ds *DataStore) RebalanceStatus() (json.RawMessage, error) {
+	return ds.RebalanceStatusContext(context.Background())
+}
+
+// RebalanceStatusContext is like RebalanceStatus, but aborts the
+// request if the context is cancelled.
+func (ds *DataStore) RebalanceStatusContext(ctx context.Context) (json.RawMessage, error) {
+	return ds.admin(ctx, "GET", "/admin/rebalance")
+}
+
+// Cleanup asks every node to remove the records it has handed off in
+// a rebalance, returning the number each removed. It fails with a
+// *StatusError whose StatusCode is 409 until every node has settled.
+func (ds *DataStore) Cleanup() (removed map[string]int64, err error) {
+	return ds.CleanupContext(context.Background())
+}
+
+// CleanupContext is like Cleanup, but aborts the request if the
+// context is cancelled.
+func (ds *DataStore) CleanupContext(ctx context.Context) (removed map[string]int64, err error) {
+	body, err := ds.admin(ctx, "POST", "/admin/rebalance/cleanup")
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &removed)
+	return
+}
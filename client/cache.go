@@ -0,0 +1,204 @@
+package kludge
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CacheStats counts the reads a DataStore's cache has served. Hits
+// were answered from the cache without asking the datastore,
+// Revalidated were confirmed to be current by the datastore without
+// the value being sent again, and Misses were fetched in full.
+type CacheStats struct {
+	Hits        int64
+	Revalidated int64
+	Misses      int64
+	Entries     int
+	Bytes       int64
+}
+
+type cacheEntry struct {
+	key     string
+	value   []byte
+	etag    string
+	fetched time.Time
+}
+
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+// cache is a least-recently-used cache of values, bounded by the total
+// size of the keys and values it holds.
+type cache struct {
+	lock   sync.Mutex
+	max    int64
+	maxAge time.Duration
+	size   int64
+	lru    *list.List
+	items  map[string]*list.Element
+
+	// gen is advanced whenever an entry is invalidated, so that reads
+	// that were in flight at the time do not put back a value that may
+	// be out of date.
+	gen uint64
+
+	stats CacheStats
+}
+
+func newCache(max int64, maxAge time.Duration) *cache {
+	return &cache{
+		max:    max,
+		maxAge: maxAge,
+		lru:    list.New(),
+		items:  make(map[string]*list.Element, 0),
+	}
+}
+
+// get returns the entry for a key, whether it is recent enough to be
+// used without revalidation, and the cache's generation.
+func (c *cache) get(key string) (e *cacheEntry, fresh bool, gen uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elt, ok := c.items[key]; ok {
+		c.lru.MoveToFront(elt)
+		e = elt.Value.(*cacheEntry)
+		fresh = c.maxAge > 0 && time.Since(e.fetched) < c.maxAge
+	}
+	return e, fresh, c.gen
+}
+
+// put stores a value, unless an entry has been invalidated since the
+// generation given was read.
+func (c *cache) put(key string, value []byte, etag string, gen uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if gen != c.gen {
+		return
+	}
+	c.removeKey(key)
+	e := &cacheEntry{key, value, etag, time.Now()}
+	if e.size() > c.max {
+		return
+	}
+	c.items[key] = c.lru.PushFront(e)
+	c.size += e.size()
+	for c.size > c.max {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// touch marks an entry as just revalidated.
+func (c *cache) touch(e *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e.fetched = time.Now()
+}
+
+// invalidate drops a key from the cache.
+func (c *cache) invalidate(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.gen++
+	c.removeKey(key)
+}
+
+func (c *cache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.gen++
+	c.lru.Init()
+	c.items = make(map[string]*list.Element, 0)
+	c.size = 0
+}
+
+func (c *cache) removeKey(key string) {
+	if elt, ok := c.items[key]; ok {
+		c.removeElement(elt)
+	}
+}
+
+func (c *cache) removeElement(elt *list.Element) {
+	e := c.lru.Remove(elt).(*cacheEntry)
+	delete(c.items, e.key)
+	c.size -= e.size()
+}
+
+func (c *cache) count(hits, revalidated, misses int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stats.Hits += hits
+	c.stats.Revalidated += revalidated
+	c.stats.Misses += misses
+}
+
+// Invalidate drops a key from the DataStore's cache, if it has one, so
+// that the next read fetches it from the datastore. Keys written
+// through the DataStore are invalidated automatically; this is for
+// changes learned of some other way.
+func (ds *DataStore) Invalidate(key string) {
+	if ds.cache != nil {
+		ds.cache.invalidate(key)
+	}
+}
+
+// InvalidateAll empties the DataStore's cache, if it has one.
+func (ds *DataStore) InvalidateAll() {
+	if ds.cache != nil {
+		ds.cache.clear()
+	}
+}
+
+// CacheStats returns the counters of the DataStore's cache; they are
+// all zero if it has none.
+func (ds *DataStore) CacheStats() (stats CacheStats) {
+	if ds.cache == nil {
+		return
+	}
+	ds.cache.lock.Lock()
+	defer ds.cache.lock.Unlock()
+	stats = ds.cache.stats
+	stats.Entries = len(ds.cache.items)
+	stats.Bytes = ds.cache.size
+	return
+}
+
+// cachedGet reads a key through the cache. Cached values that are too
+// old to be used as they are are revalidated with their entity tag.
+func (ds *DataStore) cachedGet(ctx context.Context, key string) (value []byte, ok bool, err error) {
+	e, fresh, gen := ds.cache.get(key)
+	if fresh {
+		ds.cache.count(1, 0, 0)
+		return append([]byte{}, e.value...), true, nil
+	}
+
+	var header http.Header
+	if e != nil {
+		header = http.Header{"If-None-Match": {e.etag}}
+	}
+	resp, err := ds.do(ctx, "GET", "/data/"+key, nil, header)
+	if err != nil {
+		return
+	}
+	if e != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		ds.cache.touch(e)
+		ds.cache.count(0, 1, 0)
+		return append([]byte{}, e.value...), true, nil
+	}
+
+	ds.cache.count(0, 0, 1)
+	etag := resp.Header.Get("ETag")
+	if value, ok, err = readValue(resp); err != nil {
+		return
+	}
+	if ok && etag != "" {
+		ds.cache.put(key, append([]byte{}, value...), etag, gen)
+	} else {
+		ds.cache.invalidate(key)
+	}
+	return
+}
@@ -0,0 +1,116 @@
+package kludge
+
+import (
+	"fmt"
+	"github.com/gokyle/kludge/client/kludgetest"
+	"testing"
+	"time"
+)
+
+func cachedStore(t *testing.T, maxBytes int64, maxAge time.Duration) (*DataStore, *kludgetest.Server) {
+	srv := kludgetest.NewServer()
+	ds, err := Connect(srv.Addr(), nil, WithCache(maxBytes, maxAge))
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	return ds, srv
+}
+
+func mustGet(t *testing.T, ds *DataStore, key, expected string) {
+	v, ok, err := ds.Get(key)
+	if err != nil || !ok || string(v) != expected {
+		fmt.Printf("[!] GET %s returned %q, %v, %v; expected %q\n", key, v,
+			ok, err, expected)
+		t.FailNow()
+	}
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	ds, srv := cachedStore(t, 1024, 0)
+	defer srv.Close()
+	srv.Set("foo", []byte("bar"))
+
+	mustGet(t, ds, "foo", "bar")
+	mustGet(t, ds, "foo", "bar")
+	if stats := ds.CacheStats(); stats.Misses != 1 || stats.Revalidated != 1 {
+		fmt.Printf("[!] bad cache stats: %+v\n", stats)
+		t.FailNow()
+	}
+
+	// A change made by another client is seen on revalidation.
+	srv.Set("foo", []byte("baz"))
+	mustGet(t, ds, "foo", "baz")
+	srv.Del("foo")
+	if _, ok, _ := ds.Get("foo"); ok {
+		fmt.Println("[!] deleted key served from the cache")
+		t.FailNow()
+	}
+	if stats := ds.CacheStats(); stats.Entries != 0 {
+		fmt.Println("[!] deleted key left in the cache")
+		t.FailNow()
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	ds, srv := cachedStore(t, 1024, time.Hour)
+	defer srv.Close()
+	srv.Set("foo", []byte("bar"))
+
+	mustGet(t, ds, "foo", "bar")
+	before := srv.Requests()
+	srv.Set("foo", []byte("baz"))
+	mustGet(t, ds, "foo", "bar")
+	if srv.Requests() != before {
+		fmt.Println("[!] fresh entry was revalidated")
+		t.FailNow()
+	}
+
+	ds.Invalidate("foo")
+	mustGet(t, ds, "foo", "baz")
+
+	// Writes through the DataStore drop the cached value.
+	ds.Set("foo", []byte("quux"))
+	mustGet(t, ds, "foo", "quux")
+	ds.Del("foo")
+	if _, ok, _ := ds.Get("foo"); ok {
+		fmt.Println("[!] deleted key served from the cache")
+		t.FailNow()
+	}
+	if stats := ds.CacheStats(); stats.Hits != 1 {
+		fmt.Printf("[!] bad cache stats: %+v\n", stats)
+		t.FailNow()
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	ds, srv := cachedStore(t, 16, time.Hour)
+	defer srv.Close()
+	srv.Set("a", []byte("1234567"))
+	srv.Set("b", []byte("1234567"))
+	srv.Set("big", []byte("0123456789abcdef"))
+
+	mustGet(t, ds, "a", "1234567")
+	mustGet(t, ds, "b", "1234567")
+	mustGet(t, ds, "a", "1234567")
+	mustGet(t, ds, "big", "0123456789abcdef")
+	if stats := ds.CacheStats(); stats.Entries != 2 || stats.Bytes != 16 {
+		fmt.Printf("[!] value larger than the cache was kept: %+v\n", stats)
+		t.FailNow()
+	}
+
+	// b was used least recently, and makes way for c.
+	srv.Set("c", []byte("x"))
+	mustGet(t, ds, "c", "x")
+	before := srv.Requests()
+	mustGet(t, ds, "a", "1234567")
+	if srv.Requests() != before {
+		fmt.Println("[!] recently used entry was evicted")
+		t.FailNow()
+	}
+	mustGet(t, ds, "b", "1234567")
+	if srv.Requests() == before {
+		fmt.Println("[!] least recently used entry was kept")
+		t.FailNow()
+	}
+}
@@ -2,18 +2,40 @@ package kludge
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/gokyle/kludge/common"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Type DataStore provides for datastore interaction.
 type DataStore struct {
-	address string
-	client  *http.Client
+	endpoints []*endpoint
+	next      *uint32
+	balancer  Balancer
+	retry     struct {
+		attempts  int
+		base, max time.Duration
+	}
+	healthInterval time.Duration
+	done           chan struct{}
+	closeOnce      sync.Once
+	cache          *cache
+	cacheWatch     bool
+	ns             string
+
+	scheme    string
+	basePath  string
+	header    http.Header
+	userAgent string
+	client    *http.Client
 }
 
 var versionRegexp = regexp.MustCompile("^kludge-\\d+\\.\\d|\\.\\d+$")
@@ -22,6 +44,22 @@ var versionRegexp = regexp.MustCompile("^kludge-\\d+\\.\\d|\\.\\d+$")
 // passed in to the Connect function doesn't point to a valid kludge server.
 var ErrInvalidDatastore = fmt.Errorf("invalid datastore")
 
+// StatusError is returned when the datastore answers a request with a
+// status other than those its API uses to report success or a missing
+// key; a StatusCode of 503 means that too few replicas were available.
+// Reads refused with a 503 are retried on other frontends, but writes
+// are not, as they may have been partly applied: the caller must retry
+// them itself.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("kludge: %d %s: %s", e.StatusCode,
+		http.StatusText(e.StatusCode), e.Message)
+}
+
 // ClientVersion returns the client's version information.
 func ClientVersion() string {
 	return common.Version()
@@ -30,30 +68,120 @@ func ClientVersion() string {
 // Connect initialises a new DataStore value that will connect to the
 // target datastore. It takes an address which should be an ip:port pointing
 // to the front end, and a pointer to an http.Client. If the client is nil,
-// the default client will be used.
-func Connect(addr string, client *http.Client) (ds *DataStore, err error) {
-	ds = new(DataStore)
+// the default client will be used. Any options are applied to a copy of
+// the client, which is left as it was.
+func Connect(addr string, client *http.Client, opts ...Option) (ds *DataStore, err error) {
+	return ConnectClusterContext(context.Background(), []string{addr},
+		client, opts...)
+}
+
+// ConnectContext is like Connect, but checks the datastore's version
+// within the context.
+func ConnectContext(ctx context.Context, addr string, client *http.Client, opts ...Option) (ds *DataStore, err error) {
+	return ConnectClusterContext(ctx, []string{addr}, client, opts...)
+}
+
+// ConnectCluster is like Connect, but spreads requests across several
+// frontends to the same datastore. Frontends that fail are passed over
+// until they recover, and failed requests are retried on the others as
+// described for WithRetry. At least one of the frontends must be
+// reachable.
+func ConnectCluster(addrs []string, client *http.Client, opts ...Option) (ds *DataStore, err error) {
+	return ConnectClusterContext(context.Background(), addrs, client, opts...)
+}
+
+// ConnectClusterContext is like ConnectCluster, but checks the
+// frontends within the context.
+func ConnectClusterContext(ctx context.Context, addrs []string, client *http.Client, opts ...Option) (ds *DataStore, err error) {
+	if len(addrs) == 0 {
+		return nil, ErrInvalidDatastore
+	}
 	if client == nil {
-		ds.client = http.DefaultClient
+		client = http.DefaultClient
+	}
+	ds = &DataStore{
+		next:      new(uint32),
+		balancer:  RoundRobin,
+		done:      make(chan struct{}),
+		scheme:    "http",
+		header:    make(http.Header),
+		userAgent: "kludge-client/" + ClientVersion(),
+	}
+	ds.retry.attempts = 3
+	ds.retry.base = 50 * time.Millisecond
+	ds.retry.max = time.Second
+	for _, addr := range addrs {
+		ds.endpoints = append(ds.endpoints, &endpoint{addr: addr, healthy: true})
+	}
+	c := *client
+	ds.client = &c
+	for _, opt := range opts {
+		opt(ds)
 	}
-	ds.address = "http://" + addr
 
-	if ver := ds.Version(); ver == "" {
-		err = ErrInvalidDatastore
-	} else if !versionRegexp.MatchString(ver) {
-		err = ErrInvalidDatastore
+	err = ErrInvalidDatastore
+	for _, ep := range ds.endpoints {
+		if ds.check(ctx, ep) != "" {
+			err = nil
+		}
+	}
+	if err == nil && ds.cache != nil && ds.cacheWatch {
+		err = ds.watchCache()
+	}
+	if err == nil && ds.healthInterval > 0 {
+		go ds.healthCheck(ds.healthInterval)
+	}
+	return
+}
+
+// url returns the URL of a path in the datastore's API on an endpoint.
+// In a namespace, every path but the admin endpoints' is the
+// namespace's.
+func (ds *DataStore) url(ep *endpoint, path string) string {
+	if ds.ns != "" && !strings.HasPrefix(path, "/admin/") {
+		path = "/ns/" + url.PathEscape(ds.ns) + path
+	}
+	return ds.scheme + "://" + ep.addr + ds.basePath + path
+}
+
+// readValue reads the value in a response to a request for a key. The
+// value is returned with ok true if the key was present; a write the
+// datastore accepted without knowing whether the key was present is
+// returned as though it was not. A status the API does not use for a
+// key, or a 404 naming an error, such as a missing namespace, rather
+// than a missing key, is returned as a StatusError.
+func readValue(resp *http.Response) (value []byte, ok bool, err error) {
+	defer resp.Body.Close()
+	value, err = ioutil.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		ok = true
+	case resp.StatusCode == http.StatusCreated, resp.StatusCode == http.StatusAccepted:
+	case resp.StatusCode == http.StatusNotFound && resp.Header.Get("X-Kludge-Error") == "":
+	default:
+		if err == nil {
+			err = &StatusError{resp.StatusCode, string(value)}
+		}
+		value = nil
 	}
 	return
 }
 
 // The Version method returns the datastore's version string.
 func (ds *DataStore) Version() string {
-	resp, err := ds.client.Head(ds.address + "/data")
+	return ds.VersionContext(context.Background())
+}
+
+// VersionContext is like Version, but aborts the request if the
+// context is cancelled.
+func (ds *DataStore) VersionContext(ctx context.Context) string {
+	resp, err := ds.do(ctx, "HEAD", "/data", nil, nil)
 	if err != nil {
 		return ""
 	}
+	resp.Body.Close()
 
-	return resp.Header["X-Kludge-Version"][0]
+	return resp.Header.Get("X-Kludge-Version")
 }
 
 // Get retrieves the value of a Unicode-encoded key from the datastore. It
@@ -61,19 +189,20 @@ func (ds *DataStore) Version() string {
 // indicating whether the key is present in the datastore, and an error
 // value storing any error that occurred retrieving the key's value.
 func (ds *DataStore) Get(key string) (value []byte, ok bool, err error) {
-	url := ds.address + "/data/" + key
-	resp, err := ds.client.Get(url)
+	return ds.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but aborts the request if the context is
+// cancelled.
+func (ds *DataStore) GetContext(ctx context.Context, key string) (value []byte, ok bool, err error) {
+	if ds.cache != nil {
+		return ds.cachedGet(ctx, key)
+	}
+	resp, err := ds.do(ctx, "GET", "/data/"+key, nil, nil)
 	if err != nil {
 		return
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusOK {
-		ok = true
-	}
-
-	value, err = ioutil.ReadAll(resp.Body)
-	return
+	return readValue(resp)
 }
 
 // Set sets a new value for the key in the datastore. If the key is present,
@@ -82,20 +211,25 @@ func (ds *DataStore) Get(key string) (value []byte, ok bool, err error) {
 // present in the datastore already, and an error containing any error that
 // occurred setting the key.
 func (ds *DataStore) Set(key string, value []byte) (prev []byte, ok bool, err error) {
-	url := ds.address + "/data/" + key
-	buf := bytes.NewBuffer(value)
-	resp, err := ds.client.Post(url, "application/json", buf)
+	return ds.SetContext(context.Background(), key, value)
+}
+
+// SetContext is like Set, but aborts the request if the context is
+// cancelled. A write that is aborted may still take effect.
+func (ds *DataStore) SetContext(ctx context.Context, key string, value []byte) (prev []byte, ok bool, err error) {
+	return ds.set(ctx, key, value, "application/json")
+}
+
+// set stores a value, sending it with the given content type.
+func (ds *DataStore) set(ctx context.Context, key string, value []byte, contentType string) (prev []byte, ok bool, err error) {
+	ds.Invalidate(key)
+	defer ds.Invalidate(key)
+	resp, err := ds.do(ctx, "POST", "/data/"+key, bytes.NewReader(value),
+		http.Header{"Content-Type": {contentType}})
 	if err != nil {
 		return
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusOK {
-		ok = true
-	}
-
-	prev, err = ioutil.ReadAll(resp.Body)
-	return
+	return readValue(resp)
 }
 
 // Del removes a key from the datastore. It returns three values: the value of
@@ -103,37 +237,38 @@ func (ds *DataStore) Set(key string, value []byte) (prev []byte, ok bool, err er
 // in the database, and any error that occurred while deleting the key. The
 // boolean will be true if the key was in the database and removed.
 func (ds *DataStore) Del(key string) (prev []byte, ok bool, err error) {
-	url := ds.address + "/data/" + key
-	req, err := http.NewRequest("DELETE", url, nil)
-	if err != nil {
-		return
-	}
-	resp, err := ds.client.Do(req)
+	return ds.DelContext(context.Background(), key)
+}
+
+// DelContext is like Del, but aborts the request if the context is
+// cancelled. A delete that is aborted may still take effect.
+func (ds *DataStore) DelContext(ctx context.Context, key string) (prev []byte, ok bool, err error) {
+	ds.Invalidate(key)
+	defer ds.Invalidate(key)
+	resp, err := ds.do(ctx, "DELETE", "/data/"+key, nil, nil)
 	if err != nil {
 		return
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusOK {
-		ok = true
-	}
-
-	prev, err = ioutil.ReadAll(resp.Body)
-	return
+	return readValue(resp)
 }
 
 // List returns a slice of all the keys in the datastore as Unicode strings.
 func (ds *DataStore) List() (keys []string, err error) {
-	url := ds.address + "/data"
-	resp, err := ds.client.Get(url)
+	return ds.ListContext(context.Background())
+}
+
+// ListContext is like List, but aborts the request if the context is
+// cancelled.
+func (ds *DataStore) ListContext(ctx context.Context) (keys []string, err error) {
+	resp, err := ds.do(ctx, "GET", "/data", nil, nil)
 	if err != nil {
 		return
 	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
+	body, ok, err := readValue(resp)
 	if err != nil {
 		return
+	} else if !ok {
+		return nil, &StatusError{resp.StatusCode, string(body)}
 	}
 	keys = make([]string, 0)
 	err = json.Unmarshal(body, &keys)
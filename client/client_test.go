@@ -2,20 +2,20 @@ package kludge
 
 import (
 	"fmt"
+	"github.com/gokyle/kludge/client/kludgetest"
 	"os"
 	"testing"
 )
 
-var TestServer = "127.0.0.1:8080"
+var TestServer string
 
-func init() {
-	ds, err := Connect(TestServer, nil)
-	if err != nil {
-		fmt.Println("[!] database couldn't be reached")
-		os.Exit(1)
-	}
-	ds.Set("foo", []byte("bar"))
-	ds.Del("baz")
+func TestMain(m *testing.M) {
+	srv := kludgetest.NewServer()
+	srv.Set("foo", []byte("bar"))
+	TestServer = srv.Addr()
+	code := m.Run()
+	srv.Close()
+	os.Exit(code)
 }
 
 func TestConnect(t *testing.T) {
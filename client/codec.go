@@ -0,0 +1,150 @@
+package kludge
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// A Codec converts between values and the bytes stored in the
+// datastore. ContentType names the encoding; it is sent with the
+// values a Store writes.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	ContentType() string
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) ContentType() string                        { return "application/json" }
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (gobCodec) ContentType() string { return "application/x-gob" }
+
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("kludge: raw codec cannot encode %T", v)
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = append([]byte{}, data...)
+	case *string:
+		*v = string(data)
+	default:
+		return fmt.Errorf("kludge: raw codec cannot decode into %T", v)
+	}
+	return nil
+}
+
+func (rawCodec) ContentType() string { return "application/octet-stream" }
+
+var (
+	// JSON encodes values as JSON.
+	JSON Codec = jsonCodec{}
+
+	// Gob encodes values with encoding/gob. Each value is encoded with
+	// its own type information, so it may be decoded on its own.
+	Gob Codec = gobCodec{}
+
+	// Raw stores []byte and string values as they are.
+	Raw Codec = rawCodec{}
+)
+
+// Store wraps a DataStore to store values of a single type, encoded
+// with a codec. Its methods mirror those of the DataStore, taking and
+// returning decoded values; a value that cannot be decoded is reported
+// as an error, along with whether the key was present.
+type Store[T any] struct {
+	ds    *DataStore
+	codec Codec
+}
+
+// NewStore returns a Store of values of type T over the DataStore. If
+// the codec is nil, values are encoded as JSON.
+func NewStore[T any](ds *DataStore, codec Codec) *Store[T] {
+	if codec == nil {
+		codec = JSON
+	}
+	return &Store[T]{ds, codec}
+}
+
+// DataStore returns the DataStore the Store writes to.
+func (s *Store[T]) DataStore() *DataStore {
+	return s.ds
+}
+
+// decode decodes a value returned by the DataStore.
+func (s *Store[T]) decode(data []byte, ok bool, err error) (v T, _ bool, _ error) {
+	if err != nil || !ok {
+		return v, ok, err
+	}
+	if err = s.codec.Unmarshal(data, &v); err != nil {
+		err = fmt.Errorf("kludge: failed to decode value: %s", err.Error())
+	}
+	return v, ok, err
+}
+
+// Get retrieves and decodes the value of a key.
+func (s *Store[T]) Get(key string) (T, bool, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but aborts the request if the context is
+// cancelled.
+func (s *Store[T]) GetContext(ctx context.Context, key string) (T, bool, error) {
+	return s.decode(s.ds.GetContext(ctx, key))
+}
+
+// Set encodes and stores a value, returning the previous value of the
+// key if it was present.
+func (s *Store[T]) Set(key string, value T) (T, bool, error) {
+	return s.SetContext(context.Background(), key, value)
+}
+
+// SetContext is like Set, but aborts the request if the context is
+// cancelled.
+func (s *Store[T]) SetContext(ctx context.Context, key string, value T) (prev T, ok bool, err error) {
+	data, err := s.codec.Marshal(value)
+	if err != nil {
+		return
+	}
+	return s.decode(s.ds.set(ctx, key, data, s.codec.ContentType()))
+}
+
+// Del removes a key, returning its value if it was present.
+func (s *Store[T]) Del(key string) (T, bool, error) {
+	return s.DelContext(context.Background(), key)
+}
+
+// DelContext is like Del, but aborts the request if the context is
+// cancelled.
+func (s *Store[T]) DelContext(ctx context.Context, key string) (T, bool, error) {
+	return s.decode(s.ds.DelContext(ctx, key))
+}
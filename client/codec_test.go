@@ -0,0 +1,113 @@
+package kludge
+
+import (
+	"fmt"
+	"github.com/gokyle/kludge/client/kludgetest"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// testStore connects to a new in-memory server, and returns the
+// DataStore, the server and a function that stops it.
+func testStore(t *testing.T) (*DataStore, *kludgetest.Server, func()) {
+	srv := kludgetest.NewServer()
+	ds, err := Connect(srv.Addr(), nil)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	return ds, srv, srv.Close
+}
+
+// stored returns the value the server holds for a key, and the content
+// type it returns the value with.
+func stored(srv *kludgetest.Server, key string) (string, string) {
+	resp, err := http.Get(srv.URL + "/data/" + key)
+	if err != nil {
+		return "", ""
+	}
+	defer resp.Body.Close()
+	v, _ := ioutil.ReadAll(resp.Body)
+	return string(v), resp.Header.Get("Content-Type")
+}
+
+type point struct {
+	X, Y int
+}
+
+func TestJSONStore(t *testing.T) {
+	ds, srv, done := testStore(t)
+	defer done()
+	s := NewStore[point](ds, nil)
+
+	if _, ok, err := s.Set("p", point{1, 2}); err != nil || ok {
+		fmt.Println("[!] SET failed:", ok, err)
+		t.FailNow()
+	}
+	if v, ct := stored(srv, "p"); ct != "application/json" || v != `{"X":1,"Y":2}` {
+		fmt.Printf("[!] stored %q as %s\n", v, ct)
+		t.FailNow()
+	}
+	prev, ok, err := s.Set("p", point{3, 4})
+	if err != nil || !ok || prev != (point{1, 2}) {
+		fmt.Println("[!] bad previous value:", prev, ok, err)
+		t.FailNow()
+	}
+	if p, ok, err := s.Get("p"); err != nil || !ok || p != (point{3, 4}) {
+		fmt.Println("[!] GET failed:", p, ok, err)
+		t.FailNow()
+	}
+	if p, ok, err := s.Del("p"); err != nil || !ok || p != (point{3, 4}) {
+		fmt.Println("[!] DEL failed:", p, ok, err)
+		t.FailNow()
+	}
+	if _, ok, err := s.Get("p"); err != nil || ok {
+		fmt.Println("[!] key still present:", ok, err)
+		t.FailNow()
+	}
+
+	ds.Set("p", []byte("not json"))
+	if _, ok, err := s.Get("p"); err == nil || !ok {
+		fmt.Println("[!] expected a decoding error")
+		t.FailNow()
+	}
+}
+
+func TestGobStore(t *testing.T) {
+	ds, srv, done := testStore(t)
+	defer done()
+	s := NewStore[map[string]point](ds, Gob)
+
+	m := map[string]point{"a": {1, 2}, "b": {3, 4}}
+	s.Set("m", m)
+	if _, ct := stored(srv, "m"); ct != "application/x-gob" {
+		fmt.Println("[!] bad content type:", ct)
+		t.FailNow()
+	}
+	got, ok, err := s.Get("m")
+	if err != nil || !ok || len(got) != 2 || got["b"] != m["b"] {
+		fmt.Println("[!] GET failed:", got, ok, err)
+		t.FailNow()
+	}
+}
+
+func TestRawStore(t *testing.T) {
+	ds, srv, done := testStore(t)
+	defer done()
+	s := NewStore[string](ds, Raw)
+
+	s.Set("s", "hello")
+	if v, ct := stored(srv, "s"); ct != "application/octet-stream" || v != "hello" {
+		fmt.Printf("[!] stored %q as %s\n", v, ct)
+		t.FailNow()
+	}
+	if v, ok, err := NewStore[[]byte](ds, Raw).Get("s"); err != nil || !ok || string(v) != "hello" {
+		fmt.Println("[!] GET failed:", v, ok, err)
+		t.FailNow()
+	}
+	if _, _, err := NewStore[int](ds, Raw).Set("i", 1); err == nil {
+		fmt.Println("[!] raw codec encoded an int")
+		t.FailNow()
+	}
+}
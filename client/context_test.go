@@ -0,0 +1,78 @@
+package kludge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContextCancel(t *testing.T) {
+	aborted := make(chan bool, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Kludge-Version", common.Version())
+		if r.Method == "HEAD" {
+			return
+		}
+		// Hang until the client gives up. The server only notices the
+		// client going away once the body has been read.
+		ioutil.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+			aborted <- true
+		case <-time.After(5 * time.Second):
+			aborted <- false
+		}
+	}))
+	defer srv.Close()
+
+	ds, err := Connect(strings.TrimPrefix(srv.URL, "http://"), nil)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err = ds.GetContext(ctx, "foo")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		fmt.Println("[!] expected the deadline to be exceeded, got", err)
+		t.FailNow()
+	} else if time.Since(start) > time.Second {
+		fmt.Println("[!] request was not aborted at the deadline")
+		t.FailNow()
+	}
+	if !<-aborted {
+		fmt.Println("[!] server did not see the request aborted")
+		t.FailNow()
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, _, err = ds.SetContext(ctx, "foo", []byte("bar")); !errors.Is(err, context.Canceled) {
+		fmt.Println("[!] expected the request to be cancelled, got", err)
+		t.FailNow()
+	}
+	<-aborted
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err = ds.ListContext(ctx); !errors.Is(err, context.Canceled) {
+		fmt.Println("[!] request went ahead with a cancelled context:", err)
+		t.FailNow()
+	}
+	if _, err = ConnectContext(ctx, strings.TrimPrefix(srv.URL, "http://"), nil); err != ErrInvalidDatastore {
+		fmt.Println("[!] connect succeeded with a cancelled context")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,216 @@
+package kludge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gokyle/kludge/merkle"
+	"github.com/gokyle/kludge/ring"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// A DiffResult lists the keys in which a target datastore differs from
+// a source: those Missing from the target, those Extra in it, and
+// those whose values or content types are Different. Each list is in
+// key order.
+type DiffResult struct {
+	Missing   []string `json:"missing"`
+	Extra     []string `json:"extra"`
+	Different []string `json:"different"`
+}
+
+// Same reports whether the datastores were found to hold the same keys
+// and values.
+func (d DiffResult) Same() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0 && len(d.Different) == 0
+}
+
+type keyDigest struct {
+	Key  string `json:"key"`
+	Hash []byte `json:"hash"`
+}
+
+// digest fetches the datastore's hash tree over the keys beginning
+// with prefix; a depth of zero leaves it to the datastore.
+func (ds *DataStore) digest(ctx context.Context, prefix string, depth int) (*merkle.Tree, error) {
+	q := url.Values{}
+	q.Set("prefix", prefix)
+	if depth > 0 {
+		q.Set("depth", strconv.Itoa(depth))
+	}
+	resp, err := ds.do(ctx, "GET", "/digest?"+q.Encode(), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	body, ok, err := readValue(resp)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, &StatusError{resp.StatusCode, string(body)}
+	}
+	var d struct {
+		Tree []byte `json:"tree"`
+	}
+	if err = json.Unmarshal(body, &d); err != nil {
+		return nil, err
+	}
+	tree := new(merkle.Tree)
+	if err = tree.UnmarshalBinary(d.Tree); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// keyDigests fetches the hashes of the keys beginning with prefix in
+// the ranges of tokens.
+func (ds *DataStore) keyDigests(ctx context.Context, prefix string, ranges []ring.Range) (map[string][]byte, error) {
+	body, err := json.Marshal(struct {
+		Prefix string       `json:"prefix"`
+		Ranges []ring.Range `json:"ranges"`
+	}{prefix, ranges})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ds.do(ctx, "POST", "/digest", bytes.NewReader(body),
+		http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return nil, err
+	}
+	data, ok, err := readValue(resp)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, &StatusError{resp.StatusCode, string(data)}
+	}
+	var digests []keyDigest
+	if err = json.Unmarshal(data, &digests); err != nil {
+		return nil, err
+	}
+	hashes := make(map[string][]byte, len(digests))
+	for _, d := range digests {
+		hashes[d.Key] = d.Hash
+	}
+	return hashes, nil
+}
+
+// Diff compares the keys beginning with prefix in two datastores,
+// reporting how the target differs from the source. Values and their
+// content types are compared by their hashes: each datastore builds a hash tree over its
+// keys, of the given depth (zero for the datastore's default), and
+// only the hashes of the keys in the ranges where the trees differ are
+// fetched. Versions are not compared, so data copied from one
+// datastore to the other compares the same. Keys written during the
+// comparison may be reported either way.
+func Diff(ctx context.Context, src, dst *DataStore, prefix string, depth int) (result DiffResult, err error) {
+	srcTree, err := src.digest(ctx, prefix, depth)
+	if err != nil {
+		return
+	}
+	dstTree, err := dst.digest(ctx, prefix, depth)
+	if err != nil {
+		return
+	}
+	ranges, err := srcTree.Diff(dstTree)
+	if err != nil || len(ranges) == 0 {
+		return
+	}
+
+	srcHashes, err := src.keyDigests(ctx, prefix, ranges)
+	if err != nil {
+		return
+	}
+	dstHashes, err := dst.keyDigests(ctx, prefix, ranges)
+	if err != nil {
+		return
+	}
+	for key, hash := range srcHashes {
+		if other, ok := dstHashes[key]; !ok {
+			result.Missing = append(result.Missing, key)
+		} else if !bytes.Equal(hash, other) {
+			result.Different = append(result.Different, key)
+		}
+	}
+	for key := range dstHashes {
+		if _, ok := srcHashes[key]; !ok {
+			result.Extra = append(result.Extra, key)
+		}
+	}
+	sort.Strings(result.Missing)
+	sort.Strings(result.Extra)
+	sort.Strings(result.Different)
+	return
+}
+
+// A SyncResult counts the keys a sync wrote to the target and deleted
+// from it.
+type SyncResult struct {
+	Written int `json:"written"`
+	Deleted int `json:"deleted"`
+}
+
+// item reads a key with its content type. The data endpoint would
+// answer a key written without one with a type it guessed, so the key
+// is read by scanning for it: no other key beginning with it sorts
+// before it.
+func (ds *DataStore) item(ctx context.Context, key string) (item Item, ok bool, err error) {
+	items, _, err := ds.ScanContext(ctx, key, "", 1)
+	if err != nil || len(items) == 0 || items[0].Key != key {
+		return
+	}
+	return items[0], true, nil
+}
+
+// Sync makes the target datastore match the source in the keys a Diff
+// found: the missing and different keys are copied from the source in
+// batches with their content types, and if deleteExtra is set, the
+// extra keys are deleted. Keys deleted from the source since the Diff
+// are left as they are.
+func Sync(ctx context.Context, src, dst *DataStore, diff DiffResult, deleteExtra bool) (result SyncResult, err error) {
+	var batch []Item
+	size := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		res, err := dst.BatchContext(ctx, batch, Overwrite)
+		result.Written += res.Written
+		batch, size = nil, 0
+		return err
+	}
+
+	keys := append(append([]string{}, diff.Missing...), diff.Different...)
+	for _, key := range keys {
+		item, ok, err := src.item(ctx, key)
+		if err != nil {
+			return result, err
+		} else if !ok {
+			continue
+		}
+		if size+len(item.Value) > importBatchBytes {
+			if err = flush(); err != nil {
+				return result, err
+			}
+		}
+		batch = append(batch, Item{Key: key, Value: item.Value, Type: item.Type})
+		size += len(item.Value)
+		if len(batch) >= importBatchItems {
+			if err = flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	if err = flush(); err != nil || !deleteExtra {
+		return
+	}
+
+	for _, key := range diff.Extra {
+		if _, _, err = dst.DelContext(ctx, key); err != nil {
+			return
+		}
+		result.Deleted++
+	}
+	return
+}
@@ -0,0 +1,87 @@
+package kludge
+
+import (
+	"context"
+	"fmt"
+	"github.com/gokyle/kludge/client/kludgetest"
+	"strings"
+	"testing"
+)
+
+func TestDiffSync(t *testing.T) {
+	src := kludgetest.NewServer()
+	defer src.Close()
+	dst := kludgetest.NewServer()
+	defer dst.Close()
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("k/%03d", i)
+		src.Set(key, []byte(key))
+		dst.Set(key, []byte(key))
+	}
+	src.Set("k/missing", []byte("only in the source"))
+	dst.Set("k/extra", []byte("only in the target"))
+	dst.Set("k/050", []byte("changed"))
+	dst.Set("other", []byte("outside the prefix"))
+
+	from, err := Connect(src.Addr(), nil)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	to, err := Connect(dst.Addr(), nil)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+
+	// Keys differing only in their content types differ.
+	ctx := context.Background()
+	if _, _, err = from.set(ctx, "k/typed", []byte("v"), "text/plain"); err != nil {
+		fmt.Println("[!] set failed:", err.Error())
+		t.FailNow()
+	}
+	if _, _, err = to.set(ctx, "k/typed", []byte("v"), "application/octet-stream"); err != nil {
+		fmt.Println("[!] set failed:", err.Error())
+		t.FailNow()
+	}
+
+	diff, err := Diff(ctx, from, to, "k/", 0)
+	if err != nil {
+		fmt.Println("[!] diff failed:", err.Error())
+		t.FailNow()
+	}
+	if strings.Join(diff.Missing, ",") != "k/missing" ||
+		strings.Join(diff.Extra, ",") != "k/extra" ||
+		strings.Join(diff.Different, ",") != "k/050,k/typed" {
+		fmt.Printf("[!] diff returned %+v\n", diff)
+		t.FailNow()
+	}
+
+	res, err := Sync(ctx, from, to, diff, true)
+	if err != nil || res.Written != 3 || res.Deleted != 1 {
+		fmt.Println("[!] sync returned", res, err)
+		t.FailNow()
+	}
+	if value, _ := dst.Get("k/050"); string(value) != "k/050" {
+		fmt.Printf("[!] k/050 synced as %q\n", value)
+		t.FailNow()
+	}
+	if item, _, err := to.item(ctx, "k/typed"); err != nil || item.Type != "text/plain" {
+		fmt.Printf("[!] k/typed synced with content type %q (%v)\n", item.Type, err)
+		t.FailNow()
+	}
+	if item, _, err := to.item(ctx, "k/050"); err != nil || item.Type != "" {
+		fmt.Printf("[!] k/050 synced with content type %q (%v)\n", item.Type, err)
+		t.FailNow()
+	}
+	if _, ok := dst.Get("other"); !ok {
+		fmt.Println("[!] sync deleted a key outside the prefix")
+		t.FailNow()
+	}
+
+	diff, err = Diff(ctx, from, to, "k/", 0)
+	if err != nil || !diff.Same() {
+		fmt.Printf("[!] datastores differ after sync: %+v %v\n", diff, err)
+		t.FailNow()
+	}
+}
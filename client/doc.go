@@ -11,11 +11,78 @@
  three operations are methods called on a DataStore value, and they
  return three values: a key value, a boolean indicating whether the
  key was present in the datastore before the operation was called,
- and an error value indicating any error that occurred.
+ and an error value indicating any error that occurred. Failures
+ reported by the datastore, such as a 503 when too few replicas are
+ available, are returned as a *StatusError.
+
+ Put and GetTo stream a value from an io.Reader or to an io.Writer,
+ for values too large to be conveniently held in memory. Values larger
+ than the datastore accepts are refused with a *StatusError whose
+ StatusCode is 413.
 
  Additionally, the List method may be called to retrieve a list of all
  the keys present in the datastore.
 
+ Each method has a variant taking a context, such as GetContext; when
+ the context is cancelled or its deadline passes, the request in flight
+ is aborted and the context's error returned. Writes that are aborted
+ may still have taken effect.
+
+ A Store wraps a DataStore to hold values of a single Go type, which
+ are encoded with a Codec: JSON, Gob, or Raw for []byte and string
+ values. NewStore[T] returns one; its Get, Set and Del methods take
+ and return decoded values, and writes are sent with the codec's
+ content type.
+
+ ConnectCluster connects to several frontends of the same datastore,
+ and spreads requests across them with the balancer chosen through
+ WithBalancer. Frontends that fail are passed over until they recover,
+ which WithHealthCheck detects with periodic checks. Reads that fail
+ are retried with backoff on the other frontends, as set by WithRetry;
+ writes are only retried if they could not connect, as a write that
+ reached a frontend may have taken effect. A write refused with a 503
+ is returned as a *StatusError, and callers that want it made must
+ retry it themselves.
+
+ The kludgetest package provides an in-memory server implementing the
+ datastore's REST interface, for testing code that uses this package
+ without a running cluster.
+
+ Connect takes options that tune the client: WithTransport and
+ WithTimeout adjust the HTTP client used, WithHTTPS and WithBasePath
+ select where the API is found, and WithHeader and WithUserAgent set
+ headers sent with every request.
+
+ WithCache keeps recently read values in a least-recently-used cache
+ bounded by size. Cached values are revalidated with the datastore's
+ entity tags, which costs a round trip but not the value, unless they
+ are younger than the maximum age given. Set and Del drop the keys
+ they write from the cache; Invalidate and InvalidateAll drop keys
+ changed elsewhere, and CacheStats reports how the cache is used.
+ WithCacheWatch drops keys as soon as the datastore reports their
+ changes.
+
+ Watch and WatchKey report the changes to keys on a channel of
+ Events, reconnecting if the connection is lost; a watch may be
+ resumed after the version of the last event seen.
+
+ Scan reads the keys and their values a page at a time, and Batch
+ writes many keys in one request. Export and Import build on them to
+ move data in JSON Lines, one key to a line with its value
+ base64-encoded and its content type.
+
+ Diff compares two datastores, such as the old and new clusters of a
+ migration, by the hashes of their keys and values, and Sync copies
+ the keys that differ from one to the other.
+
+ CreateNamespace creates a namespace, a set of keys kept apart from
+ those of the default namespace and of every other, and Namespace
+ returns a DataStore acting on its keys through the same frontends.
+ DeleteNamespace deletes a namespace along with its keys, and
+ ClearNamespace deletes the keys alone. SetNamespaceLimits caps the
+ keys, bytes and request rate of a namespace, and NamespaceUsage
+ reports how much of them it uses.
+
 */
 /*
    Copyright (c) 2013 Kyle Isom <kyle@gokyle.org>
@@ -0,0 +1,272 @@
+package kludge
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Balancer chooses the frontend each request is sent to.
+type Balancer int
+
+const (
+	// RoundRobin sends requests to each healthy frontend in turn.
+	RoundRobin Balancer = iota
+
+	// LeastLatency sends requests to the healthy frontend that has
+	// answered most quickly of late.
+	LeastLatency
+)
+
+// downTime is how long a frontend that failed is passed over before
+// requests are tried on it again, when no health checks are run.
+var downTime = 5 * time.Second
+
+// EndpointStatus describes one of the frontends a DataStore talks to.
+// Latency is a moving average of its response times.
+type EndpointStatus struct {
+	Addr    string
+	Healthy bool
+	Latency time.Duration
+}
+
+type endpoint struct {
+	addr string
+
+	lock     sync.Mutex
+	healthy  bool
+	failedAt time.Time
+	latency  time.Duration
+}
+
+// available returns true if requests should be sent to the endpoint:
+// it is healthy, or it failed long enough ago to be tried again if
+// that is allowed.
+func (ep *endpoint) available(retry bool) bool {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	return ep.healthy || (retry && time.Since(ep.failedAt) > downTime)
+}
+
+func (ep *endpoint) succeeded(rtt time.Duration) {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	ep.healthy = true
+	if ep.latency == 0 {
+		ep.latency = rtt
+	} else {
+		ep.latency = (7*ep.latency + rtt) / 8
+	}
+}
+
+func (ep *endpoint) failed() {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	ep.healthy = false
+	ep.failedAt = time.Now()
+}
+
+func (ep *endpoint) status() EndpointStatus {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	return EndpointStatus{ep.addr, ep.healthy, ep.latency}
+}
+
+// Endpoints returns the state of each of the frontends the DataStore
+// talks to.
+func (ds *DataStore) Endpoints() []EndpointStatus {
+	var status []EndpointStatus
+	for _, ep := range ds.endpoints {
+		status = append(status, ep.status())
+	}
+	return status
+}
+
+// pick chooses the endpoint for the next attempt at a request,
+// preferring available endpoints that have not been tried yet.
+func (ds *DataStore) pick(tried map[*endpoint]bool) *endpoint {
+	n := len(ds.endpoints)
+	start := int(atomic.AddUint32(ds.next, 1) % uint32(n))
+	var best, fallback *endpoint
+	var bestLatency time.Duration
+	for i := 0; i < n; i++ {
+		ep := ds.endpoints[(start+i)%n]
+		if tried[ep] {
+			continue
+		}
+		if !ep.available(ds.healthInterval == 0) {
+			if fallback == nil {
+				fallback = ep
+			}
+			continue
+		}
+		if ds.balancer == RoundRobin {
+			return ep
+		}
+		if latency := ep.status().Latency; best == nil || latency < bestLatency {
+			best, bestLatency = ep, latency
+		}
+	}
+	switch {
+	case best != nil:
+		return best
+	case fallback != nil:
+		return fallback
+	}
+	// Every endpoint has been tried; start over.
+	return ds.endpoints[start]
+}
+
+// retryable returns true if a request may be sent again after it
+// failed with the given error or response. Requests that could not
+// connect were never seen by the frontend, and may always be sent
+// elsewhere; other failures are only retried for requests that are
+// idempotent.
+func retryable(idempotent bool, resp *http.Response, err error) bool {
+	if err != nil {
+		var op *net.OpError
+		if errors.As(err, &op) && op.Op == "dial" {
+			return true
+		}
+		return idempotent
+	}
+	return idempotent && resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// backoff returns the time to wait before the given retry, chosen at
+// random up to an exponentially growing limit.
+func (ds *DataStore) backoff(retry int) time.Duration {
+	limit := ds.retry.max
+	if retry < 32 && ds.retry.base<<uint(retry) < limit {
+		limit = ds.retry.base << uint(retry)
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+// do sends a request to the datastore, with the default headers and
+// any given for the request. GET and HEAD requests that fail, or are
+// answered with a 503, are retried on other frontends up to the
+// configured number of attempts; other requests are only retried if
+// they could not connect. A write answered with a 503 may have reached
+// some replicas, so it is returned to the caller, which must retry it
+// itself if it still wants it made. A frontend that fails is passed
+// over for a time, but not one answering with a 503 because too few
+// replicas are available. A body is consumed as it is sent, so only
+// one held in a *bytes.Reader, which can be rewound, is sent more than
+// once. The request is aborted if the context is cancelled.
+func (ds *DataStore) do(ctx context.Context, method, path string, body io.Reader, header http.Header) (resp *http.Response, err error) {
+	idempotent := method == "GET" || method == "HEAD"
+	rd, rewind := body.(*bytes.Reader)
+	tried := make(map[*endpoint]bool, 0)
+	for attempt := 0; ; attempt++ {
+		ep := ds.pick(tried)
+		tried[ep] = true
+		if rewind {
+			rd.Seek(0, io.SeekStart)
+		}
+
+		start := time.Now()
+		resp, err = ds.send(ctx, ep, method, path, body, header)
+		if err == nil && resp.StatusCode != http.StatusServiceUnavailable {
+			ep.succeeded(time.Since(start))
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		// A 503 marked with an error is the frontend reporting too
+		// few replicas; only a frontend that could not be reached, or
+		// is itself unavailable, is passed over.
+		if err != nil || resp.Header.Get("X-Kludge-Error") == "" {
+			ep.failed()
+		}
+		if attempt+1 >= ds.retry.attempts || (body != nil && !rewind) ||
+			!retryable(idempotent, resp, err) {
+			return
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(ds.backoff(attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (ds *DataStore) send(ctx context.Context, ep *endpoint, method, path string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, ds.url(ep, path), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range ds.header {
+		req.Header[name] = append([]string{}, values...)
+	}
+	if ds.userAgent != "" {
+		req.Header.Set("User-Agent", ds.userAgent)
+	}
+	for name, values := range header {
+		req.Header[name] = append([]string{}, values...)
+	}
+	return ds.client.Do(req.WithContext(ctx))
+}
+
+// check asks an endpoint for the datastore's version, marking it
+// healthy if it answers as a kludge frontend should.
+func (ds *DataStore) check(ctx context.Context, ep *endpoint) string {
+	start := time.Now()
+	resp, err := ds.send(ctx, ep, "HEAD", "/data", nil, nil)
+	if err != nil {
+		ep.failed()
+		return ""
+	}
+	resp.Body.Close()
+
+	ver := resp.Header.Get("X-Kludge-Version")
+	if resp.StatusCode != http.StatusOK || !versionRegexp.MatchString(ver) {
+		ep.failed()
+		return ""
+	}
+	ep.succeeded(time.Since(start))
+	return ver
+}
+
+// healthCheck checks every endpoint at each interval, until the
+// DataStore is closed.
+func (ds *DataStore) healthCheck(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ds.done:
+			return
+		}
+		for _, ep := range ds.endpoints {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			ds.check(ctx, ep)
+			cancel()
+		}
+	}
+}
+
+// Close stops the DataStore's health checks. It is not needed if none
+// were set up with WithHealthCheck.
+func (ds *DataStore) Close() error {
+	ds.closeOnce.Do(func() { close(ds.done) })
+	return nil
+}
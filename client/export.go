@@ -0,0 +1,246 @@
+package kludge
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// An Item is a key with its value, content type and version, as
+// returned by Scan and written by Batch. It is also the record of an
+// export, one to a line.
+type Item struct {
+	Key     string `json:"key"`
+	Value   []byte `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Version uint64 `json:"version,omitempty"`
+}
+
+// A BatchMode decides what a batch does with items whose keys are
+// already present.
+type BatchMode string
+
+const (
+	// Overwrite writes every item.
+	Overwrite BatchMode = "overwrite"
+
+	// Skip leaves present keys as they are.
+	Skip BatchMode = "skip"
+
+	// FailOnConflict writes nothing if any key is present.
+	FailOnConflict BatchMode = "fail"
+)
+
+// A BatchResult counts the items a batch wrote and skipped. Conflicts
+// lists the keys that stopped a FailOnConflict batch.
+type BatchResult struct {
+	Written   int      `json:"written"`
+	Skipped   int      `json:"skipped"`
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// Scan returns up to limit of the keys beginning with prefix that sort
+// after the key after, with their values, in key order; a limit of
+// zero leaves it to the datastore. If next is not empty, there may be
+// more keys, which are scanned by passing it as after. A page may hold
+// fewer keys than the limit, or none, before the scan is complete.
+func (ds *DataStore) Scan(prefix, after string, limit int) (items []Item, next string, err error) {
+	return ds.ScanContext(context.Background(), prefix, after, limit)
+}
+
+// ScanContext is like Scan, but aborts the request if the context is
+// cancelled.
+func (ds *DataStore) ScanContext(ctx context.Context, prefix, after string, limit int) (items []Item, next string, err error) {
+	return ds.scan(ctx, prefix, after, limit, false)
+}
+
+// ScanKeys is like Scan, but returns only the keys.
+func (ds *DataStore) ScanKeys(prefix, after string, limit int) (keys []string, next string, err error) {
+	return ds.ScanKeysContext(context.Background(), prefix, after, limit)
+}
+
+// ScanKeysContext is like ScanKeys, but aborts the request if the
+// context is cancelled.
+func (ds *DataStore) ScanKeysContext(ctx context.Context, prefix, after string, limit int) (keys []string, next string, err error) {
+	items, next, err := ds.scan(ctx, prefix, after, limit, true)
+	for _, item := range items {
+		keys = append(keys, item.Key)
+	}
+	return
+}
+
+func (ds *DataStore) scan(ctx context.Context, prefix, after string, limit int, keysOnly bool) (items []Item, next string, err error) {
+	q := url.Values{}
+	if keysOnly {
+		q.Set("keys", "true")
+	}
+	if prefix != "" {
+		q.Set("prefix", prefix)
+	}
+	if after != "" {
+		q.Set("after", after)
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	resp, err := ds.do(ctx, "GET", "/scan?"+q.Encode(), nil, nil)
+	if err != nil {
+		return
+	}
+	body, ok, err := readValue(resp)
+	if err != nil {
+		return
+	} else if !ok {
+		return nil, "", &StatusError{resp.StatusCode, string(body)}
+	}
+	var page struct {
+		Items []Item `json:"items"`
+		Next  string `json:"next"`
+	}
+	if err = json.Unmarshal(body, &page); err != nil {
+		return
+	}
+	return page.Items, page.Next, nil
+}
+
+// Batch writes a list of items in a single request. Keys are checked
+// before they are written, but not atomically with the writes. A
+// FailOnConflict batch that finds keys present writes nothing, and
+// returns them in the result along with a *StatusError whose
+// StatusCode is 409. Like Set, a Batch is only retried on another
+// frontend if it could not connect.
+func (ds *DataStore) Batch(items []Item, mode BatchMode) (result BatchResult, err error) {
+	return ds.BatchContext(context.Background(), items, mode)
+}
+
+// BatchContext is like Batch, but aborts the request if the context is
+// cancelled. A batch that is aborted may still take effect in part.
+func (ds *DataStore) BatchContext(ctx context.Context, items []Item, mode BatchMode) (result BatchResult, err error) {
+	body, err := json.Marshal(struct {
+		Mode  BatchMode `json:"mode,omitempty"`
+		Items []Item    `json:"items"`
+	}{mode, items})
+	if err != nil {
+		return
+	}
+	invalidate := func() {
+		for _, item := range items {
+			ds.Invalidate(item.Key)
+		}
+	}
+	invalidate()
+	defer invalidate()
+	resp, err := ds.do(ctx, "POST", "/batch", bytes.NewReader(body),
+		http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return
+	}
+	data, ok, err := readValue(resp)
+	if serr, conflict := err.(*StatusError); conflict && serr.StatusCode == http.StatusConflict {
+		json.Unmarshal([]byte(serr.Message), &result)
+		serr.Message = fmt.Sprintf("%d keys already present", len(result.Conflicts))
+		return
+	} else if err != nil {
+		return
+	} else if !ok {
+		return result, &StatusError{resp.StatusCode, string(data)}
+	}
+	err = json.Unmarshal(data, &result)
+	return
+}
+
+// Export writes every key beginning with prefix to w in key order,
+// with its value and version, as JSON Lines: one JSON Item to a line,
+// with the value base64-encoded. It returns the number of keys
+// written. The keys are read a page at a time, so that an export of a
+// datastore being written to may include some writes made during it
+// and not others.
+func (ds *DataStore) Export(ctx context.Context, prefix string, w io.Writer) (n int, err error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	after := ""
+	for {
+		var items []Item
+		items, after, err = ds.ScanContext(ctx, prefix, after, 0)
+		if err != nil {
+			return
+		}
+		for _, item := range items {
+			if err = enc.Encode(item); err != nil {
+				return
+			}
+			n++
+		}
+		if after == "" {
+			break
+		}
+	}
+	err = bw.Flush()
+	return
+}
+
+// The limits on the batches an import is written in.
+const (
+	importBatchItems = 500
+	importBatchBytes = 4 << 20
+)
+
+// Import loads the items in an export read from r, in batches, each
+// handled according to mode; the items are written with new versions.
+// Blank lines are ignored. The results of the batches are summed; a
+// FailOnConflict import stops at the first batch holding a present
+// key, leaving the batches before it written.
+func (ds *DataStore) Import(ctx context.Context, r io.Reader, mode BatchMode) (result BatchResult, err error) {
+	var batch []Item
+	size := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		res, err := ds.BatchContext(ctx, batch, mode)
+		result.Written += res.Written
+		result.Skipped += res.Skipped
+		result.Conflicts = append(result.Conflicts, res.Conflicts...)
+		batch, size = nil, 0
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, rerr := br.ReadBytes('\n')
+		if rerr != nil && rerr != io.EOF {
+			return result, rerr
+		}
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			var item Item
+			if err = json.Unmarshal(data, &item); err != nil {
+				return result, fmt.Errorf("kludge: line %d: %s", line, err.Error())
+			} else if item.Key == "" {
+				return result, fmt.Errorf("kludge: line %d: no key", line)
+			}
+			if size+len(data) > importBatchBytes {
+				if err = flush(); err != nil {
+					return
+				}
+			}
+			batch = append(batch, item)
+			size += len(data)
+			if len(batch) >= importBatchItems {
+				if err = flush(); err != nil {
+					return
+				}
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+	}
+	err = flush()
+	return
+}
@@ -0,0 +1,178 @@
+package kludge
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/gokyle/kludge/client/kludgetest"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestScan(t *testing.T) {
+	srv := kludgetest.NewServer()
+	defer srv.Close()
+	for _, key := range []string{"a", "b/1", "b/2", "b/3", "c"} {
+		srv.Set(key, []byte("value of "+key))
+	}
+	ds, err := Connect(srv.Addr(), nil)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+
+	var keys []string
+	after := ""
+	for pages := 0; ; pages++ {
+		items, next, err := ds.Scan("b/", after, 2)
+		if err != nil || pages > 2 {
+			fmt.Println("[!] scan failed:", err)
+			t.FailNow()
+		}
+		for _, item := range items {
+			if string(item.Value) != "value of "+item.Key {
+				fmt.Printf("[!] %s scanned with %q\n", item.Key, item.Value)
+				t.FailNow()
+			}
+			keys = append(keys, item.Key)
+		}
+		if after = next; after == "" {
+			break
+		}
+	}
+	if strings.Join(keys, ",") != "b/1,b/2,b/3" {
+		fmt.Println("[!] scanned", keys)
+		t.FailNow()
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src := kludgetest.NewServer()
+	defer src.Close()
+	src.Set("foo", []byte("bar"))
+	src.Set("bin", []byte{0, 1, 2, 0xff})
+	dst := kludgetest.NewServer()
+	defer dst.Close()
+	dst.Set("foo", []byte("old"))
+
+	from, err := Connect(src.Addr(), nil)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	to, err := Connect(dst.Addr(), nil)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+
+	var buf bytes.Buffer
+	n, err := from.Export(context.Background(), "", &buf)
+	if err != nil || n != 2 {
+		fmt.Println("[!] export returned", n, err)
+		t.FailNow()
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], `{"key":"bin","value":"AAEC/w=="`) {
+		fmt.Printf("[!] exported %q\n", buf.String())
+		t.FailNow()
+	}
+	export := buf.String()
+
+	// A conflicting key stops the import without writing anything.
+	res, err := to.Import(context.Background(), strings.NewReader(export), FailOnConflict)
+	if serr, ok := err.(*StatusError); !ok || serr.StatusCode != http.StatusConflict ||
+		len(res.Conflicts) != 1 || res.Conflicts[0] != "foo" {
+		fmt.Println("[!] conflicting import returned", res, err)
+		t.FailNow()
+	}
+	if _, ok := dst.Get("bin"); ok {
+		fmt.Println("[!] conflicting import wrote keys")
+		t.FailNow()
+	}
+
+	res, err = to.Import(context.Background(), strings.NewReader(export), Skip)
+	if err != nil || res.Written != 1 || res.Skipped != 1 {
+		fmt.Println("[!] skipping import returned", res, err)
+		t.FailNow()
+	}
+	if v, _ := dst.Get("foo"); string(v) != "old" {
+		fmt.Println("[!] skipping import overwrote foo")
+		t.FailNow()
+	}
+	if v, _ := dst.Get("bin"); !bytes.Equal(v, []byte{0, 1, 2, 0xff}) {
+		fmt.Printf("[!] imported %q\n", v)
+		t.FailNow()
+	}
+
+	res, err = to.Import(context.Background(), strings.NewReader(export+"\n\n"), Overwrite)
+	if err != nil || res.Written != 2 {
+		fmt.Println("[!] overwriting import returned", res, err)
+		t.FailNow()
+	}
+	if v, _ := dst.Get("foo"); string(v) != "bar" {
+		fmt.Println("[!] overwriting import left foo as", string(v))
+		t.FailNow()
+	}
+
+	if _, err = to.Import(context.Background(), strings.NewReader("{\n"), Overwrite); err == nil {
+		fmt.Println("[!] a malformed export was imported")
+		t.FailNow()
+	}
+}
+
+func TestExportImportContentType(t *testing.T) {
+	src := kludgetest.NewServer()
+	defer src.Close()
+	dst := kludgetest.NewServer()
+	defer dst.Close()
+
+	req, err := http.NewRequest("PUT", "http://"+src.Addr()+"/data/doc", strings.NewReader(`{"a":1}`))
+	if err != nil {
+		fmt.Println("[!] building the request failed:", err.Error())
+		t.FailNow()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		fmt.Println("[!] PUT failed:", err.Error())
+		t.FailNow()
+	} else {
+		resp.Body.Close()
+	}
+
+	from, err := Connect(src.Addr(), nil)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	to, err := Connect(dst.Addr(), nil)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+
+	var buf bytes.Buffer
+	if n, err := from.Export(context.Background(), "", &buf); err != nil || n != 1 {
+		fmt.Println("[!] export returned", n, err)
+		t.FailNow()
+	} else if !strings.Contains(buf.String(), `"type":"application/json"`) {
+		fmt.Printf("[!] exported %q without its content type\n", buf.String())
+		t.FailNow()
+	}
+	if _, err = to.Import(context.Background(), &buf, Overwrite); err != nil {
+		fmt.Println("[!] import failed:", err.Error())
+		t.FailNow()
+	}
+
+	resp, err := http.Get("http://" + dst.Addr() + "/data/doc")
+	if err != nil {
+		fmt.Println("[!] GET failed:", err.Error())
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		fmt.Printf("[!] the imported key has content type %q\n", ct)
+		t.FailNow()
+	}
+}
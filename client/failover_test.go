@@ -0,0 +1,267 @@
+package kludge
+
+import (
+	"fmt"
+	"github.com/gokyle/kludge/client/kludgetest"
+	"github.com/gokyle/kludge/common"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// frontendStub answers every request after the given delay, with the
+// given status for requests other than version checks, which it
+// counts.
+type frontendStub struct {
+	*httptest.Server
+	lock   sync.Mutex
+	status int
+	delay  time.Duration
+	count  int
+}
+
+func newFrontendStub(status int) *frontendStub {
+	fs := &frontendStub{status: status}
+	fs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fs.lock.Lock()
+		status, delay := fs.status, fs.delay
+		if r.Method != "HEAD" {
+			fs.count++
+		}
+		fs.lock.Unlock()
+		time.Sleep(delay)
+
+		w.Header().Add("X-Kludge-Version", common.Version())
+		if r.Method == "HEAD" {
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(r.URL.Path))
+	}))
+	return fs
+}
+
+func (fs *frontendStub) addr() string {
+	return strings.TrimPrefix(fs.URL, "http://")
+}
+
+func (fs *frontendStub) requests() int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.count
+}
+
+func (fs *frontendStub) set(status int, delay time.Duration) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.status, fs.delay = status, delay
+}
+
+var fastRetry = WithRetry(3, time.Millisecond, 5*time.Millisecond)
+
+func TestFailover(t *testing.T) {
+	down := newFrontendStub(http.StatusServiceUnavailable)
+	defer down.Close()
+	up := newFrontendStub(http.StatusOK)
+	defer up.Close()
+
+	ds, err := ConnectCluster([]string{down.addr(), up.addr()}, nil, fastRetry)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	for i := 0; i < 4; i++ {
+		if v, ok, err := ds.Get("foo"); err != nil || !ok || string(v) != "/data/foo" {
+			fmt.Printf("[!] GET was not retried: %q, %v, %v\n", v, ok, err)
+			t.FailNow()
+		}
+	}
+	if n := down.requests(); n != 1 {
+		fmt.Println("[!] failed frontend was not passed over; requests:", n)
+		t.FailNow()
+	}
+
+	// A write that is refused with a 503 may have reached some
+	// replicas, and is not retried.
+	up.set(http.StatusServiceUnavailable, 0)
+	before := down.requests() + up.requests()
+	_, _, err = ds.Set("foo", []byte("bar"))
+	if se, ok := err.(*StatusError); !ok || se.StatusCode != http.StatusServiceUnavailable {
+		fmt.Println("[!] expected a 503 status error, got", err)
+		t.FailNow()
+	}
+	if n := down.requests() + up.requests() - before; n != 1 {
+		fmt.Println("[!] write was retried; requests:", n)
+		t.FailNow()
+	}
+}
+
+func TestQuorumUnavailable(t *testing.T) {
+	short := kludgetest.NewServer()
+	defer short.Close()
+	up := kludgetest.NewServer()
+	defer up.Close()
+	up.Set("foo", []byte("bar"))
+	short.SetUnavailable(true)
+
+	ds, err := ConnectCluster([]string{short.Addr(), up.Addr()}, nil, fastRetry)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	for i := 0; i < 4; i++ {
+		if v, ok, err := ds.Get("foo"); err != nil || !ok || string(v) != "bar" {
+			fmt.Printf("[!] GET was not retried: %q, %v, %v\n", v, ok, err)
+			t.FailNow()
+		}
+	}
+
+	// A frontend short of replicas is working, and is not passed over.
+	if n := short.Requests(); n < 2 {
+		fmt.Println("[!] frontend short of replicas was passed over; requests:", n)
+		t.FailNow()
+	}
+	for _, status := range ds.Endpoints() {
+		if !status.Healthy {
+			fmt.Println("[!] bad endpoint status:", ds.Endpoints())
+			t.FailNow()
+		}
+	}
+}
+
+func TestNamespaceRotation(t *testing.T) {
+	a := newFrontendStub(http.StatusOK)
+	defer a.Close()
+	b := newFrontendStub(http.StatusOK)
+	defer b.Close()
+
+	ds, err := ConnectCluster([]string{a.addr(), b.addr()}, nil, fastRetry)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	team := ds.Namespace("team")
+	for _, d := range []*DataStore{ds, team} {
+		if _, _, err = d.Get("foo"); err != nil {
+			fmt.Println("[!] GET failed:", err.Error())
+			t.FailNow()
+		}
+	}
+
+	// The namespace takes its turn in the DataStore's rotation.
+	if a.requests() != 1 || b.requests() != 1 {
+		fmt.Println("[!] requests were not rotated:", a.requests(), b.requests())
+		t.FailNow()
+	}
+}
+
+func TestFailoverConnectionRefused(t *testing.T) {
+	dead := newFrontendStub(http.StatusOK)
+	up := newFrontendStub(http.StatusOK)
+	defer up.Close()
+
+	ds, err := ConnectCluster([]string{dead.addr(), up.addr()}, nil, fastRetry)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	dead.Close()
+
+	// Writes that could not connect never reached a frontend, so they
+	// are sent to another.
+	for i := 0; i < 4; i++ {
+		if _, ok, err := ds.Set("foo", []byte("bar")); err != nil || !ok {
+			fmt.Println("[!] write was not retried:", err)
+			t.FailNow()
+		}
+	}
+	status := ds.Endpoints()
+	if status[0].Healthy || !status[1].Healthy {
+		fmt.Println("[!] bad endpoint status:", status)
+		t.FailNow()
+	}
+}
+
+func TestAllFrontendsDown(t *testing.T) {
+	fs := newFrontendStub(http.StatusServiceUnavailable)
+	defer fs.Close()
+
+	ds, err := Connect(fs.addr(), nil, fastRetry)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	if _, _, err = ds.Get("foo"); err == nil {
+		fmt.Println("[!] expected GET to fail")
+		t.FailNow()
+	}
+	if n := fs.requests(); n != 3 {
+		fmt.Println("[!] expected 3 attempts, saw", n)
+		t.FailNow()
+	}
+
+	if _, err = ConnectCluster(nil, nil); err != ErrInvalidDatastore {
+		fmt.Println("[!] connected to an empty cluster")
+		t.FailNow()
+	}
+}
+
+func TestLeastLatency(t *testing.T) {
+	slow := newFrontendStub(http.StatusOK)
+	defer slow.Close()
+	fast := newFrontendStub(http.StatusOK)
+	defer fast.Close()
+	slow.set(http.StatusOK, 20*time.Millisecond)
+
+	ds, err := ConnectCluster([]string{slow.addr(), fast.addr()}, nil,
+		WithBalancer(LeastLatency))
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	// Both frontends were measured when connecting.
+	for i := 0; i < 8; i++ {
+		ds.Get("foo")
+	}
+	if n := slow.requests(); n != 0 {
+		fmt.Println("[!] slow frontend was used; requests:", n)
+		t.FailNow()
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	fs := newFrontendStub(http.StatusOK)
+	defer fs.Close()
+	other := newFrontendStub(http.StatusOK)
+	defer other.Close()
+
+	ds, err := ConnectCluster([]string{fs.addr(), other.addr()}, nil,
+		fastRetry, WithHealthCheck(100*time.Millisecond))
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	defer ds.Close()
+
+	fs.set(http.StatusServiceUnavailable, 0)
+	for i := 0; i < 2; i++ {
+		ds.Get("foo")
+	}
+	if ds.Endpoints()[0].Healthy {
+		fmt.Println("[!] failing frontend is still healthy")
+		t.FailNow()
+	}
+
+	// Version checks still succeed, so the frontend is brought back.
+	deadline := time.Now().Add(time.Second)
+	for !ds.Endpoints()[0].Healthy {
+		if time.Now().After(deadline) {
+			fmt.Println("[!] health check did not restore the frontend")
+			t.FailNow()
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,708 @@
+// Package kludgetest provides an in-memory kludge server for tests. It
+// implements the datastore's REST interface over a map, so that code
+// using the client package can be tested without running a cluster.
+//
+//	srv := kludgetest.NewServer()
+//	defer srv.Close()
+//	ds, err := kludge.Connect(srv.Addr(), nil)
+package kludgetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"github.com/gokyle/kludge/frontend"
+	"github.com/gokyle/kludge/merkle"
+	"github.com/gokyle/kludge/ring"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	value       []byte
+	contentType string
+	version     uint64
+}
+
+// Server is an in-memory kludge server. Its methods may be used to
+// seed and inspect the data while the server is running.
+type Server struct {
+	*httptest.Server
+
+	// ns is the name of the namespace the server holds, if it is not
+	// the default one.
+	ns string
+
+	lock        sync.Mutex
+	data        map[string]entry
+	version     uint64
+	unavailable bool
+	requests    int
+	maxValue    int64
+
+	// events lists every change, for watchers; notify is closed when
+	// one is made.
+	events []frontend.Event
+	notify chan struct{}
+
+	// namespaces holds a server, not listening, for each namespace,
+	// which answers the requests made in it. Those servers refuse
+	// writes over their namespace's limits; rates are not limited.
+	namespaces map[string]*namespace
+	limits     frontend.Limits
+}
+
+type namespace struct {
+	info frontend.Namespace
+	srv  *Server
+}
+
+func newServer(ns string) *Server {
+	return &Server{
+		ns:         ns,
+		data:       make(map[string]entry, 0),
+		maxValue:   frontend.DefaultMaxValueSize,
+		namespaces: make(map[string]*namespace, 0),
+	}
+}
+
+// NewServer starts an empty server listening on a local port.
+func NewServer() *Server {
+	s := newServer("")
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Namespace returns the server holding a namespace's keys, creating
+// the namespace if it does not exist. Its methods may be used to seed
+// and inspect the namespace, but it does not listen for requests.
+func (s *Server) Namespace(name string) *Server {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ns, ok := s.namespaces[name]
+	if !ok {
+		ns = &namespace{frontend.Namespace{Name: name, Created: time.Now().UTC()}, newServer(name)}
+		s.namespaces[name] = ns
+	}
+	return ns.srv
+}
+
+// Addr returns the server's address, as passed to kludge.Connect.
+func (s *Server) Addr() string {
+	return s.Listener.Addr().String()
+}
+
+// Get returns the value of a key.
+func (s *Server) Get(key string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.data[key]
+	return e.value, ok
+}
+
+// Set stores a value for a key.
+func (s *Server) Set(key string, value []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.set(key, append([]byte{}, value...), "")
+}
+
+// Del removes a key.
+func (s *Server) Del(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.del(key)
+}
+
+// set and del change a key under a new version, and report the change
+// to watchers. The lock must be held.
+func (s *Server) set(key string, value []byte, contentType string) {
+	version := s.stamp()
+	s.data[key] = entry{value, contentType, version}
+	s.changed(frontend.Event{Key: key, Version: version})
+}
+
+func (s *Server) del(key string) {
+	delete(s.data, key)
+	s.changed(frontend.Event{Key: key, Version: s.stamp(), Deleted: true})
+}
+
+// stamp returns the version of a new write: as a frontend's, the time
+// in nanoseconds, but kept increasing so that no two writes share one.
+// The lock must be held.
+func (s *Server) stamp() uint64 {
+	s.version++
+	if now := uint64(time.Now().UnixNano()); now > s.version {
+		s.version = now
+	}
+	return s.version
+}
+
+func (s *Server) changed(ev frontend.Event) {
+	s.events = append(s.events, ev)
+	if s.notify != nil {
+		close(s.notify)
+		s.notify = nil
+	}
+}
+
+// Keys returns the keys present, in order.
+func (s *Server) Keys() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.keys()
+}
+
+func (s *Server) keys() []string {
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SetUnavailable makes the server answer requests for data with a 503,
+// marked as a frontend marks it when too few replicas are available,
+// until it is called again with false. Version checks are still
+// answered.
+func (s *Server) SetUnavailable(unavailable bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.unavailable = unavailable
+}
+
+// SetMaxValueSize sets the largest value the server accepts; larger
+// values are refused with a 413. It defaults to the frontend's
+// default.
+func (s *Server) SetMaxValueSize(max int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.maxValue = max
+}
+
+// Requests returns the number of requests for data the server has
+// answered, not counting version checks.
+func (s *Server) Requests() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests
+}
+
+// ServeHTTP answers a request as a kludge frontend would. Values carry
+// ETags and the content type they were written with, and reads with a
+// matching If-None-Match are answered with a 304. Keys and batches are
+// checked with the frontend's own checks, and writes are versioned by
+// the clock. Changes are reported to watchers as they are made; watches must
+// be stopped before the server is closed.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/ns/") {
+		s.namespaced(w, r)
+		return
+	}
+	w.Header().Add("X-Kludge-Version", common.Version())
+	if r.URL.Path == "/admin/ns" || strings.HasPrefix(r.URL.Path, "/admin/ns/") {
+		s.adminNamespaces(w, r)
+		return
+	} else if r.URL.Path == "/admin/usage" {
+		s.adminUsage(w, r)
+		return
+	}
+	switch r.URL.Path {
+	case "/watch":
+		s.watch(w, r)
+		return
+	case "/scan":
+		s.scan(w, r)
+		return
+	case "/batch":
+		s.batch(w, r)
+		return
+	case "/digest":
+		s.digest(w, r)
+		return
+	}
+	if r.URL.Path != "/data" && !strings.HasPrefix(r.URL.Path, "/data/") {
+		http.NotFound(w, r)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/data"), "/")
+	if r.Method == "HEAD" && key == "" {
+		w.Header().Add("content-length", "0")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if !frontend.ValidKey(s.ns, key) {
+		frontend.InvalidKey(w)
+		return
+	}
+
+	var body []byte
+	if r.Method == "POST" || r.Method == "PUT" {
+		s.lock.Lock()
+		max := s.maxValue
+		s.lock.Unlock()
+		var err error
+		if body, err = ioutil.ReadAll(io.LimitReader(r.Body, max+1)); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		} else if int64(len(body)) > max {
+			frontend.TooLarge(w, max)
+			return
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests++
+	if s.unavailable {
+		frontend.ServerError(w, frontend.ErrQuorum)
+		return
+	}
+
+	prev, ok := s.data[key]
+	switch {
+	case key == "" && r.Method == "GET":
+		list, _ := json.Marshal(s.keys())
+		w.Write(list)
+		return
+	case key == "":
+		s.notImplemented(w, r)
+		return
+	case (r.Method == "GET" || r.Method == "HEAD") && ok:
+		etag := frontend.ETag(prev.version)
+		w.Header().Set("ETag", etag)
+		if prev.contentType != "" {
+			w.Header().Set("Content-Type", prev.contentType)
+		}
+		if frontend.MatchETag(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(prev.value)))
+		if r.Method == "HEAD" {
+			return
+		}
+	case r.Method == "GET" || r.Method == "HEAD":
+	case r.Method == "POST" || r.Method == "PUT":
+		if len(r.Header.Get("Content-Type")) > common.MaxTypeLen {
+			frontend.BadRequest(w, fmt.Sprintf("Content types may not be longer than %d bytes.", common.MaxTypeLen))
+			return
+		}
+		if err := s.overLimit([]frontend.Item{{Key: key, Value: body}}); err != nil {
+			w.WriteHeader(http.StatusInsufficientStorage)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		s.set(key, body, r.Header.Get("Content-Type"))
+		if !ok {
+			w.WriteHeader(http.StatusCreated)
+		}
+		w.Write(prev.value)
+		return
+	case r.Method == "DELETE" && ok:
+		s.del(key)
+	case r.Method == "DELETE":
+	default:
+		s.notImplemented(w, r)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	w.Write(prev.value)
+}
+
+func (s *Server) notImplemented(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNotImplemented)
+	w.Write([]byte("Method " + r.Method + " not implemented."))
+}
+
+// scan returns a page of keys as a frontend's scan endpoint does.
+func (s *Server) scan(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix, after := q.Get("prefix"), q.Get("after")
+	if !frontend.ValidKey(s.ns, prefix) || !frontend.ValidKey(s.ns, after) {
+		frontend.InvalidKey(w)
+		return
+	}
+	limit := frontend.DefaultScanLimit
+	if param := q.Get("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit < 1 {
+			frontend.BadRequest(w, "Invalid limit "+param+".")
+			return
+		}
+	}
+	if limit > frontend.MaxScanLimit {
+		limit = frontend.MaxScanLimit
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests++
+	if s.unavailable {
+		frontend.ServerError(w, frontend.ErrQuorum)
+		return
+	}
+	page := frontend.ScanPage{Items: make([]frontend.Item, 0)}
+	for _, key := range s.keys() {
+		if key <= after || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if len(page.Items) == limit {
+			page.Next = page.Items[limit-1].Key
+			break
+		}
+		e := s.data[key]
+		if q.Get("keys") == "true" {
+			e.value = nil
+		}
+		page.Items = append(page.Items, frontend.Item{Key: key,
+			Value: e.value, Type: e.contentType, Version: e.version})
+	}
+	body, _ := json.Marshal(page)
+	w.Write(body)
+}
+
+// batch writes a batch as a frontend's batch endpoint does, refusing
+// the same batches.
+func (s *Server) batch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.notImplemented(w, r)
+		return
+	}
+	s.lock.Lock()
+	max := s.maxValue
+	s.lock.Unlock()
+	req, ok := frontend.ReadBatch(w, r, s.ns, frontend.DefaultMaxBatchSize, max)
+	if !ok {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests++
+	if s.unavailable {
+		frontend.ServerError(w, frontend.ErrQuorum)
+		return
+	}
+	if err := s.overLimit(req.Items); err != nil {
+		w.WriteHeader(http.StatusInsufficientStorage)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	var result frontend.BatchResult
+	if req.Mode == frontend.BatchFail {
+		for _, item := range req.Items {
+			if _, ok := s.data[item.Key]; ok {
+				result.Conflicts = append(result.Conflicts, item.Key)
+			}
+		}
+		if len(result.Conflicts) > 0 {
+			body, _ := json.Marshal(result)
+			w.WriteHeader(http.StatusConflict)
+			w.Write(body)
+			return
+		}
+	}
+	for _, item := range req.Items {
+		if _, ok := s.data[item.Key]; ok && req.Mode == frontend.BatchSkip {
+			result.Skipped++
+			continue
+		}
+		s.set(item.Key, item.Value, item.Type)
+		result.Written++
+	}
+	body, _ := json.Marshal(result)
+	w.Write(body)
+}
+
+// namespaced passes a request made in a namespace to its server.
+func (s *Server) namespaced(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/ns/")
+	name := rest
+	if i := strings.Index(rest, "/"); i >= 0 {
+		name, rest = rest[:i], rest[i:]
+	}
+	s.lock.Lock()
+	ns, ok := s.namespaces[name]
+	s.lock.Unlock()
+	if !ok {
+		w.Header().Add("X-Kludge-Version", common.Version())
+		w.Header().Set("X-Kludge-Error", frontend.ErrNoNamespace.Error())
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(frontend.ErrNoNamespace.Error()))
+		return
+	}
+	u := *r.URL
+	u.Path, u.RawPath = rest, ""
+	nr := r.WithContext(r.Context())
+	nr.URL = &u
+	ns.srv.ServeHTTP(w, nr)
+}
+
+// adminNamespaces answers as a frontend's namespace admin endpoints
+// do.
+func (s *Server) adminNamespaces(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/ns"), "/")
+	name, sub := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		name, sub = path[:i], path[i+1:]
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ns, ok := s.namespaces[name]
+	var v interface{}
+	status := http.StatusOK
+	switch {
+	case path == "" && r.Method == "GET":
+		list := make([]frontend.Namespace, 0, len(s.namespaces))
+		for _, name := range s.names() {
+			list = append(list, s.namespaces[name].info)
+		}
+		v = list
+	case path != "" && !frontend.ValidNamespace(name):
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(frontend.ErrInvalidNamespace.Error()))
+		return
+	case (r.Method == "PUT" || r.Method == "POST") && sub == "":
+		if ok {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(frontend.ErrNamespaceExists.Error()))
+			return
+		}
+		ns = &namespace{frontend.Namespace{Name: name, Created: time.Now().UTC()}, newServer(name)}
+		s.namespaces[name] = ns
+		v, status = ns.info, http.StatusCreated
+	case !ok:
+		w.Header().Set("X-Kludge-Error", frontend.ErrNoNamespace.Error())
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(frontend.ErrNoNamespace.Error()))
+		return
+	case r.Method == "GET" && sub == "":
+		v = ns.info
+	case r.Method == "GET" && sub == "usage":
+		v = ns.usage()
+	case (r.Method == "PUT" || r.Method == "POST") && sub == "limits":
+		var limits frontend.Limits
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil ||
+			limits.MaxKeys < 0 || limits.MaxBytes < 0 || limits.MaxRate < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(frontend.ErrInvalidLimits.Error()))
+			return
+		}
+		ns.info.Limits = limits
+		ns.srv.lock.Lock()
+		ns.srv.limits = limits
+		ns.srv.lock.Unlock()
+		v = ns.info
+	case r.Method == "DELETE" && (sub == "" || sub == "data"):
+		ns.srv.lock.Lock()
+		deleted := len(ns.srv.data)
+		for key := range ns.srv.data {
+			ns.srv.del(key)
+		}
+		ns.srv.lock.Unlock()
+		if sub == "" {
+			delete(s.namespaces, name)
+		}
+		v = map[string]int{"deleted": deleted}
+	default:
+		s.notImplemented(w, r)
+		return
+	}
+	body, _ := json.Marshal(v)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// adminUsage answers as a frontend's usage endpoint does.
+func (s *Server) adminUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.notImplemented(w, r)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	list := make([]frontend.NamespaceUsage, 0, len(s.namespaces))
+	for _, name := range s.names() {
+		list = append(list, s.namespaces[name].usage())
+	}
+	body, _ := json.Marshal(list)
+	w.Write(body)
+}
+
+// names returns the namespaces' names in order. The lock must be held.
+func (s *Server) names() []string {
+	names := make([]string, 0, len(s.namespaces))
+	for name := range s.namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// usage reports a namespace's usage.
+func (ns *namespace) usage() frontend.NamespaceUsage {
+	ns.srv.lock.Lock()
+	defer ns.srv.lock.Unlock()
+	u := frontend.NamespaceUsage{Name: ns.info.Name, Limits: ns.info.Limits}
+	for _, e := range ns.srv.data {
+		u.Keys++
+		u.Bytes += int64(len(e.value))
+	}
+	return u
+}
+
+// overLimit returns the error a frontend would refuse writing the items
+// with if they would take the server over its limits. The lock must be
+// held.
+func (s *Server) overLimit(items []frontend.Item) error {
+	keys, size := int64(len(s.data)), int64(0)
+	for _, e := range s.data {
+		size += int64(len(e.value))
+	}
+	seen := make(map[string]bool, 0)
+	for _, item := range items {
+		e, ok := s.data[item.Key]
+		if !ok && !seen[item.Key] {
+			keys++
+		}
+		seen[item.Key] = true
+		size += int64(len(item.Value) - len(e.value))
+	}
+	switch {
+	case s.limits.MaxKeys > 0 && keys > s.limits.MaxKeys:
+		return frontend.ErrKeyLimit
+	case s.limits.MaxBytes > 0 && size > s.limits.MaxBytes:
+		return frontend.ErrByteLimit
+	}
+	return nil
+}
+
+// digest answers as a frontend's digest endpoint does.
+func (s *Server) digest(w http.ResponseWriter, r *http.Request) {
+	var req frontend.DigestRequest
+	depth := frontend.DefaultDigestDepth
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	} else {
+		req.Prefix = r.URL.Query().Get("prefix")
+		if param := r.URL.Query().Get("depth"); param != "" {
+			depth, _ = strconv.Atoi(param)
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests++
+	if s.unavailable {
+		frontend.ServerError(w, frontend.ErrQuorum)
+		return
+	}
+	tree := merkle.New(ring.Range{}, uint(depth))
+	var d frontend.Digest
+	digests := make([]frontend.KeyDigest, 0)
+	for _, key := range s.keys() {
+		if !strings.HasPrefix(key, req.Prefix) {
+			continue
+		}
+		token := ring.Token([]byte(key))
+		hash := frontend.ItemDigest(key, s.data[key].value, s.data[key].contentType)
+		tree.Add(token, hash)
+		d.Keys++
+		for _, rng := range req.Ranges {
+			if rng.Contains(token) {
+				digests = append(digests, frontend.KeyDigest{Key: key, Hash: hash})
+				break
+			}
+		}
+	}
+
+	var body []byte
+	if r.Method == "POST" {
+		body, _ = json.Marshal(digests)
+	} else {
+		d.Tree, _ = tree.MarshalBinary()
+		body, _ = json.Marshal(d)
+	}
+	w.Write(body)
+}
+
+// watch streams changes as a frontend's watch endpoint does.
+func (s *Server) watch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix, exact := q.Get("prefix"), false
+	if key := q.Get("key"); key != "" {
+		prefix, exact = key, true
+	}
+	if !frontend.ValidKey(s.ns, prefix) {
+		frontend.InvalidKey(w)
+		return
+	}
+	var since uint64
+	param := q.Get("since")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		param = id
+	}
+	if param != "" {
+		var err error
+		if since, err = strconv.ParseUint(param, 10, 64); err != nil {
+			frontend.BadRequest(w, "Invalid version "+param+".")
+			return
+		}
+	}
+
+	s.lock.Lock()
+	if since == 0 {
+		since = s.stamp()
+	}
+	s.lock.Unlock()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "id: %d\n\n", since)
+	w.(http.Flusher).Flush()
+
+	for {
+		s.lock.Lock()
+		var events []frontend.Event
+		for _, ev := range s.events {
+			if ev.Version > since && strings.HasPrefix(ev.Key, prefix) &&
+				(!exact || ev.Key == prefix) {
+				events = append(events, ev)
+			}
+		}
+		if s.notify == nil {
+			s.notify = make(chan struct{})
+		}
+		notify := s.notify
+		s.lock.Unlock()
+
+		for _, ev := range events {
+			if frontend.WriteEvent(w, ev) != nil {
+				return
+			}
+			since = ev.Version
+		}
+		w.(http.Flusher).Flush()
+		select {
+		case <-notify:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package kludgetest_test
+
+import (
+	"fmt"
+	"github.com/gokyle/kludge/client"
+	"github.com/gokyle/kludge/client/kludgetest"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	srv := kludgetest.NewServer()
+	defer srv.Close()
+	srv.Set("seeded", []byte("value"))
+
+	ds, err := kludge.Connect(srv.Addr(), nil)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	if v, ok, err := ds.Get("seeded"); err != nil || !ok || string(v) != "value" {
+		fmt.Printf("[!] seeded key returned %q, %v, %v\n", v, ok, err)
+		t.FailNow()
+	}
+	if _, ok, err := ds.Set("foo", []byte("bar")); err != nil || ok {
+		fmt.Println("[!] new key reported as present:", err)
+		t.FailNow()
+	}
+	if v, ok := srv.Get("foo"); !ok || string(v) != "bar" {
+		fmt.Println("[!] write not stored")
+		t.FailNow()
+	}
+	resp, err := http.Head(srv.URL + "/data/foo")
+	if err != nil || resp.Header.Get("Content-Type") != "application/json" ||
+		resp.Header.Get("Content-Length") != "3" {
+		fmt.Println("[!] HEAD did not describe the value:", err)
+		t.FailNow()
+	}
+
+	keys, err := ds.List()
+	if err != nil || fmt.Sprint(keys) != "[foo seeded]" {
+		fmt.Println("[!] bad key list:", keys, err)
+		t.FailNow()
+	}
+	if prev, ok, err := ds.Del("foo"); err != nil || !ok || string(prev) != "bar" {
+		fmt.Printf("[!] DEL returned %q, %v, %v\n", prev, ok, err)
+		t.FailNow()
+	}
+	if _, ok, err := ds.Del("foo"); err != nil || ok {
+		fmt.Println("[!] deleted key reported as present:", err)
+		t.FailNow()
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	srv := kludgetest.NewServer()
+	defer srv.Close()
+	ds, err := kludge.Connect(srv.Addr(), nil,
+		kludge.WithRetry(1, 0, 0))
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+
+	srv.SetUnavailable(true)
+	_, _, err = ds.Get("foo")
+	if se, ok := err.(*kludge.StatusError); !ok || se.StatusCode != http.StatusServiceUnavailable {
+		fmt.Println("[!] expected a 503, got", err)
+		t.FailNow()
+	}
+	srv.SetUnavailable(false)
+	if _, _, err = ds.Get("foo"); err != nil {
+		fmt.Println("[!] server still unavailable:", err.Error())
+		t.FailNow()
+	}
+	if n := srv.Requests(); n != 2 {
+		fmt.Println("[!] expected 2 requests, saw", n)
+		t.FailNow()
+	}
+}
+
+// The server refuses the batches a frontend refuses, and stamps writes
+// with versions taken from the clock as a frontend does.
+func TestBatch(t *testing.T) {
+	srv := kludgetest.NewServer()
+	defer srv.Close()
+	srv.SetMaxValueSize(4)
+
+	post := func(body string) int {
+		resp, err := http.Post(srv.URL+"/batch", "application/json",
+			strings.NewReader(body))
+		if err != nil {
+			fmt.Println("[!] batch failed:", err.Error())
+			t.FailNow()
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, body := range []string{
+		`{"mode":"merge","items":[]}`,
+		`{"items":[{"key":"","value":"YQ=="}]}`,
+		`{"items":[{"key":"\u0001a","value":"YQ=="}]}`,
+		`{"items":[{"key":"a\u0000","value":"YQ=="}]}`,
+		`not json`,
+	} {
+		if code := post(body); code != http.StatusBadRequest {
+			fmt.Printf("[!] batch %s answered with %d\n", body, code)
+			t.FailNow()
+		}
+	}
+	if code := post(`{"items":[{"key":"a","value":"YWJjZGU="}]}`); code != http.StatusRequestEntityTooLarge {
+		fmt.Println("[!] oversized value answered with", code)
+		t.FailNow()
+	}
+
+	before := uint64(time.Now().UnixNano())
+	if code := post(`{"items":[{"key":"a","value":"YQ=="}]}`); code != http.StatusOK {
+		fmt.Println("[!] batch answered with", code)
+		t.FailNow()
+	}
+	resp, err := http.Get(srv.URL + "/data/a")
+	if err != nil {
+		fmt.Println("[!] GET failed:", err.Error())
+		t.FailNow()
+	}
+	resp.Body.Close()
+	version, _ := strconv.ParseUint(strings.Trim(resp.Header.Get("ETag"), `"`), 16, 64)
+	if version < before {
+		fmt.Println("[!] version not taken from the clock:", version)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,215 @@
+package kludge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// A Namespace is a separate set of keys in the datastore.
+type Namespace struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Limits  Limits    `json:"limits"`
+}
+
+// Limits caps a namespace's use of the datastore: the number of keys
+// it holds, the total size of their values, and the requests a second
+// each frontend serves in it. A zero limit is no limit. Writes that
+// would take a namespace over its keys or bytes fail with a
+// *StatusError whose StatusCode is 507, and requests over its rate
+// with one whose StatusCode is 429.
+type Limits struct {
+	MaxKeys  int64   `json:"max_keys,omitempty"`
+	MaxBytes int64   `json:"max_bytes,omitempty"`
+	MaxRate  float64 `json:"max_rate,omitempty"`
+}
+
+// A Usage reports the number of keys a namespace holds and the total
+// size of their values, along with its limits. The counts are kept by
+// the nodes as keys are written, and are approximate while replicas
+// disagree.
+type Usage struct {
+	Name   string `json:"name"`
+	Keys   int64  `json:"keys"`
+	Bytes  int64  `json:"bytes"`
+	Limits Limits `json:"limits"`
+}
+
+// Namespace returns a DataStore acting on the keys in a namespace,
+// which must have been created with CreateNamespace; its requests fail
+// with a *StatusError whose StatusCode is 404 if it has not. It shares
+// the frontends, their rotation, options and health checks of the
+// DataStore it is made from, but not its cache, and closing it has no effect: it is
+// done with when that DataStore is closed. The admin methods act on
+// the whole datastore whichever namespace they are called in.
+func (ds *DataStore) Namespace(name string) *DataStore {
+	nds := &DataStore{
+		endpoints:      ds.endpoints,
+		next:           ds.next,
+		balancer:       ds.balancer,
+		retry:          ds.retry,
+		healthInterval: ds.healthInterval,
+		done:           ds.done,
+		scheme:         ds.scheme,
+		basePath:       ds.basePath,
+		header:         ds.header,
+		userAgent:      ds.userAgent,
+		client:         ds.client,
+		ns:             name,
+	}
+	nds.closeOnce.Do(func() {})
+	return nds
+}
+
+// NamespaceName returns the name of the namespace the DataStore acts
+// in, or "" for the default namespace.
+func (ds *DataStore) NamespaceName() string {
+	return ds.ns
+}
+
+// Namespaces lists the datastore's namespaces in order of their names.
+func (ds *DataStore) Namespaces() ([]Namespace, error) {
+	return ds.NamespacesContext(context.Background())
+}
+
+// NamespacesContext is like Namespaces, but aborts the request if the
+// context is cancelled.
+func (ds *DataStore) NamespacesContext(ctx context.Context) (list []Namespace, err error) {
+	body, err := ds.admin(ctx, "GET", "/admin/ns")
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &list)
+	return
+}
+
+// CreateNamespace creates a namespace. It fails with a *StatusError
+// whose StatusCode is 409 if the namespace already exists, or 400 if
+// the name is not made of ASCII letters, digits, '_', '.' and '-'.
+func (ds *DataStore) CreateNamespace(name string) (*Namespace, error) {
+	return ds.CreateNamespaceContext(context.Background(), name)
+}
+
+// CreateNamespaceContext is like CreateNamespace, but aborts the
+// request if the context is cancelled.
+func (ds *DataStore) CreateNamespaceContext(ctx context.Context, name string) (ns *Namespace, err error) {
+	body, err := ds.admin(ctx, "PUT", "/admin/ns/"+url.PathEscape(name))
+	if err != nil {
+		return
+	}
+	ns = new(Namespace)
+	if err = json.Unmarshal(body, ns); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// DeleteNamespace deletes a namespace and every key in it, returning
+// the number of keys deleted.
+func (ds *DataStore) DeleteNamespace(name string) (deleted int, err error) {
+	return ds.DeleteNamespaceContext(context.Background(), name)
+}
+
+// DeleteNamespaceContext is like DeleteNamespace, but aborts the
+// request if the context is cancelled.
+func (ds *DataStore) DeleteNamespaceContext(ctx context.Context, name string) (deleted int, err error) {
+	return ds.deleted(ctx, "/admin/ns/"+url.PathEscape(name))
+}
+
+// ClearNamespace deletes every key in a namespace, leaving the
+// namespace itself, and returns the number of keys deleted.
+func (ds *DataStore) ClearNamespace(name string) (deleted int, err error) {
+	return ds.ClearNamespaceContext(context.Background(), name)
+}
+
+// ClearNamespaceContext is like ClearNamespace, but aborts the request
+// if the context is cancelled.
+func (ds *DataStore) ClearNamespaceContext(ctx context.Context, name string) (deleted int, err error) {
+	return ds.deleted(ctx, "/admin/ns/"+url.PathEscape(name)+"/data")
+}
+
+// deleted makes a DELETE request to a namespace admin endpoint,
+// returning the number of keys it reports deleting.
+func (ds *DataStore) deleted(ctx context.Context, path string) (int, error) {
+	body, err := ds.admin(ctx, "DELETE", path)
+	if err != nil {
+		return 0, err
+	}
+	var res struct {
+		Deleted int `json:"deleted"`
+	}
+	err = json.Unmarshal(body, &res)
+	return res.Deleted, err
+}
+
+// SetNamespaceLimits replaces a namespace's limits, returning the
+// namespace as it now is. Frontends other than the one answering may
+// take a few seconds to apply them.
+func (ds *DataStore) SetNamespaceLimits(name string, limits Limits) (*Namespace, error) {
+	return ds.SetNamespaceLimitsContext(context.Background(), name, limits)
+}
+
+// SetNamespaceLimitsContext is like SetNamespaceLimits, but aborts the
+// request if the context is cancelled.
+func (ds *DataStore) SetNamespaceLimitsContext(ctx context.Context, name string, limits Limits) (ns *Namespace, err error) {
+	body, err := json.Marshal(limits)
+	if err != nil {
+		return
+	}
+	resp, err := ds.do(ctx, "PUT", "/admin/ns/"+url.PathEscape(name)+"/limits",
+		bytes.NewReader(body), http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return
+	}
+	data, ok, err := readValue(resp)
+	if err != nil {
+		return
+	} else if !ok {
+		return nil, &StatusError{resp.StatusCode, string(data)}
+	}
+	ns = new(Namespace)
+	if err = json.Unmarshal(data, ns); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// NamespaceUsage returns a namespace's usage.
+func (ds *DataStore) NamespaceUsage(name string) (*Usage, error) {
+	return ds.NamespaceUsageContext(context.Background(), name)
+}
+
+// NamespaceUsageContext is like NamespaceUsage, but aborts the request
+// if the context is cancelled.
+func (ds *DataStore) NamespaceUsageContext(ctx context.Context, name string) (u *Usage, err error) {
+	body, err := ds.admin(ctx, "GET", "/admin/ns/"+url.PathEscape(name)+"/usage")
+	if err != nil {
+		return
+	}
+	u = new(Usage)
+	if err = json.Unmarshal(body, u); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Usages returns the usage of every namespace, in order of their
+// names.
+func (ds *DataStore) Usages() ([]Usage, error) {
+	return ds.UsagesContext(context.Background())
+}
+
+// UsagesContext is like Usages, but aborts the request if the context
+// is cancelled.
+func (ds *DataStore) UsagesContext(ctx context.Context) (list []Usage, err error) {
+	body, err := ds.admin(ctx, "GET", "/admin/usage")
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &list)
+	return
+}
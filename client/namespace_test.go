@@ -0,0 +1,130 @@
+package kludge
+
+import (
+	"fmt"
+	"github.com/gokyle/kludge/client/kludgetest"
+	"testing"
+)
+
+func TestNamespace(t *testing.T) {
+	srv := kludgetest.NewServer()
+	defer srv.Close()
+	ds, err := Connect(srv.Addr(), nil)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	defer ds.Close()
+
+	if _, err = ds.CreateNamespace("tenant-a"); err != nil {
+		fmt.Println("[!] failed to create namespace:", err.Error())
+		t.FailNow()
+	}
+	if _, err = ds.CreateNamespace("tenant-a"); err == nil {
+		fmt.Println("[!] namespace created twice")
+		t.FailNow()
+	} else if serr, ok := err.(*StatusError); !ok || serr.StatusCode != 409 {
+		fmt.Println("[!] second create failed with", err)
+		t.FailNow()
+	}
+
+	a := ds.Namespace("tenant-a")
+	if _, _, err = a.Set("key", []byte("in a")); err != nil {
+		fmt.Println("[!] set in namespace failed:", err.Error())
+		t.FailNow()
+	}
+	if _, _, err = ds.Set("key", []byte("default")); err != nil {
+		fmt.Println("[!] set failed:", err.Error())
+		t.FailNow()
+	}
+	if value, ok, err := a.Get("key"); err != nil || !ok || string(value) != "in a" {
+		fmt.Printf("[!] namespace read %q %v %v\n", value, ok, err)
+		t.FailNow()
+	}
+	if value, ok := srv.Namespace("tenant-a").Get("key"); !ok || string(value) != "in a" {
+		fmt.Printf("[!] namespace holds %q\n", value)
+		t.FailNow()
+	}
+	if value, ok := srv.Get("key"); !ok || string(value) != "default" {
+		fmt.Printf("[!] default namespace holds %q\n", value)
+		t.FailNow()
+	}
+
+	list, err := ds.Namespaces()
+	if err != nil || len(list) != 1 || list[0].Name != "tenant-a" {
+		fmt.Println("[!] namespaces listed as", list, err)
+		t.FailNow()
+	}
+
+	a.Close()
+	if _, ok, err := ds.Get("key"); err != nil || !ok {
+		fmt.Println("[!] closing a namespace closed its datastore:", err)
+		t.FailNow()
+	}
+
+	if deleted, err := ds.ClearNamespace("tenant-a"); err != nil || deleted != 1 {
+		fmt.Println("[!] clear returned", deleted, err)
+		t.FailNow()
+	}
+	if _, ok, err := a.Get("key"); err != nil || ok {
+		fmt.Println("[!] key survived clearing its namespace:", err)
+		t.FailNow()
+	}
+	if _, err = ds.DeleteNamespace("tenant-a"); err != nil {
+		fmt.Println("[!] delete failed:", err.Error())
+		t.FailNow()
+	}
+	if _, _, err = a.Get("key"); err == nil {
+		fmt.Println("[!] read from a deleted namespace succeeded")
+		t.FailNow()
+	} else if serr, ok := err.(*StatusError); !ok || serr.StatusCode != 404 {
+		fmt.Println("[!] read from a deleted namespace failed with", err)
+		t.FailNow()
+	}
+}
+
+func TestNamespaceLimits(t *testing.T) {
+	srv := kludgetest.NewServer()
+	defer srv.Close()
+	ds, err := Connect(srv.Addr(), nil)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	defer ds.Close()
+
+	if _, err = ds.CreateNamespace("team"); err != nil {
+		fmt.Println("[!] failed to create namespace:", err.Error())
+		t.FailNow()
+	}
+	ns, err := ds.SetNamespaceLimits("team", Limits{MaxKeys: 2, MaxBytes: 10})
+	if err != nil || ns.Limits.MaxKeys != 2 {
+		fmt.Println("[!] set limits returned", ns, err)
+		t.FailNow()
+	}
+	team := ds.Namespace("team")
+	for _, key := range []string{"a", "b"} {
+		if _, _, err = team.Set(key, []byte("1234")); err != nil {
+			fmt.Println("[!] set within the limits failed:", err.Error())
+			t.FailNow()
+		}
+	}
+	if _, _, err = team.Set("c", []byte("1")); err == nil {
+		fmt.Println("[!] set over the key limit succeeded")
+		t.FailNow()
+	} else if serr, ok := err.(*StatusError); !ok || serr.StatusCode != 507 {
+		fmt.Println("[!] set over the key limit failed with", err)
+		t.FailNow()
+	}
+
+	u, err := ds.NamespaceUsage("team")
+	if err != nil || u.Keys != 2 || u.Bytes != 8 || u.Limits.MaxBytes != 10 {
+		fmt.Println("[!] usage reported as", u, err)
+		t.FailNow()
+	}
+	list, err := ds.Usages()
+	if err != nil || len(list) != 1 || list[0] != *u {
+		fmt.Println("[!] usages reported as", list, err)
+		t.FailNow()
+	}
+}
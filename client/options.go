@@ -0,0 +1,126 @@
+package kludge
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// An Option configures a DataStore; options are passed to Connect.
+type Option func(ds *DataStore)
+
+// WithTransport sets the transport the DataStore's HTTP client makes
+// requests through.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(ds *DataStore) {
+		ds.client.Transport = rt
+	}
+}
+
+// WithTimeout bounds the time each request to the datastore may take,
+// including reading the response body.
+func WithTimeout(d time.Duration) Option {
+	return func(ds *DataStore) {
+		ds.client.Timeout = d
+	}
+}
+
+// WithBasePath sets the path the datastore's API is served under, for
+// frontends behind a proxy that mounts them somewhere other than the
+// root; with a base path of "/kludge", keys are found under
+// "/kludge/data/".
+func WithBasePath(path string) Option {
+	return func(ds *DataStore) {
+		path = strings.Trim(path, "/")
+		if path != "" {
+			path = "/" + path
+		}
+		ds.basePath = path
+	}
+}
+
+// WithHTTPS connects to the datastore over HTTPS. The TLS settings are
+// those of the HTTP client's transport.
+func WithHTTPS() Option {
+	return func(ds *DataStore) {
+		ds.scheme = "https"
+	}
+}
+
+// WithHeader adds a header that is sent with every request, such as an
+// authorisation token expected by a proxy in front of the datastore.
+func WithHeader(name, value string) Option {
+	return func(ds *DataStore) {
+		ds.header.Add(name, value)
+	}
+}
+
+// WithUserAgent sets the User-Agent sent with every request. It
+// defaults to "kludge-client/" followed by the client's version.
+func WithUserAgent(ua string) Option {
+	return func(ds *DataStore) {
+		ds.userAgent = ua
+	}
+}
+
+// WithBalancer sets how requests are spread across the frontends given
+// to ConnectCluster. The default is RoundRobin.
+func WithBalancer(b Balancer) Option {
+	return func(ds *DataStore) {
+		ds.balancer = b
+	}
+}
+
+// WithRetry sets the number of attempts made at each request, and the
+// backoff between them: before the n'th retry, the client waits for a
+// random time of up to base doubled n times, and at most max. GET
+// requests are retried when they fail or are answered with a 503;
+// writes are retried only when they could not connect, since a write
+// that reached a frontend may have taken effect. By default, requests
+// are attempted three times, with a backoff of 50ms up to a second.
+func WithRetry(attempts int, base, max time.Duration) Option {
+	return func(ds *DataStore) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		ds.retry.attempts = attempts
+		ds.retry.base, ds.retry.max = base, max
+	}
+}
+
+// WithHealthCheck checks each frontend at the given interval, so that
+// frontends that have failed are only used again once they answer.
+// Without health checks, a frontend that fails is passed over for a
+// few seconds before requests are tried on it again. The checks run
+// until the DataStore is closed.
+func WithHealthCheck(interval time.Duration) Option {
+	return func(ds *DataStore) {
+		ds.healthInterval = interval
+	}
+}
+
+// WithCache keeps the values read through the DataStore in a cache of
+// up to maxBytes of keys and values, evicting the least recently used
+// first. Cached values are returned without asking the datastore for
+// up to maxAge after they were fetched; after that, they are
+// revalidated with their ETag, so that the value is only sent again if
+// it has changed. With a maxAge of zero, every read is revalidated.
+// Keys written through the DataStore are dropped from its cache, but
+// writes by other clients are only seen once a value is revalidated,
+// unless WithCacheWatch is also given.
+func WithCache(maxBytes int64, maxAge time.Duration) Option {
+	return func(ds *DataStore) {
+		ds.cache = newCache(maxBytes, maxAge)
+	}
+}
+
+// WithCacheWatch watches every key in the datastore for as long as the
+// DataStore is open, dropping keys from the cache set up by WithCache
+// as soon as their changes are reported; cached values then rarely
+// need to be revalidated, and a long maxAge may be used. Connect fails
+// if the watch cannot be started.
+func WithCacheWatch() Option {
+	return func(ds *DataStore) {
+		ds.cacheWatch = true
+	}
+}
@@ -0,0 +1,118 @@
+package kludge
+
+import (
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingTransport counts the requests made through it.
+type countingTransport struct {
+	lock  sync.Mutex
+	count int
+}
+
+func (ct *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ct.lock.Lock()
+	ct.count++
+	ct.lock.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// headerHandler answers version requests under /kludge, and records
+// the last request it received.
+func headerHandler(last *http.Request) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*last = *r
+		if !strings.HasPrefix(r.URL.Path, "/kludge/data") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Add("X-Kludge-Version", common.Version())
+	})
+}
+
+func TestCustomClient(t *testing.T) {
+	var last http.Request
+	srv := httptest.NewServer(headerHandler(&last))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	ct := new(countingTransport)
+	client := &http.Client{Transport: ct}
+	ds, err := Connect(addr, client, WithBasePath("/kludge/"),
+		WithTimeout(time.Second))
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	if ct.count != 1 {
+		fmt.Println("[!] supplied client was not used")
+		t.FailNow()
+	}
+	if client.Timeout != 0 {
+		fmt.Println("[!] options modified the supplied client")
+		t.FailNow()
+	}
+	ds.Get("foo")
+	if last.URL.Path != "/kludge/data/foo" {
+		fmt.Println("[!] base path not used:", last.URL.Path)
+		t.FailNow()
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	var last http.Request
+	srv := httptest.NewServer(headerHandler(&last))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	if _, err := Connect(addr, nil); err != ErrInvalidDatastore {
+		fmt.Println("[!] expected an invalid datastore without the base path")
+		t.FailNow()
+	}
+	if ua := last.Header.Get("User-Agent"); ua != "kludge-client/"+ClientVersion() {
+		fmt.Println("[!] bad default user agent:", ua)
+		t.FailNow()
+	}
+
+	ds, err := Connect(addr, nil, WithBasePath("kludge"),
+		WithUserAgent("test-agent"), WithHeader("X-Token", "secret"))
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	ds.Set("foo", []byte("bar"))
+	if last.Header.Get("User-Agent") != "test-agent" {
+		fmt.Println("[!] user agent not set")
+		t.FailNow()
+	} else if last.Header.Get("X-Token") != "secret" {
+		fmt.Println("[!] default header not sent")
+		t.FailNow()
+	} else if last.Header.Get("Content-Type") != "application/json" {
+		fmt.Println("[!] content type not set")
+		t.FailNow()
+	}
+}
+
+func TestHTTPS(t *testing.T) {
+	var last http.Request
+	srv := httptest.NewTLSServer(headerHandler(&last))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "https://")
+
+	if _, err := Connect(addr, srv.Client(), WithBasePath("kludge")); err == nil {
+		fmt.Println("[!] plain HTTP connection to a TLS server succeeded")
+		t.FailNow()
+	}
+	if _, err := Connect(addr, srv.Client(), WithBasePath("kludge"),
+		WithHTTPS()); err != nil {
+		fmt.Println("[!] connect over HTTPS failed:", err.Error())
+		t.FailNow()
+	}
+}
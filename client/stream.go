@@ -0,0 +1,72 @@
+package kludge
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Put stores the value read from r until EOF, without holding it in
+// memory; if its length is not known, it is sent in chunks. Put
+// returns whether the key was present, but not its previous value. A
+// value larger than the datastore accepts is refused with a
+// *StatusError whose StatusCode is 413.
+//
+// Unless r is a *bytes.Reader, the value can only be sent once, so a
+// Put that fails to connect is not retried on another frontend.
+func (ds *DataStore) Put(key string, r io.Reader) (ok bool, err error) {
+	return ds.PutContext(context.Background(), key, r)
+}
+
+// PutContext is like Put, but aborts the request if the context is
+// cancelled. A write that is aborted may still take effect.
+func (ds *DataStore) PutContext(ctx context.Context, key string, r io.Reader) (ok bool, err error) {
+	// The HTTP client closes request bodies once they are sent, which
+	// is the caller's business rather than ours.
+	if _, closer := r.(io.Closer); closer {
+		r = ioutil.NopCloser(r)
+	}
+	ds.Invalidate(key)
+	defer ds.Invalidate(key)
+	resp, err := ds.do(ctx, "POST", "/data/"+key, r,
+		http.Header{"Content-Type": {"application/octet-stream"}})
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		ok = true
+	case http.StatusCreated:
+	default:
+		_, _, err = readValue(resp)
+		return
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return
+}
+
+// GetTo copies the value of a key to w as it is received, returning
+// the number of bytes written and whether the key was present. Values
+// read this way are not cached.
+func (ds *DataStore) GetTo(key string, w io.Writer) (n int64, ok bool, err error) {
+	return ds.GetToContext(context.Background(), key, w)
+}
+
+// GetToContext is like GetTo, but aborts the request if the context
+// is cancelled; part of the value may have been written by then.
+func (ds *DataStore) GetToContext(ctx context.Context, key string, w io.Writer) (n int64, ok bool, err error) {
+	resp, err := ds.do(ctx, "GET", "/data/"+key, nil, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// A missing key is not an error, but a missing namespace is.
+		_, _, err = readValue(resp)
+		return
+	}
+	n, err = io.Copy(w, resp.Body)
+	return n, true, err
+}
@@ -0,0 +1,83 @@
+package kludge
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gokyle/kludge/client/kludgetest"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPutGetTo(t *testing.T) {
+	srv := kludgetest.NewServer()
+	defer srv.Close()
+	ds, err := Connect(srv.Addr(), nil)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+
+	// A MultiReader's length is unknown, so the value is sent chunked.
+	value := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	ok, err := ds.Put("big", io.MultiReader(bytes.NewReader(value)))
+	if err != nil || ok {
+		fmt.Println("[!] PUT of a new key returned", ok, err)
+		t.FailNow()
+	}
+	if stored, _ := srv.Get("big"); !bytes.Equal(stored, value) {
+		fmt.Printf("[!] stored %d bytes, expected %d\n", len(stored), len(value))
+		t.FailNow()
+	}
+	if ok, err = ds.Put("big", strings.NewReader("small")); err != nil || !ok {
+		fmt.Println("[!] PUT of an existing key returned", ok, err)
+		t.FailNow()
+	}
+
+	var buf bytes.Buffer
+	n, ok, err := ds.GetTo("big", &buf)
+	if err != nil || !ok || n != 5 || buf.String() != "small" {
+		fmt.Printf("[!] GetTo returned %d, %v, %v: %q\n", n, ok, err, buf.String())
+		t.FailNow()
+	}
+	buf.Reset()
+	if n, ok, err = ds.GetTo("missing", &buf); err != nil || ok || n != 0 {
+		fmt.Println("[!] GetTo of a missing key returned", n, ok, err)
+		t.FailNow()
+	}
+	_, _, err = ds.Namespace("missing").GetTo("big", &buf)
+	if se, ok := err.(*StatusError); !ok || se.StatusCode != http.StatusNotFound {
+		fmt.Println("[!] GetTo in a missing namespace returned", err)
+		t.FailNow()
+	}
+}
+
+func TestPutTooLarge(t *testing.T) {
+	srv := kludgetest.NewServer()
+	defer srv.Close()
+	srv.SetMaxValueSize(16)
+	ds, err := Connect(srv.Addr(), nil)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+
+	if _, err = ds.Put("foo", strings.NewReader("0123456789abcdef")); err != nil {
+		fmt.Println("[!] value at the limit refused:", err.Error())
+		t.FailNow()
+	}
+	_, err = ds.Put("bar", io.MultiReader(strings.NewReader("0123456789abcdefg")))
+	if se, ok := err.(*StatusError); !ok || se.StatusCode != http.StatusRequestEntityTooLarge {
+		fmt.Println("[!] expected a 413, got", err)
+		t.FailNow()
+	}
+	if _, _, err = ds.Set("bar", []byte("0123456789abcdefg")); err == nil {
+		fmt.Println("[!] SET of a value over the limit succeeded")
+		t.FailNow()
+	}
+	if _, ok := srv.Get("bar"); ok {
+		fmt.Println("[!] value over the limit was stored")
+		t.FailNow()
+	}
+}
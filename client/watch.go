@@ -0,0 +1,177 @@
+package kludge
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An Event reports a change to a watched key: a write, or with Deleted
+// set, its removal. An event with Lost set has no key; it reports that
+// the datastore may have missed changes up to its version, so that
+// anything derived from the keys watched should be rebuilt.
+type Event struct {
+	Key     string `json:"key"`
+	Version uint64 `json:"version"`
+	Deleted bool   `json:"deleted"`
+	Lost    bool   `json:"lost"`
+}
+
+// watchRetryMin is the least time a watch waits before reconnecting.
+const watchRetryMin = 100 * time.Millisecond
+
+// Watch reports the changes to keys beginning with prefix on the
+// returned channel, until the context is cancelled, when the channel
+// is closed. Changes with versions newer than since are reported, or
+// if since is zero, those made from now on; a watch may therefore be
+// resumed after the version of the last event seen. If the connection
+// is lost, Watch reconnects and resumes by itself. An error is
+// returned if the first connection fails.
+//
+// The keys reported are dropped from the DataStore's cache, and a Lost
+// event empties it. A timeout set with WithTimeout applies to the
+// stream as a whole, which is reopened each time it expires.
+func (ds *DataStore) Watch(ctx context.Context, prefix string, since uint64) (<-chan Event, error) {
+	return ds.watch(ctx, "prefix", prefix, since)
+}
+
+// WatchKey is like Watch, but reports the changes to a single key.
+func (ds *DataStore) WatchKey(ctx context.Context, key string, since uint64) (<-chan Event, error) {
+	return ds.watch(ctx, "key", key, since)
+}
+
+func (ds *DataStore) watch(ctx context.Context, param, value string, since uint64) (<-chan Event, error) {
+	resp, err := ds.openWatch(ctx, param, value, since)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for failures := 0; ; failures++ {
+			if resp != nil {
+				since = ds.readEvents(ctx, resp, since, events)
+				failures = 0
+			}
+			wait := ds.backoff(failures)
+			if wait < watchRetryMin {
+				wait = watchRetryMin
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			resp, _ = ds.openWatch(ctx, param, value, since)
+		}
+	}()
+	return events, nil
+}
+
+// openWatch starts a watch stream.
+func (ds *DataStore) openWatch(ctx context.Context, param, value string, since uint64) (*http.Response, error) {
+	path := "/watch?" + param + "=" + url.QueryEscape(value)
+	if since != 0 {
+		path += "&since=" + strconv.FormatUint(since, 10)
+	}
+	resp, err := ds.do(ctx, "GET", path, nil,
+		http.Header{"Accept": {"text/event-stream"}})
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode != http.StatusOK {
+		_, _, err = readValue(resp)
+		if err == nil {
+			err = &StatusError{resp.StatusCode, ""}
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// readEvents delivers the events in a watch stream until it ends or
+// the context is cancelled, returning the version to resume after.
+// The resume point only moves past an event once the event has been
+// delivered. Events may arrive out of version order, so if one is cut
+// off, the resume point is moved back below it, and the events
+// delivered since are reported again.
+func (ds *DataStore) readEvents(ctx context.Context, resp *http.Response, since uint64, events chan<- Event) uint64 {
+	defer resp.Body.Close()
+	var kind, data string
+	var id uint64
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		line := lines.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			kind = strings.TrimSpace(line[len("event:"):])
+		case strings.HasPrefix(line, "data:"):
+			data = strings.TrimSpace(line[len("data:"):])
+		case strings.HasPrefix(line, "id:"):
+			id, _ = strconv.ParseUint(strings.TrimSpace(line[len("id:"):]), 10, 64)
+		case line == "":
+			var ev Event
+			if kind != "" && json.Unmarshal([]byte(data), &ev) == nil {
+				ds.invalidateEvent(ev)
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return resumeBefore(since, id)
+				}
+			}
+			// An event with only an ID marks where the stream starts.
+			if id > since {
+				since = id
+			}
+			kind, data, id = "", "", 0
+		}
+	}
+	return resumeBefore(since, id)
+}
+
+// resumeBefore returns the point to resume a watch after when the
+// event with the given ID has not been delivered.
+func resumeBefore(since, id uint64) uint64 {
+	if id != 0 && id <= since {
+		return id - 1
+	}
+	return since
+}
+
+func (ds *DataStore) invalidateEvent(ev Event) {
+	if ev.Lost {
+		ds.InvalidateAll()
+	} else {
+		ds.Invalidate(ev.Key)
+	}
+}
+
+// watchCache drops keys from the cache as their changes are reported,
+// until the DataStore is closed.
+func (ds *DataStore) watchCache() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := ds.Watch(ctx, "", 0)
+	if err != nil {
+		cancel()
+		return err
+	}
+	go func() {
+		defer cancel()
+		for {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					return
+				}
+			case <-ds.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
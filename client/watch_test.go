@@ -0,0 +1,139 @@
+package kludge
+
+import (
+	"context"
+	"fmt"
+	"github.com/gokyle/kludge/client/kludgetest"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(time.Second):
+		fmt.Println("[!] timed out waiting for an event")
+		t.FailNow()
+	}
+	return Event{}
+}
+
+func TestWatch(t *testing.T) {
+	srv := kludgetest.NewServer()
+	defer srv.Close()
+	ds, err := Connect(srv.Addr(), nil)
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := ds.Watch(ctx, "foo/", 0)
+	if err != nil {
+		fmt.Println("[!] watch failed:", err.Error())
+		t.FailNow()
+	}
+	srv.Set("foo/a", []byte("1"))
+	ds.Set("bar", []byte("2"))
+	ds.Del("foo/a")
+	set, del := nextEvent(t, events), nextEvent(t, events)
+	if set.Key != "foo/a" || set.Deleted || del.Key != "foo/a" || !del.Deleted {
+		fmt.Printf("[!] unexpected events %+v, %+v\n", set, del)
+		t.FailNow()
+	}
+
+	// The stream is reopened, after the last event, if it is cut.
+	srv.CloseClientConnections()
+	time.Sleep(50 * time.Millisecond)
+	srv.Set("foo/b", []byte("3"))
+	if ev := nextEvent(t, events); ev.Key != "foo/b" {
+		fmt.Printf("[!] reconnected watch reported %+v\n", ev)
+		t.FailNow()
+	}
+
+	// A watch may be resumed from an event's version.
+	keyEvents, err := ds.WatchKey(ctx, "foo/a", set.Version)
+	if err != nil {
+		fmt.Println("[!] watch failed:", err.Error())
+		t.FailNow()
+	}
+	if ev := nextEvent(t, keyEvents); ev != del {
+		fmt.Printf("[!] resumed watch reported %+v\n", ev)
+		t.FailNow()
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+// The resume point of a stream only passes events once they have been
+// delivered, and falls back below one that arrives out of order but is
+// not delivered.
+func TestReadEvents(t *testing.T) {
+	ds := new(DataStore)
+	stream := func(body string) *http.Response {
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(body))}
+	}
+	const start = "id: 5\n\n"
+	const ev10 = "event: set\nid: 10\ndata: {\"key\":\"a\",\"version\":10}\n\n"
+	const ev8 = "event: set\nid: 8\ndata: {\"key\":\"b\",\"version\":8}\n\n"
+
+	for _, c := range []struct {
+		body      string
+		delivered int
+		since     uint64
+	}{
+		{start, 0, 5},
+		{start + ev10, 1, 10},
+		{start + ev10 + ev8, 2, 10},
+		{start + ev10[:len(ev10)-1], 0, 5},
+		{start + ev10 + ev8[:len(ev8)-1], 1, 7},
+	} {
+		events := make(chan Event, 2)
+		since := ds.readEvents(context.Background(), stream(c.body), 0, events)
+		if len(events) != c.delivered || since != c.since {
+			fmt.Printf("[!] delivered %d events and resumed after %d from %q\n",
+				len(events), since, c.body)
+			t.FailNow()
+		}
+	}
+
+	// An event that cannot be delivered is not passed either.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if since := ds.readEvents(ctx, stream(start+ev10), 0, make(chan Event)); since != 5 {
+		fmt.Println("[!] undelivered event passed, resuming after", since)
+		t.FailNow()
+	}
+}
+
+func TestCacheWatch(t *testing.T) {
+	srv := kludgetest.NewServer()
+	defer srv.Close()
+	srv.Set("foo", []byte("bar"))
+	ds, err := Connect(srv.Addr(), nil, WithCache(1024, time.Hour),
+		WithCacheWatch())
+	if err != nil {
+		fmt.Println("[!] connect failed:", err.Error())
+		t.FailNow()
+	}
+	defer ds.Close()
+
+	mustGet(t, ds, "foo", "bar")
+	srv.Set("foo", []byte("baz"))
+	for deadline := time.Now().Add(time.Second); ; {
+		if v, _, _ := ds.Get("foo"); string(v) == "baz" {
+			break
+		} else if time.Now().After(deadline) {
+			fmt.Println("[!] change by another client not seen")
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
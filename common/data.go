@@ -1,10 +1,35 @@
 package common
 
+import (
+	"bytes"
+	"github.com/gokyle/kludge/ring"
+	"time"
+)
+
 const (
 	OpGet = iota
 	OpSet
 	OpDel
 	OpLst
+	OpTree // gob-encoded [][]byte: the Merkle tree for each range
+	OpVers // gob-encoded []KeyVersion for the keys in the ranges
+	OpHint // Val is a gob-encoded Hint
+	OpStats
+	OpScan      // gob-encoded []Item for the keys in the ranges after Key beginning with Val
+	OpRebalance // JSON-encoded RebalanceStatus
+	OpCleanup   // removes the records for ranges the node doesn't hold
+	OpWatch     // gob-encoded []Change after Version for keys beginning with Key
+	OpLog       // gob-encoded []Change from the change log, starting at sequence Version
+	OpBackup    // starts a backup to the archive named by Key, replacing it if Val is BackupOverwrite; JSON-encoded BackupStatus
+	OpBackupStatus
+	OpUsage // gob-encoded []Usage for the namespace named by Key, or for all of them
+	OpBatch // Val is a gob-encoded []Item to set; gob-encoded []string of the errors setting each
+)
+
+// The kinds of gossip members.
+const (
+	MemberNode     = "node"
+	MemberFrontend = "frontend"
 )
 
 var opNames map[byte]string
@@ -15,15 +40,43 @@ func init() {
 	opNames[OpSet] = "SET"
 	opNames[OpDel] = "DEL"
 	opNames[OpLst] = "LST"
+	opNames[OpTree] = "TREE"
+	opNames[OpVers] = "VERS"
+	opNames[OpHint] = "HINT"
+	opNames[OpStats] = "STATS"
+	opNames[OpScan] = "SCAN"
+	opNames[OpRebalance] = "REBALANCE"
+	opNames[OpCleanup] = "CLEANUP"
+	opNames[OpWatch] = "WATCH"
+	opNames[OpLog] = "LOG"
+	opNames[OpBackup] = "BACKUP"
+	opNames[OpBackupStatus] = "BACKUPSTATUS"
+	opNames[OpUsage] = "USAGE"
+	opNames[OpBatch] = "BATCH"
 }
 
+// An Operation is sent from the frontend (or from another node) to a
+// node. The Version is the timestamp assigned to a write by the
+// frontend that accepted it; a node will not let a write replace a
+// value with a newer version. Ranges is used by the operations that act
+// on ranges of the token ring rather than on a single key, and Limit
+// bounds the number of results returned by a scan. Type is the content
+// type a value is set with, which is kept with the value.
 type Operation struct {
-	OpCode byte
-	Key    []byte
-	Val    []byte
-	WID    int // ID of the handling worker
+	OpCode  byte
+	Key     []byte
+	Val     []byte
+	Type    string
+	Version uint64
+	Ranges  []ring.Range
+	Limit   int
+	WID     int // ID of the handling worker
 }
 
+// MaxTypeLen is the length of the longest content type a value may be
+// stored with.
+const MaxTypeLen = 255
+
 func (op *Operation) Name() string {
 	return opNames[op.OpCode]
 }
@@ -37,8 +90,124 @@ func (req *Request) OpName() string {
 	return req.Op.Name()
 }
 
+// A Response carries the result of an operation. For single key
+// operations, Version is the version of the value in Body; a deleted
+// key has KeyOK set to false but retains the version of its deletion.
+// Type is the content type of the value, if it was set with one.
 type Response struct {
-	KeyOK  bool
-	Body   []byte
-	ErrMsg string
+	KeyOK   bool
+	Body    []byte
+	Type    string
+	Version uint64
+	ErrMsg  string
+}
+
+// A KeyVersion describes the state of a single key on a node, without
+// its value. A list of these is returned in response to an OpVers
+// operation.
+type KeyVersion struct {
+	Key     []byte
+	Version uint64
+	Deleted bool
+}
+
+// A Hint is a write held by one node on behalf of another node that
+// could not be reached when the write was made. The holder delivers
+// the write to the target once it becomes reachable again.
+type Hint struct {
+	Target ring.Node
+	Op     Operation
+}
+
+// An Item is a key with its record, as returned by an OpScan. A scan
+// returns the items for the keys beginning with the operation's Val in
+// key order, starting after its Key, or at the first key beginning
+// with Val if that is later; if it returns Limit items, there may be
+// more.
+type Item struct {
+	Key     []byte
+	Val     []byte
+	Type    string
+	Version uint64
+	Deleted bool
+}
+
+// A Change is a write applied by a node, as returned by an OpWatch or
+// an OpLog.
+//
+// For an OpWatch, a node returns the changes it has applied with
+// versions newer than the operation's Version, in version order. The
+// response's Version is the node's horizon: changes up to it may have
+// been forgotten, so a watcher that has seen less may have missed some.
+//
+// For an OpLog, a node returns up to Limit entries of its change log,
+// in which every write it applies is given the next sequence number
+// Seq, starting at the operation's Version. The response's Version is
+// the sequence number of the next change; entries older than the
+// node's retention window are trimmed, so a reader that falls behind
+// finds its entries starting later than it asked. The log records
+// which keys changed, not their values: a reader that wants a value
+// reads the key, and may find a later one than the entry's version.
+type Change struct {
+	Seq     uint64
+	Key     []byte
+	Version uint64
+	Deleted bool
+}
+
+// BackupOverwrite, as the Val of an OpBackup, has the backup replace
+// an existing archive of the same name.
+const BackupOverwrite = "overwrite"
+
+// BackupStatus describes the last backup a node was asked to make,
+// as returned by OpBackup and OpBackupStatus. Path is the archive
+// written, and Err the reason the backup failed; Checksum is set once
+// the archive is complete.
+type BackupStatus struct {
+	Path     string
+	Running  bool
+	Records  int64
+	Bytes    int64
+	Checksum string
+	Err      string
+	Started  time.Time
+	Finished time.Time
+}
+
+// RebalanceStatus describes a node's progress in taking over the
+// ranges it has been assigned since the ring last changed. A node is
+// settled once it holds all the data for its ranges.
+type RebalanceStatus struct {
+	Settled bool
+	Ranges  int
+	Done    int
+	Keys    int64
+	Bytes   int64
+	Started time.Time
+}
+
+// Keys in a namespace are stored as NamespacePrefix, the namespace's
+// name, a NUL byte and the key the client gave.
+const NamespacePrefix = "\x01"
+
+// KeyNamespace returns the namespace a stored key belongs to; ok is
+// false for a key in the default namespace.
+func KeyNamespace(key []byte) (ns string, ok bool) {
+	if len(key) == 0 || key[0] != NamespacePrefix[0] {
+		return "", false
+	}
+	end := bytes.IndexByte(key, 0)
+	if end < 0 {
+		return "", false
+	}
+	return string(key[1:end]), true
+}
+
+// Usage is a namespace's share of a node's records, as returned by an
+// OpUsage: the number of live keys it holds and the total size of
+// their values.
+type Usage struct {
+	Namespace string
+	Keys      int64
+	Bytes     int64
 }
@@ -0,0 +1,47 @@
+package common
+
+import (
+	"encoding/gob"
+	"errors"
+	"net"
+	"time"
+)
+
+// LinkTimeout bounds the time a single exchange with a node may take,
+// including connecting to it.
+var LinkTimeout = 5 * time.Second
+
+// SendOperation sends an operation to the node listening on addr and
+// returns its response. If the node reports an error, it is returned
+// along with the response.
+func SendOperation(addr string, op *Operation) (resp *Response, err error) {
+	conn, err := net.DialTimeout("tcp", addr, LinkTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(LinkTimeout))
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	if err = enc.Encode(op); err != nil {
+		return
+	}
+
+	resp = new(Response)
+	if err = dec.Decode(resp); err != nil {
+		resp = nil
+		return
+	}
+	if resp.ErrMsg != "" {
+		err = errors.New(resp.ErrMsg)
+	}
+	return
+}
+
+// NewVersion returns a version for a new write, taken from the local
+// clock. Versions are compared to resolve conflicting writes, with the
+// most recent write winning.
+func NewVersion() uint64 {
+	return uint64(time.Now().UnixNano())
+}
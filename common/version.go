@@ -10,8 +10,8 @@ var version struct {
 
 func init() {
 	version.Major = 0
-	version.Minor = 1
-	version.Patch = 3
+	version.Minor = 2
+	version.Patch = 0
 }
 
 func Version() string {
@@ -0,0 +1,129 @@
+package faultproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Control returns the HTTP control API for a set of proxies, keyed by
+// name. For each proxy, /<name> reports its faults, connection counts
+// and addresses as JSON on GET; a POST sets the faults from the form
+// values latency (a duration such as "200ms"), drop, blackhole,
+// truncate_request and truncate_response, with missing values clearing
+// the fault; and a DELETE clears every fault.
+func Control(proxies map[string]*Proxy) http.Handler {
+	mux := http.NewServeMux()
+	for name, p := range proxies {
+		mux.Handle("/"+name, control{p})
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		status := make(map[string]proxyStatus, 0)
+		for name, p := range proxies {
+			status[name] = statusOf(p)
+		}
+		writeJSON(w, status)
+	})
+	return mux
+}
+
+type control struct {
+	p *Proxy
+}
+
+type proxyStatus struct {
+	Addr             string
+	Target           string
+	Latency          string
+	Drop             bool
+	Blackhole        bool
+	TruncateRequest  int
+	TruncateResponse int
+	Accepted         int
+	Dropped          int
+}
+
+func statusOf(p *Proxy) proxyStatus {
+	f := p.Faults()
+	accepted, dropped := p.Counts()
+	return proxyStatus{
+		Addr:             p.Addr(),
+		Target:           p.Target(),
+		Latency:          f.Latency.String(),
+		Drop:             f.Drop,
+		Blackhole:        f.Blackhole,
+		TruncateRequest:  f.TruncateRequest,
+		TruncateResponse: f.TruncateResponse,
+		Accepted:         accepted,
+		Dropped:          dropped,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func (c control) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST", "PUT":
+		f, err := parseFaults(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		c.p.Set(f)
+	case "DELETE":
+		c.p.Set(Faults{})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method " + r.Method + " not allowed."))
+		return
+	}
+	writeJSON(w, statusOf(c.p))
+}
+
+func parseFaults(r *http.Request) (f Faults, err error) {
+	if err = r.ParseForm(); err != nil {
+		return
+	}
+	if s := r.Form.Get("latency"); s != "" {
+		if f.Latency, err = time.ParseDuration(s); err != nil {
+			return
+		}
+	}
+	if s := r.Form.Get("drop"); s != "" {
+		if f.Drop, err = strconv.ParseBool(s); err != nil {
+			return
+		}
+	}
+	if s := r.Form.Get("blackhole"); s != "" {
+		if f.Blackhole, err = strconv.ParseBool(s); err != nil {
+			return
+		}
+	}
+	if s := r.Form.Get("truncate_request"); s != "" {
+		if f.TruncateRequest, err = strconv.Atoi(s); err != nil {
+			return
+		}
+	}
+	if s := r.Form.Get("truncate_response"); s != "" {
+		if f.TruncateResponse, err = strconv.Atoi(s); err != nil {
+			return
+		}
+	}
+	return
+}
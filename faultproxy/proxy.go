@@ -0,0 +1,240 @@
+// Package faultproxy is a TCP proxy for the node link that injects
+// faults into the connections passing through it. It is placed between
+// a frontend and a node, or between two nodes, so that their handling
+// of slow, failed and corrupt exchanges can be tested on one machine.
+//
+// The faults in effect are chosen when a connection is accepted, and
+// apply to the whole of it; since the node link carries a single
+// exchange per connection, changing the faults affects every request
+// from then on without disturbing those in flight.
+package faultproxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// Faults describe what the proxy does to the connections it accepts.
+// With no faults set, traffic passes through unchanged.
+type Faults struct {
+	// Latency delays the data in each direction before it is
+	// forwarded.
+	Latency time.Duration
+
+	// Drop closes connections as soon as they are accepted.
+	Drop bool
+
+	// Blackhole accepts connections and reads from them, but never
+	// forwards anything or answers, as if the node had hung.
+	Blackhole bool
+
+	// TruncateRequest and TruncateResponse cut a connection once the
+	// given number of bytes have been forwarded to the node or back to
+	// the client, leaving the peer with a partial message. Zero
+	// disables truncation.
+	TruncateRequest  int
+	TruncateResponse int
+}
+
+func (f Faults) String() string {
+	return fmt.Sprintf("latency=%s drop=%v blackhole=%v truncate_request=%d truncate_response=%d",
+		f.Latency, f.Drop, f.Blackhole, f.TruncateRequest, f.TruncateResponse)
+}
+
+// Proxy forwards connections from its listener to a target address.
+type Proxy struct {
+	target   string
+	listener net.Listener
+
+	lock   sync.Mutex
+	faults Faults
+	conns  map[net.Conn]bool
+	closed bool
+	wg     sync.WaitGroup
+
+	accepted, dropped int
+}
+
+// Listen sets up a proxy to the target on the given address, which may
+// have a port of 0 to listen on any free port. The proxy does not
+// accept connections until Serve is called.
+func Listen(addr, target string) (p *Proxy, err error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	p = &Proxy{
+		target:   target,
+		listener: l,
+		conns:    make(map[net.Conn]bool, 0),
+	}
+	return
+}
+
+// Addr returns the address the proxy is listening on.
+func (p *Proxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+// Target returns the address connections are forwarded to.
+func (p *Proxy) Target() string {
+	return p.target
+}
+
+// Set replaces the faults applied to new connections.
+func (p *Proxy) Set(f Faults) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.faults = f
+}
+
+// Faults returns the faults applied to new connections.
+func (p *Proxy) Faults() Faults {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.faults
+}
+
+// Counts returns the number of connections accepted, and the number of
+// those that were dropped or blackholed.
+func (p *Proxy) Counts() (accepted, dropped int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.accepted, p.dropped
+}
+
+// Serve accepts connections until the proxy is closed.
+func (p *Proxy) Serve() error {
+	for {
+		conn, err := p.listener.Accept()
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			continue
+		} else if err != nil {
+			p.lock.Lock()
+			closed := p.closed
+			p.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		f, ok := p.track(conn)
+		if !ok {
+			conn.Close()
+			continue
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.handle(conn, f)
+		}()
+	}
+}
+
+// Close stops the proxy, closing the connections passing through it.
+func (p *Proxy) Close() error {
+	p.lock.Lock()
+	p.closed = true
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.lock.Unlock()
+
+	err := p.listener.Close()
+	p.wg.Wait()
+	return err
+}
+
+// track records a connection so that it is closed along with the
+// proxy, and returns the faults to apply to it. It returns false if the
+// proxy has been closed.
+func (p *Proxy) track(conn net.Conn) (Faults, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return Faults{}, false
+	}
+	p.conns[conn] = true
+	p.accepted++
+	if p.faults.Drop || p.faults.Blackhole {
+		p.dropped++
+	}
+	return p.faults, true
+}
+
+func (p *Proxy) untrack(conn net.Conn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.conns, conn)
+}
+
+func (p *Proxy) handle(client net.Conn, f Faults) {
+	defer p.untrack(client)
+	defer client.Close()
+
+	switch {
+	case f.Drop:
+		return
+	case f.Blackhole:
+		io.Copy(ioutil.Discard, client)
+		return
+	}
+
+	server, err := net.Dial("tcp", p.target)
+	if err != nil {
+		return
+	}
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		server.Close()
+		return
+	}
+	p.conns[server] = true
+	p.lock.Unlock()
+	defer p.untrack(server)
+	defer server.Close()
+
+	// Either direction ending ends the exchange; closing both sides
+	// unblocks the other copy.
+	done := make(chan bool, 2)
+	go func() {
+		forward(server, client, f.Latency, f.TruncateRequest)
+		done <- true
+	}()
+	go func() {
+		forward(client, server, f.Latency, f.TruncateResponse)
+		done <- true
+	}()
+	<-done
+	client.Close()
+	server.Close()
+	<-done
+}
+
+// forward copies data from src to dst, waiting for the latency before
+// passing on each read. If limit is positive, only that many bytes are
+// forwarded.
+func forward(dst io.Writer, src io.Reader, latency time.Duration, limit int) {
+	if limit > 0 {
+		src = io.LimitReader(src, int64(limit))
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			time.Sleep(latency)
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package faultproxy
+
+import (
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"github.com/gokyle/kludge/node"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNode runs a node over TCP behind a proxy, and returns the node
+// and the proxy.
+func testNode(t *testing.T) (*node.Node, *Proxy) {
+	n, err := node.New(node.Config{Store: node.NewMemStore()})
+	if err != nil {
+		fmt.Println("[!] failed to set up node:", err.Error())
+		t.FailNow()
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("[!] failed to listen:", err.Error())
+		t.FailNow()
+	}
+	go n.Serve(l)
+
+	p, err := Listen("127.0.0.1:0", l.Addr().String())
+	if err != nil {
+		fmt.Println("[!] failed to set up proxy:", err.Error())
+		t.FailNow()
+	}
+	go p.Serve()
+	return n, p
+}
+
+func set(p *Proxy, key, value string) error {
+	_, err := common.SendOperation(p.Addr(), &common.Operation{
+		OpCode:  common.OpSet,
+		Key:     []byte(key),
+		Val:     []byte(value),
+		Version: common.NewVersion(),
+	})
+	return err
+}
+
+func stored(n *node.Node, key string) bool {
+	resp := n.Handle(&common.Operation{OpCode: common.OpGet, Key: []byte(key)})
+	return resp.KeyOK
+}
+
+func TestPassThrough(t *testing.T) {
+	n, p := testNode(t)
+	defer p.Close()
+
+	if err := set(p, "foo", "bar"); err != nil {
+		fmt.Println("[!] request through proxy failed:", err.Error())
+		t.FailNow()
+	}
+	if !stored(n, "foo") {
+		fmt.Println("[!] write did not reach the node")
+		t.FailNow()
+	}
+}
+
+func TestLatency(t *testing.T) {
+	_, p := testNode(t)
+	defer p.Close()
+
+	p.Set(Faults{Latency: 20 * time.Millisecond})
+	start := time.Now()
+	if err := set(p, "foo", "bar"); err != nil {
+		fmt.Println("[!] request through proxy failed:", err.Error())
+		t.FailNow()
+	}
+	if time.Since(start) < 40*time.Millisecond {
+		fmt.Println("[!] request was not delayed")
+		t.FailNow()
+	}
+}
+
+func TestDrop(t *testing.T) {
+	n, p := testNode(t)
+	defer p.Close()
+
+	p.Set(Faults{Drop: true})
+	if err := set(p, "foo", "bar"); err == nil {
+		fmt.Println("[!] request succeeded over a dropped connection")
+		t.FailNow()
+	}
+	if stored(n, "foo") {
+		fmt.Println("[!] dropped write reached the node")
+		t.FailNow()
+	}
+	if accepted, dropped := p.Counts(); accepted != 1 || dropped != 1 {
+		fmt.Printf("[!] bad counts: %d accepted, %d dropped\n",
+			accepted, dropped)
+		t.FailNow()
+	}
+}
+
+func TestBlackhole(t *testing.T) {
+	_, p := testNode(t)
+	defer p.Close()
+
+	timeout := common.LinkTimeout
+	common.LinkTimeout = 50 * time.Millisecond
+	defer func() { common.LinkTimeout = timeout }()
+
+	p.Set(Faults{Blackhole: true})
+	err := set(p, "foo", "bar")
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		fmt.Println("[!] expected a timeout, got", err)
+		t.FailNow()
+	}
+}
+
+func TestTruncateRequest(t *testing.T) {
+	n, p := testNode(t)
+	defer p.Close()
+
+	p.Set(Faults{TruncateRequest: 16})
+	if err := set(p, "foo", "bar"); err == nil {
+		fmt.Println("[!] truncated request succeeded")
+		t.FailNow()
+	}
+	if stored(n, "foo") {
+		fmt.Println("[!] truncated write was applied")
+		t.FailNow()
+	}
+
+	// The node gives up on the partial request and carries on.
+	deadline := time.Now().Add(time.Second)
+	for n.Stats().Get("bad_requests") == nil {
+		if time.Now().After(deadline) {
+			fmt.Println("[!] node did not count the bad request")
+			t.FailNow()
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	p.Set(Faults{})
+	if err := set(p, "foo", "bar"); err != nil {
+		fmt.Println("[!] node failed after a bad request:", err.Error())
+		t.FailNow()
+	}
+}
+
+func TestTruncateResponse(t *testing.T) {
+	n, p := testNode(t)
+	defer p.Close()
+
+	p.Set(Faults{TruncateResponse: 16})
+	if err := set(p, "foo", "bar"); err == nil {
+		fmt.Println("[!] truncated response was decoded")
+		t.FailNow()
+	}
+
+	// The write itself reached the node; only its answer was lost.
+	if !stored(n, "foo") {
+		fmt.Println("[!] write did not reach the node")
+		t.FailNow()
+	}
+}
+
+func TestControl(t *testing.T) {
+	_, p := testNode(t)
+	defer p.Close()
+	srv := httptest.NewServer(Control(map[string]*Proxy{"node0": p}))
+	defer srv.Close()
+
+	resp, err := http.PostForm(srv.URL+"/node0", url.Values{
+		"latency":          {"15ms"},
+		"truncate_request": {"8"},
+	})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		fmt.Println("[!] failed to set faults:", err)
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if f := p.Faults(); f.Latency != 15*time.Millisecond || f.TruncateRequest != 8 {
+		fmt.Println("[!] faults not set:", f)
+		t.FailNow()
+	}
+
+	resp, err = http.PostForm(srv.URL+"/node0", url.Values{"drop": {"maybe"}})
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		fmt.Println("[!] invalid faults were accepted")
+		t.FailNow()
+	}
+	resp.Body.Close()
+
+	req, _ := http.NewRequest("DELETE", srv.URL+"/node0", nil)
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		fmt.Println("[!] failed to clear faults:", err.Error())
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if f := p.Faults(); f != (Faults{}) {
+		fmt.Println("[!] faults not cleared:", f)
+		t.FailNow()
+	}
+
+	resp, err = http.Get(srv.URL + "/")
+	if err != nil {
+		fmt.Println("[!] failed to get status:", err.Error())
+		t.FailNow()
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), p.Addr()) {
+		fmt.Println("[!] status does not list the proxy:", string(body))
+		t.FailNow()
+	}
+}
@@ -0,0 +1,507 @@
+package frontend
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"github.com/gokyle/kludge/ring"
+	"sort"
+)
+
+// A reply is the result of sending an operation to a single node.
+type reply struct {
+	node ring.Node
+	resp *common.Response
+	err  error
+}
+
+func (f *Frontend) sendRequest(node ring.Node, op *common.Operation) (resp *common.Response, err error) {
+	if f.nodeDown(node) {
+		return nil, errNodeDown
+	}
+	resp, err = f.send(node.Addr, op)
+	if err != nil {
+		f.logger.Printf("%s request to %s failed: %s", op.Name(), node.ID,
+			err.Error())
+	}
+	return
+}
+
+// fanout sends the operation to each of the nodes concurrently. The
+// replies are delivered on the returned channel as they arrive; the
+// channel is buffered so that replies which are never read do not
+// leak goroutines.
+func (f *Frontend) fanout(op *common.Operation, nodes []ring.Node) <-chan *reply {
+	replies := make(chan *reply, len(nodes))
+	for _, n := range nodes {
+		f.background.Add(1)
+		go func(n ring.Node) {
+			defer f.background.Done()
+			resp, err := f.sendRequest(n, op)
+			replies <- &reply{n, resp, err}
+		}(n)
+	}
+	return replies
+}
+
+// gather reads replies until quorum of them have succeeded or all n
+// have arrived. It returns the successful replies and the number of
+// replies still outstanding.
+func gather(replies <-chan *reply, n, quorum int) (ok []*reply, pending int) {
+	for pending = n; pending > 0 && len(ok) < quorum; pending-- {
+		r := <-replies
+		if r.err == nil {
+			ok = append(ok, r)
+		}
+	}
+	return
+}
+
+// newest returns the reply carrying the most recent version.
+func newest(replies []*reply) (latest *reply) {
+	for _, r := range replies {
+		if latest == nil || r.resp.Version > latest.resp.Version {
+			latest = r
+		}
+	}
+	return
+}
+
+// Get reads a key from its replicas, returning the newest value and
+// whether the key exists.
+func (f *Frontend) Get(key string) ([]byte, bool, error) {
+	value, ok, _, err := f.GetVersion(key)
+	return value, ok, err
+}
+
+// GetVersion is like Get, but also returns the version of the value
+// read, or of the deletion of the key; it is zero if the key has never
+// been written.
+func (f *Frontend) GetVersion(key string) ([]byte, bool, uint64, error) {
+	resp, err := f.read(key)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	return resp.Body, resp.KeyOK, resp.Version, nil
+}
+
+// read returns the newest of the responses of a read quorum of the
+// key's replicas, which carries the value along with its version and
+// content type.
+func (f *Frontend) read(key string) (*common.Response, error) {
+	op := &common.Operation{
+		OpCode: common.OpGet,
+		Key:    []byte(key),
+	}
+	nodes := f.ring.Lookup(op.Key, f.cfg.Replicas)
+	replies := f.fanout(op, nodes)
+	ok, pending := gather(replies, len(nodes), f.cfg.ReadQuorum)
+	if len(ok) < f.cfg.ReadQuorum {
+		f.stats.Add("quorum_failures", 1)
+		return nil, ErrQuorum
+	}
+
+	latest := newest(ok)
+	f.background.Add(1)
+	go func() {
+		defer f.background.Done()
+		f.readRepair(op.Key, latest, ok, replies, pending)
+	}()
+	return latest.resp, nil
+}
+
+// readRepair waits for the rest of the replicas to answer a read, then
+// brings any replica that returned an out of date version up to date
+// with the version returned to the client. A newer version that only
+// arrives in a late reply belongs to a write still in progress; passing
+// it on could reach a replica ahead of the write itself, which would
+// then report the wrong previous value.
+func (f *Frontend) readRepair(key []byte, latest *reply, seen []*reply, replies <-chan *reply, pending int) {
+	for ; pending > 0; pending-- {
+		if r := <-replies; r.err == nil {
+			seen = append(seen, r)
+		}
+	}
+
+	if latest.resp.Version == 0 {
+		return
+	}
+	repair := &common.Operation{
+		Key:     key,
+		Version: latest.resp.Version,
+	}
+	if latest.resp.KeyOK {
+		repair.OpCode = common.OpSet
+		repair.Val = latest.resp.Body
+		repair.Type = latest.resp.Type
+	} else {
+		repair.OpCode = common.OpDel
+	}
+
+	for _, r := range seen {
+		if r.resp.Version >= latest.resp.Version {
+			continue
+		}
+		f.logger.Printf("read repair of %q on %s (version %d -> %d)",
+			key, r.node.ID, r.resp.Version, latest.resp.Version)
+		f.stats.Add("read_repairs", 1)
+		f.sendRequest(r.node, repair)
+	}
+}
+
+// writeKey stamps a write with a new version and sends it to the key's
+// replicas. The previous value returned is the newest one reported by
+// the replicas that acknowledged the write.
+//
+// If hinted handoff is enabled, the write is handed to another node for
+// each replica that fails, to be delivered when the replica returns.
+// Hints count towards the write quorum, so a write can succeed while
+// its replicas are down; if no replica acknowledged it, hinted is set
+// and the previous value is unknown.
+func (f *Frontend) writeKey(op *common.Operation) (prev []byte, ok, hinted bool, err error) {
+	op.Version = uint64(f.clock().UnixNano())
+	nodes := f.ring.Lookup(op.Key, f.cfg.Replicas)
+	replies := f.fanout(op, nodes)
+
+	var acks []*reply
+	var down []ring.Node
+	pending := len(nodes)
+	for ; pending > 0 && len(acks) < f.cfg.WriteQuorum; pending-- {
+		r := <-replies
+		if r.err == nil {
+			acks = append(acks, r)
+		} else {
+			down = append(down, r.node)
+		}
+	}
+
+	hints := 0
+	if f.cfg.HintedHandoff {
+		hints = f.handoff(op, nodes, down)
+		f.background.Add(1)
+		go func(pending int) {
+			defer f.background.Done()
+			var down []ring.Node
+			for ; pending > 0; pending-- {
+				if r := <-replies; r.err != nil {
+					down = append(down, r.node)
+				}
+			}
+			f.handoff(op, nodes, down)
+		}(pending)
+	}
+
+	if len(acks)+hints < f.cfg.WriteQuorum {
+		f.stats.Add("quorum_failures", 1)
+		return nil, false, false, ErrQuorum
+	} else if len(acks) == 0 {
+		return nil, false, true, nil
+	}
+
+	r := newest(acks)
+	return r.resp.Body, r.resp.KeyOK, false, nil
+}
+
+// writeBatch sets a list of items, sending each node a single OpBatch
+// holding every item it replicates; the nodes are sent their batches
+// concurrently. Each item is stamped with a version of its own, later
+// items with later versions, and succeeds as a Set would: once a write
+// quorum of its replicas have applied it, or taken a hint for it. It
+// returns the number of items written. If any item fails, ErrQuorum
+// is returned, and the write is partial: the other items are written,
+// and a failed item may still have reached some of its replicas.
+func (f *Frontend) writeBatch(items []Item) (written int, err error) {
+	version := uint64(f.clock().UnixNano())
+	ops := make([]*common.Operation, len(items))
+	replicas := make([][]ring.Node, len(items))
+	byNode := make(map[string][]int, 0)
+	nodes := make([]ring.Node, 0)
+	for i, item := range items {
+		ops[i] = &common.Operation{
+			OpCode:  common.OpSet,
+			Key:     []byte(item.Key),
+			Val:     item.Value,
+			Type:    item.Type,
+			Version: version + uint64(i),
+		}
+		replicas[i] = f.ring.Lookup(ops[i].Key, f.cfg.Replicas)
+		for _, n := range replicas[i] {
+			if _, ok := byNode[n.ID]; !ok {
+				nodes = append(nodes, n)
+			}
+			byNode[n.ID] = append(byNode[n.ID], i)
+		}
+	}
+
+	type batchReply struct {
+		node ring.Node
+		errs []string
+		err  error
+	}
+	replies := make(chan *batchReply, len(nodes))
+	for _, n := range nodes {
+		batch := make([]common.Item, 0, len(byNode[n.ID]))
+		for _, i := range byNode[n.ID] {
+			batch = append(batch, common.Item{
+				Key:     ops[i].Key,
+				Val:     ops[i].Val,
+				Type:    ops[i].Type,
+				Version: ops[i].Version,
+			})
+		}
+		buf := new(bytes.Buffer)
+		if err = gob.NewEncoder(buf).Encode(batch); err != nil {
+			return 0, err
+		}
+		op := &common.Operation{OpCode: common.OpBatch, Val: buf.Bytes()}
+		f.background.Add(1)
+		go func(n ring.Node) {
+			defer f.background.Done()
+			r := &batchReply{node: n}
+			var resp *common.Response
+			if resp, r.err = f.sendRequest(n, op); r.err == nil {
+				r.err = gob.NewDecoder(bytes.NewBuffer(resp.Body)).Decode(&r.errs)
+			}
+			if r.err == nil && len(r.errs) != len(byNode[n.ID]) {
+				r.err = fmt.Errorf("%s answered %d of %d items", n.ID,
+					len(r.errs), len(byNode[n.ID]))
+			}
+			replies <- r
+		}(n)
+	}
+
+	acks := make([]int, len(items))
+	down := make([][]ring.Node, len(items))
+	for range nodes {
+		r := <-replies
+		for j, i := range byNode[r.node.ID] {
+			if r.err == nil && r.errs[j] == "" {
+				acks[i]++
+			} else {
+				down[i] = append(down[i], r.node)
+			}
+		}
+	}
+	for i := range items {
+		if f.cfg.HintedHandoff {
+			acks[i] += f.handoff(ops[i], replicas[i], down[i])
+		}
+		if acks[i] >= f.cfg.WriteQuorum {
+			written++
+		}
+	}
+	if written < len(items) {
+		f.stats.Add("quorum_failures", 1)
+		err = ErrQuorum
+	}
+	return
+}
+
+// handoff stores a hint for each of the down replicas of a write on
+// the next available node along the ring that is not already one of
+// the write's replicas. It returns the number of hints stored.
+func (f *Frontend) handoff(op *common.Operation, replicas, down []ring.Node) (hinted int) {
+	if len(down) == 0 {
+		return
+	}
+	skip := make(map[string]bool, 0)
+	for _, n := range replicas {
+		skip[n.ID] = true
+	}
+	candidates := f.ring.Lookup(op.Key, f.ring.Len())
+
+	for _, target := range down {
+		buf := new(bytes.Buffer)
+		err := gob.NewEncoder(buf).Encode(&common.Hint{Target: target, Op: *op})
+		if err != nil {
+			f.logger.Printf("failed to encode hint: %s", err.Error())
+			continue
+		}
+		hint := &common.Operation{
+			OpCode: common.OpHint,
+			Key:    op.Key,
+			Val:    buf.Bytes(),
+		}
+
+		stored := false
+		for _, n := range candidates {
+			if skip[n.ID] {
+				continue
+			}
+			if _, err = f.sendRequest(n, hint); err == nil {
+				stored = true
+				break
+			}
+			// The node is down or its hint storage is full.
+			skip[n.ID] = true
+		}
+		if stored {
+			hinted++
+			f.stats.Add("hints_sent", 1)
+		} else {
+			f.logger.Printf("no node could take hint for %s", target.ID)
+			f.stats.Add("hint_failures", 1)
+		}
+	}
+	return
+}
+
+// Set writes a value to the key's replicas, returning the previous
+// value and whether there was one. If the write was only stored as
+// hints, the previous value is unknown, and none is returned.
+func (f *Frontend) Set(key string, value []byte) ([]byte, bool, error) {
+	return f.SetType(key, value, "")
+}
+
+// SetType is like Set, but stores the value with a content type, which
+// is returned when the value is read.
+func (f *Frontend) SetType(key string, value []byte, ctype string) ([]byte, bool, error) {
+	prev, ok, _, err := f.writeKey(setOp(key, value, ctype))
+	return prev, ok, err
+}
+
+func setOp(key string, value []byte, ctype string) *common.Operation {
+	return &common.Operation{
+		OpCode: common.OpSet,
+		Key:    []byte(key),
+		Val:    value,
+		Type:   ctype,
+	}
+}
+
+// Delete removes a key, returning its previous value and whether there
+// was one. As with Set, a delete only stored as hints returns neither.
+func (f *Frontend) Delete(key string) ([]byte, bool, error) {
+	prev, ok, _, err := f.writeKey(delOp(key))
+	return prev, ok, err
+}
+
+func delOp(key string) *common.Operation {
+	return &common.Operation{OpCode: common.OpDel, Key: []byte(key)}
+}
+
+// Keys merges the key versions of every node, listing the keys of the
+// default namespace. Since each key is held by several replicas, the
+// listing is complete as long as fewer nodes than the replication
+// factor fail to answer. Versions are compared so that a key deleted
+// on some replicas, or held by a node that has not yet cleaned up
+// after a rebalance, is listed only if its newest record is live.
+func (f *Frontend) Keys() ([]string, error) {
+	nodes := f.ring.Nodes()
+	replies := f.fanout(&common.Operation{
+		OpCode: common.OpVers,
+		Ranges: []ring.Range{{}},
+	}, nodes)
+
+	newest := make(map[string]common.KeyVersion, 0)
+	failed := 0
+	for range nodes {
+		r := <-replies
+		var versions []common.KeyVersion
+		if r.err == nil {
+			r.err = gob.NewDecoder(bytes.NewBuffer(r.resp.Body)).Decode(&versions)
+		}
+		if r.err != nil {
+			failed++
+			continue
+		}
+		for _, kv := range versions {
+			if cur, ok := newest[string(kv.Key)]; !ok || kv.Version > cur.Version {
+				newest[string(kv.Key)] = kv
+			}
+		}
+	}
+	if failed >= f.cfg.Replicas {
+		f.stats.Add("quorum_failures", 1)
+		return nil, ErrQuorum
+	}
+
+	keys := make([]string, 0, len(newest))
+	for k, kv := range newest {
+		if !kv.Deleted && !namespacedKey(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// nodeStats collects the counters of every node, keyed by node ID. A
+// node that cannot be reached is reported with a null entry.
+func (f *Frontend) nodeStats() map[string]*json.RawMessage {
+	nodes := f.ring.Nodes()
+	replies := f.fanout(&common.Operation{OpCode: common.OpStats}, nodes)
+
+	all := make(map[string]*json.RawMessage, len(nodes))
+	for range nodes {
+		r := <-replies
+		if r.err != nil || !json.Valid(r.resp.Body) {
+			all[r.node.ID] = nil
+			continue
+		}
+		raw := json.RawMessage(r.resp.Body)
+		all[r.node.ID] = &raw
+	}
+	return all
+}
+
+// errUnsettled is returned when a cleanup is asked for while some node
+// is still rebalancing.
+var errUnsettled = errors.New("rebalancing is still in progress")
+
+// rebalanceStatus collects the rebalancing progress of every node,
+// keyed by node ID, and reports whether every node has settled. A node
+// that cannot be reached is reported with a null entry, and counts as
+// unsettled.
+func (f *Frontend) rebalanceStatus() (all map[string]*common.RebalanceStatus, settled bool) {
+	nodes := f.ring.Nodes()
+	replies := f.fanout(&common.Operation{OpCode: common.OpRebalance}, nodes)
+
+	settled = true
+	all = make(map[string]*common.RebalanceStatus, len(nodes))
+	for range nodes {
+		r := <-replies
+		status := new(common.RebalanceStatus)
+		if r.err == nil {
+			r.err = json.Unmarshal(r.resp.Body, status)
+		}
+		if r.err != nil {
+			all[r.node.ID] = nil
+			settled = false
+			continue
+		}
+		all[r.node.ID] = status
+		settled = settled && status.Settled
+	}
+	return
+}
+
+// cleanup asks every node to remove the records it no longer
+// replicates, once all of them have settled, and returns the number
+// of records each removed.
+func (f *Frontend) cleanup() (map[string]int64, error) {
+	if _, settled := f.rebalanceStatus(); !settled {
+		return nil, errUnsettled
+	}
+
+	nodes := f.ring.Nodes()
+	replies := f.fanout(&common.Operation{OpCode: common.OpCleanup}, nodes)
+	removed := make(map[string]int64, len(nodes))
+	var err error
+	for range nodes {
+		r := <-replies
+		var n int64
+		if r.err == nil {
+			r.err = json.Unmarshal(r.resp.Body, &n)
+		}
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+		removed[r.node.ID] = n
+	}
+	return removed, err
+}
@@ -0,0 +1,121 @@
+package frontend
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"github.com/gokyle/kludge/merkle"
+	"github.com/gokyle/kludge/ring"
+)
+
+// DefaultDigestDepth is the depth of the digest tree returned unless
+// another is asked for: 1024 leaves, so that a few differing keys
+// among millions are found by exchanging the hashes of a few thousand.
+const DefaultDigestDepth = 10
+
+// A Digest is a hash tree over the live keys beginning with a prefix,
+// as returned by the digest endpoint. Tree is the tree's binary
+// encoding, and Keys the number of keys folded into it.
+type Digest struct {
+	Keys int    `json:"keys"`
+	Tree []byte `json:"tree"`
+}
+
+// A DigestRequest asks the digest endpoint for the hashes of the keys
+// beginning with Prefix whose tokens fall in Ranges.
+type DigestRequest struct {
+	Prefix string       `json:"prefix"`
+	Ranges []ring.Range `json:"ranges"`
+}
+
+// A KeyDigest is the hash of a key, its value and its content type.
+type KeyDigest struct {
+	Key  string `json:"key"`
+	Hash []byte `json:"hash"`
+}
+
+// ItemDigest returns the hash of a key, its value and its content
+// type. Unlike the digests nodes compare during anti-entropy, it leaves
+// out the version, so that the same data written to two datastores at
+// different times hashes the same.
+func ItemDigest(key string, value []byte, contentType string) []byte {
+	var n [binary.MaxVarintLen64]byte
+	h := sha1.New()
+	h.Write(n[:binary.PutUvarint(n[:], uint64(len(key)))])
+	h.Write([]byte(key))
+	h.Write(n[:binary.PutUvarint(n[:], uint64(len(contentType)))])
+	h.Write([]byte(contentType))
+	h.Write(value)
+	return h.Sum(nil)
+}
+
+// scanAll calls fn for every live key beginning with prefix, in key
+// order.
+func (f *Frontend) scanAll(prefix string, fn func(item Item)) error {
+	for next := ""; ; {
+		items, after, err := f.Scan(prefix, next, MaxScanLimit)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			fn(item)
+		}
+		if after == "" {
+			return nil
+		}
+		next = after
+	}
+}
+
+// Digest builds a hash tree of the given depth over the whole ring
+// from the live keys beginning with prefix, their values and their
+// content types. Two datastores holding the same keys, values and
+// content types have the same tree, and
+// comparing trees gives the ranges of tokens in which they differ.
+func (f *Frontend) Digest(prefix string, depth uint) (tree *merkle.Tree, keys int, err error) {
+	return f.digestIn("", prefix, depth)
+}
+
+// digestIn builds the tree for the keys in a namespace. The keys are
+// hashed and placed as they are known to clients, so that a namespace
+// compares the same as a datastore holding the same keys in another.
+func (f *Frontend) digestIn(ns, prefix string, depth uint) (tree *merkle.Tree, keys int, err error) {
+	tree = merkle.New(ring.Range{}, depth)
+	strip := len(NamespaceKey(ns, ""))
+	err = f.scanAll(NamespaceKey(ns, prefix), func(item Item) {
+		key := item.Key[strip:]
+		tree.Add(ring.Token([]byte(key)), ItemDigest(key, item.Value, item.Type))
+		keys++
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	tree.Seal()
+	f.stats.Add("digests", 1)
+	return
+}
+
+// DigestKeys returns the hashes of the live keys beginning with prefix
+// whose tokens fall in one of the ranges, in key order.
+func (f *Frontend) DigestKeys(prefix string, ranges []ring.Range) (digests []KeyDigest, err error) {
+	return f.digestKeysIn("", prefix, ranges)
+}
+
+func (f *Frontend) digestKeysIn(ns, prefix string, ranges []ring.Range) (digests []KeyDigest, err error) {
+	digests = make([]KeyDigest, 0)
+	strip := len(NamespaceKey(ns, ""))
+	err = f.scanAll(NamespaceKey(ns, prefix), func(item Item) {
+		key := item.Key[strip:]
+		token := ring.Token([]byte(key))
+		for _, r := range ranges {
+			if r.Contains(token) {
+				digests = append(digests, KeyDigest{key,
+					ItemDigest(key, item.Value, item.Type)})
+				break
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
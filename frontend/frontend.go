@@ -0,0 +1,223 @@
+// Package frontend implements the kludge HTTP frontend: the REST
+// interface described in the specification, and the coordination of
+// reads and writes across the replicas of each key. The kludgesrv
+// daemon wraps a Frontend with its configuration and an HTTP server;
+// tests may run frontends in process over a simulated node link.
+package frontend
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"github.com/gokyle/kludge/gossip"
+	"github.com/gokyle/kludge/ring"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrQuorum is returned when too few replicas answer a request for it
+// to succeed.
+var ErrQuorum = errors.New("not enough replicas available")
+
+// errNodeDown is the error for requests to nodes known to be dead,
+// which are not attempted.
+var errNodeDown = errors.New("node is down")
+
+// DefaultMaxValueSize is the largest value a frontend accepts unless
+// configured otherwise.
+const DefaultMaxValueSize = 16 << 20
+
+// Logger is the interface the frontend logs through.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+type nullLogger struct{}
+
+func (nullLogger) Printf(format string, args ...interface{}) {}
+
+// Config describes the frontend's view of the cluster. Each key is
+// stored on Replicas nodes; a read succeeds once ReadQuorum of them
+// have answered, and a write once WriteQuorum of them have
+// acknowledged it.
+type Config struct {
+	Ring          *ring.Ring
+	Replicas      int
+	ReadQuorum    int
+	WriteQuorum   int
+	HintedHandoff bool
+
+	// MaxValueSize is the largest value, in bytes, that may be stored;
+	// larger values are refused with a 413. It defaults to
+	// DefaultMaxValueSize.
+	MaxValueSize int64
+
+	// MaxBatchSize is the largest body, in bytes, of a request to the
+	// batch endpoint. It defaults to DefaultMaxBatchSize.
+	MaxBatchSize int64
+
+	// WatchInterval is how often watchers' nodes are asked for their
+	// changes, and WatchSlack how far back each request looks to catch
+	// changes that arrive out of order; see Watch. They default to
+	// 250ms and a second.
+	WatchInterval time.Duration
+	WatchSlack    time.Duration
+
+	// Send carries an operation to a node; it defaults to
+	// common.SendOperation.
+	Send func(addr string, op *common.Operation) (*common.Response, error)
+
+	// Down reports whether a node is known to have failed, in which
+	// case requests to it are not attempted. By default, every node is
+	// tried.
+	Down func(n ring.Node) bool
+
+	// Members lists the cluster for the cluster endpoint; without it,
+	// the nodes on the ring are listed.
+	Members func() []gossip.Member
+
+	// NamespaceCache is how long the frontend remembers whether a
+	// namespace exists before checking again, and so how long a
+	// namespace created or deleted through another frontend may take
+	// to be noticed. It defaults to DefaultNamespaceCache.
+	NamespaceCache time.Duration
+
+	// Clock supplies the versions of writes; it defaults to time.Now.
+	Clock func() time.Time
+
+	Logger Logger
+}
+
+// Frontend coordinates client requests across the nodes.
+type Frontend struct {
+	cfg    Config
+	ring   *ring.Ring
+	send   func(addr string, op *common.Operation) (*common.Response, error)
+	clock  func() time.Time
+	logger Logger
+	mux    *http.ServeMux
+
+	// namespaces caches the namespaces looked up for requests made in
+	// them, and quotas holds the usage and request tokens of those with
+	// limits.
+	nsLock     sync.Mutex
+	namespaces map[string]nsEntry
+	quotas     map[string]*quotaState
+
+	// stats holds the frontend's counters, which are returned by the
+	// stats endpoint.
+	stats *expvar.Map
+
+	// background tracks the requests to nodes, read repairs and
+	// hand-offs that may continue after a client's request has been
+	// answered.
+	background sync.WaitGroup
+}
+
+// New sets up a frontend. Quorums that are not given default to a
+// majority of the replicas.
+func New(cfg Config) (*Frontend, error) {
+	if cfg.Ring == nil {
+		return nil, fmt.Errorf("frontend: no ring")
+	}
+	if cfg.Replicas == 0 {
+		cfg.Replicas = 1
+	}
+	if cfg.ReadQuorum == 0 {
+		cfg.ReadQuorum = cfg.Replicas/2 + 1
+	}
+	if cfg.WriteQuorum == 0 {
+		cfg.WriteQuorum = cfg.Replicas/2 + 1
+	}
+	if cfg.MaxValueSize == 0 {
+		cfg.MaxValueSize = DefaultMaxValueSize
+	}
+	if cfg.MaxBatchSize == 0 {
+		cfg.MaxBatchSize = DefaultMaxBatchSize
+	}
+	if cfg.WatchInterval <= 0 {
+		cfg.WatchInterval = 250 * time.Millisecond
+	}
+	if cfg.WatchSlack <= 0 {
+		cfg.WatchSlack = time.Second
+	}
+	if cfg.NamespaceCache <= 0 {
+		cfg.NamespaceCache = DefaultNamespaceCache
+	}
+	if cfg.Replicas < 1 || cfg.ReadQuorum < 1 ||
+		cfg.ReadQuorum > cfg.Replicas || cfg.WriteQuorum < 1 ||
+		cfg.WriteQuorum > cfg.Replicas {
+		return nil, fmt.Errorf("invalid replication settings (N=%d, R=%d, W=%d)",
+			cfg.Replicas, cfg.ReadQuorum, cfg.WriteQuorum)
+	}
+
+	f := &Frontend{
+		cfg:    cfg,
+		ring:   cfg.Ring,
+		send:   cfg.Send,
+		clock:  cfg.Clock,
+		logger: cfg.Logger,
+		stats:  new(expvar.Map).Init(),
+
+		namespaces: make(map[string]nsEntry, 0),
+		quotas:     make(map[string]*quotaState, 0),
+	}
+	if f.send == nil {
+		f.send = common.SendOperation
+	}
+	if f.clock == nil {
+		f.clock = time.Now
+	}
+	if f.logger == nil {
+		f.logger = nullLogger{}
+	}
+	f.routes()
+	return f, nil
+}
+
+// Stats returns the frontend's counters.
+func (f *Frontend) Stats() *expvar.Map {
+	return f.stats
+}
+
+// Wait blocks until the work started by earlier requests, including
+// requests to slow replicas, read repairs and hand-offs, has finished.
+func (f *Frontend) Wait() {
+	f.background.Wait()
+}
+
+// nodeDown returns true if the node is known to have failed.
+func (f *Frontend) nodeDown(n ring.Node) bool {
+	return f.cfg.Down != nil && f.cfg.Down(n)
+}
+
+// AddNode places a node on the ring, or updates its address.
+func (f *Frontend) AddNode(n ring.Node) {
+	if cur, ok := f.ring.Node(n.ID); !ok || cur != n {
+		f.ring.Add(n)
+	}
+}
+
+// RemoveNode takes a node off the ring.
+func (f *Frontend) RemoveNode(id string) {
+	f.ring.Remove(id)
+}
+
+// MemberChanged keeps the ring up to date with the nodes that have
+// been seen through gossip. Nodes that fail stay on the ring, since
+// their keys are still assigned to them; writes for them are handed
+// off until they return. Only nodes that leave the cluster are
+// removed.
+func (f *Frontend) MemberChanged(m gossip.Member) {
+	if m.Kind != common.MemberNode {
+		return
+	}
+	switch m.State {
+	case gossip.Alive, gossip.Suspect:
+		f.AddNode(ring.Node{ID: m.ID, Addr: m.Service})
+	case gossip.Left:
+		f.RemoveNode(m.ID)
+	}
+}
@@ -0,0 +1,625 @@
+package frontend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"github.com/gokyle/kludge/merkle"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var keyIDRegexp = regexp.MustCompile("^/data/(.+)$")
+
+// invalidKey is the message refusing a key that may not be used.
+const invalidKey = "Keys may not contain NUL bytes, nor begin with the bytes 1 or 2 outside a namespace."
+
+func ServerError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrQuorum:
+		// Named in a header, so that clients do not take the
+		// frontend itself for unavailable.
+		w.Header().Set("X-Kludge-Error", err.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errUnsettled:
+		w.WriteHeader(http.StatusConflict)
+	case ErrInvalidNamespace:
+		w.WriteHeader(http.StatusBadRequest)
+	case ErrNoNamespace:
+		// Named in a header, so that clients do not take it for
+		// a missing key.
+		w.Header().Set("X-Kludge-Error", err.Error())
+		w.WriteHeader(http.StatusNotFound)
+	case ErrNamespaceExists:
+		w.WriteHeader(http.StatusConflict)
+	case ErrInvalidLimits:
+		w.WriteHeader(http.StatusBadRequest)
+	case ErrRateLimited:
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	case ErrKeyLimit, ErrByteLimit:
+		w.WriteHeader(http.StatusInsufficientStorage)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write([]byte(err.Error()))
+}
+
+func BadRequest(w http.ResponseWriter, msg string) {
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(msg))
+}
+
+// InvalidKey refuses a key that may not be used.
+func InvalidKey(w http.ResponseWriter) {
+	BadRequest(w, invalidKey)
+}
+
+// TooLarge refuses a value larger than the frontend accepts.
+func TooLarge(w http.ResponseWriter, max int64) {
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	fmt.Fprintf(w, "Values may not be larger than %d bytes.", max)
+}
+
+func NotImplemented(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNotImplemented)
+	msg := "Method " + r.Method + " not implemented."
+	w.Write([]byte(msg))
+}
+
+func VersionHeader(w http.ResponseWriter) {
+	version := common.Version()
+	w.Header().Add("X-Kludge-Version", version)
+}
+
+// ETag returns the entity tag for a version of a key's value.
+func ETag(version uint64) string {
+	return fmt.Sprintf("\"%x\"", version)
+}
+
+// MatchETag returns true if an If-None-Match header lists the entity
+// tag.
+func MatchETag(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func KeyID(r *http.Request) string {
+	return keyIDRegexp.ReplaceAllString(r.URL.Path, "$1")
+}
+
+func (f *Frontend) listKeys(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	var err error
+	if ns := namespace(r); ns == "" {
+		keys, err = f.Keys()
+	} else {
+		prefix := NamespaceKey(ns, "")
+		keys = make([]string, 0)
+		err = f.scanAll(prefix, func(item Item) {
+			keys = append(keys, item.Key[len(prefix):])
+		})
+	}
+	if err == nil {
+		var body []byte
+		if body, err = json.Marshal(keys); err == nil {
+			w.Write(body)
+			return
+		}
+	}
+	ServerError(w, err)
+}
+
+func (f *Frontend) getKey(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/data" || r.URL.Path == "/data/" {
+		f.listKeys(w, r)
+		return
+	}
+	key := NamespaceKey(namespace(r), KeyID(r))
+	resp, err := f.read(key)
+	if err != nil {
+		ServerError(w, err)
+		return
+	}
+	if !resp.KeyOK {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(resp.Body)
+		return
+	}
+	etag := ETag(resp.Version)
+	w.Header().Set("ETag", etag)
+	if resp.Type != "" {
+		w.Header().Set("Content-Type", resp.Type)
+	}
+	if MatchETag(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	if r.Method != "HEAD" {
+		w.Write(resp.Body)
+	}
+}
+
+func (f *Frontend) delKey(w http.ResponseWriter, r *http.Request) {
+	ns := namespace(r)
+	body, ok, hinted, err := f.writeKey(delOp(NamespaceKey(ns, KeyID(r))))
+	if err != nil {
+		ServerError(w, err)
+		return
+	}
+	if hinted {
+		f.acceptHinted(w, ns)
+		return
+	} else if !ok {
+		w.WriteHeader(http.StatusNotFound)
+	} else if ns != "" {
+		f.countWrite(ns, -1, -int64(len(body)))
+	}
+	w.Write(body)
+}
+
+func (f *Frontend) setKey(w http.ResponseWriter, r *http.Request) {
+	ns := namespace(r)
+	key := NamespaceKey(ns, KeyID(r))
+	defer r.Body.Close()
+
+	// The body may be chunked, in which case its length is not known
+	// until it has been read.
+	max := f.cfg.MaxValueSize
+	if r.ContentLength > max {
+		TooLarge(w, max)
+		return
+	}
+	ctype := r.Header.Get("Content-Type")
+	if len(ctype) > common.MaxTypeLen {
+		BadRequest(w, fmt.Sprintf("Content types may not be longer than %d bytes.", common.MaxTypeLen))
+		return
+	}
+	value, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		f.logger.Printf("request for %s failed: %s", r.URL.String(),
+			err.Error())
+		ServerError(w, err)
+		return
+	} else if int64(len(value)) > max {
+		TooLarge(w, max)
+		return
+	}
+	if ns != "" {
+		if err = f.checkQuota(ns, []Item{{Key: key, Value: value}}); err != nil {
+			ServerError(w, err)
+			return
+		}
+	}
+	body, ok, hinted, err := f.writeKey(setOp(key, value, ctype))
+	if err != nil {
+		ServerError(w, err)
+		return
+	}
+	if hinted {
+		f.acceptHinted(w, ns)
+		return
+	}
+	if ns != "" {
+		if ok {
+			f.countWrite(ns, 0, int64(len(value)-len(body)))
+		} else {
+			f.countWrite(ns, 1, int64(len(value)))
+		}
+	}
+	if !ok {
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write(body)
+}
+
+// acceptHinted answers a write that was only stored as hints. Whether
+// the key was present is unknown, so the write is accepted without a
+// previous value, and the namespace's usage is fetched again rather
+// than guessed.
+func (f *Frontend) acceptHinted(w http.ResponseWriter, ns string) {
+	if ns != "" {
+		f.staleUsage(ns)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (f *Frontend) key(w http.ResponseWriter, r *http.Request) {
+	f.logger.Printf("%s request to %s", r.Method, r.URL.String())
+	VersionHeader(w)
+	if strings.Contains(r.URL.Path, "\x00") || !ValidKey(namespace(r), KeyID(r)) {
+		InvalidKey(w)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		f.getKey(w, r)
+	case "POST", "PUT":
+		f.setKey(w, r)
+	case "DELETE":
+		f.delKey(w, r)
+	case "HEAD":
+		// A HEAD of a key answers as a GET would, without the value;
+		// one of /data is a cheap check that the frontend is up.
+		if r.URL.Path == "/data" || r.URL.Path == "/data/" {
+			w.Header().Add("content-length", "0")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		f.getKey(w, r)
+	default:
+		f.logger.Printf("received unsupported request for method %s",
+			r.Method)
+		NotImplemented(w, r)
+
+	}
+}
+
+// stats reports the frontend's counters along with those of every node.
+func (f *Frontend) serveStats(w http.ResponseWriter, r *http.Request) {
+	VersionHeader(w)
+	if r.Method != "GET" {
+		NotImplemented(w, r)
+		return
+	}
+	frontend := json.RawMessage(f.stats.String())
+	body, err := json.Marshal(map[string]interface{}{
+		"frontend": &frontend,
+		"nodes":    f.nodeStats(),
+	})
+	if err != nil {
+		ServerError(w, err)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(body)
+}
+
+// cluster lists the members of the cluster. Without gossip, only the
+// configured nodes are listed.
+func (f *Frontend) cluster(w http.ResponseWriter, r *http.Request) {
+	VersionHeader(w)
+	if r.Method != "GET" {
+		NotImplemented(w, r)
+		return
+	}
+
+	var list interface{}
+	if f.cfg.Members != nil {
+		list = f.cfg.Members()
+	} else {
+		list = f.ring.Nodes()
+	}
+	body, err := json.Marshal(list)
+	if err != nil {
+		ServerError(w, err)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(body)
+}
+
+// rebalance reports the rebalancing progress of every node. A POST to
+// /admin/rebalance/cleanup removes the records nodes have handed off,
+// and is refused with a conflict until every node has settled.
+func (f *Frontend) rebalance(w http.ResponseWriter, r *http.Request) {
+	VersionHeader(w)
+	var body []byte
+	var err error
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/admin/rebalance":
+		all, settled := f.rebalanceStatus()
+		body, err = json.Marshal(map[string]interface{}{
+			"settled": settled,
+			"nodes":   all,
+		})
+	case r.Method == "POST" && r.URL.Path == "/admin/rebalance/cleanup":
+		var removed map[string]int64
+		if removed, err = f.cleanup(); err == nil {
+			f.logger.Printf("cleanup removed %v", removed)
+			body, err = json.Marshal(removed)
+		}
+	default:
+		NotImplemented(w, r)
+		return
+	}
+	if err != nil {
+		ServerError(w, err)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(body)
+}
+
+// watch streams the changes to a key, or to the keys beginning with a
+// prefix, as Server-Sent Events. Changes after the version given by
+// the since parameter, or by a Last-Event-ID header, are reported; the
+// stream starts with an event carrying no data whose ID is the version
+// the watch starts after, so that a client can resume from it.
+func (f *Frontend) watch(w http.ResponseWriter, r *http.Request) {
+	VersionHeader(w)
+	if r.Method != "GET" {
+		NotImplemented(w, r)
+		return
+	}
+	q := r.URL.Query()
+	prefix, exact := q.Get("prefix"), false
+	if key := q.Get("key"); key != "" {
+		prefix, exact = key, true
+	}
+	ns := namespace(r)
+	if !ValidKey(ns, prefix) {
+		InvalidKey(w)
+		return
+	}
+	prefix = NamespaceKey(ns, prefix)
+	var since uint64
+	param := q.Get("since")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		param = id
+	}
+	if param != "" {
+		var err error
+		if since, err = strconv.ParseUint(param, 10, 64); err != nil {
+			BadRequest(w, "Invalid version "+param+".")
+			return
+		}
+	}
+	if since == 0 {
+		since = uint64(f.clock().UnixNano())
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		ServerError(w, errors.New("streaming is not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "id: %d\n\n", since)
+	flusher.Flush()
+	f.Watch(r.Context(), prefix, since, func(ev Event) error {
+		if exact && !ev.Lost && ev.Key != prefix {
+			return nil
+		}
+		if !ev.Lost {
+			ev.Key = ev.Key[len(NamespaceKey(ns, "")):]
+		}
+		if err := WriteEvent(w, ev); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+}
+
+// scan returns a page of keys with their values as a JSON ScanPage.
+// The prefix and after parameters choose the keys, and limit the size
+// of the page; with keys=true, the values are left out.
+func (f *Frontend) scan(w http.ResponseWriter, r *http.Request) {
+	VersionHeader(w)
+	if r.Method != "GET" {
+		NotImplemented(w, r)
+		return
+	}
+	q := r.URL.Query()
+	limit := 0
+	if param := q.Get("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit < 1 {
+			BadRequest(w, "Invalid limit "+param+".")
+			return
+		}
+	}
+	ns := namespace(r)
+	prefix, after := q.Get("prefix"), q.Get("after")
+	if !ValidKey(ns, prefix) || !ValidKey(ns, after) {
+		InvalidKey(w)
+		return
+	}
+	if after != "" {
+		after = NamespaceKey(ns, after)
+	}
+	items, next, err := f.Scan(NamespaceKey(ns, prefix), after, limit)
+	if err != nil {
+		ServerError(w, err)
+		return
+	}
+	strip := len(NamespaceKey(ns, ""))
+	for i := range items {
+		items[i].Key = items[i].Key[strip:]
+		if q.Get("keys") == "true" {
+			items[i].Value = nil
+		}
+	}
+	if next != "" {
+		next = next[strip:]
+	}
+	body, err := json.Marshal(ScanPage{Items: items, Next: next})
+	if err != nil {
+		ServerError(w, err)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(body)
+}
+
+// batch writes the items in a JSON BatchRequest, answering with a
+// BatchResult; a batch refused for its conflicts is answered with a
+// 409.
+func (f *Frontend) batch(w http.ResponseWriter, r *http.Request) {
+	VersionHeader(w)
+	if r.Method != "POST" {
+		NotImplemented(w, r)
+		return
+	}
+	ns := namespace(r)
+	req, ok := ReadBatch(w, r, ns, f.cfg.MaxBatchSize, f.cfg.MaxValueSize)
+	if !ok {
+		return
+	}
+	for i, item := range req.Items {
+		req.Items[i].Key = NamespaceKey(ns, item.Key)
+	}
+	if ns != "" {
+		if err := f.checkQuota(ns, req.Items); err != nil {
+			ServerError(w, err)
+			return
+		}
+		defer f.staleUsage(ns)
+	}
+
+	result, err := f.Batch(req.Items, req.Mode)
+	if err != nil && err != ErrConflict {
+		ServerError(w, err)
+		return
+	}
+	for i, key := range result.Conflicts {
+		result.Conflicts[i] = key[len(NamespaceKey(ns, "")):]
+	}
+	body, _ := json.Marshal(result)
+	w.Header().Set("content-type", "application/json")
+	if err == ErrConflict {
+		w.WriteHeader(http.StatusConflict)
+	}
+	w.Write(body)
+}
+
+// ReadBatch reads a BatchRequest from the body of a request made to
+// the batch endpoint in a namespace, refusing it as the endpoint does
+// if the body is larger than maxBatch bytes, or it holds an invalid
+// mode, key or value. If ok is false, the request has been answered.
+func ReadBatch(w http.ResponseWriter, r *http.Request, ns string, maxBatch, maxValue int64) (req BatchRequest, ok bool) {
+	defer r.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBatch+1))
+	if err != nil {
+		ServerError(w, err)
+		return
+	} else if int64(len(data)) > maxBatch {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "Batches may not be larger than %d bytes.", maxBatch)
+		return
+	}
+
+	if err = json.Unmarshal(data, &req); err != nil {
+		BadRequest(w, "Invalid batch: "+err.Error())
+		return
+	}
+	switch req.Mode {
+	case "", BatchOverwrite, BatchSkip, BatchFail:
+	default:
+		BadRequest(w, "Invalid mode "+req.Mode+".")
+		return
+	}
+	for _, item := range req.Items {
+		if item.Key == "" || !ValidKey(ns, item.Key) {
+			BadRequest(w, "Keys may not be empty. "+invalidKey)
+			return
+		} else if int64(len(item.Value)) > maxValue {
+			TooLarge(w, maxValue)
+			return
+		} else if len(item.Type) > common.MaxTypeLen {
+			BadRequest(w, fmt.Sprintf("Content types may not be longer than %d bytes.", common.MaxTypeLen))
+			return
+		}
+	}
+	return req, true
+}
+
+// digest answers a GET with the Digest of the keys beginning with the
+// prefix parameter, in a tree of the depth asked for, and a POST of a
+// DigestRequest with the KeyDigests of the keys it asks for.
+func (f *Frontend) digest(w http.ResponseWriter, r *http.Request) {
+	VersionHeader(w)
+	var body []byte
+	var err error
+	switch r.Method {
+	case "GET":
+		q := r.URL.Query()
+		if !ValidKey(namespace(r), q.Get("prefix")) {
+			InvalidKey(w)
+			return
+		}
+		depth := DefaultDigestDepth
+		if param := q.Get("depth"); param != "" {
+			depth, err = strconv.Atoi(param)
+			if err != nil || depth < 0 || depth > merkle.MaxDepth {
+				BadRequest(w, "Invalid depth "+param+".")
+				return
+			}
+		}
+		var tree *merkle.Tree
+		var keys int
+		tree, keys, err = f.digestIn(namespace(r), q.Get("prefix"), uint(depth))
+		if err != nil {
+			ServerError(w, err)
+			return
+		}
+		encoded, _ := tree.MarshalBinary()
+		body, err = json.Marshal(Digest{Keys: keys, Tree: encoded})
+	case "POST":
+		defer r.Body.Close()
+		var req DigestRequest
+		err = json.NewDecoder(io.LimitReader(r.Body, f.cfg.MaxBatchSize)).Decode(&req)
+		if err != nil {
+			BadRequest(w, "Invalid digest request: "+err.Error())
+			return
+		}
+		if !ValidKey(namespace(r), req.Prefix) {
+			InvalidKey(w)
+			return
+		}
+		var digests []KeyDigest
+		digests, err = f.digestKeysIn(namespace(r), req.Prefix, req.Ranges)
+		if err != nil {
+			ServerError(w, err)
+			return
+		}
+		body, err = json.Marshal(digests)
+	default:
+		NotImplemented(w, r)
+		return
+	}
+	if err != nil {
+		ServerError(w, err)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(body)
+}
+
+// routes sets up the frontend's endpoints.
+func (f *Frontend) routes() {
+	f.mux = http.NewServeMux()
+	f.mux.HandleFunc("/data", f.key)
+	f.mux.HandleFunc("/data/", f.key)
+	f.mux.HandleFunc("/watch", f.watch)
+	f.mux.HandleFunc("/scan", f.scan)
+	f.mux.HandleFunc("/batch", f.batch)
+	f.mux.HandleFunc("/digest", f.digest)
+	f.mux.HandleFunc("/admin/stats", f.serveStats)
+	f.mux.HandleFunc("/admin/cluster", f.cluster)
+	f.mux.HandleFunc("/admin/rebalance", f.rebalance)
+	f.mux.HandleFunc("/admin/rebalance/", f.rebalance)
+	f.mux.HandleFunc("/admin/ns", f.serveNamespaces)
+	f.mux.HandleFunc("/admin/ns/", f.serveNamespaces)
+	f.mux.HandleFunc("/admin/usage", f.serveUsage)
+	f.mux.HandleFunc("/ns/", f.namespaced)
+}
+
+// ServeHTTP serves the frontend's REST interface.
+func (f *Frontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.ServeHTTP(w, r)
+}
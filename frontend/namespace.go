@@ -0,0 +1,368 @@
+package frontend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gokyle/kludge/common"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Namespaced keys are stored under nsDataPrefix, the namespace's name
+// and a NUL byte, so that no two namespaces' keys, nor those of the
+// default namespace, can collide. Each namespace is recorded by a
+// JSON Namespace stored under nsMetaPrefix and its name. Keys in the
+// default namespace may not begin with either prefix; since names are
+// made of ASCII letters, digits and punctuation, every key stored for
+// namespaces sorts before nsEnd.
+const (
+	nsDataPrefix = common.NamespacePrefix
+	nsMetaPrefix = "\x02"
+	nsEnd        = "\x02\x7f"
+)
+
+// MaxNamespaceLen is the longest name a namespace may have.
+const MaxNamespaceLen = 64
+
+// DefaultNamespaceCache is how long a frontend remembers whether a
+// namespace exists unless configured otherwise.
+const DefaultNamespaceCache = 5 * time.Second
+
+var namespaceRegexp = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+
+// The errors returned for requests naming namespaces.
+var (
+	ErrInvalidNamespace = errors.New("invalid namespace name")
+	ErrNoNamespace      = errors.New("namespace does not exist")
+	ErrNamespaceExists  = errors.New("namespace already exists")
+)
+
+// A Namespace is a separate set of keys, as returned by the namespace
+// admin endpoints.
+type Namespace struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Limits  Limits    `json:"limits"`
+}
+
+// ValidNamespace reports whether a name may be given to a namespace:
+// up to MaxNamespaceLen ASCII letters, digits, '_', '.' and '-'.
+func ValidNamespace(name string) bool {
+	return len(name) <= MaxNamespaceLen && namespaceRegexp.MatchString(name)
+}
+
+// NamespaceKey returns the key under which a key in a namespace is
+// stored; keys in the default namespace, named "", are stored as they
+// are.
+func NamespaceKey(ns, key string) string {
+	if ns == "" {
+		return key
+	}
+	return nsDataPrefix + ns + "\x00" + key
+}
+
+// namespacedKey reports whether a stored key belongs to a namespace,
+// or records one, rather than to the default namespace.
+func namespacedKey(key string) bool {
+	return strings.HasPrefix(key, nsDataPrefix) || strings.HasPrefix(key, nsMetaPrefix)
+}
+
+// ValidKey reports whether a client may use a key in a namespace.
+func ValidKey(ns, key string) bool {
+	if strings.Contains(key, "\x00") {
+		return false
+	}
+	return ns != "" || !namespacedKey(key)
+}
+
+type nsEntry struct {
+	ns      *Namespace
+	fetched time.Time
+}
+
+func (f *Frontend) readNamespace(name string) (*Namespace, error) {
+	body, ok, err := f.Get(nsMetaPrefix + name)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrNoNamespace
+	}
+	ns := new(Namespace)
+	if err = json.Unmarshal(body, ns); err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// cacheNamespace remembers a namespace, or that it does not exist if
+// ns is nil.
+func (f *Frontend) cacheNamespace(name string, ns *Namespace) {
+	f.nsLock.Lock()
+	defer f.nsLock.Unlock()
+	f.namespaces[name] = nsEntry{ns, time.Now()}
+}
+
+// lookupNamespace returns a namespace, or ErrNoNamespace. Lookups are
+// cached for NamespaceCache, so that a namespace created or deleted
+// through another frontend may take that long to be noticed.
+func (f *Frontend) lookupNamespace(name string) (*Namespace, error) {
+	if !ValidNamespace(name) {
+		return nil, ErrInvalidNamespace
+	}
+	f.nsLock.Lock()
+	e, ok := f.namespaces[name]
+	f.nsLock.Unlock()
+	if !ok || time.Since(e.fetched) > f.cfg.NamespaceCache {
+		ns, err := f.readNamespace(name)
+		if err != nil && err != ErrNoNamespace {
+			return nil, err
+		}
+		e.ns = ns
+		f.cacheNamespace(name, ns)
+	}
+	if e.ns == nil {
+		return nil, ErrNoNamespace
+	}
+	return e.ns, nil
+}
+
+// Namespace returns a namespace, or ErrNoNamespace.
+func (f *Frontend) Namespace(name string) (*Namespace, error) {
+	if !ValidNamespace(name) {
+		return nil, ErrInvalidNamespace
+	}
+	ns, err := f.readNamespace(name)
+	if err == nil || err == ErrNoNamespace {
+		f.cacheNamespace(name, ns)
+	}
+	return ns, err
+}
+
+// Namespaces lists the namespaces in order of their names.
+func (f *Frontend) Namespaces() (list []Namespace, err error) {
+	list = make([]Namespace, 0)
+	var derr error
+	err = f.scanAll(nsMetaPrefix, func(item Item) {
+		var ns Namespace
+		if err := json.Unmarshal(item.Value, &ns); err != nil {
+			derr = err
+			return
+		}
+		list = append(list, ns)
+	})
+	if err == nil {
+		err = derr
+	}
+	return
+}
+
+// CreateNamespace creates a namespace, returning ErrNamespaceExists if
+// it already exists. Two frontends creating the same namespace at once
+// may both succeed.
+func (f *Frontend) CreateNamespace(name string) (*Namespace, error) {
+	if !ValidNamespace(name) {
+		return nil, ErrInvalidNamespace
+	}
+	if _, err := f.readNamespace(name); err == nil {
+		return nil, ErrNamespaceExists
+	} else if err != ErrNoNamespace {
+		return nil, err
+	}
+	ns := &Namespace{Name: name, Created: f.clock().UTC()}
+	body, err := json.Marshal(ns)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err = f.Set(nsMetaPrefix+name, body); err != nil {
+		return nil, err
+	}
+	f.cacheNamespace(name, ns)
+	f.stats.Add("namespaces_created", 1)
+	return ns, nil
+}
+
+// ClearNamespace deletes every key in a namespace, returning the
+// number deleted. Keys written while it runs may survive it.
+func (f *Frontend) ClearNamespace(name string) (deleted int, err error) {
+	if !ValidNamespace(name) {
+		return 0, ErrInvalidNamespace
+	}
+	prefix := NamespaceKey(name, "")
+	var keys []string
+	err = f.scanAll(prefix, func(item Item) {
+		keys = append(keys, item.Key)
+	})
+	if err != nil {
+		return
+	}
+	defer f.staleUsage(name)
+	for _, key := range keys {
+		if _, _, err = f.Delete(key); err != nil {
+			return
+		}
+		deleted++
+	}
+	return
+}
+
+// DeleteNamespace deletes a namespace along with its keys, returning
+// the number of keys deleted. The namespace is removed first, so that
+// no more writes are made to it through this frontend.
+func (f *Frontend) DeleteNamespace(name string) (deleted int, err error) {
+	if _, err = f.Namespace(name); err != nil {
+		return
+	}
+	if _, _, err = f.Delete(nsMetaPrefix + name); err != nil {
+		return
+	}
+	f.cacheNamespace(name, nil)
+	f.nsLock.Lock()
+	delete(f.quotas, name)
+	f.nsLock.Unlock()
+	f.stats.Add("namespaces_deleted", 1)
+	return f.ClearNamespace(name)
+}
+
+type nsContextKey struct{}
+
+// namespace returns the namespace a request was made in, or "" for
+// the default namespace.
+func namespace(r *http.Request) string {
+	ns, _ := r.Context().Value(nsContextKey{}).(string)
+	return ns
+}
+
+// namespaced serves the requests under /ns/:name/, which act on the
+// namespace's keys as the endpoints of the same names act on the
+// default namespace's: data, scan, batch, watch and digest.
+func (f *Frontend) namespaced(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/ns/")
+	name := rest
+	if i := strings.Index(rest, "/"); i >= 0 {
+		name, rest = rest[:i], rest[i:]
+	} else {
+		rest = ""
+	}
+	ns, err := f.lookupNamespace(name)
+	if err == nil {
+		err = f.allow(ns)
+	}
+	if err != nil {
+		VersionHeader(w)
+		ServerError(w, err)
+		return
+	}
+
+	nr := r.WithContext(context.WithValue(r.Context(), nsContextKey{}, name))
+	u := *r.URL
+	u.Path, u.RawPath = rest, ""
+	nr.URL = &u
+	switch {
+	case rest == "/data" || strings.HasPrefix(rest, "/data/"):
+		f.key(w, nr)
+	case rest == "/scan":
+		f.scan(w, nr)
+	case rest == "/batch":
+		f.batch(w, nr)
+	case rest == "/watch":
+		f.watch(w, nr)
+	case rest == "/digest":
+		f.digest(w, nr)
+	default:
+		VersionHeader(w)
+		http.NotFound(w, r)
+	}
+}
+
+// serveNamespaces serves the namespace admin endpoints: a GET of /admin/ns
+// lists the namespaces, and /admin/ns/:name creates one with a PUT or
+// POST, describes it with a GET and deletes it, with its keys, with a
+// DELETE. A DELETE of /admin/ns/:name/data deletes the keys alone, a
+// PUT of Limits to /admin/ns/:name/limits replaces its limits, and a
+// GET of /admin/ns/:name/usage reports its usage.
+func (f *Frontend) serveNamespaces(w http.ResponseWriter, r *http.Request) {
+	VersionHeader(w)
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/ns"), "/")
+	name, sub := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		name, sub = path[:i], path[i+1:]
+	}
+
+	var v interface{}
+	var err error
+	status := http.StatusOK
+	switch {
+	case path == "" && r.Method == "GET":
+		v, err = f.Namespaces()
+	case path == "":
+		NotImplemented(w, r)
+		return
+	case sub == "data" && r.Method == "DELETE":
+		if _, err = f.lookupNamespace(name); err == nil {
+			var deleted int
+			deleted, err = f.ClearNamespace(name)
+			v = map[string]int{"deleted": deleted}
+		}
+	case sub == "limits" && (r.Method == "PUT" || r.Method == "POST"):
+		var limits Limits
+		if err = json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			BadRequest(w, "Invalid limits: "+err.Error())
+			return
+		}
+		v, err = f.SetLimits(name, limits)
+	case sub == "usage" && r.Method == "GET":
+		v, err = f.Usage(name)
+	case sub != "":
+		NotImplemented(w, r)
+		return
+	case r.Method == "GET":
+		v, err = f.Namespace(name)
+	case r.Method == "PUT" || r.Method == "POST":
+		v, err = f.CreateNamespace(name)
+		status = http.StatusCreated
+	case r.Method == "DELETE":
+		var deleted int
+		deleted, err = f.DeleteNamespace(name)
+		v = map[string]int{"deleted": deleted}
+	default:
+		NotImplemented(w, r)
+		return
+	}
+	if err != nil {
+		ServerError(w, err)
+		return
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		ServerError(w, err)
+		return
+	}
+	f.logger.Printf("%s request to %s", r.Method, r.URL.String())
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// serveUsage reports the usage of every namespace.
+func (f *Frontend) serveUsage(w http.ResponseWriter, r *http.Request) {
+	VersionHeader(w)
+	if r.Method != "GET" {
+		NotImplemented(w, r)
+		return
+	}
+	list, err := f.Usages()
+	if err != nil {
+		ServerError(w, err)
+		return
+	}
+	body, err := json.Marshal(list)
+	if err != nil {
+		ServerError(w, err)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(body)
+}
@@ -0,0 +1,279 @@
+package frontend
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"github.com/gokyle/kludge/common"
+	"math"
+	"time"
+)
+
+// The errors returned for requests a namespace's limits refuse.
+var (
+	ErrRateLimited   = errors.New("namespace request rate exceeded")
+	ErrKeyLimit      = errors.New("namespace key limit reached")
+	ErrByteLimit     = errors.New("namespace byte limit reached")
+	ErrInvalidLimits = errors.New("invalid namespace limits")
+)
+
+// Limits caps a namespace's use of the datastore: the number of keys
+// it holds, the total size of their values, and the requests a second
+// each frontend serves in it. A zero limit is no limit.
+type Limits struct {
+	MaxKeys  int64   `json:"max_keys,omitempty"`
+	MaxBytes int64   `json:"max_bytes,omitempty"`
+	MaxRate  float64 `json:"max_rate,omitempty"`
+}
+
+// A NamespaceUsage is a namespace's usage, as returned by the usage
+// endpoints, along with its limits.
+type NamespaceUsage struct {
+	Name   string `json:"name"`
+	Keys   int64  `json:"keys"`
+	Bytes  int64  `json:"bytes"`
+	Limits Limits `json:"limits"`
+}
+
+// quotaState is a frontend's record of a namespace's usage, as last
+// fetched from the nodes and adjusted for the writes made through the
+// frontend since, and of the tokens left for its requests.
+type quotaState struct {
+	usage   common.Usage
+	fetched time.Time
+	tokens  float64
+	filled  time.Time
+}
+
+// quota returns a namespace's quota state; the caller must hold nsLock.
+func (f *Frontend) quota(ns string) *quotaState {
+	q, ok := f.quotas[ns]
+	if !ok {
+		q = new(quotaState)
+		f.quotas[ns] = q
+	}
+	return q
+}
+
+// nodeUsage sums the usage the nodes report for a namespace, or for
+// every namespace if ns is empty. Each key is counted by every replica
+// holding it, so the sums are divided by the number of replicas; the
+// result is approximate while replicas disagree, or while nodes hold
+// records they have handed off in a rebalance.
+func (f *Frontend) nodeUsage(ns string) (map[string]common.Usage, error) {
+	nodes := f.ring.Nodes()
+	replies := f.fanout(&common.Operation{
+		OpCode: common.OpUsage,
+		Key:    []byte(ns),
+	}, nodes)
+
+	sums := make(map[string]common.Usage, 0)
+	failed := 0
+	for range nodes {
+		r := <-replies
+		var list []common.Usage
+		if r.err == nil {
+			r.err = gob.NewDecoder(bytes.NewBuffer(r.resp.Body)).Decode(&list)
+		}
+		if r.err != nil {
+			failed++
+			continue
+		}
+		for _, u := range list {
+			sum := sums[u.Namespace]
+			sum.Namespace = u.Namespace
+			sum.Keys += u.Keys
+			sum.Bytes += u.Bytes
+			sums[u.Namespace] = sum
+		}
+	}
+	if failed >= f.cfg.Replicas {
+		f.stats.Add("quorum_failures", 1)
+		return nil, ErrQuorum
+	}
+
+	copies := int64(f.cfg.Replicas)
+	if n := int64(len(nodes)); n < copies {
+		copies = n
+	}
+	for name, sum := range sums {
+		sum.Keys = (sum.Keys + copies - 1) / copies
+		sum.Bytes = (sum.Bytes + copies - 1) / copies
+		sums[name] = sum
+	}
+	return sums, nil
+}
+
+// Usage returns a namespace's usage, as its nodes report it.
+func (f *Frontend) Usage(name string) (*NamespaceUsage, error) {
+	ns, err := f.Namespace(name)
+	if err != nil {
+		return nil, err
+	}
+	sums, err := f.nodeUsage(name)
+	if err != nil {
+		return nil, err
+	}
+	u := sums[name]
+	f.nsLock.Lock()
+	q := f.quota(name)
+	q.usage, q.fetched = u, time.Now()
+	f.nsLock.Unlock()
+	return &NamespaceUsage{name, u.Keys, u.Bytes, ns.Limits}, nil
+}
+
+// Usages returns the usage of every namespace, in order of their
+// names.
+func (f *Frontend) Usages() ([]NamespaceUsage, error) {
+	list, err := f.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+	sums, err := f.nodeUsage("")
+	if err != nil {
+		return nil, err
+	}
+	all := make([]NamespaceUsage, 0, len(list))
+	for _, ns := range list {
+		u := sums[ns.Name]
+		all = append(all, NamespaceUsage{ns.Name, u.Keys, u.Bytes, ns.Limits})
+	}
+	return all, nil
+}
+
+// SetLimits replaces a namespace's limits. Frontends other than this
+// one may take as long as NamespaceCache to apply them.
+func (f *Frontend) SetLimits(name string, limits Limits) (*Namespace, error) {
+	if limits.MaxKeys < 0 || limits.MaxBytes < 0 || limits.MaxRate < 0 ||
+		math.IsNaN(limits.MaxRate) || math.IsInf(limits.MaxRate, 0) {
+		return nil, ErrInvalidLimits
+	}
+	ns, err := f.Namespace(name)
+	if err != nil {
+		return nil, err
+	}
+	ns.Limits = limits
+	body, err := json.Marshal(ns)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err = f.Set(nsMetaPrefix+name, body); err != nil {
+		return nil, err
+	}
+	f.cacheNamespace(name, ns)
+	return ns, nil
+}
+
+// allow takes a token for a request in a namespace, returning
+// ErrRateLimited if none is left. Tokens are added at the namespace's
+// MaxRate, and up to a second's worth may be saved for a burst.
+func (f *Frontend) allow(ns *Namespace) error {
+	rate := ns.Limits.MaxRate
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(rate, 1)
+	now := time.Now()
+
+	f.nsLock.Lock()
+	defer f.nsLock.Unlock()
+	q := f.quota(ns.Name)
+	if q.filled.IsZero() {
+		q.tokens = burst
+	} else {
+		q.tokens = math.Min(burst, q.tokens+now.Sub(q.filled).Seconds()*rate)
+	}
+	q.filled = now
+	if q.tokens < 1 {
+		f.stats.Add("rate_limited", 1)
+		return ErrRateLimited
+	}
+	q.tokens--
+	return nil
+}
+
+// checkQuota returns ErrKeyLimit or ErrByteLimit if writing the items,
+// whose keys are those stored, would take a namespace over its limits.
+// The namespace's usage is fetched from the nodes once it is older
+// than NamespaceCache; writes that seem to take it over a limit are
+// checked against the values they replace, so that a namespace at its
+// limit may still overwrite its keys with values no larger. Writes
+// made at once through several frontends may together take a
+// namespace a little over its limits.
+func (f *Frontend) checkQuota(name string, items []Item) error {
+	ns, err := f.lookupNamespace(name)
+	if err != nil {
+		return err
+	}
+	limits := ns.Limits
+	if limits.MaxKeys <= 0 && limits.MaxBytes <= 0 {
+		return nil
+	}
+
+	f.nsLock.Lock()
+	q := f.quota(name)
+	usage, fetched := q.usage, q.fetched
+	f.nsLock.Unlock()
+	if time.Since(fetched) > f.cfg.NamespaceCache {
+		sums, err := f.nodeUsage(name)
+		if err != nil {
+			return err
+		}
+		usage = sums[name]
+		f.nsLock.Lock()
+		q.usage, q.fetched = usage, time.Now()
+		f.nsLock.Unlock()
+	}
+
+	over := func(keys, size int64) error {
+		switch {
+		case limits.MaxKeys > 0 && keys > 0 && usage.Keys+keys > limits.MaxKeys:
+			return ErrKeyLimit
+		case limits.MaxBytes > 0 && size > 0 && usage.Bytes+size > limits.MaxBytes:
+			return ErrByteLimit
+		}
+		return nil
+	}
+	keys, size := int64(len(items)), int64(0)
+	for _, item := range items {
+		size += int64(len(item.Value))
+	}
+	if over(keys, size) == nil {
+		return nil
+	}
+	for _, item := range items {
+		value, ok, err := f.Get(item.Key)
+		if err != nil {
+			return err
+		} else if ok {
+			keys--
+			size -= int64(len(value))
+		}
+	}
+	if err = over(keys, size); err != nil {
+		f.stats.Add("quota_refusals", 1)
+	}
+	return err
+}
+
+// countWrite adjusts the frontend's record of a namespace's usage for
+// a write made through it.
+func (f *Frontend) countWrite(name string, keys, size int64) {
+	f.nsLock.Lock()
+	defer f.nsLock.Unlock()
+	if q, ok := f.quotas[name]; ok {
+		q.usage.Keys += keys
+		q.usage.Bytes += size
+	}
+}
+
+// staleUsage makes the frontend fetch a namespace's usage again before
+// the next write is checked against its limits.
+func (f *Frontend) staleUsage(name string) {
+	f.nsLock.Lock()
+	defer f.nsLock.Unlock()
+	if q, ok := f.quotas[name]; ok {
+		q.fetched = time.Time{}
+	}
+}
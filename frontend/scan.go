@@ -0,0 +1,200 @@
+package frontend
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"github.com/gokyle/kludge/common"
+	"github.com/gokyle/kludge/ring"
+	"sort"
+	"strings"
+)
+
+// The limits on the number of keys in a page of a scan.
+const (
+	DefaultScanLimit = 100
+	MaxScanLimit     = 1000
+)
+
+// DefaultMaxBatchSize is the largest batch request body a frontend
+// accepts unless configured otherwise; it leaves room for a value of
+// the default maximum size, base64-encoded.
+const DefaultMaxBatchSize = 32 << 20
+
+// An Item is a key with its value, content type and version, as
+// returned by a scan and written by a batch. In JSON, the value is
+// base64-encoded.
+type Item struct {
+	Key     string `json:"key"`
+	Value   []byte `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Version uint64 `json:"version,omitempty"`
+}
+
+// A ScanPage is a page of the keys returned by the scan endpoint. If
+// Next is set, there may be more keys, which are scanned by asking for
+// the keys after it.
+type ScanPage struct {
+	Items []Item `json:"items"`
+	Next  string `json:"next,omitempty"`
+}
+
+// Scan returns up to limit of the live keys beginning with prefix that
+// sort after the key after, with their values, in key order. If next
+// is not empty, the scan is resumed by scanning after it; the page
+// may hold fewer keys than the limit, or none, even so.
+//
+// Every node is asked for a page of its records, and the pages merged
+// as Keys merges the listings. A node that returns a full page may
+// hold more keys beyond the last in its page, so the merged page ends
+// at the first such key.
+func (f *Frontend) Scan(prefix, after string, limit int) (items []Item, next string, err error) {
+	if limit <= 0 {
+		limit = DefaultScanLimit
+	} else if limit > MaxScanLimit {
+		limit = MaxScanLimit
+	}
+	// The nodes start at the first key beginning with the prefix, or
+	// after the key they are given if that is later. Outside a
+	// namespace, the keys stored for namespaces are skipped.
+	start := after
+	if !namespacedKey(prefix) && start < nsEnd {
+		start = nsEnd
+	}
+
+	nodes := f.ring.Nodes()
+	replies := f.fanout(&common.Operation{
+		OpCode: common.OpScan,
+		Key:    []byte(start),
+		Val:    []byte(prefix),
+		Ranges: []ring.Range{{}},
+		Limit:  limit,
+	}, nodes)
+
+	newest := make(map[string]common.Item, 0)
+	failed := 0
+	bounded := false
+	for range nodes {
+		r := <-replies
+		var page []common.Item
+		if r.err == nil {
+			r.err = gob.NewDecoder(bytes.NewBuffer(r.resp.Body)).Decode(&page)
+		}
+		if r.err != nil {
+			failed++
+			continue
+		}
+		if len(page) == limit {
+			last := string(page[len(page)-1].Key)
+			if !bounded || last < next {
+				next, bounded = last, true
+			}
+		}
+		for _, item := range page {
+			cur, ok := newest[string(item.Key)]
+			if !ok || item.Version > cur.Version {
+				newest[string(item.Key)] = item
+			}
+		}
+	}
+	if failed >= f.cfg.Replicas {
+		f.stats.Add("quorum_failures", 1)
+		return nil, "", ErrQuorum
+	}
+
+	keys := make([]string, 0, len(newest))
+	for key := range newest {
+		if key > after && (!bounded || key <= next) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	items = make([]Item, 0, len(keys))
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			if key > prefix {
+				// Past the keys beginning with the prefix.
+				next = ""
+				break
+			}
+			continue
+		}
+		if item := newest[key]; !item.Deleted {
+			items = append(items, Item{Key: key, Value: item.Val,
+				Type: item.Type, Version: item.Version})
+		}
+	}
+	f.stats.Add("scans", 1)
+	return items, next, nil
+}
+
+// The conflict modes of a batch, which decide what becomes of the
+// items for keys that are already present.
+const (
+	BatchOverwrite = "overwrite"
+	BatchSkip      = "skip"
+	BatchFail      = "fail"
+)
+
+// ErrConflict is returned by a batch in BatchFail mode that holds keys
+// already present.
+var ErrConflict = errors.New("keys already present")
+
+// A BatchRequest is the body of a request to the batch endpoint.
+type BatchRequest struct {
+	Mode  string `json:"mode,omitempty"`
+	Items []Item `json:"items"`
+}
+
+// A BatchResult reports the outcome of a batch: the number of items
+// written, the number skipped as their keys were present, and the keys
+// that were present in BatchFail mode.
+type BatchResult struct {
+	Written   int      `json:"written"`
+	Skipped   int      `json:"skipped"`
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// Batch writes a list of items, each as Set would, sending each node
+// the items it replicates together (see writeBatch). In BatchOverwrite
+// mode, the default, every item is written. In BatchSkip mode, items
+// for keys that are present are skipped. In BatchFail mode, nothing is
+// written if any key is present, and ErrConflict is returned with the
+// keys that are. Keys are checked before they are written, but not
+// atomically: a key written by another client in between is
+// overwritten. If some items cannot be written, ErrQuorum is returned
+// and the batch is left partly written; result.Written counts the
+// items that were.
+func (f *Frontend) Batch(items []Item, mode string) (result BatchResult, err error) {
+	if mode == "" {
+		mode = BatchOverwrite
+	}
+	present := make(map[string]bool, 0)
+	if mode != BatchOverwrite {
+		for _, item := range items {
+			_, ok, _, err := f.GetVersion(item.Key)
+			if err != nil {
+				return result, err
+			}
+			present[item.Key] = ok
+			if ok && mode == BatchFail {
+				result.Conflicts = append(result.Conflicts, item.Key)
+			}
+		}
+		if len(result.Conflicts) > 0 {
+			return result, ErrConflict
+		}
+	}
+
+	write := make([]Item, 0, len(items))
+	for _, item := range items {
+		if present[item.Key] {
+			result.Skipped++
+			continue
+		}
+		write = append(write, item)
+	}
+	result.Written, err = f.writeBatch(write)
+	f.stats.Add("batch_writes", int64(result.Written))
+	return
+}
@@ -0,0 +1,153 @@
+package frontend
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"io"
+	"sort"
+	"time"
+)
+
+// An Event reports a change to a key to a watcher. An event with Lost
+// set has no key; it reports that changes up to its version may have
+// been missed, as a node has forgotten them or was restarted.
+type Event struct {
+	Key     string `json:"key,omitempty"`
+	Version uint64 `json:"version"`
+	Deleted bool   `json:"deleted,omitempty"`
+	Lost    bool   `json:"lost,omitempty"`
+}
+
+// WriteEvent writes an event to a watch stream, in the Server-Sent
+// Events format. The event's version is its ID, so that a client that
+// reconnects with a Last-Event-ID header resumes after it.
+func WriteEvent(w io.Writer, ev Event) error {
+	kind := "set"
+	switch {
+	case ev.Lost:
+		kind = "lost"
+	case ev.Deleted:
+		kind = "del"
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", kind,
+		ev.Version, data)
+	return err
+}
+
+type changesByVersion []common.Change
+
+func (c changesByVersion) Len() int           { return len(c) }
+func (c changesByVersion) Less(i, j int) bool { return c[i].Version < c[j].Version }
+func (c changesByVersion) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// changes asks every node for the changes to keys beginning with
+// prefix after a version. Each change is returned once, however many
+// replicas report it, in version order, along with the newest horizon
+// among the nodes that answered.
+func (f *Frontend) changes(prefix string, after uint64) (changes []common.Change, horizon uint64) {
+	nodes := f.ring.Nodes()
+	replies := f.fanout(&common.Operation{
+		OpCode:  common.OpWatch,
+		Key:     []byte(prefix),
+		Version: after,
+	}, nodes)
+
+	seen := make(map[string]bool, 0)
+	for range nodes {
+		r := <-replies
+		var reported []common.Change
+		if r.err == nil {
+			r.err = gob.NewDecoder(bytes.NewBuffer(r.resp.Body)).Decode(&reported)
+		}
+		if r.err != nil {
+			continue
+		}
+		if r.resp.Version > horizon {
+			horizon = r.resp.Version
+		}
+		for _, c := range reported {
+			if namespacedKey(string(c.Key)) && !namespacedKey(prefix) {
+				continue
+			}
+			id := fmt.Sprintf("%x/%s", c.Version, c.Key)
+			if !seen[id] {
+				seen[id] = true
+				changes = append(changes, c)
+			}
+		}
+	}
+	sort.Stable(changesByVersion(changes))
+	return
+}
+
+// Watch calls fn with each change to a key beginning with prefix that
+// has a version newer than since, or with every change from now on if
+// since is zero, until the context is done or fn returns an error,
+// which Watch returns.
+//
+// The nodes are asked for their changes every WatchInterval. Since
+// writes may reach a node out of version order, each poll looks back
+// WatchSlack before the newest change reported; a change that reaches
+// the nodes later than that after a newer one, such as a write handed
+// off to a node that was down, is not reported. Changes are reported
+// in version order, except for those caught by looking back.
+func (f *Frontend) Watch(ctx context.Context, prefix string, since uint64, fn func(ev Event) error) error {
+	if since == 0 {
+		since = uint64(f.clock().UnixNano())
+	}
+	f.stats.Add("watchers", 1)
+	defer f.stats.Add("watchers", -1)
+
+	cursor, lost := since, uint64(0)
+	reported := make(map[string]uint64, 0)
+	ticker := time.NewTicker(f.cfg.WatchInterval)
+	defer ticker.Stop()
+	for {
+		after := uint64(0)
+		if slack := uint64(f.cfg.WatchSlack); cursor > slack {
+			after = cursor - slack
+		}
+		changes, horizon := f.changes(prefix, after)
+		if horizon > cursor && horizon > lost {
+			lost = horizon
+			if err := fn(Event{Version: horizon, Lost: true}); err != nil {
+				return err
+			}
+		}
+
+		for _, c := range changes {
+			id := fmt.Sprintf("%x/%s", c.Version, c.Key)
+			if _, ok := reported[id]; ok || c.Version <= since {
+				continue
+			}
+			reported[id] = c.Version
+			err := fn(Event{Key: string(c.Key), Version: c.Version,
+				Deleted: c.Deleted})
+			if err != nil {
+				return err
+			}
+			if c.Version > cursor {
+				cursor = c.Version
+			}
+		}
+		for id, version := range reported {
+			if version <= after {
+				delete(reported, id)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
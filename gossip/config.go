@@ -0,0 +1,66 @@
+package gossip
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultPort is the port gossip listens on if no address is given.
+const DefaultPort = "5989"
+
+// ParseConfig builds a configuration from the gossip section of a
+// kludge configuration file, returning it with the address to listen
+// on. The section has the following keys, all but advertise optional:
+//
+//	listen           address to listen on (default ":5989")
+//	advertise        address other members reach this one on
+//	seeds            comma-separated gossip addresses to join through
+//	probe_interval   time between probes (default 1s)
+//	probe_timeout    time to wait for a direct probe (default 300ms)
+//	suspect_timeout  time before a suspect is declared dead (default 5s)
+//	sync_interval    time between full membership exchanges (default 30s)
+//
+// The member's ID, kind, and service address must be filled in by the
+// caller.
+func ParseConfig(section map[string]string) (cfg Config, listen string, err error) {
+	cfg = DefaultConfig()
+	listen = section["listen"]
+	if listen == "" {
+		listen = ":" + DefaultPort
+	}
+
+	cfg.Addr = strings.TrimSpace(section["advertise"])
+	if cfg.Addr == "" {
+		err = fmt.Errorf("gossip: no advertised address")
+		return
+	}
+
+	for _, seed := range strings.Split(section["seeds"], ",") {
+		if seed = strings.TrimSpace(seed); seed != "" {
+			cfg.Seeds = append(cfg.Seeds, seed)
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"probe_interval":  &cfg.ProbeInterval,
+		"probe_timeout":   &cfg.ProbeTimeout,
+		"suspect_timeout": &cfg.SuspectTimeout,
+		"sync_interval":   &cfg.SyncInterval,
+	}
+	for name, d := range durations {
+		s, ok := section[name]
+		if !ok {
+			continue
+		}
+		if *d, err = time.ParseDuration(s); err != nil {
+			err = fmt.Errorf("gossip: invalid value %s for %s: %s",
+				s, name, err.Error())
+			return
+		}
+	}
+	if cfg.ProbeTimeout >= cfg.ProbeInterval {
+		err = fmt.Errorf("gossip: probe timeout must be shorter than the probe interval")
+	}
+	return
+}
@@ -0,0 +1,650 @@
+// Package gossip implements a SWIM-style membership protocol, used by
+// kludge nodes and frontends to find each other and to detect failed
+// members.
+//
+// Each member periodically probes another member chosen in round-robin
+// order. If the member does not answer, a few other members are asked
+// to probe it on the prober's behalf; if none of them gets an answer
+// either, the member is suspected. A suspected member that does not
+// refute the suspicion within the suspicion timeout is declared dead.
+// Changes in membership are piggybacked on the probe messages, and
+// members periodically exchange their full membership lists with a
+// random member to heal any divergence.
+//
+// Each member carries an incarnation number, which only the member
+// itself may increase. A member that learns it is suspected or has been
+// declared dead increases its incarnation and announces that it is
+// alive; an update supersedes another with a lower incarnation, and
+// with equal incarnations the later state (alive, suspect, dead, left)
+// wins. Incarnations start from the time the member started, so that a
+// restarted member supersedes its own earlier death.
+package gossip
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State is the liveness state of a member.
+type State byte
+
+const (
+	Alive State = iota
+	Suspect
+	Dead
+	Left
+)
+
+var stateNames = map[State]string{
+	Alive:   "alive",
+	Suspect: "suspect",
+	Dead:    "dead",
+	Left:    "left",
+}
+
+func (s State) String() string {
+	return stateNames[s]
+}
+
+// Member describes a single member of the cluster. Addr is the address
+// the member gossips on; Service is the address of the service it
+// provides, which is the link address for nodes and the HTTP address
+// for frontends.
+type Member struct {
+	ID          string
+	Addr        string
+	Kind        string
+	Service     string
+	State       State
+	Incarnation uint64
+}
+
+// supersedes returns true if the update should replace cur.
+func (m *Member) supersedes(cur *Member) bool {
+	if m.Incarnation != cur.Incarnation {
+		return m.Incarnation > cur.Incarnation
+	}
+	return m.State > cur.State
+}
+
+// Logger is the interface used to report membership changes.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+type nullLogger struct{}
+
+func (nullLogger) Printf(format string, args ...interface{}) {}
+
+// Config describes the local member and the protocol's timing.
+type Config struct {
+	ID      string
+	Addr    string
+	Kind    string
+	Service string
+
+	// Seeds are the gossip addresses contacted to join the cluster.
+	Seeds []string
+
+	ProbeInterval  time.Duration
+	ProbeTimeout   time.Duration
+	SuspectTimeout time.Duration
+	SyncInterval   time.Duration
+	IndirectProbes int
+
+	// Notify, if not nil, is called whenever a member's state changes.
+	// It is called without any locks held, but must not block.
+	Notify func(Member)
+	Logger Logger
+
+	// Seed seeds the random choices made by the protocol. If it is
+	// zero, the current time is used.
+	Seed int64
+}
+
+// DefaultConfig returns a configuration with the default timings.
+func DefaultConfig() Config {
+	return Config{
+		ProbeInterval:  time.Second,
+		ProbeTimeout:   300 * time.Millisecond,
+		SuspectTimeout: 5 * time.Second,
+		SyncInterval:   30 * time.Second,
+		IndirectProbes: 3,
+	}
+}
+
+type msgType byte
+
+const (
+	msgPing msgType = iota
+	msgAck
+	msgPingReq
+	msgSync
+	msgSyncReply
+)
+
+type message struct {
+	Type    msgType
+	Seq     uint64
+	From    Member
+	Target  Member
+	Updates []Member
+}
+
+// maxPiggyback bounds the number of updates carried by a probe.
+const maxPiggyback = 16
+
+type broadcast struct {
+	member Member
+	sends  int
+}
+
+// Gossip runs the membership protocol for the local member.
+type Gossip struct {
+	cfg       Config
+	transport Transport
+	logger    Logger
+
+	lock      sync.Mutex
+	members   map[string]*Member
+	suspected map[string]time.Time
+	queue     []*broadcast
+	acks      map[uint64]func()
+	seq       uint64
+	probes    []string
+	rand      *rand.Rand
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     sync.WaitGroup
+}
+
+// New sets up the membership protocol for the local member described
+// by cfg, communicating over the transport. Zero timings in cfg are
+// replaced with the defaults. The protocol is not started until Start
+// is called.
+func New(cfg Config, t Transport) *Gossip {
+	def := DefaultConfig()
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = def.ProbeInterval
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = def.ProbeTimeout
+	}
+	if cfg.SuspectTimeout <= 0 {
+		cfg.SuspectTimeout = def.SuspectTimeout
+	}
+	if cfg.SyncInterval <= 0 {
+		cfg.SyncInterval = def.SyncInterval
+	}
+	if cfg.IndirectProbes <= 0 {
+		cfg.IndirectProbes = def.IndirectProbes
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+
+	g := &Gossip{
+		cfg:       cfg,
+		transport: t,
+		logger:    cfg.Logger,
+		members:   make(map[string]*Member, 0),
+		suspected: make(map[string]time.Time, 0),
+		acks:      make(map[uint64]func(), 0),
+		rand:      rand.New(rand.NewSource(cfg.Seed)),
+		stop:      make(chan struct{}),
+	}
+	if g.logger == nil {
+		g.logger = nullLogger{}
+	}
+	g.members[cfg.ID] = &Member{
+		ID:          cfg.ID,
+		Addr:        cfg.Addr,
+		Kind:        cfg.Kind,
+		Service:     cfg.Service,
+		State:       Alive,
+		Incarnation: uint64(time.Now().Unix()),
+	}
+	return g
+}
+
+// Start joins the cluster through the seeds and begins probing.
+func (g *Gossip) Start() {
+	g.done.Add(3)
+	go g.receiver()
+	go g.prober()
+	go g.syncer()
+	for _, seed := range g.cfg.Seeds {
+		if seed != g.cfg.Addr {
+			g.sendSync(seed, msgSync)
+		}
+	}
+}
+
+// Leave announces that the local member is leaving the cluster, then
+// stops the protocol.
+func (g *Gossip) Leave() {
+	g.lock.Lock()
+	self := g.members[g.cfg.ID]
+	self.State = Left
+	g.enqueue(self)
+	targets := g.pick(len(g.members), "")
+	g.lock.Unlock()
+
+	for _, m := range targets {
+		g.sendSync(m.Addr, msgSyncReply)
+	}
+	g.Stop()
+}
+
+// Stop halts the protocol and closes the transport.
+func (g *Gossip) Stop() {
+	g.stopOnce.Do(func() {
+		close(g.stop)
+		g.transport.Close()
+		g.done.Wait()
+	})
+}
+
+// Self returns the local member.
+func (g *Gossip) Self() Member {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return *g.members[g.cfg.ID]
+}
+
+// Member returns the member with the given ID.
+func (g *Gossip) Member(id string) (m Member, ok bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if p, known := g.members[id]; known {
+		m, ok = *p, true
+	}
+	return
+}
+
+// Members returns every known member, including the local member and
+// those that are dead or have left, sorted by ID.
+func (g *Gossip) Members() []Member {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	members := make([]Member, 0, len(g.members))
+	for _, m := range g.members {
+		members = append(members, *m)
+	}
+	sort.Sort(byID(members))
+	return members
+}
+
+func (g *Gossip) nextSeq() uint64 {
+	g.seq++
+	return g.seq
+}
+
+// retransmits is the number of times an update is piggybacked.
+func (g *Gossip) retransmits() int {
+	n := 3
+	for size := len(g.members); size > 1; size >>= 1 {
+		n += 3
+	}
+	return n
+}
+
+// enqueue queues an update about a member for piggybacking.
+func (g *Gossip) enqueue(m *Member) {
+	for _, b := range g.queue {
+		if b.member.ID == m.ID {
+			b.member = *m
+			b.sends = 0
+			return
+		}
+	}
+	g.queue = append(g.queue, &broadcast{*m, 0})
+}
+
+// piggyback returns the updates to attach to an outgoing message.
+func (g *Gossip) piggyback() []Member {
+	sort.Sort(bySends(g.queue))
+	limit := g.retransmits()
+	var updates []Member
+	kept := g.queue[:0]
+	for _, b := range g.queue {
+		if len(updates) < maxPiggyback {
+			updates = append(updates, b.member)
+			b.sends++
+		}
+		if b.sends < limit {
+			kept = append(kept, b)
+		}
+	}
+	g.queue = kept
+	return updates
+}
+
+// apply merges an update into the membership, returning the changed
+// member if the update was news. The lock must be held.
+func (g *Gossip) apply(u Member) (changed *Member) {
+	if u.ID == "" {
+		return
+	}
+	if u.ID == g.cfg.ID {
+		self := g.members[u.ID]
+		if (u.State == Suspect || u.State == Dead) &&
+			u.Incarnation >= self.Incarnation && self.State == Alive {
+			self.Incarnation = u.Incarnation + 1
+			g.logger.Printf("gossip: refuting %s at incarnation %d",
+				u.State, self.Incarnation)
+			g.enqueue(self)
+		}
+		return
+	}
+
+	cur, known := g.members[u.ID]
+	if known && !u.supersedes(cur) {
+		return
+	}
+	if !known {
+		cur = new(Member)
+		g.members[u.ID] = cur
+	}
+	prev := cur.State
+	*cur = u
+	if u.State == Suspect {
+		if _, ok := g.suspected[u.ID]; !ok {
+			g.suspected[u.ID] = time.Now()
+		}
+	} else {
+		delete(g.suspected, u.ID)
+	}
+	g.enqueue(cur)
+	if !known || prev != u.State {
+		g.logger.Printf("gossip: %s (%s at %s) is %s", u.ID, u.Kind,
+			u.Service, u.State)
+		m := *cur
+		changed = &m
+	}
+	return
+}
+
+// merge applies a set of updates and notifies the listener of any
+// changes.
+func (g *Gossip) merge(updates ...Member) {
+	var changes []Member
+	g.lock.Lock()
+	for _, u := range updates {
+		if m := g.apply(u); m != nil {
+			changes = append(changes, *m)
+		}
+	}
+	g.lock.Unlock()
+
+	if g.cfg.Notify != nil {
+		for _, m := range changes {
+			g.cfg.Notify(m)
+		}
+	}
+}
+
+// pick returns up to n random members that are alive or suspected,
+// excluding the local member and the member with the given ID. The
+// lock must be held.
+func (g *Gossip) pick(n int, exclude string) []Member {
+	var candidates []Member
+	for _, m := range g.members {
+		if m.ID == g.cfg.ID || m.ID == exclude || m.State > Suspect {
+			continue
+		}
+		candidates = append(candidates, *m)
+	}
+	sort.Sort(byID(candidates))
+	g.rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+func (g *Gossip) send(addr string, msg *message) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		g.logger.Printf("gossip: failed to encode message: %s",
+			err.Error())
+		return
+	}
+	if err := g.transport.Send(addr, buf.Bytes()); err != nil {
+		g.logger.Printf("gossip: send to %s failed: %s", addr,
+			err.Error())
+	}
+}
+
+// sendMessage fills in the sender and piggybacked updates and sends
+// the message.
+func (g *Gossip) sendMessage(addr string, t msgType, seq uint64, target Member) {
+	g.lock.Lock()
+	msg := &message{
+		Type:    t,
+		Seq:     seq,
+		From:    *g.members[g.cfg.ID],
+		Target:  target,
+		Updates: g.piggyback(),
+	}
+	g.lock.Unlock()
+	g.send(addr, msg)
+}
+
+// sendSync sends the full membership list to addr.
+func (g *Gossip) sendSync(addr string, t msgType) {
+	g.lock.Lock()
+	msg := &message{
+		Type: t,
+		From: *g.members[g.cfg.ID],
+	}
+	for _, m := range g.members {
+		msg.Updates = append(msg.Updates, *m)
+	}
+	g.lock.Unlock()
+	g.send(addr, msg)
+}
+
+// expectAck registers fn to be called when an ack with the sequence
+// number arrives within the timeout.
+func (g *Gossip) expectAck(seq uint64, timeout time.Duration, fn func()) {
+	g.lock.Lock()
+	g.acks[seq] = fn
+	g.lock.Unlock()
+	time.AfterFunc(timeout, func() {
+		g.lock.Lock()
+		delete(g.acks, seq)
+		g.lock.Unlock()
+	})
+}
+
+func (g *Gossip) receiver() {
+	defer g.done.Done()
+	for {
+		data, err := g.transport.Receive()
+		if err != nil {
+			select {
+			case <-g.stop:
+				return
+			default:
+			}
+			g.logger.Printf("gossip: receive failed: %s", err.Error())
+			continue
+		}
+
+		msg := new(message)
+		err = gob.NewDecoder(bytes.NewBuffer(data)).Decode(msg)
+		if err != nil {
+			g.logger.Printf("gossip: invalid message: %s", err.Error())
+			continue
+		}
+		g.handle(msg)
+	}
+}
+
+func (g *Gossip) handle(msg *message) {
+	g.merge(msg.From)
+	g.merge(msg.Updates...)
+
+	switch msg.Type {
+	case msgPing:
+		g.sendMessage(msg.From.Addr, msgAck, msg.Seq, Member{})
+	case msgAck:
+		g.lock.Lock()
+		fn, ok := g.acks[msg.Seq]
+		delete(g.acks, msg.Seq)
+		g.lock.Unlock()
+		if ok {
+			fn()
+		}
+	case msgPingReq:
+		g.lock.Lock()
+		seq := g.nextSeq()
+		g.lock.Unlock()
+		requester, reqSeq := msg.From.Addr, msg.Seq
+		g.expectAck(seq, g.cfg.ProbeTimeout, func() {
+			g.sendMessage(requester, msgAck, reqSeq, Member{})
+		})
+		g.sendMessage(msg.Target.Addr, msgPing, seq, Member{})
+	case msgSync:
+		g.sendSync(msg.From.Addr, msgSyncReply)
+	}
+}
+
+// nextTarget returns the next member to probe. Members are probed in
+// a random order that is reshuffled after each full pass.
+func (g *Gossip) nextTarget() (target Member, ok bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for attempts := 0; attempts < 2; attempts++ {
+		for len(g.probes) > 0 {
+			id := g.probes[0]
+			g.probes = g.probes[1:]
+			m, known := g.members[id]
+			if known && m.State <= Suspect {
+				return *m, true
+			}
+		}
+		for _, m := range g.pick(len(g.members), "") {
+			g.probes = append(g.probes, m.ID)
+		}
+	}
+	return
+}
+
+func (g *Gossip) prober() {
+	defer g.done.Done()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-time.After(g.cfg.ProbeInterval):
+		}
+		g.probe()
+		g.reap()
+	}
+}
+
+// probe runs one round of failure detection.
+func (g *Gossip) probe() {
+	target, ok := g.nextTarget()
+	if !ok {
+		return
+	}
+
+	acked := make(chan struct{}, g.cfg.IndirectProbes+1)
+	ack := func() { acked <- struct{}{} }
+
+	g.lock.Lock()
+	seq := g.nextSeq()
+	g.lock.Unlock()
+	g.expectAck(seq, g.cfg.ProbeInterval, ack)
+	g.sendMessage(target.Addr, msgPing, seq, Member{})
+
+	select {
+	case <-acked:
+		return
+	case <-time.After(g.cfg.ProbeTimeout):
+	}
+
+	g.lock.Lock()
+	helpers := g.pick(g.cfg.IndirectProbes, target.ID)
+	g.lock.Unlock()
+	for _, h := range helpers {
+		g.lock.Lock()
+		seq := g.nextSeq()
+		g.lock.Unlock()
+		g.expectAck(seq, g.cfg.ProbeInterval, ack)
+		g.sendMessage(h.Addr, msgPingReq, seq, target)
+	}
+
+	select {
+	case <-acked:
+		return
+	case <-time.After(g.cfg.ProbeInterval - g.cfg.ProbeTimeout):
+	}
+
+	if target.State == Alive {
+		target.State = Suspect
+		g.merge(target)
+	}
+}
+
+// reap declares dead every member whose suspicion has timed out.
+func (g *Gossip) reap() {
+	var dead []Member
+	g.lock.Lock()
+	for id, since := range g.suspected {
+		if time.Since(since) >= g.cfg.SuspectTimeout {
+			m := *g.members[id]
+			m.State = Dead
+			dead = append(dead, m)
+		}
+	}
+	g.lock.Unlock()
+	g.merge(dead...)
+}
+
+func (g *Gossip) syncer() {
+	defer g.done.Done()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-time.After(g.cfg.SyncInterval):
+		}
+
+		g.lock.Lock()
+		peers := g.pick(1, "")
+		g.lock.Unlock()
+		if len(peers) > 0 {
+			g.sendSync(peers[0].Addr, msgSync)
+		} else {
+			// Everyone else is gone; try to rejoin through the seeds.
+			for _, seed := range g.cfg.Seeds {
+				if seed != g.cfg.Addr {
+					g.sendSync(seed, msgSync)
+				}
+			}
+		}
+	}
+}
+
+type byID []Member
+
+func (p byID) Len() int           { return len(p) }
+func (p byID) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byID) Less(i, j int) bool { return p[i].ID < p[j].ID }
+
+type bySends []*broadcast
+
+func (p bySends) Len() int           { return len(p) }
+func (p bySends) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p bySends) Less(i, j int) bool { return p[i].sends < p[j].sends }
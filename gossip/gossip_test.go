@@ -0,0 +1,236 @@
+package gossip
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memNetwork connects in-memory transports; a member may be cut off to
+// simulate its failure.
+type memNetwork struct {
+	lock  sync.Mutex
+	boxes map[string]chan []byte
+	down  map[string]bool
+}
+
+type memTransport struct {
+	net  *memNetwork
+	addr string
+	box  chan []byte
+	done chan struct{}
+}
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{
+		boxes: make(map[string]chan []byte, 0),
+		down:  make(map[string]bool, 0),
+	}
+}
+
+func (n *memNetwork) listen(addr string) *memTransport {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	box := make(chan []byte, 64)
+	n.boxes[addr] = box
+	return &memTransport{n, addr, box, make(chan struct{})}
+}
+
+func (n *memNetwork) setDown(addr string, down bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.down[addr] = down
+}
+
+func (t *memTransport) Send(addr string, msg []byte) error {
+	t.net.lock.Lock()
+	box, ok := t.net.boxes[addr]
+	cut := t.net.down[addr] || t.net.down[t.addr]
+	t.net.lock.Unlock()
+	if !ok || cut {
+		return nil
+	}
+	select {
+	case box <- msg:
+	default:
+	}
+	return nil
+}
+
+func (t *memTransport) Receive() ([]byte, error) {
+	select {
+	case msg := <-t.box:
+		return msg, nil
+	case <-t.done:
+		return nil, errors.New("closed")
+	}
+}
+
+func (t *memTransport) Close() error {
+	close(t.done)
+	return nil
+}
+
+func testConfig(id string) Config {
+	return Config{
+		ID:             id,
+		Addr:           id + ":5989",
+		Kind:           "node",
+		Service:        id + ":5987",
+		Seeds:          []string{"a:5989"},
+		ProbeInterval:  20 * time.Millisecond,
+		ProbeTimeout:   5 * time.Millisecond,
+		SuspectTimeout: 100 * time.Millisecond,
+		SyncInterval:   50 * time.Millisecond,
+	}
+}
+
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return cond()
+}
+
+func state(g *Gossip, id string) State {
+	m, ok := g.Member(id)
+	if !ok {
+		return Left + 1
+	}
+	return m.State
+}
+
+func startCluster(network *memNetwork, ids ...string) []*Gossip {
+	var members []*Gossip
+	for _, id := range ids {
+		g := New(testConfig(id), network.listen(id+":5989"))
+		g.Start()
+		members = append(members, g)
+	}
+	return members
+}
+
+func TestJoin(t *testing.T) {
+	network := newMemNetwork()
+	members := startCluster(network, "a", "b", "c")
+	defer func() {
+		for _, g := range members {
+			g.Stop()
+		}
+	}()
+
+	joined := waitFor(2*time.Second, func() bool {
+		for _, g := range members {
+			if len(g.Members()) != 3 {
+				return false
+			}
+		}
+		return true
+	})
+	if !joined {
+		fmt.Println("[!] members did not find each other")
+		t.FailNow()
+	}
+
+	m, _ := members[2].Member("b")
+	if m.Service != "b:5987" || m.Kind != "node" || m.State != Alive {
+		fmt.Printf("[!] unexpected member %+v\n", m)
+		t.FailNow()
+	}
+}
+
+func TestFailureDetection(t *testing.T) {
+	network := newMemNetwork()
+	var lock sync.Mutex
+	var events []Member
+	cfg := testConfig("a")
+	cfg.Notify = func(m Member) {
+		lock.Lock()
+		events = append(events, m)
+		lock.Unlock()
+	}
+	a := New(cfg, network.listen("a:5989"))
+	a.Start()
+	others := startCluster(network, "b", "c")
+	defer func() {
+		a.Stop()
+		for _, g := range others {
+			g.Stop()
+		}
+	}()
+
+	if !waitFor(2*time.Second, func() bool { return state(a, "c") == Alive }) {
+		fmt.Println("[!] c never joined")
+		t.FailNow()
+	}
+
+	network.setDown("c:5989", true)
+	if !waitFor(3*time.Second, func() bool { return state(a, "c") == Dead }) {
+		fmt.Println("[!] c was not declared dead, state:", state(a, "c"))
+		t.FailNow()
+	}
+	if state(a, "b") != Alive {
+		fmt.Println("[!] b should still be alive")
+		t.FailNow()
+	}
+
+	lock.Lock()
+	sawDead := false
+	for _, m := range events {
+		sawDead = sawDead || (m.ID == "c" && m.State == Dead)
+	}
+	lock.Unlock()
+	if !sawDead {
+		fmt.Println("[!] no notification of c's death")
+		t.FailNow()
+	}
+
+	// Once reachable again, c refutes its death.
+	network.setDown("c:5989", false)
+	if !waitFor(3*time.Second, func() bool { return state(a, "c") == Alive }) {
+		fmt.Println("[!] c did not rejoin, state:", state(a, "c"))
+		t.FailNow()
+	}
+}
+
+func TestLeave(t *testing.T) {
+	network := newMemNetwork()
+	members := startCluster(network, "a", "b")
+	defer members[0].Stop()
+
+	if !waitFor(2*time.Second, func() bool { return state(members[0], "b") == Alive }) {
+		fmt.Println("[!] b never joined")
+		t.FailNow()
+	}
+	members[1].Leave()
+	if !waitFor(time.Second, func() bool { return state(members[0], "b") == Left }) {
+		fmt.Println("[!] b's departure was not seen")
+		t.FailNow()
+	}
+}
+
+func TestSupersedes(t *testing.T) {
+	cur := &Member{State: Suspect, Incarnation: 5}
+	cases := []struct {
+		update Member
+		wins   bool
+	}{
+		{Member{State: Alive, Incarnation: 5}, false},
+		{Member{State: Alive, Incarnation: 6}, true},
+		{Member{State: Dead, Incarnation: 5}, true},
+		{Member{State: Dead, Incarnation: 4}, false},
+	}
+	for _, c := range cases {
+		if c.update.supersedes(cur) != c.wins {
+			fmt.Printf("[!] %+v supersedes %+v should be %v\n",
+				c.update, *cur, c.wins)
+			t.FailNow()
+		}
+	}
+}
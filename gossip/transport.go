@@ -0,0 +1,59 @@
+package gossip
+
+import "net"
+
+// Transport carries gossip messages between members. Messages may be
+// lost, duplicated, or reordered; the protocol tolerates all three.
+type Transport interface {
+	// Send sends a message to the member at addr.
+	Send(addr string, msg []byte) error
+
+	// Receive blocks until a message arrives. Once the transport is
+	// closed, it returns an error.
+	Receive() ([]byte, error)
+
+	Close() error
+}
+
+// maxPacket is the largest UDP payload.
+const maxPacket = 65507
+
+type udpTransport struct {
+	conn *net.UDPConn
+}
+
+// ListenUDP returns a transport sending and receiving messages as UDP
+// datagrams on the given address.
+func ListenUDP(addr string) (Transport, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTransport{conn}, nil
+}
+
+func (t *udpTransport) Send(addr string, msg []byte) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	_, err = t.conn.WriteToUDP(msg, udpAddr)
+	return err
+}
+
+func (t *udpTransport) Receive() ([]byte, error) {
+	buf := make([]byte, maxPacket)
+	n, _, err := t.conn.ReadFromUDP(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
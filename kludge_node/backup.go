@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/gokyle/goconfig"
+	"github.com/gokyle/kludge/common"
+	"github.com/gokyle/kludge/node"
+	"github.com/jmhodges/levigo"
+	"net"
+	"os"
+	"time"
+)
+
+// nodeAddr returns the address the node configured in cfgmap listens
+// on, as reached from the local host.
+func nodeAddr(cfgmap goconfig.ConfigMap) string {
+	addr := listenAddr
+	if cfgAddr, ok := cfgmap["datastore"]["listen"]; ok {
+		addr = cfgAddr
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	return addr
+}
+
+func backupStatus(op *common.Operation, addr string) (status common.BackupStatus, err error) {
+	resp, err := common.SendOperation(addr, op)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(resp.Body, &status)
+	return
+}
+
+// runBackup asks the running node to back itself up to the named
+// archive in its backup directory, and waits for it to finish. An
+// existing archive is only replaced if overwrite is set.
+func runBackup(cfgmap goconfig.ConfigMap, name string, overwrite bool) {
+	addr := nodeAddr(cfgmap)
+	op := &common.Operation{OpCode: common.OpBackup, Key: []byte(name)}
+	if overwrite {
+		op.Val = []byte(common.BackupOverwrite)
+	}
+	status, err := backupStatus(op, addr)
+	if err != nil {
+		fmt.Println("[!] failed to start backup:", err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("backing up to", status.Path)
+
+	for status.Running {
+		<-time.After(time.Second)
+		status, err = backupStatus(&common.Operation{OpCode: common.OpBackupStatus}, addr)
+		if err != nil {
+			fmt.Println("[!] failed to check on backup:", err.Error())
+			os.Exit(1)
+		}
+	}
+	if status.Err != "" {
+		fmt.Println("[!] backup failed:", status.Err)
+		os.Exit(1)
+	}
+	fmt.Printf("backed up %d records (%d bytes) in %s\n", status.Records,
+		status.Bytes, status.Finished.Sub(status.Started))
+	fmt.Println("sha256:", status.Checksum)
+}
+
+// runRestore rebuilds the configured datastore from a backup archive.
+// The datastore must not exist; it is built under a temporary name and
+// only moved into place once the archive has been verified.
+func runRestore(cfgmap goconfig.ConfigMap, archive string) {
+	dir := cfgmap["datastore"]["datastore"]
+	if dir == "" {
+		fmt.Println("[!] no datastore specified")
+		os.Exit(1)
+	}
+	if _, err := os.Stat(dir); err == nil {
+		fmt.Printf("[!] %s already exists; move it aside to restore\n", dir)
+		os.Exit(1)
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		fmt.Println("[!] failed to open archive:", err.Error())
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	tmp := dir + ".restore"
+	os.RemoveAll(tmp)
+	opts := levigo.NewOptions()
+	opts.SetCreateIfMissing(true)
+	opts.SetErrorIfExists(true)
+	db, err := levigo.Open(tmp, opts)
+	if err != nil {
+		fmt.Println("[!] failed to create datastore:", err.Error())
+		os.Exit(1)
+	}
+	info, err := node.Restore(bufio.NewReader(f), &levelStore{db})
+	db.Close()
+	if err == nil {
+		err = os.Rename(tmp, dir)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		fmt.Println("[!] restore failed:", err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Printf("restored %d records to %s\n", info.Records, dir)
+	fmt.Printf("backup of node %s taken by %s at %s\n", info.NodeID,
+		info.Version, info.Created.Format(time.RFC3339))
+}
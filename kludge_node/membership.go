@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/gokyle/goconfig"
+	"github.com/gokyle/kludge/common"
+	"github.com/gokyle/kludge/gossip"
+)
+
+// members is the node's gossip membership. It is nil if the cluster is
+// configured statically.
+var members *gossip.Gossip
+
+// initGossip joins the gossip cluster if the config has a gossip
+// section. Other nodes are added to the ring as they are discovered;
+// gossip is started once the node is running.
+func initGossip(cfgmap goconfig.ConfigMap) (regen bool) {
+	section, ok := cfgmap["gossip"]
+	if !ok {
+		return
+	}
+
+	cfg, listen, err := gossip.ParseConfig(section)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	cfg.ID = nodeID
+	cfg.Kind = common.MemberNode
+	cfg.Service = advertise
+	cfg.Notify = func(m gossip.Member) {
+		kn.MemberChanged(m)
+	}
+	cfg.Logger = logger
+
+	transport, err := gossip.ListenUDP(listen)
+	if err != nil {
+		logger.Fatal("failed to set up gossip: ", err.Error())
+	}
+	members = gossip.New(cfg, transport)
+	return false
+}
@@ -5,11 +5,15 @@ import (
 	"fmt"
 	"github.com/gokyle/goconfig"
 	"github.com/gokyle/kludge/logsrv/logsrvc"
+	"github.com/gokyle/kludge/node"
+	"github.com/gokyle/kludge/ring"
 	"github.com/gokyle/uuid"
 	"github.com/jmhodges/levigo"
+	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -21,8 +25,9 @@ var (
 	logger     *logsrvc.Logger
 	nodeID     string
 	listenAddr = ":5987"
-	poolSize   = 4
-	reqBuf     = 16
+	advertise  string
+	nodeCfg    = node.DefaultConfig()
+	kn         *node.Node
 )
 
 func initLogging(cfgmap goconfig.ConfigMap) (regen bool) {
@@ -72,7 +77,7 @@ func initDatastore(cfgmap goconfig.ConfigMap) (regen bool) {
 	if cfgReqBuf, ok := cfg["request_buffer"]; ok {
 		var err error
 
-		reqBuf, err = strconv.Atoi(cfgReqBuf)
+		nodeCfg.RequestBuffer, err = strconv.Atoi(cfgReqBuf)
 		if err != nil {
 			logger.Printf("invalid value %s for request buffer: %s",
 				cfgReqBuf, err.Error())
@@ -82,18 +87,165 @@ func initDatastore(cfgmap goconfig.ConfigMap) (regen bool) {
 	if cfgPSize, ok := cfg["pool_size"]; ok {
 		var err error
 
-		poolSize, err = strconv.Atoi(cfgPSize)
+		nodeCfg.PoolSize, err = strconv.Atoi(cfgPSize)
 		if err != nil {
 			logger.Printf("invalid value %s for pool size: %s",
 				cfgPSize, err.Error())
 		}
 	}
+
+	if cfgChunkSize, ok := cfg["chunk_size"]; ok {
+		var err error
+
+		nodeCfg.ChunkSize, err = strconv.Atoi(cfgChunkSize)
+		if err != nil {
+			logger.Printf("invalid value %s for chunk size: %s",
+				cfgChunkSize, err.Error())
+		}
+	}
+
+	if cfgFeedSize, ok := cfg["feed_size"]; ok {
+		var err error
+
+		nodeCfg.FeedSize, err = strconv.Atoi(cfgFeedSize)
+		if err != nil {
+			logger.Printf("invalid value %s for feed size: %s",
+				cfgFeedSize, err.Error())
+		}
+	}
+
+	if cfgRetention, ok := cfg["log_retention"]; ok {
+		var err error
+
+		nodeCfg.LogRetention, err = time.ParseDuration(cfgRetention)
+		if err != nil {
+			logger.Printf("invalid value %s for log retention: %s",
+				cfgRetention, err.Error())
+		}
+	}
+
+	if cfgInterval, ok := cfg["log_trim"]; ok {
+		var err error
+
+		nodeCfg.LogTrim, err = time.ParseDuration(cfgInterval)
+		if err != nil {
+			logger.Printf("invalid value %s for log trim interval: %s",
+				cfgInterval, err.Error())
+		}
+	}
+
+	nodeCfg.BackupDir = cfg["backup_dir"]
+
 	dbOpts = levigo.NewOptions()
 	dbOpts.SetCache(levigo.NewLRUCache(3 << 20))
 	dbOpts.SetCreateIfMissing(true)
 	return false
 }
 
+// initCluster reads the optional cluster section, which describes how
+// the node finds the other replicas of its data. Without gossip, the
+// section lists every node in the cluster, including this one, which
+// is identified by its advertised address. With gossip, the node is
+// identified by its node ID and the peers are discovered.
+func initCluster(cfgmap goconfig.ConfigMap) (regen bool) {
+	cfg, ok := cfgmap["cluster"]
+	if !ok {
+		if _, ok = cfgmap["gossip"]; ok {
+			logger.Fatal("gossip requires a cluster section")
+		}
+		// A standalone node is only identified in its backups.
+		nodeCfg.ID = nodeID
+		return
+	}
+
+	advertise = strings.TrimSpace(cfg["advertise"])
+	if advertise == "" {
+		logger.Fatal("cluster configured without an advertised address")
+	}
+	peers, err := ring.ParseNodes(cfg["peers"])
+	if err != nil {
+		logger.Fatal("invalid peer list: ", err.Error())
+	}
+
+	_, useGossip := cfgmap["gossip"]
+	if useGossip {
+		if len(peers) > 0 {
+			logger.Fatal("the peer list may not be used with gossip")
+		}
+		nodeCfg.ID = nodeID
+		nodeCfg.Gossip = true
+		peers = append(peers, ring.Node{ID: nodeID, Addr: advertise})
+	} else {
+		nodeCfg.ID = advertise
+	}
+	nodeCfg.Addr = advertise
+
+	vnodes := 0
+	if cfgVNodes, ok := cfg["vnodes"]; ok {
+		vnodes, err = strconv.Atoi(cfgVNodes)
+		if err != nil {
+			logger.Printf("invalid value %s for vnodes: %s",
+				cfgVNodes, err.Error())
+		}
+	}
+	nodeCfg.Ring = ring.New(vnodes)
+	for _, peer := range peers {
+		nodeCfg.Ring.Add(peer)
+	}
+	if _, ok := nodeCfg.Ring.Node(nodeCfg.ID); !ok {
+		logger.Fatalf("%s is not in the peer list", nodeCfg.ID)
+	}
+
+	if cfgReplicas, ok := cfg["replicas"]; ok {
+		nodeCfg.Replicas, err = strconv.Atoi(cfgReplicas)
+		if err != nil {
+			logger.Printf("invalid value %s for replicas: %s",
+				cfgReplicas, err.Error())
+		}
+	}
+
+	if cfgInterval, ok := cfg["anti_entropy"]; ok {
+		nodeCfg.AntiEntropy, err = time.ParseDuration(cfgInterval)
+		if err != nil {
+			logger.Printf("invalid value %s for anti-entropy interval: %s",
+				cfgInterval, err.Error())
+		}
+	}
+
+	if cfgMaxHints, ok := cfg["max_hint_bytes"]; ok {
+		nodeCfg.MaxHintBytes, err = strconv.ParseInt(cfgMaxHints, 10, 64)
+		if err != nil {
+			logger.Printf("invalid value %s for hint storage: %s",
+				cfgMaxHints, err.Error())
+		}
+	}
+
+	if cfgInterval, ok := cfg["hint_replay"]; ok {
+		nodeCfg.HintReplay, err = time.ParseDuration(cfgInterval)
+		if err != nil {
+			logger.Printf("invalid value %s for hint replay interval: %s",
+				cfgInterval, err.Error())
+		}
+	}
+
+	if cfgInterval, ok := cfg["rebalance_delay"]; ok {
+		nodeCfg.RebalanceDelay, err = time.ParseDuration(cfgInterval)
+		if err != nil {
+			logger.Printf("invalid value %s for rebalance delay: %s",
+				cfgInterval, err.Error())
+		}
+	}
+
+	if cfgInterval, ok := cfg["rebalance_retry"]; ok {
+		nodeCfg.RebalanceRetry, err = time.ParseDuration(cfgInterval)
+		if err != nil {
+			logger.Printf("invalid value %s for rebalance retry interval: %s",
+				cfgInterval, err.Error())
+		}
+	}
+	return false
+}
+
 func updateConfig(cfg goconfig.ConfigMap, cfgFile string) {
 	err := cfg.WriteFile(cfgFile)
 	if err != nil {
@@ -107,6 +259,12 @@ func updateConfig(cfg goconfig.ConfigMap, cfgFile string) {
 func init() {
 	configFile := flag.String("f", "backendrc",
 		"path to configuration file")
+	backup := flag.Bool("backup", false,
+		"back up the running node to the archive named by the argument")
+	overwrite := flag.Bool("overwrite", false,
+		"with -backup, replace an existing archive of the same name")
+	restore := flag.String("restore", "",
+		"rebuild the datastore from a backup archive")
 	flag.Parse()
 
 	cfg, err := goconfig.ParseFile(*configFile)
@@ -115,6 +273,14 @@ func init() {
 		os.Exit(1)
 	}
 
+	if *backup {
+		runBackup(cfg, flag.Arg(0), *overwrite)
+		os.Exit(0)
+	} else if *restore != "" {
+		runRestore(cfg, *restore)
+		os.Exit(0)
+	}
+
 	if initLogging(cfg) {
 		updateConfig(cfg, *configFile)
 	}
@@ -122,6 +288,14 @@ func init() {
 	if initDatastore(cfg) {
 		updateConfig(cfg, *configFile)
 	}
+
+	if initCluster(cfg) {
+		updateConfig(cfg, *configFile)
+	}
+
+	if initGossip(cfg) {
+		updateConfig(cfg, *configFile)
+	}
 }
 
 func main() {
@@ -135,16 +309,37 @@ func main() {
 	}
 	defer ldb.Close()
 
-	go startPool()
-	go listener()
+	nodeCfg.Store = &levelStore{ldb}
+	nodeCfg.Logger = logger
+	kn, err = node.New(nodeCfg)
+	if err != nil {
+		logger.Fatal("Failed to start kludge backend: ", err.Error())
+	}
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		logger.Fatalf("failed to listen on %s: %s\n", listenAddr,
+			err.Error())
+	}
+
+	go func() {
+		err := kn.Serve(listener)
+		logger.Println("listener failure: ", err.Error())
+	}()
+	kn.Start()
+	if members != nil {
+		members.Start()
+	}
 	signal.Notify(sigc, os.Kill, os.Interrupt, syscall.SIGTERM)
 	<-sigc
 
-	// the worker pool is managed in pool.go.
-	if reqQ != nil {
-		close(reqQ)
-		logger.Println("giving workers time to complete")
-		<-time.After(250 * time.Millisecond)
+	if members != nil {
+		members.Stop()
 	}
+
+	// Closing the listener stops the worker pool.
+	kn.Stop()
+	listener.Close()
+	logger.Println("giving workers time to complete")
+	<-time.After(250 * time.Millisecond)
 	logger.Println("kludge is shutting down")
 }
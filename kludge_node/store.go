@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/gokyle/kludge/node"
+	"github.com/jmhodges/levigo"
+)
+
+// levelStore keeps the node's records in LevelDB. Every write is
+// synced to disk before it is acknowledged.
+type levelStore struct {
+	db *levigo.DB
+}
+
+func (s *levelStore) Get(key []byte) ([]byte, error) {
+	ropts := levigo.NewReadOptions()
+	ropts.SetVerifyChecksums(true)
+	defer ropts.Close()
+
+	return s.db.Get(ropts, key)
+}
+
+func (s *levelStore) Put(key, value []byte) error {
+	wopts := levigo.NewWriteOptions()
+	wopts.SetSync(true)
+	defer wopts.Close()
+
+	return s.db.Put(wopts, key, value)
+}
+
+func (s *levelStore) Write(b *node.Batch) error {
+	batch := levigo.NewWriteBatch()
+	defer batch.Close()
+	for _, op := range b.Ops {
+		if op.Value == nil {
+			batch.Delete(op.Key)
+		} else {
+			batch.Put(op.Key, op.Value)
+		}
+	}
+
+	wopts := levigo.NewWriteOptions()
+	wopts.SetSync(true)
+	defer wopts.Close()
+	return s.db.Write(wopts, batch)
+}
+
+func (s *levelStore) Iterate(start []byte, fn func(key, value []byte) bool) error {
+	ropts := levigo.NewReadOptions()
+	ropts.SetFillCache(false)
+	defer ropts.Close()
+
+	it := s.db.NewIterator(ropts)
+	defer it.Close()
+	if len(start) == 0 {
+		it.SeekToFirst()
+	} else {
+		it.Seek(start)
+	}
+	for ; it.Valid(); it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			break
+		}
+	}
+	return it.GetError()
+}
+
+// Snapshot takes a LevelDB snapshot, which backups read from while the
+// node goes on writing.
+func (s *levelStore) Snapshot() (node.Snapshot, error) {
+	return &levelSnapshot{s.db, s.db.NewSnapshot()}, nil
+}
+
+type levelSnapshot struct {
+	db   *levigo.DB
+	snap *levigo.Snapshot
+}
+
+func (s *levelSnapshot) Iterate(start []byte, fn func(key, value []byte) bool) error {
+	ropts := levigo.NewReadOptions()
+	ropts.SetFillCache(false)
+	ropts.SetSnapshot(s.snap)
+	defer ropts.Close()
+
+	it := s.db.NewIterator(ropts)
+	defer it.Close()
+	if len(start) == 0 {
+		it.SeekToFirst()
+	} else {
+		it.Seek(start)
+	}
+	for ; it.Valid(); it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			break
+		}
+	}
+	return it.GetError()
+}
+
+func (s *levelSnapshot) Release() {
+	s.db.ReleaseSnapshot(s.snap)
+}
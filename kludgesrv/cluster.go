@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gokyle/goconfig"
+	"github.com/gokyle/kludge/frontend"
+	"github.com/gokyle/kludge/ring"
+	"os"
+	"strconv"
+)
+
+// initCluster reads the cluster section of the config. If gossip is
+// configured, the nodes are discovered through it; otherwise, they are
+// listed in the cluster section. If the section is missing entirely,
+// the frontend talks to a single node on the local machine.
+func initCluster(cfgmap goconfig.ConfigMap) (fecfg frontend.Config) {
+	_, useGossip := cfgmap["gossip"]
+	cfg, ok := cfgmap["cluster"]
+	if !ok {
+		cfg = make(map[string]string, 0)
+		if !useGossip {
+			cfg["nodes"] = "127.0.0.1:5987"
+		}
+	}
+
+	nodes, err := ring.ParseNodes(cfg["nodes"])
+	if err != nil {
+		fmt.Println("invalid node list:", err.Error())
+		os.Exit(1)
+	} else if len(nodes) == 0 && !useGossip {
+		fmt.Println("no nodes in cluster")
+		os.Exit(1)
+	} else if len(nodes) > 0 && useGossip {
+		fmt.Println("the node list may not be used with gossip")
+		os.Exit(1)
+	}
+
+	fecfg.Ring = ring.New(configInt(cfg, "vnodes", 0))
+	for _, n := range nodes {
+		fecfg.Ring.Add(n)
+	}
+
+	fecfg.Replicas = configInt(cfg, "replicas", 1)
+	fecfg.ReadQuorum = configInt(cfg, "read_quorum", fecfg.Replicas/2+1)
+	fecfg.WriteQuorum = configInt(cfg, "write_quorum", fecfg.Replicas/2+1)
+
+	fecfg.HintedHandoff = true
+	if s, ok := cfg["hinted_handoff"]; ok {
+		fecfg.HintedHandoff, err = strconv.ParseBool(s)
+		if err != nil {
+			fmt.Printf("invalid value %s for hinted_handoff: %s\n",
+				s, err.Error())
+			os.Exit(1)
+		}
+	}
+	fecfg.Logger = logger
+	return
+}
+
+func configInt(cfg map[string]string, name string, def int) int {
+	s, ok := cfg[name]
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		fmt.Printf("invalid value %s for %s: %s\n", s, name, err.Error())
+		os.Exit(1)
+	}
+	return n
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gokyle/goconfig"
+	"github.com/gokyle/kludge/common"
+	"github.com/gokyle/kludge/frontend"
+	"github.com/gokyle/kludge/gossip"
+	"github.com/gokyle/kludge/ring"
+	"os"
+)
+
+// members is the frontend's gossip membership. It is nil if the
+// cluster is configured statically.
+var members *gossip.Gossip
+
+// initGossip joins the gossip cluster if the config has a gossip
+// section. Nodes are added to the frontend's ring as they are
+// discovered, and requests to nodes gossip has declared dead are not
+// attempted.
+func initGossip(cfgmap goconfig.ConfigMap, fecfg *frontend.Config) {
+	section, ok := cfgmap["gossip"]
+	if !ok {
+		return
+	}
+
+	cfg, listen, err := gossip.ParseConfig(section)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	cfg.ID = nodeID
+	cfg.Kind = common.MemberFrontend
+	cfg.Service = address
+	cfg.Notify = func(m gossip.Member) {
+		fe.MemberChanged(m)
+	}
+	cfg.Logger = logger
+
+	transport, err := gossip.ListenUDP(listen)
+	if err != nil {
+		fmt.Println("failed to set up gossip:", err.Error())
+		os.Exit(1)
+	}
+	members = gossip.New(cfg, transport)
+	fecfg.Down = nodeDown
+	fecfg.Members = members.Members
+}
+
+// nodeDown returns true if gossip has declared the node dead.
+func nodeDown(n ring.Node) bool {
+	m, ok := members.Member(n.ID)
+	return ok && m.State == gossip.Dead
+}
@@ -1,16 +1,16 @@
 package main
 
 import (
+	"expvar"
 	"flag"
 	"fmt"
 	"github.com/gokyle/goconfig"
-	"github.com/gokyle/kludge/common"
+	"github.com/gokyle/kludge/frontend"
 	"github.com/gokyle/kludge/logsrv/logsrvc"
 	"github.com/gokyle/uuid"
-	"io"
 	"net/http"
 	"os"
-	"regexp"
+	"time"
 )
 
 var (
@@ -18,123 +18,18 @@ var (
 	address    string
 	nodeID     string
 	logger     *logsrvc.Logger
+	fe         *frontend.Frontend
 )
 
-var keyIDRegexp = regexp.MustCompile("^/data/(.+)$")
-
-func ServerError(w http.ResponseWriter, err error) {
-	w.WriteHeader(http.StatusInternalServerError)
-	w.Write([]byte(err.Error()))
-}
-
-func NotImplemented(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusNotImplemented)
-	msg := "Method " + r.Method + " not implemented."
-	w.Write([]byte(msg))
-}
-
-func VersionHeader(w http.ResponseWriter) {
-	version := common.Version()
-	w.Header().Add("X-Kludge-Version", version)
-}
-
-func KeyID(r *http.Request) string {
-	return keyIDRegexp.ReplaceAllString(r.URL.Path, "$1")
-}
-
-func ListKeys(w http.ResponseWriter, r *http.Request) {
-	keys, err := listKeys()
-	if err != nil {
-		ServerError(w, err)
-		return
-	}
-	w.Write(keys)
-}
-
-func GetKey(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == "/data" || r.URL.Path == "/data/" {
-		ListKeys(w, r)
-		return
-	}
-	key := KeyID(r)
-	body, ok, err := getKey(key)
-	if err != nil {
-		ServerError(w, err)
-		return
-	}
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
-	}
-	w.Write(body)
-}
-
-func DelKey(w http.ResponseWriter, r *http.Request) {
-	body, ok, err := delKey(KeyID(r))
-	if err != nil {
-		ServerError(w, err)
-		return
-	}
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
-	}
-	w.Write(body)
-}
-
-func SetKey(w http.ResponseWriter, r *http.Request) {
-	key := KeyID(r)
-	defer r.Body.Close()
-
-	var value []byte
-	if r.ContentLength > 0 {
-		value = make([]byte, r.ContentLength)
-	} else {
-		value = make([]byte, 0)
-	}
-	_, err := io.ReadFull(r.Body, value)
-	if err != nil {
-		logger.Printf("request for %s failed: %s", r.URL.String(),
-			err.Error())
-		ServerError(w, err)
-		return
-	}
-	body, ok, err := setKey(key, value)
-	if err != nil {
-		ServerError(w, err)
-		return
-	}
-	if !ok {
-		w.WriteHeader(http.StatusCreated)
-	}
-	w.Write(body)
-}
-
-func Key(w http.ResponseWriter, r *http.Request) {
-	logger.Printf("%s request to %s", r.Method, r.URL.String())
-	VersionHeader(w)
-	switch r.Method {
-	case "GET":
-		GetKey(w, r)
-	case "POST", "PUT":
-		SetKey(w, r)
-	case "DELETE":
-		DelKey(w, r)
-	case "HEAD":
-		w.Header().Add("content-length", "0")
-		w.WriteHeader(http.StatusOK)
-		return
-	default:
-		logger.Print("received unsupported request for method ",
-			r.Method)
-		NotImplemented(w, r)
-
-	}
-}
-
 func main() {
 	defer logger.Shutdown()
-	address = "127.0.0.1:8080"
-	http.HandleFunc("/data", Key)
-	http.HandleFunc("/data/", Key)
+	// The frontend's counters are also published at /debug/vars.
+	expvar.Publish("frontend", fe.Stats())
+	http.Handle("/", fe)
+	if members != nil {
+		members.Start()
+		defer members.Stop()
+	}
 	logger.Println("serving on", address)
 	logger.Fatal(http.ListenAndServe(address, nil))
 }
@@ -150,6 +45,37 @@ func init() {
 		os.Exit(1)
 	}
 	regen := initLogging(cfg["logging"])
+	address = "127.0.0.1:8080"
+	if srvAddr := cfg["server"]["address"]; srvAddr != "" {
+		address = srvAddr
+	}
+	fecfg := initCluster(cfg)
+	fecfg.MaxValueSize = int64(configInt(cfg["server"], "max_value_size",
+		frontend.DefaultMaxValueSize))
+	fecfg.MaxBatchSize = int64(configInt(cfg["server"], "max_batch_size",
+		frontend.DefaultMaxBatchSize))
+	if s, ok := cfg["server"]["watch_interval"]; ok {
+		fecfg.WatchInterval, err = time.ParseDuration(s)
+		if err != nil {
+			fmt.Printf("invalid value %s for watch_interval: %s\n",
+				s, err.Error())
+			os.Exit(1)
+		}
+	}
+	if s, ok := cfg["server"]["namespace_cache"]; ok {
+		fecfg.NamespaceCache, err = time.ParseDuration(s)
+		if err != nil {
+			fmt.Printf("invalid value %s for namespace_cache: %s\n",
+				s, err.Error())
+			os.Exit(1)
+		}
+	}
+	initGossip(cfg, &fecfg)
+	fe, err = frontend.New(fecfg)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
 	if regen {
 		cfg["logging"]["node_id"] = nodeID
 		err = cfg.WriteFile(*cfgFile)
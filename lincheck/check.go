@@ -0,0 +1,222 @@
+package lincheck
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"time"
+)
+
+// never is the return time of operations that failed, which may take
+// effect at any point after they were invoked.
+const never = time.Duration(math.MaxInt64)
+
+// Result describes the outcome of a check. If the history is not
+// linearizable, Key is the first key whose history is not, Ops is that
+// key's history, and Partial is the longest sequence of its operations
+// that could be linearized before the search failed.
+type Result struct {
+	Linearizable bool
+	Key          string
+	Ops          []Op
+	Partial      []Op
+}
+
+// state is the value of a key at some point in a linearization.
+type state struct {
+	value   string
+	present bool
+}
+
+// step applies an operation to the state, returning false if the
+// operation's output could not have been seen in that state.
+func step(st state, op *Op) (bool, state) {
+	if !op.Failed() {
+		if op.OK != st.present || (op.OK && op.Output != st.value) {
+			return false, st
+		}
+	}
+	switch op.Kind {
+	case Set:
+		return true, state{op.Value, true}
+	case Del:
+		return true, state{}
+	}
+	return true, st
+}
+
+// Check checks a history for linearizability, one key at a time. Keys
+// are assumed to be absent before the history begins.
+func Check(ops []Op) Result {
+	byKey := make(map[string][]Op, 0)
+	for _, op := range ops {
+		if op.Kind == Get && op.Failed() {
+			continue
+		}
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+
+	var keys []string
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if partial, ok := checkKey(byKey[key]); !ok {
+			return Result{Key: key, Ops: byKey[key], Partial: partial}
+		}
+	}
+	return Result{Linearizable: true}
+}
+
+// An entry marks the invocation or completion of an operation. The
+// entries of a history form a doubly-linked list in time order, from
+// which operations are removed as they are linearized.
+type entry struct {
+	call       bool
+	id         int
+	time       time.Duration
+	op         *Op
+	match      *entry
+	prev, next *entry
+}
+
+type byTime []*entry
+
+func (p byTime) Len() int      { return len(p) }
+func (p byTime) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// Less orders invocations before completions at the same time, so that
+// such operations are treated as concurrent.
+func (p byTime) Less(i, j int) bool {
+	if p[i].time != p[j].time {
+		return p[i].time < p[j].time
+	}
+	return p[i].call && !p[j].call
+}
+
+// makeEntries builds the entry list for a key's history, returning its
+// head, which is a sentinel.
+func makeEntries(ops []Op) *entry {
+	var entries []*entry
+	for i := range ops {
+		op := &ops[i]
+		call := &entry{call: true, id: i, time: op.Call, op: op}
+		ret := &entry{id: i, time: op.Return, op: op}
+		if op.Failed() {
+			ret.time = never
+		}
+		call.match = ret
+		entries = append(entries, call, ret)
+	}
+	sort.Stable(byTime(entries))
+
+	head := new(entry)
+	last := head
+	for _, e := range entries {
+		last.next, e.prev = e, last
+		last = e
+	}
+	return head
+}
+
+// lift removes an operation's entries from the list.
+func (e *entry) lift() {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	m := e.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+// unlift puts back the entries of an operation removed with lift.
+func (e *entry) unlift() {
+	m := e.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+type bitset []uint64
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << uint(i%64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << uint(i%64) }
+
+func (b bitset) key() string {
+	buf := make([]byte, 8*len(b))
+	for i, word := range b {
+		binary.BigEndian.PutUint64(buf[8*i:], word)
+	}
+	return string(buf)
+}
+
+type cacheKey struct {
+	linearized string
+	st         state
+}
+
+type frame struct {
+	e  *entry
+	st state
+}
+
+// checkKey searches for a linearization of a key's history, following
+// Wing and Gong's algorithm with Lowe's memoisation of the states that
+// have already been explored. Operations are linearized one at a time
+// while their invocations are the earliest entries left; when the
+// completion of an operation that has not been linearized is reached,
+// the search backtracks.
+func checkKey(ops []Op) (partial []Op, ok bool) {
+	head := makeEntries(ops)
+	linearized := make(bitset, (len(ops)+63)/64)
+	cache := make(map[cacheKey]bool, 0)
+	var stack []frame
+	var st state
+
+	longest := func() {
+		if len(stack) > len(partial) {
+			partial = partial[:0]
+			for _, f := range stack {
+				partial = append(partial, *f.e.op)
+			}
+		}
+	}
+
+	e := head.next
+	for head.next != nil {
+		if e.call {
+			if legal, next := step(st, e.op); legal {
+				linearized.set(e.id)
+				seen := cacheKey{linearized.key(), next}
+				if !cache[seen] {
+					cache[seen] = true
+					stack = append(stack, frame{e, st})
+					st = next
+					e.lift()
+					e = head.next
+					continue
+				}
+				linearized.clear(e.id)
+			}
+			e = e.next
+			continue
+		}
+
+		longest()
+		if len(stack) == 0 {
+			return partial, false
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		st = top.st
+		linearized.clear(top.e.id)
+		top.e.unlift()
+		e = top.e.next
+	}
+	return nil, true
+}
@@ -0,0 +1,175 @@
+// Package lincheck records the operations concurrent clients perform
+// on a kludge datastore and checks whether the history is
+// linearizable: whether every operation appears to take effect at a
+// single instant between its invocation and its completion, with the
+// results the clients saw.
+//
+// Keys are independent registers, so each key's history is checked on
+// its own. The model of a key is the datastore's: Get returns the
+// current value, while Set and Del return the value they replaced.
+// Operations that fail with an error may or may not have taken effect;
+// a failed Set or Del may take effect at any point after it was
+// invoked, or never, and a failed Get is ignored.
+package lincheck
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Client is the interface of the datastore client whose operations are
+// recorded; it is satisfied by the client package's DataStore.
+type Client interface {
+	Get(key string) ([]byte, bool, error)
+	Set(key string, value []byte) ([]byte, bool, error)
+	Del(key string) ([]byte, bool, error)
+}
+
+// Kind identifies the type of an operation.
+type Kind int
+
+const (
+	Get Kind = iota
+	Set
+	Del
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Get:
+		return "GET"
+	case Set:
+		return "SET"
+	case Del:
+		return "DEL"
+	default:
+		return fmt.Sprintf("Kind(%d)", int(k))
+	}
+}
+
+// Op is a single recorded operation. Call and Return are the times it
+// was invoked and completed, measured from the start of the history.
+// For a Get, Output and OK are the value read and whether the key was
+// present; for a Set or Del, they are the previous value.
+type Op struct {
+	Client int
+	Kind   Kind
+	Key    string
+	Value  string
+	Output string
+	OK     bool
+	Err    string
+	Call   time.Duration
+	Return time.Duration
+}
+
+// Failed returns true if the operation returned an error, so that its
+// outcome is unknown.
+func (op Op) Failed() bool {
+	return op.Err != ""
+}
+
+func (op Op) String() string {
+	var in, out string
+	switch op.Kind {
+	case Set:
+		in = fmt.Sprintf("(%q, %q)", op.Key, op.Value)
+	default:
+		in = fmt.Sprintf("(%q)", op.Key)
+	}
+	switch {
+	case op.Failed():
+		out = "error: " + op.Err
+	case op.OK:
+		out = fmt.Sprintf("%q", op.Output)
+	default:
+		out = "not found"
+	}
+	return fmt.Sprintf("[%s, %s] client %d: %s%s -> %s", op.Call,
+		op.Return, op.Client, op.Kind, in, out)
+}
+
+// History collects the operations of any number of clients. It is
+// safe for concurrent use.
+type History struct {
+	lock  sync.Mutex
+	start time.Time
+	ops   []Op
+}
+
+// NewHistory returns an empty history whose times are measured from
+// now.
+func NewHistory() *History {
+	return &History{start: time.Now()}
+}
+
+// Record performs an operation with fn and adds it to the history.
+func (h *History) Record(client int, kind Kind, key string, value []byte,
+	fn func() ([]byte, bool, error)) ([]byte, bool, error) {
+	op := Op{
+		Client: client,
+		Kind:   kind,
+		Key:    key,
+		Value:  string(value),
+		Call:   time.Since(h.start),
+	}
+	out, ok, err := fn()
+	op.Return = time.Since(h.start)
+	op.Output, op.OK = string(out), ok
+	if err != nil {
+		op.Err = err.Error()
+	}
+
+	h.lock.Lock()
+	h.ops = append(h.ops, op)
+	h.lock.Unlock()
+	return out, ok, err
+}
+
+// Ops returns the operations recorded so far, ordered by the time they
+// were invoked.
+func (h *History) Ops() []Op {
+	h.lock.Lock()
+	ops := append([]Op{}, h.ops...)
+	h.lock.Unlock()
+	sort.Sort(byCall(ops))
+	return ops
+}
+
+// Wrap returns a client that records each operation it performs in the
+// history under the given client ID.
+func (h *History) Wrap(id int, c Client) Client {
+	return &recorder{h, id, c}
+}
+
+type recorder struct {
+	h      *History
+	id     int
+	client Client
+}
+
+func (r *recorder) Get(key string) ([]byte, bool, error) {
+	return r.h.Record(r.id, Get, key, nil, func() ([]byte, bool, error) {
+		return r.client.Get(key)
+	})
+}
+
+func (r *recorder) Set(key string, value []byte) ([]byte, bool, error) {
+	return r.h.Record(r.id, Set, key, value, func() ([]byte, bool, error) {
+		return r.client.Set(key, value)
+	})
+}
+
+func (r *recorder) Del(key string) ([]byte, bool, error) {
+	return r.h.Record(r.id, Del, key, nil, func() ([]byte, bool, error) {
+		return r.client.Del(key)
+	})
+}
+
+type byCall []Op
+
+func (p byCall) Len() int           { return len(p) }
+func (p byCall) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byCall) Less(i, j int) bool { return p[i].Call < p[j].Call }
@@ -0,0 +1,146 @@
+package lincheck
+
+import (
+	"fmt"
+	"github.com/gokyle/kludge/sim"
+	"testing"
+	"time"
+)
+
+// op builds an operation on the key "k" that runs from call to ret,
+// in milliseconds. Failed operations are given an output of "!".
+func op(client int, kind Kind, value, output string, ok bool, call, ret int) Op {
+	o := Op{
+		Client: client,
+		Kind:   kind,
+		Key:    "k",
+		Value:  value,
+		Output: output,
+		OK:     ok,
+		Call:   time.Duration(call) * time.Millisecond,
+		Return: time.Duration(ret) * time.Millisecond,
+	}
+	if output == "!" {
+		o.Output, o.Err = "", "timeout"
+	}
+	return o
+}
+
+var histories = []struct {
+	name         string
+	ops          []Op
+	linearizable bool
+}{
+	{"sequential", []Op{
+		op(0, Get, "", "", false, 0, 1),
+		op(0, Set, "a", "", false, 2, 3),
+		op(1, Set, "b", "a", true, 4, 5),
+		op(0, Get, "", "b", true, 6, 7),
+		op(1, Del, "", "b", true, 8, 9),
+		op(0, Get, "", "", false, 10, 11),
+	}, true},
+	{"stale read", []Op{
+		op(0, Set, "a", "", false, 0, 1),
+		op(0, Set, "b", "a", true, 2, 3),
+		op(1, Get, "", "a", true, 4, 5),
+	}, false},
+	{"concurrent read", []Op{
+		op(0, Set, "a", "", false, 0, 1),
+		op(0, Set, "b", "a", true, 2, 6),
+		op(1, Get, "", "b", true, 3, 4),
+		op(2, Get, "", "a", true, 5, 7),
+	}, false},
+	{"concurrent reads", []Op{
+		op(0, Set, "a", "", false, 0, 1),
+		op(0, Set, "b", "a", true, 2, 6),
+		op(1, Get, "", "a", true, 3, 4),
+		op(2, Get, "", "b", true, 5, 7),
+	}, true},
+	{"lost update", []Op{
+		op(0, Set, "a", "", false, 0, 3),
+		op(1, Set, "b", "", false, 1, 2),
+	}, false},
+	{"failed write seen", []Op{
+		op(0, Set, "a", "!", false, 0, 1),
+		op(1, Get, "", "a", true, 5, 6),
+		op(1, Set, "b", "a", true, 7, 8),
+	}, true},
+	{"failed write not seen", []Op{
+		op(0, Set, "a", "!", false, 0, 1),
+		op(1, Get, "", "", false, 5, 6),
+	}, true},
+	{"failed write seen late", []Op{
+		op(0, Set, "a", "", false, 0, 1),
+		op(0, Set, "b", "!", false, 2, 3),
+		op(1, Get, "", "b", true, 4, 5),
+		op(1, Get, "", "a", true, 6, 7),
+	}, false},
+}
+
+func TestCheck(t *testing.T) {
+	for _, h := range histories {
+		res := Check(h.ops)
+		if res.Linearizable != h.linearizable {
+			fmt.Printf("[!] %s: expected linearizable=%v\n", h.name,
+				h.linearizable)
+			t.FailNow()
+		}
+		if !res.Linearizable && res.Key != "k" {
+			fmt.Printf("[!] %s: bad key %q\n", h.name, res.Key)
+			t.FailNow()
+		}
+	}
+}
+
+func TestCheckKeys(t *testing.T) {
+	ops := []Op{
+		{Kind: Set, Key: "a", Value: "1", Call: 0, Return: 1},
+		{Kind: Get, Key: "b", Output: "1", OK: true, Call: 2, Return: 3},
+	}
+	res := Check(ops)
+	if res.Linearizable || res.Key != "b" {
+		fmt.Println("[!] keys were not checked independently")
+		t.FailNow()
+	}
+}
+
+// simClient adapts a simulated frontend to the Client interface.
+type simClient struct {
+	fe *sim.Frontend
+}
+
+func (c simClient) Get(key string) ([]byte, bool, error) {
+	return c.fe.Get(key)
+}
+
+func (c simClient) Set(key string, value []byte) ([]byte, bool, error) {
+	return c.fe.Set(key, value)
+}
+
+func (c simClient) Del(key string) ([]byte, bool, error) {
+	return c.fe.Delete(key)
+}
+
+func TestWorkload(t *testing.T) {
+	c, err := sim.New(sim.Options{Nodes: 3, Replicas: 3})
+	if err != nil {
+		fmt.Println("[!] failed to set up cluster:", err.Error())
+		t.FailNow()
+	}
+
+	// A single client sees every operation in order, so its history
+	// must be linearizable.
+	w := Workload{Ops: 200, Keys: 4, Prefix: "lin"}
+	h := w.Run([]Client{simClient{c.Frontend(0)}})
+	if len(h.Ops()) != 200 {
+		fmt.Println("[!] expected 200 operations, recorded", len(h.Ops()))
+		t.FailNow()
+	}
+	if res := Check(h.Ops()); !res.Linearizable {
+		fmt.Println("[!] sequential history is not linearizable:", res.Key)
+		for _, op := range res.Ops {
+			fmt.Println("\t", op)
+		}
+		t.FailNow()
+	}
+}
@@ -0,0 +1,59 @@
+package lincheck
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// Workload describes a random mix of operations run by concurrent
+// clients over a small set of keys, so that the clients contend for
+// them. Every value written is unique, so that a read identifies the
+// write it saw.
+type Workload struct {
+	// Ops is the number of operations each client performs.
+	Ops int
+
+	// Keys is the number of keys operated on; the keys are named from
+	// Prefix, which should be unique to the run so that every key starts
+	// out absent.
+	Keys   int
+	Prefix string
+
+	// Seed seeds each client's choice of operations.
+	Seed int64
+}
+
+// Run runs the workload with one goroutine per client, and returns
+// the history of their operations.
+func (w Workload) Run(clients []Client) *History {
+	if w.Keys < 1 {
+		w.Keys = 1
+	}
+	h := NewHistory()
+	wg := new(sync.WaitGroup)
+	for i, c := range clients {
+		wg.Add(1)
+		go func(id int, c Client) {
+			defer wg.Done()
+			w.run(id, h.Wrap(id, c))
+		}(i, c)
+	}
+	wg.Wait()
+	return h
+}
+
+func (w Workload) run(id int, c Client) {
+	rng := rand.New(rand.NewSource(w.Seed + int64(id)))
+	for i := 0; i < w.Ops; i++ {
+		key := fmt.Sprintf("%sk%d", w.Prefix, rng.Intn(w.Keys))
+		switch n := rng.Intn(10); {
+		case n < 5:
+			c.Get(key)
+		case n < 8:
+			c.Set(key, []byte(fmt.Sprintf("%d.%d", id, i)))
+		default:
+			c.Del(key)
+		}
+	}
+}
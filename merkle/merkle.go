@@ -0,0 +1,194 @@
+// Package merkle builds hash trees over ranges of the kludge token ring.
+// Two nodes replicating the same range can compare their trees to find
+// the subranges where their data differs without exchanging the data
+// itself.
+//
+// A tree of depth d divides its range into 2^d leaves. Each item in the
+// range is hashed with its version and folded into the leaf covering
+// its token with XOR, so items may be added in any order. Interior
+// nodes are the SHA-1 hash of their two children.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"github.com/gokyle/kludge/ring"
+)
+
+// DefaultDepth is the depth of the trees nodes exchange during
+// anti-entropy. Trees are built for each range owned by a virtual node,
+// so a small number of leaves per tree is sufficient.
+const DefaultDepth = 6
+
+// MaxDepth is the deepest tree that may be built.
+const MaxDepth = 16
+
+// Tree is a Merkle tree over a range of tokens. The hashes are stored
+// as a complete binary tree in a flat slice: the root is at index 0,
+// and the children of the node at i are at 2i+1 and 2i+2.
+type Tree struct {
+	Range  ring.Range
+	Depth  uint
+	Hashes [][]byte
+	sealed bool
+}
+
+// Digest returns the hash of a single item for inclusion in a tree.
+func Digest(key []byte, version uint64, deleted bool) []byte {
+	var meta [9]byte
+	binary.BigEndian.PutUint64(meta[:8], version)
+	if deleted {
+		meta[8] = 1
+	}
+	h := sha1.New()
+	h.Write(key)
+	h.Write(meta[:])
+	return h.Sum(nil)
+}
+
+// New returns an empty tree of the given depth over the range.
+func New(r ring.Range, depth uint) *Tree {
+	if depth > MaxDepth {
+		depth = MaxDepth
+	}
+	// Every leaf must cover at least one token.
+	for depth > 0 && uint64(1)<<depth > r.Size() {
+		depth--
+	}
+	t := &Tree{
+		Range:  r,
+		Depth:  depth,
+		Hashes: make([][]byte, (2<<depth)-1),
+	}
+	for i := range t.Hashes {
+		t.Hashes[i] = make([]byte, sha1.Size)
+	}
+	return t
+}
+
+func (t *Tree) leaves() uint64 {
+	return 1 << t.Depth
+}
+
+// leaf returns the index into t.Hashes of the leaf covering the token.
+func (t *Tree) leaf(token uint32) int {
+	offset := uint64(token - t.Range.Start)
+	idx := offset * t.leaves() / t.Range.Size()
+	return int(t.leaves() - 1 + idx)
+}
+
+// LeafRange returns the range of tokens covered by the i'th leaf.
+func (t *Tree) LeafRange(i int) ring.Range {
+	size := t.Range.Size()
+	n := t.leaves()
+	lo := (uint64(i)*size + n - 1) / n
+	hi := (uint64(i+1)*size + n - 1) / n
+	return ring.Range{
+		Start: t.Range.Start + uint32(lo),
+		End:   t.Range.Start + uint32(hi),
+	}
+}
+
+// Add folds an item's digest into the tree. Items whose tokens fall
+// outside the tree's range are ignored.
+func (t *Tree) Add(token uint32, digest []byte) {
+	if !t.Range.Contains(token) {
+		return
+	}
+	leaf := t.Hashes[t.leaf(token)]
+	for i := range leaf {
+		leaf[i] ^= digest[i]
+	}
+	t.sealed = false
+}
+
+// Seal computes the interior hashes of the tree. It must be called
+// after all items have been added and before the tree is compared.
+func (t *Tree) Seal() {
+	if t.sealed {
+		return
+	}
+	for i := int(t.leaves()) - 2; i >= 0; i-- {
+		h := sha1.New()
+		h.Write(t.Hashes[2*i+1])
+		h.Write(t.Hashes[2*i+2])
+		t.Hashes[i] = h.Sum(nil)
+	}
+	t.sealed = true
+}
+
+// Root returns the root hash of the tree.
+func (t *Tree) Root() []byte {
+	t.Seal()
+	return t.Hashes[0]
+}
+
+// Diff compares two trees over the same range, returning the ranges
+// of the leaves that differ. Adjacent differing leaves are merged into
+// a single range.
+func (t *Tree) Diff(other *Tree) (ranges []ring.Range, err error) {
+	if t.Range != other.Range || t.Depth != other.Depth {
+		err = fmt.Errorf("merkle: tree shapes differ (%s/%d and %s/%d)",
+			t.Range, t.Depth, other.Range, other.Depth)
+		return
+	}
+	t.Seal()
+	other.Seal()
+
+	first := int(t.leaves()) - 1
+	var walk func(i int)
+	walk = func(i int) {
+		if bytes.Equal(t.Hashes[i], other.Hashes[i]) {
+			return
+		}
+		if i >= first {
+			r := t.LeafRange(i - first)
+			if n := len(ranges); n > 0 && ranges[n-1].End == r.Start {
+				ranges[n-1].End = r.End
+			} else {
+				ranges = append(ranges, r)
+			}
+			return
+		}
+		walk(2*i + 1)
+		walk(2*i + 2)
+	}
+	walk(0)
+	return
+}
+
+// MarshalBinary encodes a sealed tree for transmission to another node.
+func (t *Tree) MarshalBinary() ([]byte, error) {
+	t.Seal()
+	buf := make([]byte, 9, 9+len(t.Hashes)*sha1.Size)
+	binary.BigEndian.PutUint32(buf[0:4], t.Range.Start)
+	binary.BigEndian.PutUint32(buf[4:8], t.Range.End)
+	buf[8] = byte(t.Depth)
+	for _, h := range t.Hashes {
+		buf = append(buf, h...)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a tree produced by MarshalBinary.
+func (t *Tree) UnmarshalBinary(data []byte) error {
+	if len(data) < 9 || data[8] > MaxDepth {
+		return fmt.Errorf("merkle: invalid tree encoding")
+	}
+	r := ring.Range{
+		Start: binary.BigEndian.Uint32(data[0:4]),
+		End:   binary.BigEndian.Uint32(data[4:8]),
+	}
+	*t = *New(r, uint(data[8]))
+	data = data[9:]
+	if len(data) != len(t.Hashes)*sha1.Size {
+		return fmt.Errorf("merkle: invalid tree encoding")
+	}
+	for i := range t.Hashes {
+		copy(t.Hashes[i], data[i*sha1.Size:])
+	}
+	t.sealed = true
+	return nil
+}
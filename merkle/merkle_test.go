@@ -0,0 +1,108 @@
+package merkle
+
+import (
+	"fmt"
+	"github.com/gokyle/kludge/ring"
+	"testing"
+)
+
+func fill(t *Tree, keys map[string]uint64) {
+	for k, v := range keys {
+		t.Add(ring.Token([]byte(k)), Digest([]byte(k), v, false))
+	}
+}
+
+func TestIdenticalTrees(t *testing.T) {
+	keys := map[string]uint64{"foo": 1, "bar": 2, "baz": 3}
+	a := New(ring.Range{}, DefaultDepth)
+	b := New(ring.Range{}, DefaultDepth)
+	fill(a, keys)
+	fill(b, keys)
+
+	diffs, err := a.Diff(b)
+	if err != nil {
+		fmt.Println("[!] diff failed:", err.Error())
+		t.FailNow()
+	} else if len(diffs) != 0 {
+		fmt.Println("[!] identical trees differ:", diffs)
+		t.FailNow()
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := New(ring.Range{}, DefaultDepth)
+	b := New(ring.Range{}, DefaultDepth)
+	fill(a, map[string]uint64{"foo": 1, "bar": 2, "baz": 3})
+	fill(b, map[string]uint64{"foo": 1, "bar": 5, "quux": 3})
+
+	diffs, err := a.Diff(b)
+	if err != nil {
+		fmt.Println("[!] diff failed:", err.Error())
+		t.FailNow()
+	}
+	for _, k := range []string{"bar", "baz", "quux"} {
+		token := ring.Token([]byte(k))
+		found := false
+		for _, r := range diffs {
+			found = found || r.Contains(token)
+		}
+		if !found {
+			fmt.Printf("[!] %s not in differing ranges\n", k)
+			t.FailNow()
+		}
+	}
+}
+
+func TestLeafRanges(t *testing.T) {
+	tree := New(ring.Range{Start: 0xfffff000, End: 0x1000}, 4)
+	var total uint64
+	next := tree.Range.Start
+	for i := 0; i < 16; i++ {
+		r := tree.LeafRange(i)
+		if r.Start != next {
+			fmt.Printf("[!] leaf %d starts at %x, expected %x\n", i,
+				r.Start, next)
+			t.FailNow()
+		}
+		next = r.End
+		total += r.Size()
+	}
+	if next != tree.Range.End || total != tree.Range.Size() {
+		fmt.Println("[!] leaves don't cover the range")
+		t.FailNow()
+	}
+}
+
+func TestSmallRange(t *testing.T) {
+	tree := New(ring.Range{Start: 100, End: 104}, DefaultDepth)
+	if tree.Depth != 2 {
+		fmt.Printf("[!] expected depth 2 for 4 tokens, got %d\n",
+			tree.Depth)
+		t.FailNow()
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	a := New(ring.Range{Start: 5, End: 1 << 20}, DefaultDepth)
+	fill(a, map[string]uint64{"foo": 1, "bar": 2, "baz": 3})
+	data, err := a.MarshalBinary()
+	if err != nil {
+		fmt.Println("[!] marshal failed:", err.Error())
+		t.FailNow()
+	}
+
+	b := new(Tree)
+	if err = b.UnmarshalBinary(data); err != nil {
+		fmt.Println("[!] unmarshal failed:", err.Error())
+		t.FailNow()
+	}
+	if diffs, err := a.Diff(b); err != nil || len(diffs) != 0 {
+		fmt.Println("[!] decoded tree differs from original")
+		t.FailNow()
+	}
+
+	if err = b.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		fmt.Println("[!] expected error for truncated tree")
+		t.FailNow()
+	}
+}
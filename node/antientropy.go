@@ -0,0 +1,183 @@
+package node
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"github.com/gokyle/kludge/merkle"
+	"github.com/gokyle/kludge/ring"
+	"time"
+)
+
+// antiEntropy periodically compares the node's data with the other
+// replicas of each range it holds, and pulls any newer records it is
+// missing. Since every node does the same, replicas converge even if
+// writes and read repairs were lost while a node was down.
+func (n *Node) antiEntropy() {
+	if n.ring == nil {
+		return
+	}
+	n.every(n.cfg.AntiEntropy, func() {
+		start := time.Now()
+		pulled := n.SyncReplicas()
+		n.logger.Printf("anti-entropy pulled %d records in %s", pulled,
+			time.Since(start))
+	})
+}
+
+// SyncReplicas runs one round of anti-entropy with every peer that
+// shares a range with this node, returning the number of records
+// pulled.
+func (n *Node) SyncReplicas() (pulled int) {
+	if n.ring == nil {
+		return
+	}
+	shared := make(map[string][]ring.Range, 0)
+	peers := make(map[string]ring.Node, 0)
+	for _, seg := range n.ring.Replicated(n.cfg.ID, n.cfg.Replicas) {
+		for _, peer := range seg.Nodes {
+			if peer.ID == n.cfg.ID {
+				continue
+			}
+			peers[peer.ID] = peer
+			shared[peer.ID] = append(shared[peer.ID], seg.Range)
+		}
+	}
+
+	for id, ranges := range shared {
+		p, err := n.syncPeer(peers[id], ranges)
+		if err != nil {
+			n.logger.Printf("anti-entropy with %s failed: %s", id,
+				err.Error())
+		}
+		pulled += p
+	}
+	n.stats.Add("records_pulled", int64(pulled))
+	return
+}
+
+// findRange returns the index of the range containing the token, or
+// -1 if no range contains it.
+func findRange(ranges []ring.Range, token uint32) int {
+	for i := range ranges {
+		if ranges[i].Contains(token) {
+			return i
+		}
+	}
+	return -1
+}
+
+// buildTrees builds the local Merkle tree for each range in a single
+// pass over the store.
+func (n *Node) buildTrees(ranges []ring.Range) (trees []*merkle.Tree, err error) {
+	trees = make([]*merkle.Tree, len(ranges))
+	for i := range ranges {
+		trees[i] = merkle.New(ranges[i], merkle.DefaultDepth)
+	}
+
+	err = n.scan(func(key []byte, rec *record) {
+		token := ring.Token(key)
+		if i := findRange(ranges, token); i >= 0 {
+			trees[i].Add(token, merkle.Digest(key, rec.Version,
+				rec.Deleted))
+		}
+	})
+	return
+}
+
+// syncPeer compares the local trees for the ranges shared with a peer
+// with the peer's trees, and pulls the peer's records for every key in
+// a differing subrange that is newer on the peer.
+func (n *Node) syncPeer(peer ring.Node, ranges []ring.Range) (pulled int, err error) {
+	local, err := n.buildTrees(ranges)
+	if err != nil {
+		return
+	}
+
+	resp, err := n.send(peer.Addr, &common.Operation{
+		OpCode: common.OpTree,
+		Ranges: ranges,
+	})
+	if err != nil {
+		return
+	}
+	var encoded [][]byte
+	err = gob.NewDecoder(bytes.NewBuffer(resp.Body)).Decode(&encoded)
+	if err != nil {
+		return
+	} else if len(encoded) != len(local) {
+		err = fmt.Errorf("expected %d trees, received %d", len(local),
+			len(encoded))
+		return
+	}
+
+	var diffs []ring.Range
+	for i := range local {
+		remote := new(merkle.Tree)
+		if err = remote.UnmarshalBinary(encoded[i]); err != nil {
+			return
+		}
+		d, err := local[i].Diff(remote)
+		if err != nil {
+			return pulled, err
+		}
+		diffs = append(diffs, d...)
+	}
+	if len(diffs) == 0 {
+		return
+	}
+	return n.pullRanges(peer, diffs)
+}
+
+func (n *Node) pullRanges(peer ring.Node, ranges []ring.Range) (pulled int, err error) {
+	resp, err := n.send(peer.Addr, &common.Operation{
+		OpCode: common.OpVers,
+		Ranges: ranges,
+	})
+	if err != nil {
+		return
+	}
+	var vers []common.KeyVersion
+	err = gob.NewDecoder(bytes.NewBuffer(resp.Body)).Decode(&vers)
+	if err != nil {
+		return
+	}
+
+	for _, kv := range vers {
+		cur, err := n.readRecord(kv.Key)
+		if err != nil {
+			return pulled, err
+		} else if cur != nil && cur.Version >= kv.Version {
+			continue
+		}
+		if err = n.pullKey(peer, kv.Key); err != nil {
+			return pulled, err
+		}
+		pulled++
+	}
+	return
+}
+
+// pullKey fetches the peer's record for the key and applies it locally.
+func (n *Node) pullKey(peer ring.Node, key []byte) error {
+	resp, err := n.send(peer.Addr, &common.Operation{
+		OpCode: common.OpGet,
+		Key:    key,
+	})
+	if err != nil {
+		return err
+	} else if resp.Version == 0 {
+		return nil
+	}
+
+	rec := &record{
+		Version: resp.Version,
+		Deleted: !resp.KeyOK,
+		Type:    resp.Type,
+		Val:     resp.Body,
+	}
+	defer n.lockKey(key).Unlock()
+	_, _, err = n.applyRecord(key, rec)
+	return err
+}
@@ -0,0 +1,384 @@
+package node
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A backup archive begins with backupMagic, followed by a gzip stream
+// holding the archive's metadata as a length-prefixed JSON BackupInfo,
+// then every key and value in the store, each marked by backupRecord
+// and prefixed with its length. The stream ends with backupEnd, the
+// number of records and the SHA-256 digest of everything in the stream
+// before it.
+const (
+	backupMagic  = "KLUDGE-BACKUP 1\n"
+	backupRecord = 1
+	backupEnd    = 0
+)
+
+// BackupInfo describes a backup archive: the node it was taken from,
+// the version of kludge that took it and when. Records and Checksum
+// are only known once the archive has been written or read in full.
+type BackupInfo struct {
+	NodeID   string    `json:"node_id"`
+	Addr     string    `json:"addr,omitempty"`
+	Version  string    `json:"version"`
+	Created  time.Time `json:"created"`
+	Records  int64     `json:"records,omitempty"`
+	Checksum string    `json:"checksum,omitempty"`
+}
+
+// backupState holds the status of the last backup started through an
+// OpBackup. Only one runs at a time.
+type backupState struct {
+	sync.Mutex
+	status common.BackupStatus
+}
+
+// hashWriter passes writes on while hashing them and counting bytes.
+type hashWriter struct {
+	w io.Writer
+	h hash.Hash
+	n int64
+}
+
+func (hw *hashWriter) Write(p []byte) (int, error) {
+	hw.h.Write(p)
+	hw.n += int64(len(p))
+	return hw.w.Write(p)
+}
+
+func writeUvarint(w io.Writer, x uint64) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	_, err := w.Write(buf[:binary.PutUvarint(buf, x)])
+	return err
+}
+
+// Backup writes an archive of everything the node stores to w, taken
+// from a consistent snapshot of its store while it goes on serving
+// requests. The store must be a Snapshotter.
+func (n *Node) Backup(w io.Writer) (info *BackupInfo, err error) {
+	snapper, ok := n.store.(Snapshotter)
+	if !ok {
+		return nil, fmt.Errorf("node: the store does not support snapshots")
+	}
+	info = &BackupInfo{
+		NodeID:  n.cfg.ID,
+		Addr:    n.cfg.Addr,
+		Version: common.Version(),
+		Created: n.clock(),
+	}
+	snap, err := snapper.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+
+	if _, err = io.WriteString(w, backupMagic); err != nil {
+		return nil, err
+	}
+	zw := gzip.NewWriter(w)
+	hw := &hashWriter{w: zw, h: sha256.New()}
+	header, err := json.Marshal(info)
+	if err == nil {
+		err = writeUvarint(hw, uint64(len(header)))
+	}
+	if err == nil {
+		_, err = hw.Write(header)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var werr error
+	err = snap.Iterate(nil, func(key, value []byte) bool {
+		_, werr = hw.Write([]byte{backupRecord})
+		if werr == nil {
+			werr = writeUvarint(hw, uint64(len(key)))
+		}
+		if werr == nil {
+			_, werr = hw.Write(key)
+		}
+		if werr == nil {
+			werr = writeUvarint(hw, uint64(len(value)))
+		}
+		if werr == nil {
+			_, werr = hw.Write(value)
+		}
+		if werr != nil {
+			return false
+		}
+		info.Records++
+		return true
+	})
+	if err == nil {
+		err = werr
+	}
+	if err == nil {
+		_, err = hw.Write([]byte{backupEnd})
+	}
+	if err == nil {
+		err = writeUvarint(hw, uint64(info.Records))
+	}
+	if err != nil {
+		return nil, err
+	}
+	sum := hw.h.Sum(nil)
+	if _, err = zw.Write(sum); err != nil {
+		return nil, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	info.Checksum = hex.EncodeToString(sum)
+	return info, nil
+}
+
+// hashReader hashes what is read through it.
+type hashReader struct {
+	r *bufio.Reader
+	h hash.Hash
+}
+
+func (hr *hashReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	return n, err
+}
+
+func (hr *hashReader) ReadByte() (byte, error) {
+	c, err := hr.r.ReadByte()
+	if err == nil {
+		hr.h.Write([]byte{c})
+	}
+	return c, err
+}
+
+func readChunk(hr *hashReader, max uint64) ([]byte, error) {
+	size, err := binary.ReadUvarint(hr)
+	if err != nil {
+		return nil, err
+	} else if size > max {
+		return nil, fmt.Errorf("node: invalid backup archive")
+	}
+	buf := make([]byte, size)
+	_, err = io.ReadFull(hr, buf)
+	return buf, err
+}
+
+// maxBackupChunk bounds the length of the header, keys and values read
+// from an archive, so that a corrupt length is caught before it is
+// allocated.
+const maxBackupChunk = 1 << 30
+
+// Restore writes the records in a backup archive to a store, in
+// batches, checking the archive's checksum once every record has been
+// read. A store restored from an archive that fails to verify holds
+// some of its records and should be discarded.
+func Restore(r io.Reader, store Store) (info *BackupInfo, err error) {
+	magic := make([]byte, len(backupMagic))
+	if _, err = io.ReadFull(r, magic); err != nil {
+		return nil, err
+	} else if string(magic) != backupMagic {
+		return nil, fmt.Errorf("node: not a backup archive")
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	hr := &hashReader{r: bufio.NewReader(zr), h: sha256.New()}
+
+	header, err := readChunk(hr, maxBackupChunk)
+	if err != nil {
+		return nil, err
+	}
+	info = new(BackupInfo)
+	if err = json.Unmarshal(header, info); err != nil {
+		return nil, err
+	}
+
+	batch := new(Batch)
+	size := 0
+	for {
+		var mark byte
+		if mark, err = hr.ReadByte(); err != nil {
+			return nil, err
+		} else if mark == backupEnd {
+			break
+		} else if mark != backupRecord {
+			return nil, fmt.Errorf("node: invalid backup archive")
+		}
+
+		var key, value []byte
+		if key, err = readChunk(hr, maxBackupChunk); err != nil {
+			return nil, err
+		}
+		if value, err = readChunk(hr, maxBackupChunk); err != nil {
+			return nil, err
+		}
+		batch.Put(key, value)
+		info.Records++
+		size += len(key) + len(value)
+		if batch.Len() >= 1024 || size >= 4<<20 {
+			if err = store.Write(batch); err != nil {
+				return nil, err
+			}
+			batch, size = new(Batch), 0
+		}
+	}
+	if batch.Len() > 0 {
+		if err = store.Write(batch); err != nil {
+			return nil, err
+		}
+	}
+
+	count, err := binary.ReadUvarint(hr)
+	if err != nil {
+		return nil, err
+	}
+	expected := hr.h.Sum(nil)
+	sum := make([]byte, sha256.Size)
+	if _, err = io.ReadFull(hr.r, sum); err != nil {
+		return nil, err
+	}
+	if count != uint64(info.Records) || !bytes.Equal(sum, expected) {
+		return nil, fmt.Errorf("node: backup archive failed to verify")
+	}
+	info.Checksum = hex.EncodeToString(sum)
+	return info, nil
+}
+
+// backupName returns the default name of an archive taken now.
+func (n *Node) backupName() string {
+	id := strings.Map(func(r rune) rune {
+		if r == '/' || r == ':' || r == filepath.Separator {
+			return '_'
+		}
+		return r
+	}, n.cfg.ID)
+	if id == "" {
+		id = "node"
+	}
+	return fmt.Sprintf("%s-%s.kbk", id, n.clock().UTC().Format("20060102T150405Z"))
+}
+
+// store_backup starts a backup to the archive named by op.Key in the
+// node's backup directory, or to a name made up of the node's ID and
+// the time if Key is empty. The archive is written in the background,
+// under a temporary name until it is complete; its progress is
+// reported by an OpBackupStatus. An existing archive is only replaced
+// if op.Val is common.BackupOverwrite.
+func (n *Node) store_backup(op *common.Operation) (resp *common.Response) {
+	resp = new(common.Response)
+	name := string(op.Key)
+	if name == "" {
+		name = n.backupName()
+	}
+	overwrite := string(op.Val) == common.BackupOverwrite
+	switch {
+	case n.cfg.BackupDir == "":
+		resp.ErrMsg = "backups are not configured"
+	case name != filepath.Base(name) || strings.HasPrefix(name, "."):
+		resp.ErrMsg = "invalid backup name " + name
+	}
+	if resp.ErrMsg != "" {
+		return
+	}
+	path := filepath.Join(n.cfg.BackupDir, name)
+	if _, err := os.Lstat(path); err == nil && !overwrite {
+		resp.ErrMsg = "backup archive " + name + " already exists"
+		return
+	}
+
+	n.backup.Lock()
+	defer n.backup.Unlock()
+	if n.backup.status.Running {
+		resp.ErrMsg = "a backup is already running"
+		return
+	}
+	n.backup.status = common.BackupStatus{
+		Path:    path,
+		Running: true,
+		Started: n.clock(),
+	}
+	go n.runBackup(path, overwrite)
+	n.stats.Add("backups", 1)
+	resp.Body, _ = json.Marshal(n.backup.status)
+	return
+}
+
+// runBackup writes an archive to path, recording the outcome in the
+// backup status. Unless overwrite is set, it fails rather than replace
+// an archive already at path.
+func (n *Node) runBackup(path string, overwrite bool) {
+	var info *BackupInfo
+	var size int64
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		bw := bufio.NewWriter(f)
+		info, err = n.Backup(bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err == nil {
+			err = f.Sync()
+		}
+		if fi, serr := f.Stat(); serr == nil {
+			size = fi.Size()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil && overwrite {
+			err = os.Rename(tmp, path)
+		} else if err == nil {
+			// A link, unlike a rename, fails if the archive has
+			// been created since the backup began.
+			err = os.Link(tmp, path)
+		}
+		if err != nil || !overwrite {
+			os.Remove(tmp)
+		}
+	}
+
+	n.backup.Lock()
+	defer n.backup.Unlock()
+	n.backup.status.Running = false
+	n.backup.status.Finished = n.clock()
+	n.backup.status.Bytes = size
+	if err != nil {
+		n.stats.Add("backup_failures", 1)
+		n.backup.status.Err = err.Error()
+		n.logger.Printf("backup to %s failed: %s", path, err.Error())
+		return
+	}
+	n.backup.status.Records = info.Records
+	n.backup.status.Checksum = info.Checksum
+	n.logger.Printf("backed up %d records to %s", info.Records, path)
+}
+
+// store_backup_status reports on the last backup started.
+func (n *Node) store_backup_status(op *common.Operation) (resp *common.Response) {
+	resp = new(common.Response)
+	n.backup.Lock()
+	resp.Body, _ = json.Marshal(n.backup.status)
+	n.backup.Unlock()
+	return
+}
@@ -0,0 +1,189 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"sync"
+	"time"
+)
+
+// Every write the node applies is appended to its change log, in the
+// same batch as the write itself, under the log prefix followed by its
+// sequence number. Sequence numbers start at one and have no gaps; the
+// next one to be assigned is kept under logSeqKey so that numbering
+// resumes after a restart. Entries older than the retention window are
+// trimmed from the front of the log. Entries hold keys, not values: the
+// log says what changed and when, and the value is read from the store.
+var (
+	logPrefix = []byte("\x00log/")
+	logSeqKey = []byte("\x00logseq")
+)
+
+// logState guards the assignment of sequence numbers; the lock is held
+// while each entry is written, so that entries appear in order.
+type logState struct {
+	sync.Mutex
+	next uint64
+}
+
+// A log entry holds the change's flags, version, the time it was
+// applied and the key.
+const logEntryHeaderLen = 17
+
+func logKey(seq uint64) []byte {
+	key := make([]byte, len(logPrefix)+8)
+	copy(key, logPrefix)
+	binary.BigEndian.PutUint64(key[len(logPrefix):], seq)
+	return key
+}
+
+func encodeLogEntry(key []byte, rec *record, applied time.Time) []byte {
+	data := make([]byte, logEntryHeaderLen+len(key))
+	if rec.Deleted {
+		data[0] |= recordDeleted
+	}
+	binary.BigEndian.PutUint64(data[1:9], rec.Version)
+	binary.BigEndian.PutUint64(data[9:17], uint64(applied.UnixNano()))
+	copy(data[logEntryHeaderLen:], key)
+	return data
+}
+
+func decodeLogEntry(logkey, data []byte) (c common.Change, applied time.Time, err error) {
+	if len(logkey) != len(logPrefix)+8 || len(data) < logEntryHeaderLen {
+		err = fmt.Errorf("invalid log entry %q", logkey)
+		return
+	}
+	c = common.Change{
+		Seq:     binary.BigEndian.Uint64(logkey[len(logPrefix):]),
+		Key:     append([]byte{}, data[logEntryHeaderLen:]...),
+		Version: binary.BigEndian.Uint64(data[1:9]),
+		Deleted: data[0]&recordDeleted != 0,
+	}
+	applied = time.Unix(0, int64(binary.BigEndian.Uint64(data[9:17])))
+	return
+}
+
+// initLog picks up the log's numbering where a previous run left it.
+func (n *Node) initLog() error {
+	n.log.next = 1
+	data, err := n.store.Get(logSeqKey)
+	if err != nil {
+		return err
+	} else if data != nil {
+		if len(data) != 8 {
+			return fmt.Errorf("node: invalid log sequence number")
+		}
+		n.log.next = binary.BigEndian.Uint64(data)
+	}
+	n.stats.Add("log_trimmed", 0)
+	return nil
+}
+
+// writeLogged writes a batch, appending a change to the log with it,
+// along with any changes the write makes to the namespaces' usage.
+func (n *Node) writeLogged(batch *Batch, key []byte, rec *record, changes ...common.Usage) error {
+	n.log.Lock()
+	defer n.log.Unlock()
+	batch.Put(logKey(n.log.next), encodeLogEntry(key, rec, n.clock()))
+	next := make([]byte, 8)
+	binary.BigEndian.PutUint64(next, n.log.next+1)
+	batch.Put(logSeqKey, next)
+	if err := n.writeUsage(batch, changes...); err != nil {
+		return err
+	}
+	n.log.next++
+	return nil
+}
+
+func (n *Node) trimLogs() {
+	n.every(n.cfg.LogTrim, func() {
+		if trimmed := n.TrimLog(); trimmed > 0 {
+			n.logger.Printf("trimmed %d log entries", trimmed)
+		}
+	})
+}
+
+// TrimLog removes the log entries older than the retention window,
+// returning the number removed.
+func (n *Node) TrimLog() (trimmed int) {
+	cutoff := n.clock().Add(-n.cfg.LogRetention)
+	batch := new(Batch)
+	flush := func() bool {
+		if batch.Len() == 0 {
+			return true
+		}
+		if err := n.store.Write(batch); err != nil {
+			n.logger.Printf("failed to trim the change log: %s", err.Error())
+			return false
+		}
+		trimmed += batch.Len()
+		n.stats.Add("log_trimmed", int64(batch.Len()))
+		batch = new(Batch)
+		return true
+	}
+
+	err := n.scanPrefix(logPrefix, func(key, value []byte) bool {
+		_, applied, err := decodeLogEntry(key, value)
+		if err == nil && !applied.Before(cutoff) {
+			return false
+		}
+		batch.Delete(append([]byte{}, key...))
+		return batch.Len() < n.cfg.ScanPageSize || flush()
+	})
+	if err != nil {
+		n.logger.Printf("failed to trim the change log: %s", err.Error())
+	}
+	flush()
+	return
+}
+
+// store_log returns a page of the log's entries, starting at the
+// sequence number in op.Version. The response's Version is the number
+// the next change will be given; a reader whose entries begin later
+// than it asked, or who receives none though it asked for an earlier
+// number, has missed the changes trimmed in between.
+func (n *Node) store_log(op *common.Operation) (resp *common.Response) {
+	resp = new(common.Response)
+	limit := op.Limit
+	if limit <= 0 {
+		limit = n.cfg.ScanPageSize
+	}
+	start := op.Version
+	if start == 0 {
+		start = 1
+	}
+
+	n.log.Lock()
+	resp.Version = n.log.next
+	n.log.Unlock()
+
+	changes := make([]common.Change, 0)
+	err := n.store.Iterate(logKey(start), func(key, value []byte) bool {
+		if !bytes.HasPrefix(key, logPrefix) {
+			return false
+		}
+		c, _, err := decodeLogEntry(key, value)
+		if err != nil {
+			n.logger.Printf("skipping log entry: %s", err.Error())
+			return true
+		} else if c.Seq >= resp.Version {
+			return false
+		}
+		changes = append(changes, c)
+		return len(changes) < limit
+	})
+	if err == nil {
+		buf := new(bytes.Buffer)
+		err = gob.NewEncoder(buf).Encode(changes)
+		resp.Body = buf.Bytes()
+	}
+	if err != nil {
+		n.logger.Printf("worker %d failed to read the change log: %s",
+			op.WID, err.Error())
+		resp.ErrMsg = err.Error()
+	}
+	return
+}
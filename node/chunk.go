@@ -0,0 +1,153 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Values larger than the chunk size are split into chunks, which are
+// stored under the chunk prefix, followed by the key, a NUL byte, and
+// the version of the write and the chunk's index. The key's record
+// then holds a manifest in place of the value. Since client keys may
+// not contain NUL, no key's chunks are a prefix of another's.
+//
+// A write stores the new chunks, the manifest and the removal of the
+// old chunks in a single batch. Each write's chunks are kept under its
+// own version, so a reader that finds chunks missing has raced with a
+// later write and reads the key again; it never sees a mix of two
+// values.
+var chunkPrefix = []byte("\x00chunk/")
+
+var errChunkMissing = errors.New("chunk missing")
+
+// A manifest describes a chunked value.
+type manifest struct {
+	Size   uint64
+	Chunks uint32
+}
+
+const manifestLen = 12
+
+func (m *manifest) Encode() []byte {
+	data := make([]byte, manifestLen)
+	binary.BigEndian.PutUint64(data[:8], m.Size)
+	binary.BigEndian.PutUint32(data[8:], m.Chunks)
+	return data
+}
+
+func decodeManifest(data []byte) (m *manifest, err error) {
+	if len(data) != manifestLen {
+		return nil, fmt.Errorf("invalid chunk manifest (%d bytes)", len(data))
+	}
+	m = &manifest{
+		Size:   binary.BigEndian.Uint64(data[:8]),
+		Chunks: binary.BigEndian.Uint32(data[8:]),
+	}
+	return
+}
+
+func chunkKey(key []byte, version uint64, i uint32) []byte {
+	ck := make([]byte, 0, len(chunkPrefix)+len(key)+13)
+	ck = append(ck, chunkPrefix...)
+	ck = append(ck, key...)
+	ck = append(ck, 0)
+	var suffix [12]byte
+	binary.BigEndian.PutUint64(suffix[:8], version)
+	binary.BigEndian.PutUint32(suffix[8:], i)
+	return append(ck, suffix[:]...)
+}
+
+// putChunks adds the writes of a record to the batch, splitting its
+// value into chunks if it is too large to be stored whole.
+func (n *Node) putChunks(batch *Batch, key []byte, rec *record) {
+	size := n.cfg.ChunkSize
+	if rec.Deleted || len(rec.Val) <= size {
+		batch.Put(key, rec.Encode())
+		return
+	}
+
+	m := &manifest{Size: uint64(len(rec.Val))}
+	for off := 0; off < len(rec.Val); off += size {
+		end := off + size
+		if end > len(rec.Val) {
+			end = len(rec.Val)
+		}
+		batch.Put(chunkKey(key, rec.Version, m.Chunks), rec.Val[off:end])
+		m.Chunks++
+	}
+	manifestRec := &record{
+		Version: rec.Version,
+		Chunked: true,
+		Type:    rec.Type,
+		Val:     m.Encode(),
+	}
+	batch.Put(key, manifestRec.Encode())
+	n.stats.Add("chunked_writes", 1)
+}
+
+// deleteChunks adds the removal of a chunked record's chunks to the
+// batch; it does nothing for a record held whole.
+func (n *Node) deleteChunks(batch *Batch, key []byte, rec *record) error {
+	if rec == nil || !rec.Chunked {
+		return nil
+	}
+	m, err := decodeManifest(rec.Val)
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < m.Chunks; i++ {
+		batch.Delete(chunkKey(key, rec.Version, i))
+	}
+	return nil
+}
+
+// readChunks reassembles the value of a chunked record.
+func (n *Node) readChunks(key []byte, rec *record) (*record, error) {
+	m, err := decodeManifest(rec.Val)
+	if err != nil {
+		return nil, err
+	}
+	val := make([]byte, 0, int(m.Size))
+	for i := uint32(0); i < m.Chunks; i++ {
+		chunk, err := n.store.Get(chunkKey(key, rec.Version, i))
+		if err != nil {
+			return nil, err
+		} else if chunk == nil {
+			return nil, errChunkMissing
+		}
+		val = append(val, chunk...)
+	}
+	if uint64(len(val)) != m.Size {
+		return nil, fmt.Errorf("chunked value is %d bytes, expected %d",
+			len(val), m.Size)
+	}
+	return &record{Version: rec.Version, Type: rec.Type, Val: val}, nil
+}
+
+// loadRecord returns the full record for one read from the store,
+// reassembling its value if it was chunked.
+func (n *Node) loadRecord(key []byte, rec *record) (*record, error) {
+	if rec == nil || !rec.Chunked {
+		return rec, nil
+	}
+	full, err := n.readChunks(key, rec)
+	if err != errChunkMissing {
+		return full, err
+	}
+
+	// The record has been replaced since it was read. If the key's
+	// record is still the one read, its chunks are really missing.
+	data, err := n.store.Get(key)
+	if err != nil {
+		return nil, err
+	} else if bytes.Equal(data, rec.Encode()) {
+		return nil, fmt.Errorf("key %q: %s", key, errChunkMissing.Error())
+	}
+	cur, err := decodeRecord(data)
+	if err != nil {
+		return nil, err
+	}
+	return n.loadRecord(key, cur)
+}
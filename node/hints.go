@@ -0,0 +1,206 @@
+package node
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"sync"
+)
+
+// Hints are stored under the hint prefix, followed by the target
+// node's ID, the version of the write, and the key, so that the hints
+// for each target are replayed in the order they were written.
+var hintPrefix = []byte("\x00hint/")
+
+var errHintsFull = errors.New("hint storage is full")
+
+type hintState struct {
+	sync.Mutex
+	bytes *expvar.Int
+	count *expvar.Int
+
+	// delivering holds the targets whose hints are being delivered, so
+	// that no hint is sent twice by overlapping deliveries.
+	delivering map[string]bool
+}
+
+func hintKey(h *common.Hint) []byte {
+	key := make([]byte, 0, len(hintPrefix)+len(h.Target.ID)+18+len(h.Op.Key))
+	key = append(key, hintPrefix...)
+	key = append(key, h.Target.ID...)
+	key = append(key, fmt.Sprintf("/%016x/", h.Op.Version)...)
+	return append(key, h.Op.Key...)
+}
+
+// scanPrefix calls fn with every key and value beginning with prefix,
+// stopping early if fn returns false.
+func (n *Node) scanPrefix(prefix []byte, fn func(key, value []byte) bool) error {
+	return n.store.Iterate(prefix, func(key, value []byte) bool {
+		return bytes.HasPrefix(key, prefix) && fn(key, value)
+	})
+}
+
+// initHints counts the hints left over from a previous run.
+func (n *Node) initHints() {
+	n.hints.count = new(expvar.Int)
+	n.hints.bytes = new(expvar.Int)
+	n.hints.delivering = make(map[string]bool, 0)
+	n.stats.Set("hints", n.hints.count)
+	n.stats.Set("hint_bytes", n.hints.bytes)
+	n.stats.Add("hints_replayed", 0)
+	n.stats.Add("hints_dropped", 0)
+
+	err := n.scanPrefix(hintPrefix, func(key, value []byte) bool {
+		n.hints.count.Add(1)
+		n.hints.bytes.Add(int64(len(value)))
+		return true
+	})
+	if err != nil {
+		n.logger.Printf("failed to load hints: %s", err.Error())
+	} else if n.hints.count.Value() > 0 {
+		n.logger.Printf("%d hints (%d bytes) awaiting delivery",
+			n.hints.count.Value(), n.hints.bytes.Value())
+	}
+}
+
+// Hints returns the number of hints awaiting delivery.
+func (n *Node) Hints() int64 {
+	return n.hints.count.Value()
+}
+
+// store_hint stores a write for another node. Hints are refused once
+// the hint storage limit is reached, in which case the frontend looks
+// for another node to take the hint; if none will, the replica must be
+// repaired by anti-entropy instead.
+func (n *Node) store_hint(op *common.Operation) (resp *common.Response) {
+	resp = new(common.Response)
+	hint := new(common.Hint)
+	err := gob.NewDecoder(bytes.NewBuffer(op.Val)).Decode(hint)
+	if err != nil {
+		n.logger.Printf("worker %d received invalid hint: %s", op.WID,
+			err.Error())
+		resp.ErrMsg = err.Error()
+		return
+	}
+
+	n.hints.Lock()
+	defer n.hints.Unlock()
+	if n.hints.bytes.Value()+int64(len(op.Val)) > n.cfg.MaxHintBytes {
+		n.stats.Add("hints_dropped", 1)
+		resp.ErrMsg = errHintsFull.Error()
+		return
+	}
+
+	if err = n.store.Put(hintKey(hint), op.Val); err != nil {
+		n.logger.Printf("worker %d failed to store hint: %s", op.WID,
+			err.Error())
+		resp.ErrMsg = err.Error()
+		return
+	}
+	n.hints.count.Add(1)
+	n.hints.bytes.Add(int64(len(op.Val)))
+	n.logger.Printf("worker %d stored hint for %s", op.WID, hint.Target.ID)
+	return
+}
+
+// replayHints periodically attempts to deliver stored hints.
+func (n *Node) replayHints() {
+	n.every(n.cfg.HintReplay, func() {
+		if n.hints.count.Value() > 0 {
+			n.DeliverHints()
+		}
+	})
+}
+
+// claimHintTarget marks a target's hints as being delivered,
+// returning false if another delivery to it is under way.
+func (n *Node) claimHintTarget(id string) bool {
+	n.hints.Lock()
+	defer n.hints.Unlock()
+	if n.hints.delivering[id] {
+		return false
+	}
+	n.hints.delivering[id] = true
+	return true
+}
+
+// releaseHintTargets ends the deliveries to the targets claimed.
+func (n *Node) releaseHintTargets(claimed map[string]bool) {
+	n.hints.Lock()
+	defer n.hints.Unlock()
+	for id := range claimed {
+		delete(n.hints.delivering, id)
+	}
+}
+
+// DeliverHints sends each stored hint to its target, returning the
+// number delivered. Once a delivery to a target fails, its remaining
+// hints are left for the next attempt. Only one delivery to a target
+// runs at a time: a target whose hints are being delivered already is
+// skipped, and released once its delivered hints are removed.
+func (n *Node) DeliverHints() int {
+	var delivered [][]byte
+	var size int64
+	down := make(map[string]bool, 0)
+	claimed := make(map[string]bool, 0)
+	defer n.releaseHintTargets(claimed)
+
+	err := n.scanPrefix(hintPrefix, func(key, value []byte) bool {
+		// Invalid hints are discarded under the empty target, so
+		// that they too are only removed once.
+		hint := new(common.Hint)
+		err := gob.NewDecoder(bytes.NewBuffer(value)).Decode(hint)
+		id := hint.Target.ID
+		if err != nil {
+			id = ""
+		}
+		if down[id] {
+			return true
+		} else if !claimed[id] {
+			if !n.claimHintTarget(id) {
+				down[id] = true
+				return true
+			}
+			claimed[id] = true
+		}
+
+		if err != nil {
+			n.logger.Printf("discarding invalid hint: %s", err.Error())
+		} else if _, err = n.send(hint.Target.Addr, &hint.Op); err != nil {
+			n.logger.Printf("hint delivery to %s failed: %s",
+				id, err.Error())
+			down[id] = true
+			return true
+		}
+		delivered = append(delivered, key)
+		size += int64(len(value))
+		return true
+	})
+	if err != nil {
+		n.logger.Printf("failed to read hints: %s", err.Error())
+	}
+	if len(delivered) == 0 {
+		return 0
+	}
+
+	batch := new(Batch)
+	for _, key := range delivered {
+		batch.Delete(key)
+	}
+
+	n.hints.Lock()
+	defer n.hints.Unlock()
+	if err = n.store.Write(batch); err != nil {
+		n.logger.Printf("failed to remove delivered hints: %s",
+			err.Error())
+		return 0
+	}
+	n.hints.count.Add(-int64(len(delivered)))
+	n.hints.bytes.Add(-size)
+	n.stats.Add("hints_replayed", int64(len(delivered)))
+	n.logger.Printf("delivered %d hints", len(delivered))
+	return len(delivered)
+}
@@ -0,0 +1,85 @@
+package node
+
+import (
+	"encoding/gob"
+	"github.com/gokyle/kludge/common"
+	"net"
+	"time"
+)
+
+// Serve accepts connections on the listener and hands the operations
+// they carry to a pool of workers. It returns when the listener fails
+// permanently or is closed.
+func (n *Node) Serve(l net.Listener) error {
+	n.startPool()
+	defer close(n.reqQ)
+
+	for {
+		conn, err := l.Accept()
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			n.logger.Printf("listener failure: %s", err.Error())
+			continue
+		} else if err != nil {
+			return err
+		}
+		go n.receiver(conn)
+	}
+}
+
+// receiver reads a single operation from the connection and writes
+// back its response. Connections that do not carry a complete
+// operation within the link timeout are dropped without a response.
+func (n *Node) receiver(conn net.Conn) {
+	defer conn.Close()
+	start := time.Now().UnixNano()
+	conn.SetDeadline(time.Now().Add(common.LinkTimeout))
+	req := new(common.Request)
+	dec := gob.NewDecoder(conn)
+	respc := make(chan *common.Response)
+
+	var op = new(common.Operation)
+	if err := dec.Decode(op); err != nil {
+		n.stats.Add("bad_requests", 1)
+		n.logger.Printf("failed to read request from %s: %s",
+			conn.RemoteAddr(), err.Error())
+		return
+	}
+	req.Op = op
+	req.Resp = respc
+	n.reqQ <- req
+
+	resp := <-respc
+	defer close(respc)
+
+	enc := gob.NewEncoder(conn)
+	if err := enc.Encode(resp); err != nil {
+		n.stats.Add("failed_responses", 1)
+		n.logger.Printf("failed to send %s response to %s: %s",
+			op.Name(), conn.RemoteAddr(), err.Error())
+		return
+	}
+	rtime := (time.Now().UnixNano() - start) / 1000.0
+	n.logger.Printf("%s response time: %dus", op.Name(), rtime)
+}
+
+func (n *Node) startPool() {
+	n.reqQ = make(chan *common.Request, n.cfg.RequestBuffer)
+	for i := 0; i < n.cfg.PoolSize; i++ {
+		go n.requestHandler(i)
+	}
+}
+
+func (n *Node) requestHandler(id int) {
+	for {
+		req, ok := <-n.reqQ
+		if !ok {
+			n.logger.Printf("worker %d returns", id)
+			return
+		}
+		req.Op.WID = id
+
+		n.logger.Printf("worker %d handling %s request", id,
+			req.OpName())
+		req.Resp <- n.Handle(req.Op)
+	}
+}
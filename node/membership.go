@@ -0,0 +1,45 @@
+package node
+
+import (
+	"github.com/gokyle/kludge/common"
+	"github.com/gokyle/kludge/gossip"
+	"github.com/gokyle/kludge/ring"
+)
+
+// AddPeer places a node on the ring, or updates its address, and
+// schedules a rebalance if the ring changed.
+func (n *Node) AddPeer(peer ring.Node) {
+	if n.ring == nil {
+		return
+	}
+	if cur, ok := n.ring.Node(peer.ID); !ok || cur != peer {
+		n.ring.Add(peer)
+		n.ringChanged()
+	}
+}
+
+// RemovePeer takes a node off the ring and schedules a rebalance.
+func (n *Node) RemovePeer(id string) {
+	if n.ring == nil {
+		return
+	}
+	if _, ok := n.ring.Node(id); ok {
+		n.ring.Remove(id)
+		n.ringChanged()
+	}
+}
+
+// MemberChanged keeps the ring up to date with the nodes that have
+// been seen through gossip. As in the frontend, failed nodes keep
+// their place on the ring, and only nodes that leave are removed.
+func (n *Node) MemberChanged(m gossip.Member) {
+	if m.Kind != common.MemberNode || m.ID == n.cfg.ID {
+		return
+	}
+	switch m.State {
+	case gossip.Alive, gossip.Suspect:
+		n.AddPeer(ring.Node{ID: m.ID, Addr: m.Service})
+	case gossip.Left:
+		n.RemovePeer(m.ID)
+	}
+}
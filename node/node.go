@@ -0,0 +1,305 @@
+// Package node implements a kludge storage node: the handling of the
+// operations sent to it over the node link, and the background work
+// that keeps its data in step with the other replicas. The kludge_node
+// daemon wraps a Node with its configuration, a LevelDB store and a TCP
+// listener; tests may run several nodes in one process over a simulated
+// link.
+package node
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"github.com/gokyle/kludge/ring"
+	"sync"
+	"time"
+)
+
+// Logger is the interface the node logs through.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+type nullLogger struct{}
+
+func (nullLogger) Printf(format string, args ...interface{}) {}
+
+// Config describes a node and its place in the cluster.
+type Config struct {
+	// ID identifies the node on the ring. Addr is the address other
+	// nodes and the frontends reach it at.
+	ID   string
+	Addr string
+
+	// Ring holds the nodes of the cluster, including this one. If it
+	// is nil, the node runs standalone and does no replication.
+	Ring     *ring.Ring
+	Replicas int
+
+	// Gossip is set if the ring is maintained through gossip rather
+	// than configured. The nodes of the ring the node last settled on
+	// are then placed on the ring at startup, so that nodes it has yet
+	// to hear from are not mistaken for departures.
+	Gossip bool
+
+	Store Store
+
+	// Send carries an operation to another node; it defaults to
+	// common.SendOperation.
+	Send func(addr string, op *common.Operation) (*common.Response, error)
+
+	// Clock supplies the versions of writes that arrive without one;
+	// it defaults to time.Now.
+	Clock func() time.Time
+
+	Logger Logger
+
+	// The intervals of the background tasks run once the node is
+	// started. A zero interval disables the task; it may still be
+	// run by calling the corresponding method. RebalanceRetry, which
+	// only spaces out failed rebalances, is defaulted if zero.
+	AntiEntropy    time.Duration
+	HintReplay     time.Duration
+	RebalanceDelay time.Duration
+	RebalanceRetry time.Duration
+	LogTrim        time.Duration
+
+	// LogRetention is how long entries are kept in the change log.
+	LogRetention time.Duration
+
+	MaxHintBytes int64
+	ScanPageSize int
+
+	// ChunkSize is the largest value stored whole; larger values are
+	// split into chunks of this size.
+	ChunkSize int
+
+	// FeedSize is the number of recent changes kept for watchers.
+	FeedSize int
+
+	// BackupDir is the directory the archives of backups requested
+	// over the node link are written to; if it is empty, such requests
+	// are refused.
+	BackupDir string
+
+	// The size of the worker pool and its request queue used by Serve.
+	PoolSize      int
+	RequestBuffer int
+}
+
+// DefaultConfig returns a config for a standalone node with the usual
+// timings.
+func DefaultConfig() Config {
+	return Config{
+		Replicas:       1,
+		AntiEntropy:    10 * time.Minute,
+		HintReplay:     30 * time.Second,
+		RebalanceDelay: 2 * time.Second,
+		RebalanceRetry: 30 * time.Second,
+		LogTrim:        time.Minute,
+		LogRetention:   24 * time.Hour,
+		MaxHintBytes:   64 << 20,
+		ScanPageSize:   256,
+		ChunkSize:      1 << 20,
+		FeedSize:       4096,
+		PoolSize:       4,
+		RequestBuffer:  16,
+	}
+}
+
+// Node is a single storage node.
+type Node struct {
+	cfg    Config
+	ring   *ring.Ring
+	store  Store
+	send   func(addr string, op *common.Operation) (*common.Response, error)
+	clock  func() time.Time
+	logger Logger
+
+	// stats holds the node's counters; they are returned as JSON in
+	// response to an OpStats operation.
+	stats *expvar.Map
+
+	keyLocks [64]sync.Mutex
+	hints    hintState
+	rebal    rebalanceState
+	feed     feedState
+	log      logState
+	backup   backupState
+	usage    usageState
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	reqQ     chan *common.Request
+}
+
+// New sets up a node over its store, picking up the hints and settled
+// ring left by a previous run.
+func New(cfg Config) (n *Node, err error) {
+	if cfg.Store == nil {
+		return nil, fmt.Errorf("node: no store")
+	} else if cfg.Ring != nil {
+		if _, ok := cfg.Ring.Node(cfg.ID); !ok {
+			return nil, fmt.Errorf("node: %s is not on the ring", cfg.ID)
+		}
+	}
+	def := DefaultConfig()
+	if cfg.Replicas < 1 {
+		cfg.Replicas = def.Replicas
+	}
+	if cfg.MaxHintBytes <= 0 {
+		cfg.MaxHintBytes = def.MaxHintBytes
+	}
+	if cfg.ScanPageSize <= 0 {
+		cfg.ScanPageSize = def.ScanPageSize
+	}
+	if cfg.RebalanceRetry <= 0 {
+		cfg.RebalanceRetry = def.RebalanceRetry
+	}
+	if cfg.LogRetention <= 0 {
+		cfg.LogRetention = def.LogRetention
+	}
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = def.ChunkSize
+	}
+	if cfg.FeedSize <= 0 {
+		cfg.FeedSize = def.FeedSize
+	}
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = def.PoolSize
+	}
+	if cfg.RequestBuffer <= 0 {
+		cfg.RequestBuffer = def.RequestBuffer
+	}
+
+	n = &Node{
+		cfg:    cfg,
+		ring:   cfg.Ring,
+		store:  cfg.Store,
+		send:   cfg.Send,
+		clock:  cfg.Clock,
+		logger: cfg.Logger,
+		stats:  new(expvar.Map).Init(),
+		stop:   make(chan struct{}),
+	}
+	if n.send == nil {
+		n.send = common.SendOperation
+	}
+	if n.clock == nil {
+		n.clock = time.Now
+	}
+	if n.logger == nil {
+		n.logger = nullLogger{}
+	}
+	n.rebal.kick = make(chan struct{}, 1)
+
+	n.initHints()
+	n.initFeed()
+	if err = n.initLog(); err != nil {
+		return nil, err
+	}
+	if err = n.initUsage(); err != nil {
+		return nil, err
+	}
+	if err = n.loadRing(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// ID returns the node's ID.
+func (n *Node) ID() string {
+	return n.cfg.ID
+}
+
+// Stats returns the node's counters.
+func (n *Node) Stats() *expvar.Map {
+	return n.stats
+}
+
+// Start runs the node's background tasks.
+func (n *Node) Start() {
+	go n.antiEntropy()
+	go n.replayHints()
+	go n.rebalancer()
+	go n.trimLogs()
+}
+
+// Stop halts the background tasks and the worker pool.
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.stop)
+	})
+}
+
+// every calls fn each interval until the node is stopped.
+func (n *Node) every(interval time.Duration, fn func()) {
+	if interval <= 0 {
+		return
+	}
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-time.After(interval):
+			fn()
+		}
+	}
+}
+
+// version returns a version for a new write from the node's clock.
+func (n *Node) version() uint64 {
+	return uint64(n.clock().UnixNano())
+}
+
+// Handle carries out a single operation.
+func (n *Node) Handle(op *common.Operation) *common.Response {
+	switch op.OpCode {
+	case common.OpGet:
+		return n.store_get(op)
+	case common.OpSet:
+		return n.store_set(op)
+	case common.OpDel:
+		return n.store_del(op)
+	case common.OpLst:
+		return n.store_lst(op)
+	case common.OpTree:
+		return n.store_tree(op)
+	case common.OpVers:
+		return n.store_vers(op)
+	case common.OpHint:
+		return n.store_hint(op)
+	case common.OpStats:
+		return n.store_stats(op)
+	case common.OpScan:
+		return n.store_scan(op)
+	case common.OpRebalance:
+		return n.store_rebalance(op)
+	case common.OpCleanup:
+		return n.store_cleanup(op)
+	case common.OpWatch:
+		return n.store_watch(op)
+	case common.OpLog:
+		return n.store_log(op)
+	case common.OpBackup:
+		return n.store_backup(op)
+	case common.OpBackupStatus:
+		return n.store_backup_status(op)
+	case common.OpUsage:
+		return n.store_usage(op)
+	case common.OpBatch:
+		return n.store_batch(op)
+	default:
+		n.logger.Printf("worker %d received invalid operation %d",
+			op.WID, op.OpCode)
+		resp := new(common.Response)
+		resp.Body = []byte("invalid request")
+		return resp
+	}
+}
+
+func (n *Node) store_stats(op *common.Operation) (resp *common.Response) {
+	resp = new(common.Response)
+	resp.Body = []byte(n.stats.String())
+	return
+}
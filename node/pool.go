@@ -0,0 +1,201 @@
+package node
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"github.com/gokyle/kludge/common"
+	"github.com/gokyle/kludge/ring"
+)
+
+func (n *Node) store_get(op *common.Operation) (resp *common.Response) {
+	resp = new(common.Response)
+	n.fetchPending(op.Key)
+
+	rec, err := n.readRecord(op.Key)
+	if err != nil {
+		n.logger.Printf("error handling get from worker %d: %s",
+			op.WID, err.Error())
+		resp.ErrMsg = err.Error()
+	} else {
+		n.logger.Printf("worker %d successfully completes GET", op.WID)
+		if rec != nil {
+			resp.Version = rec.Version
+		}
+		resp.KeyOK = rec.Live()
+		if resp.KeyOK {
+			resp.Body = rec.Val
+			resp.Type = rec.Type
+		}
+	}
+	return
+}
+
+// store_write applies a new record for the key in op, filling in the
+// response with the key's previous value.
+func (n *Node) store_write(op *common.Operation, rec *record) (resp *common.Response) {
+	resp = new(common.Response)
+	if rec.Version == 0 {
+		rec.Version = n.version()
+	}
+
+	n.fetchPending(op.Key)
+	defer n.lockKey(op.Key).Unlock()
+	cur, applied, err := n.applyRecord(op.Key, rec)
+	if err != nil {
+		n.logger.Printf("worker %d failed to write key: %s", op.WID,
+			err.Error())
+		resp.ErrMsg = err.Error()
+		return
+	} else if !applied {
+		n.logger.Printf("worker %d ignores stale %s (version %d <= %d)",
+			op.WID, op.Name(), rec.Version, cur.Version)
+	}
+
+	if cur != nil {
+		resp.Version = cur.Version
+	}
+	resp.KeyOK = cur.Live()
+	if resp.KeyOK {
+		resp.Body = cur.Val
+		resp.Type = cur.Type
+	}
+	return
+}
+
+func (n *Node) store_set(op *common.Operation) (resp *common.Response) {
+	if len(op.Type) > common.MaxTypeLen {
+		return &common.Response{ErrMsg: "content type too long"}
+	}
+	resp = n.store_write(op, &record{Version: op.Version, Type: op.Type, Val: op.Val})
+	if resp.ErrMsg == "" {
+		n.logger.Printf("worker %d successfully wrote key", op.WID)
+	}
+	return
+}
+
+func (n *Node) store_del(op *common.Operation) (resp *common.Response) {
+	return n.store_write(op, &record{Version: op.Version, Deleted: true})
+}
+
+// store_batch sets each of the items in op as an OpSet would, answering
+// with the error setting each item, which is empty if it was set.
+func (n *Node) store_batch(op *common.Operation) (resp *common.Response) {
+	var items []common.Item
+	err := gob.NewDecoder(bytes.NewBuffer(op.Val)).Decode(&items)
+	if err != nil {
+		n.logger.Printf("worker %d received invalid batch: %s", op.WID,
+			err.Error())
+		return &common.Response{ErrMsg: err.Error()}
+	}
+
+	errs := make([]string, len(items))
+	for i, item := range items {
+		errs[i] = n.store_set(&common.Operation{
+			OpCode:  common.OpSet,
+			Key:     item.Key,
+			Val:     item.Val,
+			Type:    item.Type,
+			Version: item.Version,
+			WID:     op.WID,
+		}).ErrMsg
+	}
+	resp = new(common.Response)
+	buf := new(bytes.Buffer)
+	if err = gob.NewEncoder(buf).Encode(errs); err != nil {
+		resp.ErrMsg = err.Error()
+	}
+	resp.Body = buf.Bytes()
+	return
+}
+
+// scan calls fn with each client key in the store and its record as
+// stored; the values of chunked records are not reassembled.
+func (n *Node) scan(fn func(key []byte, rec *record)) error {
+	return n.store.Iterate(nil, func(key, value []byte) bool {
+		if isSysKey(key) {
+			return true
+		}
+		rec, err := decodeRecord(value)
+		if err != nil {
+			n.logger.Printf("skipping key %q: %s", key, err.Error())
+			return true
+		}
+		fn(key, rec)
+		return true
+	})
+}
+
+func (n *Node) store_lst(op *common.Operation) (resp *common.Response) {
+	resp = new(common.Response)
+	keys := make([]string, 0)
+
+	err := n.scan(func(key []byte, rec *record) {
+		if rec.Live() {
+			keys = append(keys, string(key))
+		}
+	})
+	if err != nil {
+		n.logger.Printf("worker %d failed to iterate over keys: %s",
+			op.WID, err.Error())
+		resp.ErrMsg = err.Error()
+	} else {
+		resp.Body, err = json.Marshal(keys)
+		if err != nil {
+			n.logger.Printf("worker %d failed to create JSON response: %s",
+				op.WID, err.Error())
+			resp.Body = []byte{}
+		}
+	}
+	return
+}
+
+// store_tree builds the Merkle tree for each range in op.
+func (n *Node) store_tree(op *common.Operation) (resp *common.Response) {
+	resp = new(common.Response)
+
+	trees, err := n.buildTrees(op.Ranges)
+	if err == nil {
+		encoded := make([][]byte, len(trees))
+		for i := range trees {
+			encoded[i], _ = trees[i].MarshalBinary()
+		}
+		buf := new(bytes.Buffer)
+		err = gob.NewEncoder(buf).Encode(encoded)
+		resp.Body = buf.Bytes()
+	}
+	if err != nil {
+		n.logger.Printf("worker %d failed to build trees: %s",
+			op.WID, err.Error())
+		resp.ErrMsg = err.Error()
+	}
+	return
+}
+
+// store_vers lists the version of every key in the ranges in op.
+func (n *Node) store_vers(op *common.Operation) (resp *common.Response) {
+	resp = new(common.Response)
+	vers := make([]common.KeyVersion, 0)
+
+	err := n.scan(func(key []byte, rec *record) {
+		if findRange(op.Ranges, ring.Token(key)) < 0 {
+			return
+		}
+		vers = append(vers, common.KeyVersion{
+			Key:     append([]byte{}, key...),
+			Version: rec.Version,
+			Deleted: rec.Deleted,
+		})
+	})
+	if err == nil {
+		buf := new(bytes.Buffer)
+		err = gob.NewEncoder(buf).Encode(vers)
+		resp.Body = buf.Bytes()
+	}
+	if err != nil {
+		n.logger.Printf("worker %d failed to list versions: %s",
+			op.WID, err.Error())
+		resp.ErrMsg = err.Error()
+	}
+	return
+}
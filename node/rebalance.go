@@ -0,0 +1,507 @@
+package node
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"github.com/gokyle/kludge/ring"
+	"sync"
+	"time"
+)
+
+// When the ring changes, the node takes over the ranges it has gained
+// by streaming them from the nodes that replicated them before the
+// change. The ring the node last held all of its data for is kept in
+// the store as the settled ring; the ranges to transfer are those the
+// node replicates in the current ring but not in the settled one. A
+// node that has never settled compares the current ring to the same
+// ring without itself.
+//
+// While a range is being transferred, a key that has not yet arrived
+// is fetched from the previous replicas when it is read or written, so
+// that the node can serve requests for the range immediately.
+
+var ringKey = []byte("\x00ring")
+
+var (
+	errRingChanged  = fmt.Errorf("ring changed during transfer")
+	errNotSettled   = fmt.Errorf("transfers are still in progress")
+	errNoSourceLeft = fmt.Errorf("no source could be reached")
+)
+
+// A transfer is a range to be pulled from its previous replicas.
+type transfer struct {
+	Range   ring.Range
+	Sources []ring.Node
+	Cursor  []byte
+	Done    bool
+}
+
+type rebalanceState struct {
+	sync.Mutex
+	settled   *ring.Ring
+	transfers []*transfer
+	started   time.Time
+	keys      int64
+	bytes     int64
+	kick      chan struct{}
+}
+
+// loadRing reads the settled ring from the store. In gossip mode, its
+// nodes seed the current ring so that a restarted node does not
+// mistake the nodes it has yet to hear from for departures.
+func (n *Node) loadRing() error {
+	if n.ring == nil {
+		return nil
+	}
+	data, err := n.store.Get(ringKey)
+	if err != nil {
+		return fmt.Errorf("failed to read settled ring: %s", err.Error())
+	} else if data == nil {
+		return nil
+	}
+
+	var nodes []ring.Node
+	err = gob.NewDecoder(bytes.NewBuffer(data)).Decode(&nodes)
+	if err != nil {
+		return fmt.Errorf("invalid settled ring: %s", err.Error())
+	}
+	settled := ring.New(n.ring.VNodes())
+	for _, peer := range nodes {
+		settled.Add(peer)
+		if n.cfg.Gossip && peer.ID != n.cfg.ID {
+			n.ring.Add(peer)
+		}
+	}
+	n.rebal.settled = settled
+	return nil
+}
+
+func (n *Node) saveRing(r *ring.Ring) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(r.Nodes()); err != nil {
+		return err
+	}
+	return n.store.Put(ringKey, buf.Bytes())
+}
+
+// ringChanged schedules a rebalance.
+func (n *Node) ringChanged() {
+	select {
+	case n.rebal.kick <- struct{}{}:
+	default:
+	}
+}
+
+// gainedRanges compares the settled ring with the current one and
+// returns a transfer for each piece of the ring the node has gained.
+func (n *Node) gainedRanges(settled, current *ring.Ring) (transfers []*transfer) {
+	self := n.cfg.ID
+	if settled == nil {
+		settled = current.Copy()
+		settled.Remove(self)
+	}
+	old := settled.Segments(n.cfg.Replicas)
+	for _, seg := range current.Replicated(self, n.cfg.Replicas) {
+		for _, o := range old {
+			if o.Has(self) {
+				continue
+			}
+			for _, piece := range seg.Range.Intersect(o.Range) {
+				transfers = append(transfers, &transfer{
+					Range:   piece,
+					Sources: o.Nodes,
+				})
+			}
+		}
+	}
+	return
+}
+
+// rebalancer waits for the ring to change and pulls in the ranges the
+// node has gained. Changes are collected for a short time before the
+// transfers are worked out, since a node joining or restarting usually
+// learns of several nodes at once.
+func (n *Node) rebalancer() {
+	if n.ring == nil || n.cfg.RebalanceDelay <= 0 {
+		return
+	}
+	n.ringChanged()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.rebal.kick:
+		}
+		select {
+		case <-n.stop:
+			return
+		case <-time.After(n.cfg.RebalanceDelay):
+		}
+
+		for !n.Rebalance() {
+			select {
+			case <-n.stop:
+				return
+			case <-n.rebal.kick:
+			case <-time.After(n.cfg.RebalanceRetry):
+			}
+		}
+	}
+}
+
+// Rebalance works out the transfers for the current ring and runs
+// them, returning true once the node has settled on the ring. If the
+// ring changes, or some transfer cannot be completed, it returns false.
+func (n *Node) Rebalance() bool {
+	if n.ring == nil {
+		return true
+	}
+	select {
+	case <-n.rebal.kick:
+	default:
+	}
+	current := n.ring.Copy()
+	n.rebal.Lock()
+	transfers := n.gainedRanges(n.rebal.settled, current)
+	// Keep the progress of transfers that are still needed.
+	for _, t := range transfers {
+		for _, prev := range n.rebal.transfers {
+			if prev.Range == t.Range && prev.Done {
+				t.Done = true
+			} else if prev.Range == t.Range {
+				t.Cursor = prev.Cursor
+			}
+		}
+	}
+	if len(n.rebal.transfers) == 0 {
+		n.rebal.started = time.Now()
+		n.rebal.keys, n.rebal.bytes = 0, 0
+	}
+	n.rebal.transfers = transfers
+	n.rebal.Unlock()
+
+	if len(transfers) > 0 {
+		n.logger.Printf("rebalance: taking over %d ranges", len(transfers))
+	}
+	complete := true
+	for _, t := range transfers {
+		if t.Done {
+			continue
+		}
+		if err := n.runTransfer(t); err == errRingChanged {
+			return false
+		} else if err != nil {
+			n.logger.Printf("rebalance: transfer of %s failed: %s",
+				t.Range, err.Error())
+			complete = false
+		}
+	}
+	if !complete {
+		return false
+	}
+
+	if err := n.saveRing(current); err != nil {
+		n.logger.Printf("rebalance: failed to save ring: %s", err.Error())
+		return false
+	}
+	n.rebal.Lock()
+	n.rebal.settled = current
+	n.rebal.transfers = nil
+	n.logger.Printf("rebalance: settled after moving %d keys (%d bytes) in %s",
+		n.rebal.keys, n.rebal.bytes, time.Since(n.rebal.started))
+	n.rebal.Unlock()
+	return true
+}
+
+// runTransfer streams a range from the first of its sources that can
+// be reached, one page at a time.
+func (n *Node) runTransfer(t *transfer) error {
+	for _, src := range t.Sources {
+		if src.ID == n.cfg.ID {
+			continue
+		}
+		for {
+			select {
+			case <-n.rebal.kick:
+				n.ringChanged()
+				return errRingChanged
+			default:
+			}
+
+			more, err := n.pullPage(src, t)
+			if err != nil {
+				n.logger.Printf("rebalance: pulling %s from %s failed: %s",
+					t.Range, src.ID, err.Error())
+				break
+			} else if !more {
+				n.rebal.Lock()
+				t.Done = true
+				n.rebal.Unlock()
+				return nil
+			}
+		}
+	}
+	return errNoSourceLeft
+}
+
+// pullPage applies one page of a range scan from the source, returning
+// true if there may be more to come.
+func (n *Node) pullPage(src ring.Node, t *transfer) (more bool, err error) {
+	n.rebal.Lock()
+	cursor := t.Cursor
+	n.rebal.Unlock()
+
+	resp, err := n.send(src.Addr, &common.Operation{
+		OpCode: common.OpScan,
+		Key:    cursor,
+		Ranges: []ring.Range{t.Range},
+		Limit:  n.cfg.ScanPageSize,
+	})
+	if err != nil {
+		return
+	}
+	var items []common.Item
+	err = gob.NewDecoder(bytes.NewBuffer(resp.Body)).Decode(&items)
+	if err != nil {
+		return
+	}
+
+	var size int64
+	for _, item := range items {
+		rec := &record{
+			Version: item.Version,
+			Deleted: item.Deleted,
+			Type:    item.Type,
+			Val:     item.Val,
+		}
+		l := n.lockKey(item.Key)
+		_, _, err = n.applyRecord(item.Key, rec)
+		l.Unlock()
+		if err != nil {
+			return
+		}
+		size += int64(len(item.Val))
+	}
+
+	n.rebal.Lock()
+	if len(items) > 0 {
+		t.Cursor = items[len(items)-1].Key
+	}
+	n.rebal.keys += int64(len(items))
+	n.rebal.bytes += size
+	n.rebal.Unlock()
+	n.stats.Add("keys_transferred", int64(len(items)))
+	return len(items) == n.cfg.ScanPageSize, nil
+}
+
+// pendingSources returns the previous replicas of the key if its range
+// is still being transferred to the node.
+func (n *Node) pendingSources(key []byte) []ring.Node {
+	n.rebal.Lock()
+	defer n.rebal.Unlock()
+	if len(n.rebal.transfers) == 0 {
+		return nil
+	}
+	token := ring.Token(key)
+	for _, t := range n.rebal.transfers {
+		if !t.Done && t.Range.Contains(token) {
+			return t.Sources
+		}
+	}
+	return nil
+}
+
+// fetchPending pulls the key from its previous replicas if its range
+// is still being transferred and the key has not yet arrived.
+func (n *Node) fetchPending(key []byte) {
+	sources := n.pendingSources(key)
+	if sources == nil {
+		return
+	}
+	if cur, err := n.readRecord(key); err != nil || cur != nil {
+		return
+	}
+	for _, src := range sources {
+		if src.ID == n.cfg.ID {
+			continue
+		}
+		if err := n.pullKey(src, key); err == nil {
+			return
+		}
+	}
+}
+
+// store_scan returns a page of the records in the ranges in op.
+func (n *Node) store_scan(op *common.Operation) (resp *common.Response) {
+	resp = new(common.Response)
+	limit := op.Limit
+	if limit <= 0 {
+		limit = n.cfg.ScanPageSize
+	}
+	items := make([]common.Item, 0)
+
+	start, after := op.Key, op.Key
+	if bytes.Compare(start, op.Val) < 0 {
+		start, after = op.Val, nil
+	}
+	err := n.store.Iterate(start, func(key, value []byte) bool {
+		if after != nil && bytes.Equal(key, after) {
+			return true
+		}
+		if !bytes.HasPrefix(key, op.Val) {
+			return false
+		}
+		if isSysKey(key) || findRange(op.Ranges, ring.Token(key)) < 0 {
+			return true
+		}
+		rec, err := decodeRecord(value)
+		if err == nil {
+			rec, err = n.loadRecord(key, rec)
+		}
+		if err != nil {
+			n.logger.Printf("skipping key %q: %s", key, err.Error())
+			return true
+		} else if rec == nil {
+			return true
+		}
+		items = append(items, common.Item{
+			Key:     key,
+			Val:     rec.Val,
+			Type:    rec.Type,
+			Version: rec.Version,
+			Deleted: rec.Deleted,
+		})
+		return len(items) < limit
+	})
+	if err == nil {
+		buf := new(bytes.Buffer)
+		err = gob.NewEncoder(buf).Encode(items)
+		resp.Body = buf.Bytes()
+	}
+	if err != nil {
+		n.logger.Printf("worker %d failed to scan: %s", op.WID, err.Error())
+		resp.ErrMsg = err.Error()
+	}
+	return
+}
+
+// settled returns true if the node holds all the data for its ranges
+// in the current ring. The rebalance lock must be held.
+func (n *Node) settled() bool {
+	if n.ring == nil {
+		return true
+	}
+	return n.rebal.settled != nil && len(n.rebal.transfers) == 0 &&
+		n.rebal.settled.Equal(n.ring)
+}
+
+// store_rebalance reports the node's rebalancing progress.
+func (n *Node) store_rebalance(op *common.Operation) (resp *common.Response) {
+	resp = new(common.Response)
+	n.rebal.Lock()
+	status := common.RebalanceStatus{
+		Settled: n.settled(),
+		Ranges:  len(n.rebal.transfers),
+		Keys:    n.rebal.keys,
+		Bytes:   n.rebal.bytes,
+		Started: n.rebal.started,
+	}
+	for _, t := range n.rebal.transfers {
+		if t.Done {
+			status.Done++
+		}
+	}
+	n.rebal.Unlock()
+
+	resp.Body, _ = json.Marshal(status)
+	return
+}
+
+// cleanupKey removes a key the node no longer replicates, with its
+// chunks and its count in its namespace's usage, returning false if
+// the key is gone or the node replicates it again. The key's lock must
+// be held, so that the record removed is not one written since the
+// cleanup's scan.
+func (n *Node) cleanupKey(key []byte) (bool, error) {
+	n.rebal.Lock()
+	ok := n.settled()
+	n.rebal.Unlock()
+	if !ok {
+		return false, errNotSettled
+	}
+	for _, replica := range n.ring.Lookup(key, n.cfg.Replicas) {
+		if replica.ID == n.cfg.ID {
+			return false, nil
+		}
+	}
+	rec, err := n.readStored(key)
+	if err != nil || rec == nil {
+		return false, err
+	}
+
+	batch := new(Batch)
+	batch.Delete(key)
+	if err = n.deleteChunks(batch, key, rec); err != nil {
+		n.logger.Printf("key %q: %s", key, err.Error())
+	}
+	var changes []common.Usage
+	if u, ok := usageChange(key, rec, nil); ok {
+		changes = append(changes, u)
+	}
+	return true, n.writeUsage(batch, changes...)
+}
+
+// store_cleanup removes the records in ranges the node no longer
+// replicates. It is refused until the node has settled; the frontend
+// only asks once every node has, so that no node still needs them.
+func (n *Node) store_cleanup(op *common.Operation) (resp *common.Response) {
+	resp = new(common.Response)
+	if n.ring == nil {
+		resp.Body = []byte("0")
+		return
+	}
+
+	n.rebal.Lock()
+	ok := n.settled()
+	n.rebal.Unlock()
+	if !ok {
+		resp.ErrMsg = errNotSettled.Error()
+		return
+	}
+
+	var held []ring.Range
+	for _, seg := range n.ring.Replicated(n.cfg.ID, n.cfg.Replicas) {
+		held = append(held, seg.Range)
+	}
+	var candidates [][]byte
+	err := n.scan(func(key []byte, rec *record) {
+		if findRange(held, ring.Token(key)) < 0 {
+			candidates = append(candidates, append([]byte{}, key...))
+		}
+	})
+	removed := 0
+	for _, key := range candidates {
+		if err != nil {
+			break
+		}
+		var gone bool
+		l := n.lockKey(key)
+		gone, err = n.cleanupKey(key)
+		l.Unlock()
+		if gone {
+			removed++
+		}
+	}
+	if err != nil {
+		n.logger.Printf("worker %d failed to clean up: %s", op.WID,
+			err.Error())
+		resp.ErrMsg = err.Error()
+		return
+	}
+	n.logger.Printf("cleanup removed %d keys", removed)
+	resp.Body = []byte(fmt.Sprintf("%d", removed))
+	return
+}
@@ -0,0 +1,166 @@
+package node
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"sync"
+)
+
+// A record is the form a value takes in the store. Each record carries
+// the version of the write that produced it; deleting a key replaces
+// its value with a tombstone record so that the deletion's version is
+// kept and may be propagated to other replicas.
+//
+// A record whose value was too large to be stored whole is Chunked, and
+// holds the manifest of the value's chunks in its place (see
+// chunk.go). Records are only seen in this form as they are read from
+// the store, before their value is reassembled.
+//
+// The Type is the content type the value was written with, if any. It
+// is stored after the header, preceded by its length, and only when
+// the recordTyped flag is set, so records written without one keep
+// their old form.
+type record struct {
+	Version uint64
+	Deleted bool
+	Chunked bool
+	Type    string
+	Val     []byte
+}
+
+const recordHeaderLen = 9
+
+const (
+	recordDeleted = 1 << iota
+	recordChunked
+	recordTyped
+)
+
+func (rec *record) Live() bool {
+	return rec != nil && !rec.Deleted
+}
+
+func (rec *record) Encode() []byte {
+	off := recordHeaderLen
+	if rec.Type != "" {
+		off += 1 + len(rec.Type)
+	}
+	data := make([]byte, off+len(rec.Val))
+	if rec.Deleted {
+		data[0] |= recordDeleted
+	}
+	if rec.Chunked {
+		data[0] |= recordChunked
+	}
+	if rec.Type != "" {
+		data[0] |= recordTyped
+		data[recordHeaderLen] = byte(len(rec.Type))
+		copy(data[recordHeaderLen+1:], rec.Type)
+	}
+	binary.BigEndian.PutUint64(data[1:recordHeaderLen], rec.Version)
+	copy(data[off:], rec.Val)
+	return data
+}
+
+func decodeRecord(data []byte) (rec *record, err error) {
+	if data == nil {
+		return
+	} else if len(data) < recordHeaderLen {
+		err = fmt.Errorf("invalid record (%d bytes)", len(data))
+		return
+	}
+	rec = &record{
+		Deleted: data[0]&recordDeleted != 0,
+		Chunked: data[0]&recordChunked != 0,
+		Version: binary.BigEndian.Uint64(data[1:recordHeaderLen]),
+	}
+	off := recordHeaderLen
+	if data[0]&recordTyped != 0 {
+		if len(data) == off || len(data) < off+1+int(data[off]) {
+			return nil, fmt.Errorf("invalid record type (%d bytes)", len(data))
+		}
+		rec.Type = string(data[off+1 : off+1+int(data[off])])
+		off += 1 + int(data[off])
+	}
+	rec.Val = data[off:]
+	return
+}
+
+// Keys beginning with a NUL byte are reserved for the node's own
+// bookkeeping. They are skipped when listing keys and are never
+// replicated; the frontend refuses client keys containing NUL.
+const sysPrefix = '\x00'
+
+func isSysKey(key []byte) bool {
+	return len(key) > 0 && key[0] == sysPrefix
+}
+
+// The key locks serialise the read-compare-write cycle of writes to
+// the same key; writes to different keys only contend if they hash to
+// the same lock.
+func (n *Node) lockKey(key []byte) *sync.Mutex {
+	var h uint32 = 2166136261
+	for _, b := range key {
+		h = (h ^ uint32(b)) * 16777619
+	}
+	l := &n.keyLocks[h%uint32(len(n.keyLocks))]
+	l.Lock()
+	return l
+}
+
+// readRecord returns the key's record, with its value reassembled if
+// it was chunked.
+func (n *Node) readRecord(key []byte) (*record, error) {
+	stored, err := n.readStored(key)
+	if err != nil {
+		return nil, err
+	}
+	return n.loadRecord(key, stored)
+}
+
+// readStored returns the key's record as it is stored.
+func (n *Node) readStored(key []byte) (*record, error) {
+	data, err := n.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRecord(data)
+}
+
+// writeRecord replaces the stored record for a key, removing the
+// chunks of the old one, and logs the change and counts it in the
+// usage of the key's namespace.
+func (n *Node) writeRecord(key []byte, rec, old *record) error {
+	batch := new(Batch)
+	if err := n.deleteChunks(batch, key, old); err != nil {
+		return err
+	}
+	n.putChunks(batch, key, rec)
+	var changes []common.Usage
+	if u, ok := usageChange(key, old, rec); ok {
+		changes = append(changes, u)
+	}
+	return n.writeLogged(batch, key, rec, changes...)
+}
+
+// applyRecord writes the record if it is newer than the key's current
+// record, returning the record it replaced (or that superseded it) and
+// whether the write happened. The caller must hold the key's lock.
+func (n *Node) applyRecord(key []byte, rec *record) (cur *record, applied bool, err error) {
+	stored, err := n.readStored(key)
+	if err != nil {
+		return
+	}
+	if cur, err = n.loadRecord(key, stored); err != nil {
+		return
+	}
+	if cur != nil && cur.Version >= rec.Version {
+		return
+	}
+	err = n.writeRecord(key, rec, stored)
+	if applied = err == nil; applied {
+		n.recordChange(key, rec)
+	}
+	return
+}
@@ -0,0 +1,167 @@
+package node
+
+import (
+	"sort"
+	"sync"
+)
+
+// Store is the ordered key-value store a node keeps its records in. The
+// kludge_node daemon uses LevelDB; MemStore keeps everything in memory
+// for tests.
+type Store interface {
+	// Get returns the value stored under the key, or nil if there is
+	// none.
+	Get(key []byte) ([]byte, error)
+
+	// Put stores a value, which must be durable once Put returns.
+	Put(key, value []byte) error
+
+	// Write applies a batch of changes atomically.
+	Write(b *Batch) error
+
+	// Iterate calls fn with each key and value, in key order,
+	// starting at the first key not less than start. Iteration stops
+	// early if fn returns false.
+	Iterate(start []byte, fn func(key, value []byte) bool) error
+}
+
+// A Snapshotter is a Store that can take a consistent view of its
+// contents, unaffected by later writes. Backups require one.
+type Snapshotter interface {
+	Snapshot() (Snapshot, error)
+}
+
+// A Snapshot is a view of a Store at the time it was taken, which must
+// be released once it is no longer needed.
+type Snapshot interface {
+	Iterate(start []byte, fn func(key, value []byte) bool) error
+	Release()
+}
+
+// A Batch collects changes to be written to a Store together.
+type Batch struct {
+	Ops []BatchOp
+}
+
+// A BatchOp is a single change in a batch. A nil value deletes the key.
+type BatchOp struct {
+	Key   []byte
+	Value []byte
+}
+
+// Put adds a write of the key to the batch.
+func (b *Batch) Put(key, value []byte) {
+	if value == nil {
+		value = []byte{}
+	}
+	b.Ops = append(b.Ops, BatchOp{Key: key, Value: value})
+}
+
+// Delete adds the removal of the key to the batch.
+func (b *Batch) Delete(key []byte) {
+	b.Ops = append(b.Ops, BatchOp{Key: key})
+}
+
+// Len returns the number of changes in the batch.
+func (b *Batch) Len() int {
+	return len(b.Ops)
+}
+
+// MemStore is a Store held entirely in memory.
+type MemStore struct {
+	lock sync.RWMutex
+	keys []string
+	data map[string][]byte
+}
+
+// NewMemStore returns an empty MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{data: make(map[string][]byte, 0)}
+}
+
+func (m *MemStore) Get(key []byte) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	value, ok := m.data[string(key)]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (m *MemStore) Put(key, value []byte) error {
+	b := new(Batch)
+	b.Put(key, value)
+	return m.Write(b)
+}
+
+func (m *MemStore) Write(b *Batch) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, op := range b.Ops {
+		key := string(op.Key)
+		_, present := m.data[key]
+		i := sort.SearchStrings(m.keys, key)
+		switch {
+		case op.Value != nil && !present:
+			m.keys = append(m.keys, "")
+			copy(m.keys[i+1:], m.keys[i:])
+			m.keys[i] = key
+			fallthrough
+		case op.Value != nil:
+			m.data[key] = append([]byte{}, op.Value...)
+		case present:
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			delete(m.data, key)
+		}
+	}
+	return nil
+}
+
+// Iterate walks a snapshot of the keys taken when it is called; values
+// are read as they are reached, and keys removed in the meantime are
+// skipped.
+func (m *MemStore) Iterate(start []byte, fn func(key, value []byte) bool) error {
+	m.lock.RLock()
+	i := sort.SearchStrings(m.keys, string(start))
+	keys := append([]string{}, m.keys[i:]...)
+	m.lock.RUnlock()
+
+	for _, key := range keys {
+		value, err := m.Get([]byte(key))
+		if err != nil {
+			return err
+		} else if value == nil {
+			continue
+		}
+		if !fn([]byte(key), value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Len returns the number of keys in the store.
+func (m *MemStore) Len() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return len(m.keys)
+}
+
+// Snapshot copies the store's contents.
+func (m *MemStore) Snapshot() (Snapshot, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	snap := NewMemStore()
+	snap.keys = append([]string{}, m.keys...)
+	for key, value := range m.data {
+		snap.data[key] = value
+	}
+	return memSnapshot{snap}, nil
+}
+
+type memSnapshot struct {
+	*MemStore
+}
+
+func (memSnapshot) Release() {}
@@ -0,0 +1,220 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"sort"
+	"sync"
+)
+
+// Each namespace's usage, the number of live keys it holds on the node
+// and the total size of their values, is kept under the usage prefix
+// followed by its name, and updated in the same batch as every write
+// that changes it. usageInitKey marks a store whose usage has been
+// counted; the usage of one written before it was kept is counted from
+// its records when the node starts.
+var (
+	usagePrefix  = []byte("\x00usage/")
+	usageInitKey = []byte("\x00usageinit")
+)
+
+// usageState holds the usage of each namespace with keys on the node.
+// The lock is held while each change is written, so that changes are
+// applied one at a time.
+type usageState struct {
+	sync.Mutex
+	ns map[string]common.Usage
+}
+
+func usageKey(ns string) []byte {
+	key := make([]byte, 0, len(usagePrefix)+len(ns))
+	key = append(key, usagePrefix...)
+	return append(key, ns...)
+}
+
+func encodeUsage(u common.Usage) []byte {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data[:8], uint64(u.Keys))
+	binary.BigEndian.PutUint64(data[8:], uint64(u.Bytes))
+	return data
+}
+
+func decodeUsage(ns string, data []byte) (u common.Usage, err error) {
+	if len(data) != 16 {
+		err = fmt.Errorf("invalid usage for namespace %q", ns)
+		return
+	}
+	u = common.Usage{
+		Namespace: ns,
+		Keys:      int64(binary.BigEndian.Uint64(data[:8])),
+		Bytes:     int64(binary.BigEndian.Uint64(data[8:])),
+	}
+	return
+}
+
+// valueSize returns the size of a live record's value, which for a
+// chunked record as stored is given by its manifest.
+func valueSize(rec *record) int64 {
+	if !rec.Live() {
+		return 0
+	} else if !rec.Chunked {
+		return int64(len(rec.Val))
+	}
+	m, err := decodeManifest(rec.Val)
+	if err != nil {
+		return 0
+	}
+	return int64(m.Size)
+}
+
+// usageChange returns the change that replacing the key's old record
+// with rec makes to the usage of the key's namespace; ok is false if
+// the key is in no namespace or the usage is unchanged. Either record
+// may be nil.
+func usageChange(key []byte, old, rec *record) (u common.Usage, ok bool) {
+	if u.Namespace, ok = common.KeyNamespace(key); !ok {
+		return
+	}
+	if old.Live() {
+		u.Keys--
+		u.Bytes -= valueSize(old)
+	}
+	if rec.Live() {
+		u.Keys++
+		u.Bytes += valueSize(rec)
+	}
+	return u, u.Keys != 0 || u.Bytes != 0
+}
+
+// initUsage loads the namespaces' usage, counting it from the records
+// if the store has not kept it.
+func (n *Node) initUsage() error {
+	n.usage.ns = make(map[string]common.Usage, 0)
+	data, err := n.store.Get(usageInitKey)
+	if err != nil {
+		return err
+	} else if data == nil {
+		return n.countUsage()
+	}
+
+	var derr error
+	err = n.scanPrefix(usagePrefix, func(key, value []byte) bool {
+		ns := string(key[len(usagePrefix):])
+		var u common.Usage
+		if u, derr = decodeUsage(ns, value); derr != nil {
+			return false
+		}
+		n.usage.ns[ns] = u
+		return true
+	})
+	if err == nil {
+		err = derr
+	}
+	return err
+}
+
+// countUsage counts the usage of every namespace from the records, and
+// writes it.
+func (n *Node) countUsage() error {
+	counted := make(map[string]common.Usage, 0)
+	err := n.scan(func(key []byte, rec *record) {
+		if c, ok := usageChange(key, nil, rec); ok {
+			u := counted[c.Namespace]
+			u.Namespace = c.Namespace
+			u.Keys += c.Keys
+			u.Bytes += c.Bytes
+			counted[c.Namespace] = u
+		}
+	})
+	if err != nil {
+		return err
+	}
+	changes := make([]common.Usage, 0, len(counted))
+	for _, u := range counted {
+		changes = append(changes, u)
+	}
+	batch := new(Batch)
+	batch.Put(usageInitKey, []byte{1})
+	if err = n.writeUsage(batch, changes...); err != nil {
+		return err
+	}
+	if len(changes) > 0 {
+		n.logger.Printf("counted the usage of %d namespaces", len(changes))
+	}
+	return nil
+}
+
+// writeUsage writes a batch along with the changes it makes to the
+// namespaces' usage.
+func (n *Node) writeUsage(batch *Batch, changes ...common.Usage) error {
+	n.usage.Lock()
+	defer n.usage.Unlock()
+	updated := make(map[string]common.Usage, len(changes))
+	for _, c := range changes {
+		u, ok := updated[c.Namespace]
+		if !ok {
+			u = n.usage.ns[c.Namespace]
+			u.Namespace = c.Namespace
+		}
+		u.Keys += c.Keys
+		u.Bytes += c.Bytes
+		updated[c.Namespace] = u
+	}
+	for ns, u := range updated {
+		if u.Keys > 0 {
+			batch.Put(usageKey(ns), encodeUsage(u))
+		} else {
+			batch.Delete(usageKey(ns))
+		}
+	}
+	if err := n.store.Write(batch); err != nil {
+		return err
+	}
+	for ns, u := range updated {
+		if u.Keys > 0 {
+			n.usage.ns[ns] = u
+		} else {
+			delete(n.usage.ns, ns)
+		}
+	}
+	return nil
+}
+
+type usageByNamespace []common.Usage
+
+func (u usageByNamespace) Len() int           { return len(u) }
+func (u usageByNamespace) Less(i, j int) bool { return u[i].Namespace < u[j].Namespace }
+func (u usageByNamespace) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+
+// store_usage returns the usage of the namespace named by op.Key, or
+// of every namespace with keys on the node if it is empty, in order of
+// their names. A namespace with no keys on the node is left out.
+func (n *Node) store_usage(op *common.Operation) (resp *common.Response) {
+	resp = new(common.Response)
+	list := make([]common.Usage, 0)
+	n.usage.Lock()
+	if len(op.Key) > 0 {
+		if u, ok := n.usage.ns[string(op.Key)]; ok {
+			list = append(list, u)
+		}
+	} else {
+		for _, u := range n.usage.ns {
+			list = append(list, u)
+		}
+	}
+	n.usage.Unlock()
+	sort.Sort(usageByNamespace(list))
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(list); err != nil {
+		n.logger.Printf("worker %d failed to encode usage: %s", op.WID,
+			err.Error())
+		resp.ErrMsg = err.Error()
+		return
+	}
+	resp.Body = buf.Bytes()
+	return
+}
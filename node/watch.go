@@ -0,0 +1,78 @@
+package node
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/gokyle/kludge/common"
+	"sort"
+	"sync"
+)
+
+// The feed holds the most recent changes the node has applied, in the
+// order they were applied, for the frontends to report to watchers.
+// It is kept in memory only; horizon is the newest version of the
+// changes that have been dropped from it, or of the changes that may
+// have been applied before the node started.
+type feedState struct {
+	sync.Mutex
+	changes []common.Change
+	horizon uint64
+}
+
+func (n *Node) initFeed() {
+	n.feed.horizon = n.version()
+	n.stats.Add("changes", 0)
+}
+
+// recordChange adds an applied write to the feed.
+func (n *Node) recordChange(key []byte, rec *record) {
+	n.feed.Lock()
+	defer n.feed.Unlock()
+	n.feed.changes = append(n.feed.changes, common.Change{
+		Key:     append([]byte{}, key...),
+		Version: rec.Version,
+		Deleted: rec.Deleted,
+	})
+	if over := len(n.feed.changes) - n.cfg.FeedSize; over > 0 {
+		for _, c := range n.feed.changes[:over] {
+			if c.Version > n.feed.horizon {
+				n.feed.horizon = c.Version
+			}
+		}
+		n.feed.changes = append([]common.Change{}, n.feed.changes[over:]...)
+	}
+	n.stats.Add("changes", 1)
+}
+
+type changesByVersion []common.Change
+
+func (c changesByVersion) Len() int           { return len(c) }
+func (c changesByVersion) Less(i, j int) bool { return c[i].Version < c[j].Version }
+func (c changesByVersion) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// store_watch returns the changes in the feed after op.Version for the
+// keys beginning with op.Key, oldest first. There are never more than
+// the feed holds, so they are not returned in pages.
+func (n *Node) store_watch(op *common.Operation) (resp *common.Response) {
+	resp = new(common.Response)
+	changes := make([]common.Change, 0)
+	n.feed.Lock()
+	for _, c := range n.feed.changes {
+		if c.Version > op.Version && bytes.HasPrefix(c.Key, op.Key) {
+			changes = append(changes, c)
+		}
+	}
+	resp.Version = n.feed.horizon
+	n.feed.Unlock()
+
+	sort.Stable(changesByVersion(changes))
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(changes); err != nil {
+		n.logger.Printf("worker %d failed to list changes: %s", op.WID,
+			err.Error())
+		resp.ErrMsg = err.Error()
+		return
+	}
+	resp.Body = buf.Bytes()
+	return
+}
@@ -0,0 +1,366 @@
+// Package ring implements the consistent hash ring used to assign keys
+// to kludge nodes.
+//
+// Every key is hashed to a 32-bit token. Each node places a number of
+// virtual nodes on the ring; a virtual node at token p owns the tokens
+// from p up to (but not including) the next virtual node's token. A
+// key's preference list is built by walking clockwise from the virtual
+// node owning its token and collecting distinct nodes.
+package ring
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultVNodes is the number of virtual nodes placed on the ring for
+// each node if no other value is given.
+const DefaultVNodes = 64
+
+// Node identifies a single backend node. The ID determines the node's
+// position on the ring; the Addr is where the node's link listener
+// may be reached.
+type Node struct {
+	ID   string
+	Addr string
+}
+
+// Token returns the ring position for a key.
+func Token(key []byte) uint32 {
+	sum := md5.Sum(key)
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// Range is a half-open interval [Start, End) of tokens. If End is less
+// than Start, the range wraps around the top of the ring. If Start and
+// End are equal, the range covers the entire ring; the zero Range is
+// therefore the whole ring.
+type Range struct {
+	Start uint32
+	End   uint32
+}
+
+// Contains returns true if the token falls within the range.
+func (r Range) Contains(token uint32) bool {
+	switch {
+	case r.Start < r.End:
+		return token >= r.Start && token < r.End
+	case r.Start > r.End:
+		return token >= r.Start || token < r.End
+	default:
+		return true
+	}
+}
+
+// Size returns the number of tokens in the range.
+func (r Range) Size() uint64 {
+	if r.Start == r.End {
+		return 1 << 32
+	}
+	return uint64(r.End - r.Start)
+}
+
+// spans returns the range as one or two intervals that do not wrap,
+// in ascending order.
+func (r Range) spans() [][2]uint64 {
+	switch {
+	case r.Start < r.End:
+		return [][2]uint64{{uint64(r.Start), uint64(r.End)}}
+	case r.Start > r.End:
+		if r.End == 0 {
+			return [][2]uint64{{uint64(r.Start), 1 << 32}}
+		}
+		return [][2]uint64{{0, uint64(r.End)}, {uint64(r.Start), 1 << 32}}
+	default:
+		return [][2]uint64{{0, 1 << 32}}
+	}
+}
+
+// Intersect returns the parts of the range that are also in o.
+func (r Range) Intersect(o Range) []Range {
+	var parts []Range
+	for _, a := range r.spans() {
+		for _, b := range o.spans() {
+			lo, hi := a[0], a[1]
+			if b[0] > lo {
+				lo = b[0]
+			}
+			if b[1] < hi {
+				hi = b[1]
+			}
+			if lo < hi {
+				// An end of 1<<32 wraps to zero, as it should.
+				parts = append(parts, Range{uint32(lo), uint32(hi)})
+			}
+		}
+	}
+
+	// Join the pieces on either side of the top of the ring.
+	if n := len(parts); n > 1 && parts[0].Start == 0 && parts[n-1].End == 0 {
+		parts[n-1].End = parts[0].End
+		parts = parts[1:]
+	}
+	return parts
+}
+
+func (r Range) String() string {
+	return fmt.Sprintf("[%08x, %08x)", r.Start, r.End)
+}
+
+// A Segment is a range of the ring along with the nodes that replicate
+// it, in preference order.
+type Segment struct {
+	Range Range
+	Nodes []Node
+}
+
+type vnode struct {
+	token uint32
+	node  Node
+}
+
+// Ring is a consistent hash ring. It is safe for concurrent use.
+type Ring struct {
+	lock   sync.RWMutex
+	vnodes int
+	nodes  map[string]Node
+	points []vnode
+}
+
+// New returns an empty ring that will place vnodes virtual nodes for
+// each node added to it. If vnodes is not positive, DefaultVNodes is
+// used.
+func New(vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVNodes
+	}
+	return &Ring{
+		vnodes: vnodes,
+		nodes:  make(map[string]Node, 0),
+	}
+}
+
+// Add places a node on the ring. If a node with the same ID is already
+// present, its address is updated.
+func (r *Ring) Add(n Node) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.nodes[n.ID] = n
+	r.rebuild()
+}
+
+// Remove takes the node with the given ID off the ring.
+func (r *Ring) Remove(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.nodes[id]; !ok {
+		return
+	}
+	delete(r.nodes, id)
+	r.rebuild()
+}
+
+// VNodes returns the number of virtual nodes placed for each node.
+func (r *Ring) VNodes() int {
+	return r.vnodes
+}
+
+// Equal returns true if both rings hold the same nodes.
+func (r *Ring) Equal(o *Ring) bool {
+	a, b := r.Nodes(), o.Nodes()
+	if len(a) != len(b) || r.vnodes != o.vnodes {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Len returns the number of nodes on the ring.
+func (r *Ring) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.nodes)
+}
+
+// Node returns the node with the given ID, if it is on the ring.
+func (r *Ring) Node(id string) (n Node, ok bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	n, ok = r.nodes[id]
+	return
+}
+
+// Nodes returns all the nodes on the ring, sorted by ID.
+func (r *Ring) Nodes() []Node {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	nodes := make([]Node, 0, len(r.nodes))
+	for _, n := range r.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Sort(byID(nodes))
+	return nodes
+}
+
+// Copy returns an independent copy of the ring.
+func (r *Ring) Copy() *Ring {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	c := New(r.vnodes)
+	for id, n := range r.nodes {
+		c.nodes[id] = n
+	}
+	c.points = append(c.points, r.points...)
+	return c
+}
+
+func (r *Ring) rebuild() {
+	points := make([]vnode, 0, len(r.nodes)*r.vnodes)
+	for _, n := range r.nodes {
+		for i := 0; i < r.vnodes; i++ {
+			vkey := []byte(fmt.Sprintf("%s-%d", n.ID, i))
+			points = append(points, vnode{Token(vkey), n})
+		}
+	}
+	sort.Sort(byToken(points))
+	r.points = points
+}
+
+// owner returns the index of the virtual node owning the token.
+func (r *Ring) owner(token uint32) int {
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].token > token
+	})
+	if i == 0 {
+		return len(r.points) - 1
+	}
+	return i - 1
+}
+
+// walk collects up to n distinct nodes, starting at the virtual node
+// at index i and moving clockwise.
+func (r *Ring) walk(i, n int) []Node {
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	nodes := make([]Node, 0, n)
+	seen := make(map[string]bool, n)
+	for j := 0; len(nodes) < n && j < len(r.points); j++ {
+		vn := r.points[(i+j)%len(r.points)]
+		if seen[vn.node.ID] {
+			continue
+		}
+		seen[vn.node.ID] = true
+		nodes = append(nodes, vn.node)
+	}
+	return nodes
+}
+
+// Lookup returns the preference list for a key: the n distinct nodes
+// responsible for storing it, in order. Fewer than n nodes will be
+// returned if the ring is smaller than n.
+func (r *Ring) Lookup(key []byte, n int) []Node {
+	return r.LookupToken(Token(key), n)
+}
+
+// LookupToken returns the preference list for a token.
+func (r *Ring) LookupToken(token uint32, n int) []Node {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if len(r.points) == 0 {
+		return nil
+	}
+	return r.walk(r.owner(token), n)
+}
+
+// Segments divides the ring into the ranges owned by each virtual node,
+// and returns each range with its n replicas.
+func (r *Ring) Segments(n int) []Segment {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	segs := make([]Segment, 0, len(r.points))
+	for i := range r.points {
+		next := r.points[(i+1)%len(r.points)].token
+		if next == r.points[i].token && len(r.points) > 1 {
+			// Two virtual nodes collided; the first owns nothing.
+			continue
+		}
+		segs = append(segs, Segment{
+			Range: Range{r.points[i].token, next},
+			Nodes: r.walk(i, n),
+		})
+	}
+	return segs
+}
+
+// Replicated returns the segments for which the node with the given
+// ID is one of the n replicas.
+func (r *Ring) Replicated(id string, n int) []Segment {
+	var segs []Segment
+	for _, seg := range r.Segments(n) {
+		if seg.Has(id) {
+			segs = append(segs, seg)
+		}
+	}
+	return segs
+}
+
+// Has returns true if the node with the given ID replicates the segment.
+func (seg Segment) Has(id string) bool {
+	for _, n := range seg.Nodes {
+		if n.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+type byToken []vnode
+
+func (p byToken) Len() int      { return len(p) }
+func (p byToken) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byToken) Less(i, j int) bool {
+	if p[i].token == p[j].token {
+		return p[i].node.ID < p[j].node.ID
+	}
+	return p[i].token < p[j].token
+}
+
+type byID []Node
+
+func (p byID) Len() int           { return len(p) }
+func (p byID) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byID) Less(i, j int) bool { return p[i].ID < p[j].ID }
+
+// ParseNodes parses a comma-separated list of nodes, as found in the
+// configuration files. Each entry is either an address, in which case
+// the address doubles as the node's ID, or an entry of the form
+// id@address.
+func ParseNodes(list string) (nodes []Node, err error) {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var n Node
+		if at := strings.LastIndex(entry, "@"); at >= 0 {
+			n.ID, n.Addr = entry[:at], entry[at+1:]
+		} else {
+			n.ID, n.Addr = entry, entry
+		}
+		if n.ID == "" || n.Addr == "" {
+			err = fmt.Errorf("ring: invalid node %q", entry)
+			return
+		}
+		nodes = append(nodes, n)
+	}
+	return
+}
@@ -0,0 +1,146 @@
+package ring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testRing(ids ...string) *Ring {
+	r := New(0)
+	for _, id := range ids {
+		r.Add(Node{id, id + ":5987"})
+	}
+	return r
+}
+
+func TestRangeContains(t *testing.T) {
+	r := Range{10, 20}
+	if !r.Contains(10) || !r.Contains(19) || r.Contains(20) || r.Contains(9) {
+		fmt.Println("[!] bad containment for", r)
+		t.FailNow()
+	}
+
+	r = Range{0xfffffff0, 0x10}
+	if !r.Contains(0xffffffff) || !r.Contains(0) || r.Contains(0x10) {
+		fmt.Println("[!] bad containment for", r)
+		t.FailNow()
+	}
+
+	if !(Range{}).Contains(12345) || (Range{}).Size() != 1<<32 {
+		fmt.Println("[!] zero range should cover the ring")
+		t.FailNow()
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	cases := []struct {
+		a, b Range
+		want []Range
+	}{
+		{Range{10, 20}, Range{15, 30}, []Range{{15, 20}}},
+		{Range{10, 20}, Range{20, 30}, nil},
+		{Range{10, 20}, Range{}, []Range{{10, 20}}},
+		{Range{0xfffffff0, 0x10}, Range{0x8, 0xfffffff8}, []Range{{0x8, 0x10}, {0xfffffff0, 0xfffffff8}}},
+		{Range{0xfffffff0, 0x10}, Range{0xfffffff8, 0x8}, []Range{{0xfffffff8, 0x8}}},
+		{Range{}, Range{}, []Range{{0, 0}}},
+	}
+	for _, c := range cases {
+		got := c.a.Intersect(c.b)
+		if fmt.Sprint(got) != fmt.Sprint(c.want) {
+			fmt.Printf("[!] %s intersect %s: expected %v, got %v\n",
+				c.a, c.b, c.want, got)
+			t.FailNow()
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	r := testRing("a", "b", "c", "d")
+	nodes := r.Lookup([]byte("foo"), 3)
+	if len(nodes) != 3 {
+		fmt.Printf("[!] expected 3 replicas, got %d\n", len(nodes))
+		t.FailNow()
+	}
+	seen := make(map[string]bool, 0)
+	for _, n := range nodes {
+		if seen[n.ID] {
+			fmt.Println("[!] duplicate replica", n.ID)
+			t.FailNow()
+		}
+		seen[n.ID] = true
+	}
+
+	if len(r.Lookup([]byte("foo"), 10)) != 4 {
+		fmt.Println("[!] lookup should be limited to the ring size")
+		t.FailNow()
+	}
+	if len(New(0).Lookup([]byte("foo"), 3)) != 0 {
+		fmt.Println("[!] empty ring returned replicas")
+		t.FailNow()
+	}
+}
+
+func TestLookupStable(t *testing.T) {
+	r := testRing("a", "b", "c")
+	before := r.Lookup([]byte("foo"), 1)[0]
+
+	// Adding a node only moves keys to the new node.
+	r.Add(Node{"d", "d:5987"})
+	after := r.Lookup([]byte("foo"), 1)[0]
+	if after.ID != before.ID && after.ID != "d" {
+		fmt.Printf("[!] key moved from %s to %s\n", before.ID, after.ID)
+		t.FailNow()
+	}
+}
+
+func TestSegments(t *testing.T) {
+	r := testRing("a", "b", "c")
+	segs := r.Segments(2)
+
+	var total uint64
+	for _, seg := range segs {
+		total += seg.Range.Size()
+		if len(seg.Nodes) != 2 {
+			fmt.Println("[!] segment with wrong replica count", seg)
+			t.FailNow()
+		}
+	}
+	if total != 1<<32 {
+		fmt.Printf("[!] segments cover %d tokens\n", total)
+		t.FailNow()
+	}
+
+	for _, key := range []string{"foo", "bar", "baz", "quux"} {
+		token := Token([]byte(key))
+		owners := r.LookupToken(token, 2)
+		for _, seg := range segs {
+			if !seg.Range.Contains(token) {
+				continue
+			}
+			if seg.Nodes[0] != owners[0] || seg.Nodes[1] != owners[1] {
+				fmt.Println("[!] segment replicas don't match lookup")
+				t.FailNow()
+			}
+		}
+	}
+}
+
+func TestParseNodes(t *testing.T) {
+	nodes, err := ParseNodes("10.0.0.1:5987, node-b@10.0.0.2:5987,")
+	if err != nil {
+		fmt.Println("[!] parse failed:", err.Error())
+		t.FailNow()
+	} else if len(nodes) != 2 {
+		fmt.Printf("[!] expected 2 nodes, got %d\n", len(nodes))
+		t.FailNow()
+	} else if nodes[0].ID != "10.0.0.1:5987" || nodes[1].ID != "node-b" ||
+		nodes[1].Addr != "10.0.0.2:5987" {
+		fmt.Printf("[!] unexpected nodes %+v\n", nodes)
+		t.FailNow()
+	}
+
+	if _, err = ParseNodes("@10.0.0.1:5987"); err == nil {
+		fmt.Println("[!] expected error for empty node ID")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,313 @@
+package sim
+
+import (
+	"fmt"
+	"github.com/gokyle/kludge/frontend"
+	"github.com/gokyle/kludge/node"
+	"github.com/gokyle/kludge/ring"
+	"time"
+)
+
+// Logger receives the log output of every member of the cluster.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// Options describe a simulated cluster.
+type Options struct {
+	// Seed seeds the network's random choices.
+	Seed int64
+
+	Nodes     int
+	Frontends int
+
+	// The replication settings, as in the frontend's config. Quorums
+	// that are not given default to a majority of the replicas.
+	Replicas      int
+	ReadQuorum    int
+	WriteQuorum   int
+	HintedHandoff bool
+
+	// MaxValueSize and WatchInterval are passed on to the frontends'
+	// config, and ChunkSize and BackupDir to the nodes'.
+	MaxValueSize  int64
+	WatchInterval time.Duration
+	ChunkSize     int
+	BackupDir     string
+
+	// VNodes is the number of virtual nodes per node; fewer than the
+	// usual number keep anti-entropy and rebalancing quick.
+	VNodes int
+
+	Logger Logger
+}
+
+// Node is a node in a simulated cluster. Its store survives crashes.
+type Node struct {
+	*node.Node
+	Addr  string
+	Store *node.MemStore
+	Clock *Clock
+	Up    bool
+}
+
+// Frontend is a frontend in a simulated cluster.
+type Frontend struct {
+	*frontend.Frontend
+	Addr  string
+	Clock *Clock
+}
+
+// Cluster is a set of nodes and frontends on a simulated network. Its
+// methods are not safe for concurrent use, though the nodes and
+// frontends themselves are.
+type Cluster struct {
+	Net       *Network
+	Nodes     []*Node
+	Frontends []*Frontend
+	opts      Options
+}
+
+// New sets up a cluster with every member running and reachable.
+func New(opts Options) (c *Cluster, err error) {
+	if opts.Nodes < 1 {
+		return nil, fmt.Errorf("sim: a cluster needs at least one node")
+	}
+	if opts.Frontends < 1 {
+		opts.Frontends = 1
+	}
+	if opts.Replicas < 1 {
+		opts.Replicas = 1
+	}
+	if opts.VNodes < 1 {
+		opts.VNodes = 8
+	}
+	c = &Cluster{Net: NewNetwork(opts.Seed), opts: opts}
+
+	r := ring.New(opts.VNodes)
+	for i := 0; i < opts.Nodes; i++ {
+		addr := fmt.Sprintf("node%d", i)
+		r.Add(ring.Node{ID: addr, Addr: addr})
+		c.Nodes = append(c.Nodes, &Node{
+			Addr:  addr,
+			Store: node.NewMemStore(),
+			Clock: new(Clock),
+		})
+	}
+	for _, n := range c.Nodes {
+		if err = c.start(n, r.Copy()); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := 0; i < opts.Frontends; i++ {
+		fe := &Frontend{
+			Addr:  fmt.Sprintf("frontend%d", i),
+			Clock: new(Clock),
+		}
+		fe.Frontend, err = frontend.New(frontend.Config{
+			Ring:          r.Copy(),
+			Replicas:      opts.Replicas,
+			ReadQuorum:    opts.ReadQuorum,
+			WriteQuorum:   opts.WriteQuorum,
+			HintedHandoff: opts.HintedHandoff,
+			MaxValueSize:  opts.MaxValueSize,
+			WatchInterval: opts.WatchInterval,
+			Send:          c.Net.Link(fe.Addr),
+			Clock:         fe.Clock.Now,
+			Logger:        c.logger(fe.Addr),
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.Frontends = append(c.Frontends, fe)
+	}
+
+	// Settle every node on the initial ring, so that only ranges moved
+	// by later changes are transferred.
+	c.Rebalance()
+	return c, nil
+}
+
+type prefixLogger struct {
+	prefix string
+	logger Logger
+}
+
+func (l prefixLogger) Printf(format string, args ...interface{}) {
+	l.logger.Printf(l.prefix+format, args...)
+}
+
+func (c *Cluster) logger(addr string) Logger {
+	if c.opts.Logger == nil {
+		return nil
+	}
+	return prefixLogger{addr + ": ", c.opts.Logger}
+}
+
+// start runs a node over its store and attaches it to the network.
+func (c *Cluster) start(n *Node, r *ring.Ring) (err error) {
+	cfg := node.DefaultConfig()
+	cfg.ID = n.Addr
+	cfg.Addr = n.Addr
+	cfg.Ring = r
+	cfg.Replicas = c.opts.Replicas
+	cfg.ChunkSize = c.opts.ChunkSize
+	cfg.BackupDir = c.opts.BackupDir
+	cfg.Store = n.Store
+	cfg.Send = c.Net.Link(n.Addr)
+	cfg.Clock = n.Clock.Now
+	cfg.Logger = c.logger(n.Addr)
+	if n.Node, err = node.New(cfg); err != nil {
+		return
+	}
+	c.Net.Listen(n.Addr, n.Node.Handle)
+	n.Up = true
+	return
+}
+
+// Frontend returns the i'th frontend.
+func (c *Cluster) Frontend(i int) *Frontend {
+	return c.Frontends[i]
+}
+
+// Node returns the node with the given address.
+func (c *Cluster) Node(addr string) *Node {
+	for _, n := range c.Nodes {
+		if n.Addr == addr {
+			return n
+		}
+	}
+	return nil
+}
+
+// Replicas returns the nodes holding the key, in preference order.
+func (c *Cluster) Replicas(key string) []*Node {
+	var nodes []*Node
+	r := ring.New(c.opts.VNodes)
+	for _, n := range c.Nodes {
+		r.Add(ring.Node{ID: n.Addr, Addr: n.Addr})
+	}
+	for _, rn := range r.Lookup([]byte(key), c.opts.Replicas) {
+		nodes = append(nodes, c.Node(rn.ID))
+	}
+	return nodes
+}
+
+// Crash stops a node; messages to it are refused until it restarts.
+// Its store is kept.
+func (c *Cluster) Crash(n *Node) {
+	c.Net.Close(n.Addr)
+	n.Up = false
+}
+
+// Restart starts a crashed node afresh over its store, as a process
+// restart would.
+func (c *Cluster) Restart(n *Node) error {
+	if n.Up {
+		return fmt.Errorf("sim: %s is running", n.Addr)
+	}
+	r := ring.New(c.opts.VNodes)
+	for _, peer := range c.Nodes {
+		r.Add(ring.Node{ID: peer.Addr, Addr: peer.Addr})
+	}
+	return c.start(n, r)
+}
+
+// AddNode brings a new node into the cluster, placing it on the ring of
+// every member. The nodes must be rebalanced for it to take over its
+// share of the data.
+func (c *Cluster) AddNode() (n *Node, err error) {
+	n = &Node{
+		Addr:  fmt.Sprintf("node%d", len(c.Nodes)),
+		Store: node.NewMemStore(),
+		Clock: new(Clock),
+	}
+	peer := ring.Node{ID: n.Addr, Addr: n.Addr}
+	r := ring.New(c.opts.VNodes)
+	r.Add(peer)
+	for _, other := range c.Nodes {
+		r.Add(ring.Node{ID: other.Addr, Addr: other.Addr})
+		other.AddPeer(peer)
+	}
+	if err = c.start(n, r); err != nil {
+		return nil, err
+	}
+	c.Nodes = append(c.Nodes, n)
+	for _, fe := range c.Frontends {
+		fe.AddNode(peer)
+	}
+	return
+}
+
+// RemoveNode takes a node off the ring of every member. The node keeps
+// running, so that the remaining nodes can pull its data from it when
+// they are rebalanced; it may be crashed afterwards.
+func (c *Cluster) RemoveNode(n *Node) {
+	for _, fe := range c.Frontends {
+		fe.RemoveNode(n.Addr)
+	}
+	for i, other := range c.Nodes {
+		if other == n {
+			c.Nodes = append(c.Nodes[:i], c.Nodes[i+1:]...)
+			break
+		}
+	}
+	for _, other := range c.Nodes {
+		other.RemovePeer(n.Addr)
+	}
+}
+
+// up returns the nodes that are running.
+func (c *Cluster) up() (nodes []*Node) {
+	for _, n := range c.Nodes {
+		if n.Up {
+			nodes = append(nodes, n)
+		}
+	}
+	return
+}
+
+// Wait waits for the work every frontend has left running in the
+// background to finish.
+func (c *Cluster) Wait() {
+	for _, fe := range c.Frontends {
+		fe.Wait()
+	}
+}
+
+// SyncReplicas runs a round of anti-entropy on every running node, in
+// order, and returns the number of records pulled.
+func (c *Cluster) SyncReplicas() (pulled int) {
+	for _, n := range c.up() {
+		pulled += n.SyncReplicas()
+	}
+	return
+}
+
+// DeliverHints has every running node attempt to deliver its hints,
+// and returns the number delivered.
+func (c *Cluster) DeliverHints() (delivered int) {
+	for _, n := range c.up() {
+		delivered += n.DeliverHints()
+	}
+	return
+}
+
+// Hints returns the number of hints held across the running nodes.
+func (c *Cluster) Hints() (hints int64) {
+	for _, n := range c.up() {
+		hints += n.Hints()
+	}
+	return
+}
+
+// Rebalance has every running node take over the ranges it has gained,
+// and returns true if all of them settled.
+func (c *Cluster) Rebalance() bool {
+	settled := true
+	for _, n := range c.up() {
+		settled = n.Rebalance() && settled
+	}
+	return settled
+}
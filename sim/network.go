@@ -0,0 +1,265 @@
+// Package sim runs kludge clusters inside a single process, for tests.
+// Nodes and frontends talk over a simulated network in place of the
+// TCP node link. The network can partition the cluster, delay or drop
+// messages, and refuse connections to crashed nodes, and each member
+// has its own clock that may be skewed.
+//
+// The network's random choices for a message are derived from the
+// network's seed, the endpoints, the operation and its key, and the
+// number of such messages sent before it. They do not depend on the
+// order in which goroutines run, so a test that sends its requests one
+// at a time sees the same faults on every run.
+// Background tasks are not started; tests run anti-entropy, hint
+// delivery and rebalancing explicitly, so that they happen at known
+// points.
+package sim
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRefused is returned for messages to an endpoint that is not
+	// listening, as when its process has crashed.
+	ErrRefused = errors.New("sim: connection refused")
+
+	// ErrUnreachable is returned for messages across a partition.
+	ErrUnreachable = errors.New("sim: host unreachable")
+
+	// ErrTimeout is returned for messages that are dropped, in either
+	// direction.
+	ErrTimeout = errors.New("sim: i/o timeout")
+)
+
+// A Handler answers the operations sent to an endpoint.
+type Handler func(op *common.Operation) *common.Response
+
+// Conditions describe the behaviour of messages from one endpoint to
+// another. Each message is delayed by Delay plus up to Jitter, and is
+// lost with probability Drop.
+type Conditions struct {
+	Delay  time.Duration
+	Jitter time.Duration
+	Drop   float64
+}
+
+// Network connects the endpoints of a simulated cluster.
+type Network struct {
+	lock     sync.Mutex
+	seed     int64
+	handlers map[string]Handler
+	links    map[[2]string]Conditions
+	def      Conditions
+	groups   map[string]int
+	seen     map[string]uint64
+
+	sent, dropped, refused int
+}
+
+// NewNetwork returns a network with no faults whose random choices
+// are derived from the seed.
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		seed:     seed,
+		handlers: make(map[string]Handler, 0),
+		links:    make(map[[2]string]Conditions, 0),
+		seen:     make(map[string]uint64, 0),
+	}
+}
+
+// Listen attaches a handler to the address, replacing any handler
+// already there.
+func (n *Network) Listen(addr string, h Handler) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.handlers[addr] = h
+}
+
+// Close detaches the handler from the address; messages to it are
+// refused until another handler is attached.
+func (n *Network) Close(addr string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.handlers, addr)
+}
+
+// SetDefault sets the conditions for every pair of endpoints that has
+// none of its own.
+func (n *Network) SetDefault(c Conditions) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.def = c
+}
+
+// SetLink sets the conditions for messages from one endpoint to
+// another. The reverse direction is unaffected.
+func (n *Network) SetLink(from, to string, c Conditions) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.links[[2]string{from, to}] = c
+}
+
+// ClearLinks returns every pair of endpoints to the default conditions.
+func (n *Network) ClearLinks() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.links = make(map[[2]string]Conditions, 0)
+}
+
+// Partition divides the network into the given groups of addresses;
+// endpoints may only reach others in the same group. Addresses not in
+// any group form a group of their own.
+func (n *Network) Partition(groups ...[]string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.groups = make(map[string]int, 0)
+	for i, group := range groups {
+		for _, addr := range group {
+			n.groups[addr] = i + 1
+		}
+	}
+}
+
+// Heal removes any partition.
+func (n *Network) Heal() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.groups = nil
+}
+
+// Counts returns the number of messages sent, dropped and refused.
+func (n *Network) Counts() (sent, dropped, refused int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.sent, n.dropped, n.refused
+}
+
+// draw returns two random numbers for a message. The network's lock
+// must be held.
+func (n *Network) draw(from, to string, op *common.Operation) (uint64, uint64) {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d\x00%s\x00%s\x00%d\x00", n.seed, from, to, op.OpCode)
+	h.Write(op.Key)
+	id := string(h.Sum(nil))
+	count := n.seen[id]
+	n.seen[id]++
+
+	rng := rand.New(rand.NewSource(int64(h.Sum64() ^ count*0x9e3779b97f4a7c15)))
+	return rng.Uint64(), rng.Uint64()
+}
+
+// deliver decides the fate of a message from one endpoint to another,
+// returning the delay to apply or the error the sender sees.
+func (n *Network) deliver(from, to string, op *common.Operation) (delay time.Duration, err error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.sent++
+	if n.groups != nil && n.groups[from] != n.groups[to] {
+		n.dropped++
+		return 0, ErrUnreachable
+	}
+
+	cond, ok := n.links[[2]string{from, to}]
+	if !ok {
+		cond = n.def
+	}
+	drop, jitter := n.draw(from, to, op)
+	if float64(drop>>11)/(1<<53) < cond.Drop {
+		n.dropped++
+		return 0, ErrTimeout
+	}
+	delay = cond.Delay
+	if cond.Jitter > 0 {
+		delay += time.Duration(jitter % uint64(cond.Jitter))
+	}
+	return
+}
+
+func (n *Network) handler(addr string) (h Handler, ok bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	h, ok = n.handlers[addr]
+	if !ok {
+		n.refused++
+	}
+	return
+}
+
+// Link returns a function that sends operations from the endpoint at
+// the given address, for use as the Send function of a node or
+// frontend. Operations and responses are passed through gob, as on the
+// real link, so that the handler never shares memory with the sender.
+func (n *Network) Link(from string) func(addr string, op *common.Operation) (*common.Response, error) {
+	return func(to string, op *common.Operation) (*common.Response, error) {
+		return n.send(from, to, op)
+	}
+}
+
+func (n *Network) send(from, to string, op *common.Operation) (resp *common.Response, err error) {
+	h, ok := n.handler(to)
+	if !ok {
+		return nil, ErrRefused
+	}
+	delay, err := n.deliver(from, to, op)
+	if err != nil {
+		return
+	}
+	time.Sleep(delay)
+
+	req := new(common.Operation)
+	if err = roundTrip(op, req); err != nil {
+		return
+	}
+	reply := h(req)
+
+	if delay, err = n.deliver(to, from, op); err != nil {
+		return
+	}
+	time.Sleep(delay)
+
+	resp = new(common.Response)
+	if err = roundTrip(reply, resp); err != nil {
+		return nil, err
+	}
+	if resp.ErrMsg != "" {
+		err = errors.New(resp.ErrMsg)
+	}
+	return
+}
+
+func roundTrip(in, out interface{}) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(in); err != nil {
+		return err
+	}
+	return gob.NewDecoder(buf).Decode(out)
+}
+
+// Clock is a clock that runs at the speed of the local clock, offset by
+// a skew that may be changed at any time.
+type Clock struct {
+	lock sync.Mutex
+	skew time.Duration
+}
+
+// Now returns the skewed time.
+func (c *Clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return time.Now().Add(c.skew)
+}
+
+// Skew sets the clock's offset from the local clock.
+func (c *Clock) Skew(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.skew = d
+}
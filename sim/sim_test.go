@@ -0,0 +1,1288 @@
+package sim
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/gokyle/kludge/common"
+	"github.com/gokyle/kludge/frontend"
+	"github.com/gokyle/kludge/node"
+	"github.com/gokyle/kludge/ring"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCluster(t *testing.T, opts Options) *Cluster {
+	c, err := New(opts)
+	if err != nil {
+		fmt.Println("[!] failed to set up cluster:", err.Error())
+		t.FailNow()
+	}
+	return c
+}
+
+// stored returns the value a node holds for the key, bypassing the
+// network.
+func stored(n *Node, key string) (string, bool) {
+	resp := n.Handle(&common.Operation{OpCode: common.OpGet, Key: []byte(key)})
+	return string(resp.Body), resp.KeyOK
+}
+
+func mustSet(t *testing.T, fe *Frontend, key, value string) {
+	if _, _, err := fe.Set(key, []byte(value)); err != nil {
+		fmt.Printf("[!] failed to set %s: %s\n", key, err.Error())
+		t.FailNow()
+	}
+}
+
+func TestReplication(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 5, Replicas: 3})
+	fe := c.Frontend(0)
+
+	mustSet(t, fe, "foo", "bar")
+	c.Wait()
+	for _, n := range c.Replicas("foo") {
+		if v, ok := stored(n, "foo"); !ok || v != "bar" {
+			fmt.Printf("[!] %s holds %q, %v\n", n.Addr, v, ok)
+			t.FailNow()
+		}
+	}
+
+	prev, ok, err := fe.Set("foo", []byte("baz"))
+	if err != nil || !ok || string(prev) != "bar" {
+		fmt.Printf("[!] expected previous value bar, got %q, %v, %v\n",
+			prev, ok, err)
+		t.FailNow()
+	}
+
+	keys, err := fe.Keys()
+	if err != nil || fmt.Sprint(keys) != "[foo]" {
+		fmt.Println("[!] bad key list:", keys, err)
+		t.FailNow()
+	}
+}
+
+func TestQuorumFailure(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 3, Replicas: 3})
+	fe := c.Frontend(0)
+	mustSet(t, fe, "foo", "bar")
+
+	replicas := c.Replicas("foo")
+	c.Crash(replicas[0])
+	if _, _, err := fe.Get("foo"); err != nil {
+		fmt.Println("[!] read should survive one failure:", err.Error())
+		t.FailNow()
+	}
+
+	c.Crash(replicas[1])
+	if _, _, err := fe.Get("foo"); err != frontend.ErrQuorum {
+		fmt.Println("[!] expected a quorum failure, got", err)
+		t.FailNow()
+	}
+	if _, _, err := fe.Set("foo", []byte("baz")); err != frontend.ErrQuorum {
+		fmt.Println("[!] expected a quorum failure, got", err)
+		t.FailNow()
+	}
+}
+
+func TestHintedHandoff(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 5, Replicas: 3, HintedHandoff: true})
+	fe := c.Frontend(0)
+
+	replicas := c.Replicas("foo")
+	c.Crash(replicas[0])
+	c.Crash(replicas[1])
+	mustSet(t, fe, "foo", "bar")
+	c.Wait()
+	if hints := c.Hints(); hints != 2 {
+		fmt.Println("[!] expected 2 hints, found", hints)
+		t.FailNow()
+	}
+
+	if c.DeliverHints() != 0 {
+		fmt.Println("[!] hints delivered to crashed nodes")
+		t.FailNow()
+	}
+	c.Restart(replicas[0])
+	c.Restart(replicas[1])
+	if n := c.DeliverHints(); n != 2 {
+		fmt.Println("[!] expected 2 hints delivered, got", n)
+		t.FailNow()
+	}
+	for _, n := range replicas {
+		if v, ok := stored(n, "foo"); !ok || v != "bar" {
+			fmt.Printf("[!] %s holds %q, %v\n", n.Addr, v, ok)
+			t.FailNow()
+		}
+	}
+}
+
+func TestConcurrentHintDelivery(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 5, Replicas: 3, HintedHandoff: true})
+	fe := c.Frontend(0)
+
+	down := c.Nodes[:2]
+	for _, n := range down {
+		c.Crash(n)
+	}
+	for i := 0; i < 40; i++ {
+		mustSet(t, fe, fmt.Sprintf("key%02d", i), "value")
+	}
+	c.Wait()
+	hints := c.Hints()
+	if hints == 0 {
+		fmt.Println("[!] no hints stored")
+		t.FailNow()
+	}
+
+	for _, n := range down {
+		c.Restart(n)
+	}
+	results := make(chan int)
+	for i := 0; i < 4; i++ {
+		go func() { results <- c.DeliverHints() }()
+	}
+	delivered := 0
+	for i := 0; i < 4; i++ {
+		delivered += <-results
+	}
+	if int64(delivered) != hints || c.Hints() != 0 {
+		fmt.Printf("[!] %d hints delivered of %d, %d left\n", delivered,
+			hints, c.Hints())
+		t.FailNow()
+	}
+}
+
+// partitionReplica cuts a replica of the key off from the rest of the
+// cluster, writes the key, and heals the partition.
+func partitionReplica(t *testing.T, c *Cluster, key, value string) *Node {
+	lost := c.Replicas(key)[2]
+	var others []string
+	for _, n := range c.Nodes {
+		if n != lost {
+			others = append(others, n.Addr)
+		}
+	}
+	for _, fe := range c.Frontends {
+		others = append(others, fe.Addr)
+	}
+	c.Net.Partition(others, []string{lost.Addr})
+	mustSet(t, c.Frontend(0), key, value)
+	c.Wait()
+	c.Net.Heal()
+
+	if _, ok := stored(lost, key); ok {
+		fmt.Println("[!] write crossed the partition")
+		t.FailNow()
+	}
+	return lost
+}
+
+func TestReadRepair(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 3, Replicas: 3})
+	lost := partitionReplica(t, c, "foo", "bar")
+
+	if v, ok, err := c.Frontend(0).Get("foo"); err != nil || !ok || string(v) != "bar" {
+		fmt.Printf("[!] read returned %q, %v, %v\n", v, ok, err)
+		t.FailNow()
+	}
+	c.Wait()
+	if v, ok := stored(lost, "foo"); !ok || v != "bar" {
+		fmt.Printf("[!] read repair left %q, %v\n", v, ok)
+		t.FailNow()
+	}
+}
+
+func TestAntiEntropy(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 3, Replicas: 3})
+	lost := partitionReplica(t, c, "foo", "bar")
+	partitionReplica(t, c, "baz", "quux")
+
+	if pulled := c.SyncReplicas(); pulled == 0 {
+		fmt.Println("[!] anti-entropy pulled nothing")
+		t.FailNow()
+	}
+	if v, ok := stored(lost, "foo"); !ok || v != "bar" {
+		fmt.Printf("[!] anti-entropy left %q, %v\n", v, ok)
+		t.FailNow()
+	}
+	if pulled := c.SyncReplicas(); pulled != 0 {
+		fmt.Println("[!] replicas still differ after anti-entropy")
+		t.FailNow()
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 3, Replicas: 3, Frontends: 2})
+	fast, slow := c.Frontend(0), c.Frontend(1)
+	slow.Clock.Skew(-time.Hour)
+
+	mustSet(t, fast, "foo", "fast")
+	mustSet(t, slow, "foo", "slow")
+
+	// The later write carries the older version, and loses.
+	if v, _, err := slow.Get("foo"); err != nil || string(v) != "fast" {
+		fmt.Printf("[!] expected the fast clock's write to win, got %q\n", v)
+		t.FailNow()
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 3, Replicas: 2})
+	fe := c.Frontend(0)
+	for i := 0; i < 64; i++ {
+		mustSet(t, fe, fmt.Sprintf("key%d", i), fmt.Sprint(i))
+	}
+
+	added, err := c.AddNode()
+	if err != nil {
+		fmt.Println("[!] failed to add node:", err.Error())
+		t.FailNow()
+	}
+	if !c.Rebalance() {
+		fmt.Println("[!] cluster failed to settle")
+		t.FailNow()
+	}
+	if added.Store.Len() == 0 {
+		fmt.Println("[!] new node received no keys")
+		t.FailNow()
+	}
+
+	c.RemoveNode(c.Nodes[0])
+	if !c.Rebalance() {
+		fmt.Println("[!] cluster failed to settle")
+		t.FailNow()
+	}
+	for i := 0; i < 64; i++ {
+		key := fmt.Sprintf("key%d", i)
+		for _, n := range c.Replicas(key) {
+			if v, ok := stored(n, key); !ok || v != fmt.Sprint(i) {
+				fmt.Printf("[!] %s holds %q for %s\n", n.Addr, v, key)
+				t.FailNow()
+			}
+		}
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 3, Replicas: 2})
+	fe := c.Frontend(0)
+	if _, err := fe.CreateNamespace("team"); err != nil {
+		fmt.Println("[!] failed to create namespace:", err.Error())
+		t.FailNow()
+	}
+	for i := 0; i < 48; i++ {
+		w := httptest.NewRecorder()
+		fe.ServeHTTP(w, httptest.NewRequest("PUT", fmt.Sprintf("/ns/team/data/key%d", i),
+			strings.NewReader("0123456789")))
+		if w.Code != http.StatusCreated {
+			fmt.Println("[!] write answered with", w.Code)
+			t.FailNow()
+		}
+	}
+	if _, err := c.AddNode(); err != nil {
+		fmt.Println("[!] failed to add node:", err.Error())
+		t.FailNow()
+	}
+	if !c.Rebalance() {
+		fmt.Println("[!] cluster failed to settle")
+		t.FailNow()
+	}
+
+	w := httptest.NewRecorder()
+	fe.ServeHTTP(w, httptest.NewRequest("POST", "/admin/rebalance/cleanup", nil))
+	var removed map[string]int64
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &removed) != nil {
+		fmt.Println("[!] cleanup answered with", w.Code, w.Body.String())
+		t.FailNow()
+	}
+	total := int64(0)
+	for _, n := range removed {
+		total += n
+	}
+	if total == 0 {
+		fmt.Println("[!] cleanup removed nothing")
+		t.FailNow()
+	}
+
+	for i := 0; i < 48; i++ {
+		key := common.NamespacePrefix + "team\x00" + fmt.Sprintf("key%d", i)
+		held := 0
+		for _, n := range c.Nodes {
+			if _, ok := stored(n, key); ok {
+				held++
+			}
+		}
+		if held != 2 {
+			fmt.Printf("[!] key%d is held by %d nodes after cleanup\n", i, held)
+			t.FailNow()
+		}
+	}
+	if usage, err := fe.Usage("team"); err != nil || usage.Keys != 48 || usage.Bytes != 480 {
+		fmt.Println("[!] usage after cleanup reported as", usage, err)
+		t.FailNow()
+	}
+}
+
+// faults runs a series of writes over a lossy network and returns the
+// outcome of each.
+func faults(t *testing.T, seed int64) string {
+	c := testCluster(t, Options{Seed: seed, Nodes: 3, Replicas: 3})
+	c.Net.SetDefault(Conditions{Drop: 0.25})
+	outcome := ""
+	for i := 0; i < 32; i++ {
+		_, _, err := c.Frontend(0).Set(fmt.Sprintf("key%d", i), []byte("x"))
+		if err != nil {
+			outcome += "x"
+		} else {
+			outcome += "."
+		}
+	}
+	c.Wait()
+	return outcome
+}
+
+func TestDeterminism(t *testing.T) {
+	first := faults(t, 42)
+	if second := faults(t, 42); first != second {
+		fmt.Printf("[!] runs with the same seed differ:\n\t%s\n\t%s\n",
+			first, second)
+		t.FailNow()
+	}
+	if first == faults(t, 43) {
+		fmt.Println("[!] runs with different seeds are identical")
+		t.FailNow()
+	}
+}
+
+func TestNetworkDelay(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 1})
+	c.Net.SetLink("frontend0", "node0", Conditions{Delay: 20 * time.Millisecond})
+
+	start := time.Now()
+	mustSet(t, c.Frontend(0), "foo", "bar")
+	if time.Since(start) < 20*time.Millisecond {
+		fmt.Println("[!] request was not delayed")
+		t.FailNow()
+	}
+
+	c.Net.ClearLinks()
+	start = time.Now()
+	mustSet(t, c.Frontend(0), "foo", "bar")
+	if time.Since(start) >= 20*time.Millisecond {
+		fmt.Println("[!] request was still delayed")
+		t.FailNow()
+	}
+}
+
+func TestETag(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 3, Replicas: 3})
+	fe := c.Frontend(0)
+	mustSet(t, fe, "foo", "bar")
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/data/foo", nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		fe.ServeHTTP(w, r)
+		return w
+	}
+	w := get("")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		fmt.Println("[!] no ETag on GET:", w.Code)
+		t.FailNow()
+	}
+	if w = get(etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		fmt.Println("[!] matching ETag was not answered with 304:", w.Code)
+		t.FailNow()
+	}
+
+	mustSet(t, fe, "foo", "baz")
+	if w = get(etag); w.Code != http.StatusOK || w.Body.String() != "baz" {
+		fmt.Println("[!] stale ETag matched:", w.Code)
+		t.FailNow()
+	}
+}
+
+func TestChunkedSet(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 3, Replicas: 3, MaxValueSize: 16})
+	fe := c.Frontend(0)
+
+	set := func(key, value string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		// A body of unknown length is read as a chunked one would be.
+		body := io.MultiReader(strings.NewReader(value))
+		fe.ServeHTTP(w, httptest.NewRequest("PUT", "/data/"+key, body))
+		return w
+	}
+	if w := set("foo", "bar"); w.Code != http.StatusCreated {
+		fmt.Println("[!] chunked SET failed:", w.Code, w.Body.String())
+		t.FailNow()
+	}
+	if v, ok, err := fe.Get("foo"); err != nil || !ok || string(v) != "bar" {
+		fmt.Printf("[!] chunked value stored as %q\n", v)
+		t.FailNow()
+	}
+	if w := set("foo", "0123456789abcdefg"); w.Code != http.StatusRequestEntityTooLarge {
+		fmt.Println("[!] oversized value not refused:", w.Code)
+		t.FailNow()
+	}
+	if v, _, _ := fe.Get("foo"); string(v) != "bar" {
+		fmt.Printf("[!] oversized value replaced %q\n", v)
+		t.FailNow()
+	}
+}
+
+func TestContentType(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 3, Replicas: 2, ChunkSize: 4})
+	fe := c.Frontend(0)
+
+	do := func(method, key, value, ctype string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/data/"+key, strings.NewReader(value))
+		if ctype != "" {
+			r.Header.Set("Content-Type", ctype)
+		}
+		fe.ServeHTTP(w, r)
+		return w
+	}
+	do("PUT", "small", "{}", "application/json")
+	do("PUT", "big", "0123456789", "text/plain")
+	for key, ctype := range map[string]string{"small": "application/json", "big": "text/plain"} {
+		if w := do("GET", key, "", ""); w.Header().Get("Content-Type") != ctype {
+			fmt.Printf("[!] GET of %s returned type %q\n", key, w.Header().Get("Content-Type"))
+			t.FailNow()
+		}
+		w := do("HEAD", key, "", "")
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != ctype || w.Body.Len() != 0 {
+			fmt.Printf("[!] HEAD of %s returned %d, type %q\n", key, w.Code,
+				w.Header().Get("Content-Type"))
+			t.FailNow()
+		}
+	}
+	if w := do("HEAD", "missing", "", ""); w.Code != http.StatusNotFound {
+		fmt.Println("[!] HEAD of a missing key returned", w.Code)
+		t.FailNow()
+	}
+	if w := do("PUT", "small", "{}", strings.Repeat("x", common.MaxTypeLen+1)); w.Code != http.StatusBadRequest {
+		fmt.Println("[!] overlong content type not refused:", w.Code)
+		t.FailNow()
+	}
+
+	// The type moves with the value when a node takes over its range.
+	added, err := c.AddNode()
+	if err != nil {
+		fmt.Println("[!] failed to add node:", err.Error())
+		t.FailNow()
+	}
+	if !c.Rebalance() {
+		fmt.Println("[!] cluster failed to settle")
+		t.FailNow()
+	}
+	for _, key := range []string{"small", "big"} {
+		for _, n := range c.Replicas(key) {
+			if n != added {
+				continue
+			}
+			resp := n.Handle(&common.Operation{OpCode: common.OpGet, Key: []byte(key)})
+			if resp.Type == "" {
+				fmt.Printf("[!] %s lost the type of %s\n", n.Addr, key)
+				t.FailNow()
+			}
+		}
+	}
+}
+
+func TestChunking(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 3, Replicas: 3, ChunkSize: 4})
+	fe := c.Frontend(0)
+	prefix := []byte("\x00chunk/")
+	chunks := func(expected int) {
+		c.Wait()
+		for _, n := range c.Replicas("big") {
+			count := 0
+			n.Store.Iterate(prefix, func(key, value []byte) bool {
+				if !bytes.HasPrefix(key, prefix) {
+					return false
+				}
+				count++
+				return true
+			})
+			if count != expected {
+				fmt.Printf("[!] %s holds %d chunks, expected %d\n",
+					n.Addr, count, expected)
+				t.FailNow()
+			}
+		}
+	}
+
+	// Ten bytes are stored as a manifest and three chunks.
+	mustSet(t, fe, "big", "0123456789")
+	chunks(3)
+	for _, n := range c.Nodes {
+		if v, ok := stored(n, "big"); !ok || v != "0123456789" {
+			fmt.Printf("[!] %s holds %q\n", n.Addr, v)
+			t.FailNow()
+		}
+	}
+	if keys, err := fe.Keys(); err != nil || fmt.Sprint(keys) != "[big]" {
+		fmt.Println("[!] chunks listed as keys:", keys, err)
+		t.FailNow()
+	}
+
+	// Readers racing with writes see one value or the other, whole.
+	values := []string{"0123456789", "abcdefghijklmnopq"}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			fe.Set("big", []byte(values[i%2]))
+		}
+		close(done)
+	}()
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		v, ok := stored(c.Nodes[0], "big")
+		if !ok || (v != values[0] && v != values[1]) {
+			fmt.Printf("[!] read a mixed value %q\n", v)
+			t.FailNow()
+		}
+	}
+	mustSet(t, fe, "big", "0123456")
+	chunks(2)
+
+	// A new node receives the value whole and stores it in chunks.
+	added, err := c.AddNode()
+	if err != nil {
+		fmt.Println("[!] failed to add node:", err.Error())
+		t.FailNow()
+	}
+	if !c.Rebalance() {
+		fmt.Println("[!] cluster failed to settle")
+		t.FailNow()
+	}
+	if v, ok := stored(added, "big"); !ok || v != "0123456" {
+		fmt.Printf("[!] new node holds %q\n", v)
+		t.FailNow()
+	}
+
+	if _, ok, err := fe.Delete("big"); err != nil || !ok {
+		fmt.Println("[!] failed to delete:", err)
+		t.FailNow()
+	}
+	chunks(0)
+}
+
+// readLog returns a node's change log from a sequence number, and the
+// number its next change will be given.
+func readLog(t *testing.T, n *Node, from uint64) ([]common.Change, uint64) {
+	resp := n.Handle(&common.Operation{OpCode: common.OpLog, Version: from})
+	var changes []common.Change
+	err := gob.NewDecoder(bytes.NewBuffer(resp.Body)).Decode(&changes)
+	if err != nil {
+		fmt.Println("[!] failed to read the change log:", err.Error())
+		t.FailNow()
+	}
+	return changes, resp.Version
+}
+
+func TestChangeLog(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 1, Replicas: 1})
+	fe := c.Frontend(0)
+	n := c.Nodes[0]
+	mustSet(t, fe, "foo", "bar")
+	mustSet(t, fe, "baz", "quux")
+	fe.Delete("foo")
+	c.Wait()
+
+	changes, next := readLog(t, n, 1)
+	if len(changes) != 3 || next != 4 {
+		fmt.Printf("[!] expected 3 changes before 4, got %d before %d\n",
+			len(changes), next)
+		t.FailNow()
+	}
+	for i, key := range []string{"foo", "baz", "foo"} {
+		if changes[i].Seq != uint64(i+1) || string(changes[i].Key) != key {
+			fmt.Printf("[!] change %d is %d %q\n", i, changes[i].Seq,
+				changes[i].Key)
+			t.FailNow()
+		}
+	}
+	if changes[0].Deleted || !changes[2].Deleted {
+		fmt.Println("[!] deletes logged wrongly")
+		t.FailNow()
+	}
+	if changes, _ = readLog(t, n, 3); len(changes) != 1 || changes[0].Seq != 3 {
+		fmt.Println("[!] reading from the middle of the log failed")
+		t.FailNow()
+	}
+
+	// Numbering resumes after a restart.
+	c.Crash(n)
+	if err := c.Restart(n); err != nil {
+		fmt.Println("[!] failed to restart:", err.Error())
+		t.FailNow()
+	}
+	mustSet(t, fe, "foo", "again")
+	c.Wait()
+	if changes, next = readLog(t, n, 4); len(changes) != 1 || changes[0].Seq != 4 || next != 5 {
+		fmt.Println("[!] log numbering did not survive a restart")
+		t.FailNow()
+	}
+
+	// Entries are trimmed once they leave the retention window.
+	if trimmed := n.TrimLog(); trimmed != 0 {
+		fmt.Printf("[!] trimmed %d recent entries\n", trimmed)
+		t.FailNow()
+	}
+	n.Clock.Skew(48 * time.Hour)
+	mustSet(t, fe, "baz", "later")
+	c.Wait()
+	if trimmed := n.TrimLog(); trimmed != 4 {
+		fmt.Printf("[!] trimmed %d entries, expected 4\n", trimmed)
+		t.FailNow()
+	}
+	if changes, next = readLog(t, n, 1); len(changes) != 1 || changes[0].Seq != 5 || next != 6 {
+		fmt.Println("[!] trimmed log holds", changes)
+		t.FailNow()
+	}
+}
+
+func TestScan(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 3, Replicas: 2})
+	fe := c.Frontend(0)
+	values := make(map[string]string, 0)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k/%02d", i)
+		values[key] = fmt.Sprint(i)
+		mustSet(t, fe, key, values[key])
+	}
+	mustSet(t, fe, "j", "before")
+	mustSet(t, fe, "l", "after")
+	fe.Delete("k/05")
+	c.Wait()
+
+	// Each node holds a different share of the keys, so pages end
+	// wherever the first node runs out.
+	var keys []string
+	after := ""
+	for pages := 0; ; pages++ {
+		items, next, err := fe.Scan("k/", after, 3)
+		if err != nil || pages > 20 {
+			fmt.Println("[!] scan failed:", err)
+			t.FailNow()
+		}
+		for _, item := range items {
+			if item.Key <= after || string(item.Value) != values[item.Key] {
+				fmt.Printf("[!] scanned %s = %q after %s\n", item.Key, item.Value, after)
+				t.FailNow()
+			}
+			keys = append(keys, item.Key)
+		}
+		if after = next; after == "" {
+			break
+		}
+	}
+	if len(keys) != 19 || keys[5] != "k/06" {
+		fmt.Println("[!] scanned", keys)
+		t.FailNow()
+	}
+}
+
+// A scan with a prefix starts at the first key beginning with it: the
+// nodes neither walk nor return the keys sorting below it, so a small
+// page is filled from the prefix however many keys come before.
+func TestScanPrefix(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 3, Replicas: 3})
+	fe := c.Frontend(0)
+	for i := 0; i < 20; i++ {
+		mustSet(t, fe, fmt.Sprintf("a/%02d", i), "below")
+	}
+	mustSet(t, fe, "m", "prefix")
+	mustSet(t, fe, "m/1", "1")
+	mustSet(t, fe, "m/2", "2")
+	mustSet(t, fe, "z", "above")
+	c.Wait()
+
+	resp := c.Nodes[0].Handle(&common.Operation{
+		OpCode: common.OpScan,
+		Val:    []byte("m"),
+		Ranges: []ring.Range{{}},
+		Limit:  5,
+	})
+	var page []common.Item
+	gob.NewDecoder(bytes.NewBuffer(resp.Body)).Decode(&page)
+	if len(page) != 3 || string(page[0].Key) != "m" || string(page[2].Key) != "m/2" {
+		fmt.Println("[!] node scanned the wrong keys:", len(page), "items")
+		t.FailNow()
+	}
+
+	items, next, err := fe.Scan("m", "", 2)
+	if err != nil || len(items) != 2 || items[0].Key != "m" || items[1].Key != "m/1" || next != "m/1" {
+		fmt.Println("[!] first page of prefixed scan:", items, next, err)
+		t.FailNow()
+	}
+	items, next, err = fe.Scan("m", next, 2)
+	if err != nil || len(items) != 1 || items[0].Key != "m/2" || next != "" {
+		fmt.Println("[!] second page of prefixed scan:", items, next, err)
+		t.FailNow()
+	}
+}
+
+func TestBatch(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 3, Replicas: 3})
+	fe := c.Frontend(0)
+	mustSet(t, fe, "foo", "old")
+	items := []frontend.Item{
+		{Key: "foo", Value: []byte("new")},
+		{Key: "bar", Value: []byte("baz"), Type: "text/plain"},
+	}
+
+	res, err := fe.Batch(items, frontend.BatchFail)
+	if err != frontend.ErrConflict || len(res.Conflicts) != 1 || res.Written != 0 {
+		fmt.Println("[!] conflicting batch returned", res, err)
+		t.FailNow()
+	}
+	if _, ok, _ := fe.Get("bar"); ok {
+		fmt.Println("[!] conflicting batch was written")
+		t.FailNow()
+	}
+	if res, err = fe.Batch(items, frontend.BatchSkip); err != nil ||
+		res.Written != 1 || res.Skipped != 1 {
+		fmt.Println("[!] skipping batch returned", res, err)
+		t.FailNow()
+	}
+	if v, _, _ := fe.Get("foo"); string(v) != "old" {
+		fmt.Println("[!] skipping batch overwrote foo")
+		t.FailNow()
+	}
+	if res, err = fe.Batch(items, frontend.BatchOverwrite); err != nil || res.Written != 2 {
+		fmt.Println("[!] overwriting batch returned", res, err)
+		t.FailNow()
+	}
+	if v, _, _ := fe.Get("foo"); string(v) != "new" {
+		fmt.Println("[!] overwriting batch left foo as", string(v))
+		t.FailNow()
+	}
+	if scanned, _, err := fe.Scan("bar", "", 1); err != nil || len(scanned) != 1 ||
+		scanned[0].Type != "text/plain" {
+		fmt.Println("[!] batch content type was not kept:", scanned, err)
+		t.FailNow()
+	}
+
+	// Each node is sent the items it holds in a single request.
+	items = nil
+	for i := 0; i < 30; i++ {
+		items = append(items, frontend.Item{Key: fmt.Sprintf("k/%02d", i), Value: []byte("v")})
+	}
+	c.Wait()
+	before, _, _ := c.Net.Counts()
+	if res, err = fe.Batch(items, frontend.BatchOverwrite); err != nil || res.Written != 30 {
+		fmt.Println("[!] large batch returned", res, err)
+		t.FailNow()
+	}
+	c.Wait()
+	if sent, _, _ := c.Net.Counts(); sent-before != 2*len(c.Nodes) {
+		fmt.Println("[!] batch of 30 items took", sent-before, "messages")
+		t.FailNow()
+	}
+	for _, n := range c.Nodes {
+		if v, ok := stored(n, "k/29"); !ok || v != "v" {
+			fmt.Println("[!] batch not written to", n.Addr)
+			t.FailNow()
+		}
+	}
+
+	// Without a quorum, the batch fails and reports what was written.
+	c.Crash(c.Nodes[1])
+	c.Crash(c.Nodes[2])
+	if res, err = fe.Batch(items[:2], frontend.BatchOverwrite); err != frontend.ErrQuorum || res.Written != 0 {
+		fmt.Println("[!] batch without a quorum returned", res, err)
+		t.FailNow()
+	}
+}
+
+func TestDigest(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 3, Replicas: 2})
+	fe := c.Frontend(0)
+	for i := 0; i < 50; i++ {
+		mustSet(t, fe, fmt.Sprintf("k/%02d", i), fmt.Sprint(i))
+	}
+	mustSet(t, fe, "other", "outside the prefix")
+	c.Wait()
+
+	before, keys, err := fe.Digest("k/", frontend.DefaultDigestDepth)
+	if err != nil || keys != 50 {
+		fmt.Println("[!] digest returned", keys, err)
+		t.FailNow()
+	}
+
+	// Rewriting a value as it was leaves the digest as it was.
+	mustSet(t, fe, "k/07", "7")
+	mustSet(t, fe, "k/10", "changed")
+	c.Wait()
+	after, _, err := fe.Digest("k/", frontend.DefaultDigestDepth)
+	if err != nil {
+		fmt.Println("[!] digest failed:", err.Error())
+		t.FailNow()
+	}
+	ranges, err := before.Diff(after)
+	if err != nil || len(ranges) != 1 {
+		fmt.Println("[!] digests differ in", ranges, err)
+		t.FailNow()
+	}
+
+	digests, err := fe.DigestKeys("k/", ranges)
+	if err != nil {
+		fmt.Println("[!] digest of keys failed:", err.Error())
+		t.FailNow()
+	}
+	found := false
+	for _, d := range digests {
+		if d.Key == "k/10" {
+			found = bytes.Equal(d.Hash, frontend.ItemDigest("k/10", []byte("changed"), ""))
+		}
+	}
+	if !found {
+		fmt.Println("[!] k/10 not digested in its range:", digests)
+		t.FailNow()
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 3, Replicas: 2})
+	fe := c.Frontend(0)
+	if _, err := fe.CreateNamespace("tenant"); err != nil {
+		fmt.Println("[!] failed to create namespace:", err.Error())
+		t.FailNow()
+	}
+	if _, err := fe.CreateNamespace("tenant"); err != frontend.ErrNamespaceExists {
+		fmt.Println("[!] second create returned", err)
+		t.FailNow()
+	}
+	for i := 0; i < 10; i++ {
+		mustSet(t, fe, frontend.NamespaceKey("tenant", fmt.Sprintf("k/%d", i)), "ns")
+	}
+	mustSet(t, fe, "k/0", "default")
+	c.Wait()
+
+	keys, err := fe.Keys()
+	if err != nil || len(keys) != 1 || keys[0] != "k/0" {
+		fmt.Println("[!] default namespace lists", keys, err)
+		t.FailNow()
+	}
+	items, _, err := fe.Scan("", "", 0)
+	if err != nil || len(items) != 1 || items[0].Key != "k/0" {
+		fmt.Println("[!] default namespace scans", items, err)
+		t.FailNow()
+	}
+	items, _, err = fe.Scan(frontend.NamespaceKey("tenant", "k/"), "", 0)
+	if err != nil || len(items) != 10 {
+		fmt.Println("[!] namespace scans", len(items), err)
+		t.FailNow()
+	}
+
+	list, err := fe.Namespaces()
+	if err != nil || len(list) != 1 || list[0].Name != "tenant" {
+		fmt.Println("[!] namespaces listed as", list, err)
+		t.FailNow()
+	}
+	deleted, err := fe.DeleteNamespace("tenant")
+	if err != nil || deleted != 10 {
+		fmt.Println("[!] delete returned", deleted, err)
+		t.FailNow()
+	}
+	if _, err = fe.Namespace("tenant"); err != frontend.ErrNoNamespace {
+		fmt.Println("[!] deleted namespace found:", err)
+		t.FailNow()
+	}
+	c.Wait()
+	if value, ok, _ := fe.Get("k/0"); !ok || string(value) != "default" {
+		fmt.Printf("[!] default key read as %q\n", value)
+		t.FailNow()
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 3, Replicas: 2, ChunkSize: 8})
+	fe := c.Frontend(0)
+	if _, err := fe.CreateNamespace("team"); err != nil {
+		fmt.Println("[!] failed to create namespace:", err.Error())
+		t.FailNow()
+	}
+	if _, err := fe.SetLimits("team", frontend.Limits{MaxKeys: 3, MaxBytes: 40}); err != nil {
+		fmt.Println("[!] failed to set limits:", err.Error())
+		t.FailNow()
+	}
+	do := func(method, key, value string) int {
+		w := httptest.NewRecorder()
+		fe.ServeHTTP(w, httptest.NewRequest(method, "/ns/team/data/"+key,
+			strings.NewReader(value)))
+		return w.Code
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if code := do("PUT", key, "0123456789"); code != http.StatusCreated {
+			fmt.Println("[!] write within the limits answered with", code)
+			t.FailNow()
+		}
+	}
+	if code := do("PUT", "d", "x"); code != http.StatusInsufficientStorage {
+		fmt.Println("[!] write over the key limit answered with", code)
+		t.FailNow()
+	}
+	if code := do("PUT", "a", "9876543210"); code != http.StatusOK {
+		fmt.Println("[!] overwrite at the key limit answered with", code)
+		t.FailNow()
+	}
+	if code := do("PUT", "a", strings.Repeat("x", 25)); code != http.StatusInsufficientStorage {
+		fmt.Println("[!] write over the byte limit answered with", code)
+		t.FailNow()
+	}
+	c.Wait()
+
+	usage, err := fe.Usage("team")
+	if err != nil || usage.Keys != 3 || usage.Bytes != 30 {
+		fmt.Println("[!] usage reported as", usage, err)
+		t.FailNow()
+	}
+	n := c.Nodes[0]
+	c.Crash(n)
+	if err = c.Restart(n); err != nil {
+		fmt.Println("[!] restart failed:", err.Error())
+		t.FailNow()
+	}
+	if again, err := fe.Usage("team"); err != nil || *again != *usage {
+		fmt.Println("[!] usage after a restart reported as", again, err)
+		t.FailNow()
+	}
+
+	if code := do("DELETE", "a", ""); code != http.StatusOK {
+		fmt.Println("[!] delete answered with", code)
+		t.FailNow()
+	}
+	if code := do("PUT", "d", "x"); code != http.StatusCreated {
+		fmt.Println("[!] write after a delete answered with", code)
+		t.FailNow()
+	}
+
+	if _, err = fe.SetLimits("team", frontend.Limits{MaxRate: 2}); err != nil {
+		fmt.Println("[!] failed to set limits:", err.Error())
+		t.FailNow()
+	}
+	limited := 0
+	for i := 0; i < 5; i++ {
+		if do("GET", "b", "") == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+	if limited == 0 {
+		fmt.Println("[!] requests over the rate limit were served")
+		t.FailNow()
+	}
+}
+
+func TestHintedWriteQuota(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 5, Replicas: 3, HintedHandoff: true})
+	fe := c.Frontend(0)
+	if _, err := fe.CreateNamespace("team"); err != nil {
+		fmt.Println("[!] failed to create namespace:", err.Error())
+		t.FailNow()
+	}
+	if _, err := fe.SetLimits("team", frontend.Limits{MaxKeys: 3}); err != nil {
+		fmt.Println("[!] failed to set limits:", err.Error())
+		t.FailNow()
+	}
+	do := func(method, key, value string) int {
+		w := httptest.NewRecorder()
+		fe.ServeHTTP(w, httptest.NewRequest(method, "/ns/team/data/"+key,
+			strings.NewReader(value)))
+		return w.Code
+	}
+	for _, key := range []string{"a", "b"} {
+		if code := do("PUT", key, "x"); code != http.StatusCreated {
+			fmt.Println("[!] write answered with", code)
+			t.FailNow()
+		}
+	}
+
+	// With every replica down, an overwrite is only stored as hints,
+	// and is not counted as a new key.
+	replicas := c.Replicas(frontend.NamespaceKey("team", "a"))
+	for _, n := range replicas {
+		c.Crash(n)
+	}
+	if code := do("PUT", "a", "y"); code != http.StatusAccepted {
+		fmt.Println("[!] hinted write answered with", code)
+		t.FailNow()
+	}
+	for _, n := range replicas {
+		if err := c.Restart(n); err != nil {
+			fmt.Println("[!] restart failed:", err.Error())
+			t.FailNow()
+		}
+	}
+	c.DeliverHints()
+	if code := do("PUT", "c", "x"); code != http.StatusCreated {
+		fmt.Println("[!] write within the key limit answered with", code)
+		t.FailNow()
+	}
+}
+
+// sameStores reports whether two stores hold the same keys and values.
+func sameStores(a, b *node.MemStore) bool {
+	var items []string
+	a.Iterate(nil, func(key, value []byte) bool {
+		items = append(items, string(key)+"="+string(value))
+		return true
+	})
+	i := 0
+	b.Iterate(nil, func(key, value []byte) bool {
+		if i >= len(items) || items[i] != string(key)+"="+string(value) {
+			i = -1
+			return false
+		}
+		i++
+		return true
+	})
+	return i == len(items)
+}
+
+func TestBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kludge-backup")
+	if err != nil {
+		fmt.Println("[!] failed to create backup directory:", err.Error())
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	c := testCluster(t, Options{Nodes: 1, Replicas: 1, ChunkSize: 4,
+		BackupDir: dir})
+	fe := c.Frontend(0)
+	n := c.Nodes[0]
+	mustSet(t, fe, "foo", "bar")
+	mustSet(t, fe, "big", "0123456789")
+	fe.Delete("foo")
+	c.Wait()
+
+	buf := new(bytes.Buffer)
+	info, err := n.Backup(buf)
+	if err != nil {
+		fmt.Println("[!] backup failed:", err.Error())
+		t.FailNow()
+	} else if info.NodeID != n.Addr || info.Records != int64(n.Store.Len()) {
+		fmt.Printf("[!] backup described as %+v\n", info)
+		t.FailNow()
+	}
+	archive := buf.Bytes()
+
+	restored := node.NewMemStore()
+	rinfo, err := node.Restore(bytes.NewReader(archive), restored)
+	if err != nil {
+		fmt.Println("[!] restore failed:", err.Error())
+		t.FailNow()
+	} else if rinfo.Checksum != info.Checksum || !sameStores(n.Store, restored) {
+		fmt.Println("[!] restored store differs from the original")
+		t.FailNow()
+	}
+
+	corrupt := append([]byte{}, archive...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	if _, err = node.Restore(bytes.NewReader(corrupt), node.NewMemStore()); err == nil {
+		fmt.Println("[!] a corrupt archive was restored")
+		t.FailNow()
+	}
+
+	// A backup requested over the node link is written in the
+	// background to the backup directory.
+	bad := n.Handle(&common.Operation{OpCode: common.OpBackup, Key: []byte("../x")})
+	if bad.ErrMsg == "" {
+		fmt.Println("[!] backup written outside the backup directory")
+		t.FailNow()
+	}
+	status := waitBackup(t, n, n.Handle(&common.Operation{OpCode: common.OpBackup, Key: []byte("node.kbk")}))
+	if status.Err != "" || status.Path != filepath.Join(dir, "node.kbk") {
+		fmt.Printf("[!] backup finished as %+v\n", status)
+		t.FailNow()
+	}
+	f, err := os.Open(status.Path)
+	if err != nil {
+		fmt.Println("[!] failed to open archive:", err.Error())
+		t.FailNow()
+	}
+	defer f.Close()
+	restored = node.NewMemStore()
+	if rinfo, err = node.Restore(f, restored); err != nil || rinfo.Checksum != status.Checksum {
+		fmt.Println("[!] archive failed to restore:", err)
+		t.FailNow()
+	} else if !sameStores(n.Store, restored) {
+		fmt.Println("[!] restored store differs from the original")
+		t.FailNow()
+	}
+
+	// An existing archive is only replaced when asked.
+	again := n.Handle(&common.Operation{OpCode: common.OpBackup, Key: []byte("node.kbk")})
+	if again.ErrMsg == "" {
+		fmt.Println("[!] backup replaced an existing archive")
+		t.FailNow()
+	}
+	status = waitBackup(t, n, n.Handle(&common.Operation{OpCode: common.OpBackup,
+		Key: []byte("node.kbk"), Val: []byte(common.BackupOverwrite)}))
+	if status.Err != "" || status.Checksum == "" {
+		fmt.Printf("[!] overwriting backup finished as %+v\n", status)
+		t.FailNow()
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 1 {
+		fmt.Println("[!] backup directory holds", names)
+		t.FailNow()
+	}
+}
+
+// waitBackup waits for the backup started with resp to finish,
+// returning its status.
+func waitBackup(t *testing.T, n *Node, resp *common.Response) (status common.BackupStatus) {
+	for {
+		if resp.ErrMsg != "" || json.Unmarshal(resp.Body, &status) != nil {
+			fmt.Println("[!] backup request failed:", resp.ErrMsg)
+			t.FailNow()
+		}
+		if !status.Running {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		resp = n.Handle(&common.Operation{OpCode: common.OpBackupStatus})
+	}
+}
+
+// watch collects the events of a watch until it is stopped.
+func watch(fe *Frontend, prefix string, since uint64) (events chan frontend.Event, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events = make(chan frontend.Event, 16)
+	done := make(chan bool)
+	go func() {
+		fe.Watch(ctx, prefix, since, func(ev frontend.Event) error {
+			events <- ev
+			return nil
+		})
+		close(done)
+	}()
+	return events, func() {
+		cancel()
+		<-done
+	}
+}
+
+func nextEvent(t *testing.T, events chan frontend.Event) frontend.Event {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(time.Second):
+		fmt.Println("[!] timed out waiting for an event")
+		t.FailNow()
+	}
+	return frontend.Event{}
+}
+
+func TestWatch(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 3, Replicas: 3,
+		WatchInterval: 5 * time.Millisecond})
+	fe := c.Frontend(0)
+	mustSet(t, fe, "start", "")
+	_, _, start, _ := fe.GetVersion("start")
+
+	events, stop := watch(fe, "foo/", start)
+	mustSet(t, fe, "foo/a", "1")
+	mustSet(t, fe, "bar", "2")
+	fe.Delete("foo/a")
+	set, del := nextEvent(t, events), nextEvent(t, events)
+	if set.Key != "foo/a" || set.Deleted || del.Key != "foo/a" || !del.Deleted {
+		fmt.Printf("[!] unexpected events %+v, %+v\n", set, del)
+		t.FailNow()
+	}
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	if len(events) != 0 {
+		fmt.Println("[!] change reported more than once:", <-events)
+		t.FailNow()
+	}
+
+	// A watch resumes after the last event seen.
+	events, stop = watch(fe, "foo/", set.Version)
+	if ev := nextEvent(t, events); ev != del {
+		fmt.Printf("[!] resumed watch reported %+v\n", ev)
+		t.FailNow()
+	}
+	stop()
+
+	// A restarted node has forgotten the changes made before.
+	c.Crash(c.Nodes[0])
+	if err := c.Restart(c.Nodes[0]); err != nil {
+		fmt.Println("[!] restart failed:", err.Error())
+		t.FailNow()
+	}
+	events, stop = watch(fe, "foo/", start)
+	defer stop()
+	if ev := nextEvent(t, events); !ev.Lost {
+		fmt.Printf("[!] expected lost changes, got %+v\n", ev)
+		t.FailNow()
+	}
+}
+
+func TestWatchHTTP(t *testing.T) {
+	c := testCluster(t, Options{Nodes: 1, WatchInterval: 5 * time.Millisecond})
+	fe := c.Frontend(0)
+	srv := httptest.NewServer(fe)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/watch?key=foo")
+	if err != nil {
+		fmt.Println("[!] watch failed:", err.Error())
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		fmt.Println("[!] bad content type", resp.Header.Get("Content-Type"))
+		t.FailNow()
+	}
+	lines := bufio.NewReader(resp.Body)
+	if line, _ := lines.ReadString('\n'); !strings.HasPrefix(line, "id: ") {
+		fmt.Printf("[!] stream does not start with its version: %q\n", line)
+		t.FailNow()
+	}
+	lines.ReadString('\n')
+
+	mustSet(t, fe, "foobar", "x")
+	mustSet(t, fe, "foo", "y")
+	_, _, version, _ := fe.GetVersion("foo")
+	expected := fmt.Sprintf("event: set\nid: %d\ndata: {\"key\":\"foo\",\"version\":%d}\n",
+		version, version)
+	var event string
+	for i := 0; i < 3; i++ {
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			fmt.Println("[!] stream ended:", err.Error())
+			t.FailNow()
+		}
+		event += line
+	}
+	if event != expected {
+		fmt.Printf("[!] expected event %q, got %q\n", expected, event)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gokyle/kludge/faultproxy"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s [options] name=listen,target ...:\n",
+		os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	ctlAddr := flag.String("c", "127.0.0.1:5990", "control API address")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(1)
+	}
+
+	proxies := make(map[string]*faultproxy.Proxy, 0)
+	for _, arg := range flag.Args() {
+		fields := strings.FieldsFunc(arg, func(r rune) bool {
+			return r == '=' || r == ','
+		})
+		if len(fields) != 3 || !strings.HasPrefix(arg, fields[0]+"=") {
+			fmt.Printf("[!] invalid proxy %s; expected name=listen,target\n", arg)
+			os.Exit(1)
+		}
+		name, listen, target := fields[0], fields[1], fields[2]
+		if _, ok := proxies[name]; ok {
+			fmt.Printf("[!] duplicate proxy name %s\n", name)
+			os.Exit(1)
+		}
+
+		p, err := faultproxy.Listen(listen, target)
+		if err != nil {
+			fmt.Printf("[!] failed to listen on %s: %s\n", listen, err.Error())
+			os.Exit(1)
+		}
+		proxies[name] = p
+		log.Printf("proxying %s -> %s as %s", p.Addr(), target, name)
+		go func(name string, p *faultproxy.Proxy) {
+			if err := p.Serve(); err != nil {
+				log.Fatalf("proxy %s failed: %s", name, err.Error())
+			}
+		}(name, p)
+	}
+
+	log.Printf("control API listening on %s", *ctlAddr)
+	log.Fatal(http.ListenAndServe(*ctlAddr, faultproxy.Control(proxies)))
+}
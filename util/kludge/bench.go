@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gokyle/kludge/client"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fillBatch is the number of keys written to a batch when filling the
+// key space before a run.
+const fillBatch = 500
+
+// A benchWorkload describes a benchmark run.
+type benchWorkload struct {
+	Clients  int     `json:"clients"`
+	Duration float64 `json:"duration"`
+	Reads    int     `json:"read_percent"`
+	Keys     int     `json:"keys"`
+	Dist     string  `json:"distribution"`
+	Skew     float64 `json:"skew,omitempty"`
+	Size     int     `json:"value_size"`
+	Prefix   string  `json:"prefix"`
+	Seed     int64   `json:"seed"`
+}
+
+// latencyStats summarises the latencies of a kind of operation, in
+// milliseconds.
+type latencyStats struct {
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	P999  float64 `json:"p999"`
+	Max   float64 `json:"max"`
+}
+
+// A benchResult is the outcome of a run. Elapsed is in seconds, and
+// Throughput in operations a second.
+type benchResult struct {
+	Workload   benchWorkload `json:"workload"`
+	Elapsed    float64       `json:"elapsed"`
+	Ops        int           `json:"ops"`
+	Errors     int           `json:"errors"`
+	Misses     int           `json:"misses"`
+	Throughput float64       `json:"throughput"`
+	Reads      latencyStats  `json:"reads"`
+	Writes     latencyStats  `json:"writes"`
+	All        latencyStats  `json:"all"`
+}
+
+// benchClient is one client's record of a run.
+type benchClient struct {
+	reads  []time.Duration
+	writes []time.Duration
+	errors int
+	misses int
+	err    error
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// summarise sorts the latencies and returns their statistics. The
+// percentiles are by nearest rank: the qth is the smallest latency
+// that at least a fraction q of the latencies are no greater than,
+// which is the ceil(q*n)th of n.
+func summarise(lat []time.Duration) (stats latencyStats) {
+	if len(lat) == 0 {
+		return
+	}
+	sort.Sort(durations(lat))
+	var total time.Duration
+	for _, d := range lat {
+		total += d
+	}
+	at := func(q float64) float64 {
+		rank := int(math.Ceil(q * float64(len(lat))))
+		if rank < 1 {
+			rank = 1
+		}
+		return millis(lat[rank-1])
+	}
+	stats.Count = len(lat)
+	stats.Mean = millis(total / time.Duration(len(lat)))
+	stats.P50 = at(0.5)
+	stats.P90 = at(0.9)
+	stats.P99 = at(0.99)
+	stats.P999 = at(0.999)
+	stats.Max = millis(lat[len(lat)-1])
+	return
+}
+
+func benchKey(w *benchWorkload, n uint64) string {
+	return fmt.Sprintf("%s%08d", w.Prefix, n)
+}
+
+// fill writes every key in the workload's key space, so that reads
+// find values.
+func fill(ctx context.Context, ds *kludge.DataStore, w *benchWorkload) error {
+	rng := rand.New(rand.NewSource(w.Seed))
+	items := make([]kludge.Item, 0, fillBatch)
+	for n := 0; n < w.Keys; n++ {
+		value := make([]byte, w.Size)
+		rng.Read(value)
+		items = append(items, kludge.Item{Key: benchKey(w, uint64(n)), Value: value})
+		if len(items) == fillBatch || n == w.Keys-1 {
+			if _, err := ds.BatchContext(ctx, items, kludge.Overwrite); err != nil {
+				return err
+			}
+			items = items[:0]
+		}
+	}
+	return nil
+}
+
+// runClient performs operations until the context is done.
+func runClient(ctx context.Context, ds *kludge.DataStore, w *benchWorkload, id int, rec *benchClient) {
+	rng := rand.New(rand.NewSource(w.Seed + int64(id) + 1))
+	var next func() uint64
+	if w.Dist == "zipfian" {
+		next = rand.NewZipf(rng, w.Skew, 1, uint64(w.Keys-1)).Uint64
+	} else {
+		next = func() uint64 { return uint64(rng.Intn(w.Keys)) }
+	}
+	value := make([]byte, w.Size)
+
+	for ctx.Err() == nil {
+		key := benchKey(w, next())
+		var ok bool
+		var err error
+		start := time.Now()
+		read := rng.Intn(100) < w.Reads
+		if read {
+			_, ok, err = ds.GetContext(ctx, key)
+		} else {
+			rng.Read(value)
+			_, _, err = ds.SetContext(ctx, key, value)
+		}
+		elapsed := time.Since(start)
+
+		switch {
+		case err != nil && ctx.Err() != nil:
+			return
+		case err != nil:
+			rec.errors++
+			rec.err = err
+		case read:
+			if !ok {
+				rec.misses++
+			}
+			rec.reads = append(rec.reads, elapsed)
+		default:
+			rec.writes = append(rec.writes, elapsed)
+		}
+	}
+}
+
+func printLatency(name string, stats latencyStats) {
+	fmt.Fprintf(stdout, "%-6s %8d %8.3f %8.3f %8.3f %8.3f %8.3f %8.3f\n", name,
+		stats.Count, stats.Mean, stats.P50, stats.P90, stats.P99,
+		stats.P999, stats.Max)
+}
+
+func bench(args []string) int {
+	fs := commandFlags("bench")
+	var w benchWorkload
+	fs.IntVar(&w.Clients, "c", 8, "number of concurrent clients")
+	duration := fs.Duration("d", 10*time.Second, "how long to run for")
+	fs.IntVar(&w.Reads, "reads", 90, "percentage of operations that are reads")
+	fs.IntVar(&w.Keys, "keys", 10000, "number of keys operated on")
+	fs.StringVar(&w.Dist, "dist", "uniform", "key distribution (uniform or zipfian)")
+	fs.Float64Var(&w.Skew, "skew", 1.1, "skew of the zipfian distribution, greater than 1")
+	fs.IntVar(&w.Size, "size", 100, "size of the values written, in bytes")
+	fs.StringVar(&w.Prefix, "prefix", "bench/", "prefix of the keys operated on")
+	fs.Int64Var(&w.Seed, "seed", 0, "seed for the workload (0 uses the time)")
+	noFill := fs.Bool("nofill", false, "don't write the keys before the run")
+	if code := parseArgs(fs, args, 0, 0); code >= 0 {
+		return code
+	}
+	switch {
+	case w.Clients < 1, w.Keys < 1, w.Size < 0, *duration <= 0:
+		fmt.Fprintln(stderr, "[!] clients, keys and duration must be positive")
+		return exitUsage
+	case w.Reads < 0 || w.Reads > 100:
+		fmt.Fprintln(stderr, "[!] the read percentage must be between 0 and 100")
+		return exitUsage
+	case w.Dist != "uniform" && w.Dist != "zipfian":
+		fmt.Fprintf(stderr, "[!] %s is not a supported distribution\n", w.Dist)
+		return exitUsage
+	case w.Dist == "zipfian" && w.Skew <= 1:
+		fmt.Fprintln(stderr, "[!] the skew must be greater than 1")
+		return exitUsage
+	}
+	if w.Dist != "zipfian" {
+		w.Skew = 0
+	}
+	if w.Seed == 0 {
+		w.Seed = time.Now().UnixNano()
+	}
+	w.Duration = duration.Seconds()
+
+	// The clients share a connection pool large enough that each keeps
+	// its connection between requests.
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: w.Clients,
+	}}
+	var err error
+	root, err = kludge.ConnectCluster(addrList(addrs), client)
+	if err != nil {
+		return fail("error connecting to datastore", err)
+	}
+	ds = inNamespace(root)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		cancel()
+	}()
+
+	if !*noFill {
+		if output != outputJSON {
+			fmt.Fprintf(stdout, "filling %d keys\n", w.Keys)
+		}
+		if err := fill(ctx, ds, &w); err != nil {
+			return fail("failed to fill keys", err)
+		}
+	}
+	if output != outputJSON {
+		fmt.Fprintf(stdout, "running %d clients for %s: %d%% reads, %d keys (%s), %d-byte values\n",
+			w.Clients, *duration, w.Reads, w.Keys, w.Dist, w.Size)
+	}
+
+	runCtx, stop := context.WithTimeout(ctx, *duration)
+	defer stop()
+	recs := make([]*benchClient, w.Clients)
+	wg := new(sync.WaitGroup)
+	start := time.Now()
+	for i := range recs {
+		recs[i] = new(benchClient)
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			runClient(runCtx, ds, &w, id, recs[id])
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	res := benchResult{Workload: w, Elapsed: elapsed.Seconds()}
+	var reads, writes, all []time.Duration
+	var lastErr error
+	for _, rec := range recs {
+		reads = append(reads, rec.reads...)
+		writes = append(writes, rec.writes...)
+		res.Errors += rec.errors
+		res.Misses += rec.misses
+		if rec.err != nil {
+			lastErr = rec.err
+		}
+	}
+	all = append(append(all, reads...), writes...)
+	res.Ops = len(all)
+	res.Throughput = float64(res.Ops) / elapsed.Seconds()
+	res.Reads = summarise(reads)
+	res.Writes = summarise(writes)
+	res.All = summarise(all)
+
+	if output == outputJSON {
+		printJSON(res)
+	} else {
+		fmt.Fprintf(stdout, "%d ops in %.1fs: %.1f ops/s, %d errors, %d misses\n",
+			res.Ops, res.Elapsed, res.Throughput, res.Errors, res.Misses)
+		fmt.Fprintf(stdout, "%-6s %8s %8s %8s %8s %8s %8s %8s\n", "ms", "count",
+			"mean", "p50", "p90", "p99", "p99.9", "max")
+		printLatency("read", res.Reads)
+		printLatency("write", res.Writes)
+		printLatency("all", res.All)
+	}
+	if lastErr != nil {
+		fmt.Fprintf(stderr, "[!] last error: %s\n", lastErr.Error())
+	}
+	if res.Ops == 0 && res.Errors > 0 {
+		return exitError
+	}
+	return exitOK
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// latencies returns the latencies of 1 to n milliseconds, in reverse.
+func latencies(n int) []time.Duration {
+	lat := make([]time.Duration, n)
+	for i := range lat {
+		lat[i] = time.Duration(n-i) * time.Millisecond
+	}
+	return lat
+}
+
+func TestSummarise(t *testing.T) {
+	tests := []struct {
+		lat   []time.Duration
+		stats latencyStats
+	}{
+		{nil, latencyStats{}},
+		{[]time.Duration{7 * time.Millisecond}, latencyStats{1, 7, 7, 7, 7, 7, 7}},
+		{latencies(2), latencyStats{2, 1.5, 1, 2, 2, 2, 2}},
+		{latencies(4), latencyStats{4, 2.5, 2, 4, 4, 4, 4}},
+		{latencies(10), latencyStats{10, 5.5, 5, 9, 10, 10, 10}},
+		{latencies(20), latencyStats{20, 10.5, 10, 18, 20, 20, 20}},
+		{latencies(100), latencyStats{100, 50.5, 50, 90, 99, 100, 100}},
+		{latencies(1000), latencyStats{1000, 500.5, 500, 900, 990, 999, 1000}},
+		{latencies(1001), latencyStats{1001, 501, 501, 901, 991, 1000, 1001}},
+	}
+	for _, test := range tests {
+		if stats := summarise(test.lat); stats != test.stats {
+			fmt.Printf("[!] %d latencies gave %+v, not %+v\n", len(test.lat),
+				stats, test.stats)
+			t.FailNow()
+		}
+	}
+}
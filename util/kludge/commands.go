@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/gokyle/kludge/client"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A keyResult is the JSON output of the commands acting on a key.
+// Found reports whether the key was present beforehand.
+type keyResult struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	Found bool   `json:"found"`
+}
+
+// parseArgs parses a command's flags, checking that it has been given
+// between min and max arguments (max < 0 for any number). It returns
+// the exit code to stop with, or -1 to carry on.
+func parseArgs(fs *flag.FlagSet, args []string, min, max int) int {
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return exitOK
+	} else if err != nil {
+		return exitUsage
+	}
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		for _, cmd := range commands {
+			if cmd.name == fs.Name() {
+				fmt.Fprintf(stderr, "Usage: %s %s %s\n", os.Args[0],
+					cmd.name, cmd.args)
+			}
+		}
+		return exitUsage
+	}
+	return -1
+}
+
+func notFound(key string) int {
+	if output == outputJSON {
+		printJSON(keyResult{Key: key})
+	} else {
+		fmt.Fprintf(stderr, "[!] %s is not in the datastore\n", key)
+	}
+	return exitMissing
+}
+
+func get(args []string) int {
+	fs := commandFlags("get")
+	if code := parseArgs(fs, args, 1, 1); code >= 0 {
+		return code
+	}
+	key := fs.Arg(0)
+	value, ok, err := connect().Get(key)
+	if err != nil {
+		return fail("error getting value", err)
+	} else if !ok {
+		return notFound(key)
+	}
+	if output == outputJSON {
+		printJSON(keyResult{Key: key, Value: value, Found: true})
+	} else {
+		printValue(value)
+	}
+	return exitOK
+}
+
+func set(args []string) int {
+	fs := commandFlags("set")
+	file := fs.String("f", "", "read the value from a file (- for standard input)")
+	if code := parseArgs(fs, args, 1, 2); code >= 0 {
+		return code
+	}
+	key := fs.Arg(0)
+
+	var ok bool
+	var err error
+	switch {
+	case fs.NArg() == 2 && *file != "":
+		fmt.Fprintln(stderr, "[!] give a value or a file, not both")
+		return exitUsage
+	case fs.NArg() == 2:
+		_, ok, err = connect().Set(key, []byte(fs.Arg(1)))
+	default:
+		var r io.Reader = stdin
+		if *file != "" && *file != "-" {
+			f, ferr := os.Open(*file)
+			if ferr != nil {
+				return fail("failed to open value", ferr)
+			}
+			defer f.Close()
+			r = f
+		}
+		ok, err = connect().Put(key, r)
+	}
+	if err != nil {
+		return fail("error setting value", err)
+	}
+
+	if output == outputJSON {
+		printJSON(keyResult{Key: key, Found: ok})
+	} else if ok {
+		fmt.Fprintln(stdout, "updated", key)
+	} else {
+		fmt.Fprintln(stdout, "created", key)
+	}
+	return exitOK
+}
+
+func del(args []string) int {
+	fs := commandFlags("del")
+	if code := parseArgs(fs, args, 1, 1); code >= 0 {
+		return code
+	}
+	key := fs.Arg(0)
+	_, ok, err := connect().Del(key)
+	if err != nil {
+		return fail("error deleting key", err)
+	} else if !ok {
+		return notFound(key)
+	}
+	if output == outputJSON {
+		printJSON(keyResult{Key: key, Found: true})
+	} else {
+		fmt.Fprintln(stdout, "deleted", key)
+	}
+	return exitOK
+}
+
+func ls(args []string) int {
+	fs := commandFlags("ls")
+	if code := parseArgs(fs, args, 0, 1); code >= 0 {
+		return code
+	}
+	keys, err := connect().List()
+	if err != nil {
+		return fail("failed to get keys", err)
+	}
+	matched := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if strings.HasPrefix(key, fs.Arg(0)) {
+			matched = append(matched, key)
+		}
+	}
+	sort.Strings(matched)
+
+	if output == outputJSON {
+		printJSON(matched)
+		return exitOK
+	}
+	for _, key := range matched {
+		fmt.Fprintln(stdout, key)
+	}
+	return exitOK
+}
+
+func scan(args []string) int {
+	fs := commandFlags("scan")
+	prefix := fs.String("prefix", "", "scan the keys beginning with this prefix")
+	after := fs.String("after", "", "scan the keys after this one")
+	limit := fs.Int("limit", 0, "the most keys to print (0 for all)")
+	if code := parseArgs(fs, args, 0, 0); code >= 0 {
+		return code
+	}
+
+	printed := 0
+	for next := *after; ; {
+		var items []kludge.Item
+		var err error
+		items, next, err = connect().Scan(*prefix, next, 0)
+		if err != nil {
+			return fail("scan failed", err)
+		}
+		for _, item := range items {
+			if *limit > 0 && printed == *limit {
+				return exitOK
+			}
+			if output == outputJSON {
+				printJSON(item)
+			} else {
+				fmt.Fprintf(stdout, "%s\t%s\n", item.Key, formatValue(item.Value))
+			}
+			printed++
+		}
+		if next == "" {
+			return exitOK
+		}
+	}
+}
+
+func export(args []string) int {
+	fs := commandFlags("export")
+	prefix := fs.String("prefix", "", "export the keys beginning with this prefix")
+	path := fs.String("o", "", "write the export to a file rather than standard output")
+	if code := parseArgs(fs, args, 0, 0); code >= 0 {
+		return code
+	}
+
+	var out io.Writer = stdout
+	var f *os.File
+	if *path != "" {
+		var err error
+		if f, err = os.Create(*path); err != nil {
+			return fail("failed to create export", err)
+		}
+		out = f
+	}
+	n, err := connect().Export(context.Background(), *prefix, out)
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return fail("export failed", err)
+	}
+	// An export is only complete once the file has been closed.
+	if f != nil {
+		if err = f.Close(); err != nil {
+			return fail("failed to write export", err)
+		}
+	}
+	fmt.Fprintf(stderr, "exported %d keys\n", n)
+	return exitOK
+}
+
+func importKeys(args []string) int {
+	fs := commandFlags("import")
+	mode := fs.String("mode", string(kludge.Overwrite),
+		"what to do with keys already present (overwrite, skip, fail)")
+	if code := parseArgs(fs, args, 0, 1); code >= 0 {
+		return code
+	}
+	switch kludge.BatchMode(*mode) {
+	case kludge.Overwrite, kludge.Skip, kludge.FailOnConflict:
+	default:
+		fmt.Fprintf(stderr, "[!] %s is not a supported import mode\n", *mode)
+		return exitUsage
+	}
+
+	var in io.Reader = stdin
+	if path := fs.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return fail("failed to open import", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	res, err := connect().Import(context.Background(), in, kludge.BatchMode(*mode))
+	if output == outputJSON {
+		printJSON(res)
+	} else {
+		fmt.Fprintf(stdout, "imported %d keys, skipped %d\n", res.Written, res.Skipped)
+		if len(res.Conflicts) > 0 {
+			fmt.Fprintln(stdout, "keys already present:", strings.Join(res.Conflicts, ", "))
+		}
+	}
+	if err != nil {
+		return fail("import failed", err)
+	}
+	return exitOK
+}
+
+func watch(args []string) int {
+	fs := commandFlags("watch")
+	prefix := fs.String("prefix", "", "watch the keys beginning with this prefix")
+	since := fs.Uint64("since", 0, "report the changes after this version")
+	if code := parseArgs(fs, args, 0, 1); code >= 0 {
+		return code
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		cancel()
+	}()
+
+	var events <-chan kludge.Event
+	var err error
+	if key := fs.Arg(0); key != "" {
+		events, err = connect().WatchKey(ctx, key, *since)
+	} else {
+		events, err = connect().Watch(ctx, *prefix, *since)
+	}
+	if err != nil {
+		return fail("watch failed", err)
+	}
+	for ev := range events {
+		switch {
+		case output == outputJSON:
+			printJSON(ev)
+		case ev.Lost:
+			fmt.Fprintln(stdout, "lost", ev.Version)
+		case ev.Deleted:
+			fmt.Fprintln(stdout, "del", ev.Key, ev.Version)
+		default:
+			fmt.Fprintln(stdout, "set", ev.Key, ev.Version)
+		}
+	}
+	return exitOK
+}
+
+func stats(args []string) int {
+	fs := commandFlags("stats")
+	if code := parseArgs(fs, args, 0, 0); code >= 0 {
+		return code
+	}
+	doc, err := connect().Stats()
+	if err != nil {
+		return fail("failed to get stats", err)
+	}
+	printDocument(doc)
+	return exitOK
+}
+
+func cluster(args []string) int {
+	fs := commandFlags("cluster")
+	if code := parseArgs(fs, args, 0, 1); code >= 0 {
+		return code
+	}
+
+	switch fs.Arg(0) {
+	case "", "members":
+		doc, err := connect().Cluster()
+		if err != nil {
+			return fail("failed to list the cluster", err)
+		}
+		printDocument(doc)
+	case "rebalance":
+		doc, err := connect().RebalanceStatus()
+		if err != nil {
+			return fail("failed to get rebalance status", err)
+		}
+		printDocument(doc)
+	case "cleanup":
+		removed, err := connect().Cleanup()
+		if err != nil {
+			return fail("cleanup failed", err)
+		}
+		if output == outputJSON {
+			printJSON(removed)
+			break
+		}
+		ids := make([]string, 0, len(removed))
+		for id := range removed {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			fmt.Fprintf(stdout, "%s: removed %d records\n", id, removed[id])
+		}
+	default:
+		fmt.Fprintf(stderr, "[!] %s is not a cluster command\n", fs.Arg(0))
+		return exitUsage
+	}
+	return exitOK
+}
+
+func diff(args []string) int {
+	fs := commandFlags("diff")
+	prefix := fs.String("prefix", "", "compare the keys beginning with this prefix")
+	depth := fs.Int("depth", 0, "depth of the hash trees compared (0 for the datastore's default)")
+	doSync := fs.Bool("sync", false, "copy the missing and different keys to the target")
+	deleteExtra := fs.Bool("delete", false, "with -sync, delete the keys only in the target")
+	if code := parseArgs(fs, args, 1, 1); code >= 0 {
+		return code
+	}
+	conn, err := kludge.ConnectCluster(addrList(fs.Arg(0)), nil)
+	if err != nil {
+		return fail("error connecting to target", err)
+	}
+	defer conn.Close()
+	target := inNamespace(conn)
+
+	src := connect()
+	ctx := context.Background()
+	res, err := kludge.Diff(ctx, src, target, *prefix, *depth)
+	if err != nil {
+		return fail("diff failed", err)
+	}
+	var synced *kludge.SyncResult
+	if *doSync && !res.Same() {
+		sres, err := kludge.Sync(ctx, src, target, res, *deleteExtra)
+		synced = &sres
+		if err != nil {
+			printDiff(res, synced)
+			return fail("sync failed", err)
+		}
+	}
+	printDiff(res, synced)
+	if res.Same() || synced != nil {
+		return exitOK
+	}
+	return exitDiffer
+}
+
+func printDiff(res kludge.DiffResult, synced *kludge.SyncResult) {
+	if output == outputJSON {
+		printJSON(struct {
+			kludge.DiffResult
+			Sync *kludge.SyncResult `json:"sync,omitempty"`
+		}{res, synced})
+		return
+	}
+	for _, key := range res.Missing {
+		fmt.Fprintln(stdout, "missing", key)
+	}
+	for _, key := range res.Extra {
+		fmt.Fprintln(stdout, "extra", key)
+	}
+	for _, key := range res.Different {
+		fmt.Fprintln(stdout, "differs", key)
+	}
+	fmt.Fprintf(stdout, "%d missing, %d extra, %d different\n", len(res.Missing),
+		len(res.Extra), len(res.Different))
+	if synced != nil {
+		fmt.Fprintf(stdout, "wrote %d keys, deleted %d\n", synced.Written, synced.Deleted)
+	}
+}
+
+func ns(args []string) int {
+	cmd := "list"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	fs := commandFlags("ns")
+	maxKeys := fs.Int64("keys", 0, "with limits, the most keys the namespace may hold (0 for no limit)")
+	maxBytes := fs.Int64("bytes", 0, "with limits, the most bytes of values it may hold (0 for no limit)")
+	maxRate := fs.Float64("rate", 0, "with limits, the most requests a second to each frontend (0 for no limit)")
+	if code := parseArgs(fs, args, 0, 1); code >= 0 {
+		return code
+	}
+	name := fs.Arg(0)
+	switch {
+	case cmd == "list" && name != "":
+		fmt.Fprintln(stderr, "[!] ns list takes no name")
+		return exitUsage
+	case cmd != "list" && cmd != "usage" && name == "":
+		fmt.Fprintf(stderr, "[!] ns %s needs the name of a namespace\n", cmd)
+		return exitUsage
+	}
+
+	var deleted int
+	var err error
+	switch cmd {
+	case "list":
+		list, err := connect().Namespaces()
+		if err != nil {
+			return fail("failed to list namespaces", err)
+		}
+		if output == outputJSON {
+			printJSON(list)
+			return exitOK
+		}
+		for _, ns := range list {
+			fmt.Fprintf(stdout, "%s\tcreated %s\n", ns.Name, ns.Created.Format(time.RFC3339))
+		}
+		return exitOK
+	case "create":
+		created, err := connect().CreateNamespace(name)
+		if err != nil {
+			return fail("failed to create namespace", err)
+		}
+		if output == outputJSON {
+			printJSON(created)
+		}
+		return exitOK
+	case "limits":
+		limits := kludge.Limits{MaxKeys: *maxKeys, MaxBytes: *maxBytes, MaxRate: *maxRate}
+		ns, err := connect().SetNamespaceLimits(name, limits)
+		if err != nil {
+			return fail("failed to set limits", err)
+		}
+		if output == outputJSON {
+			printJSON(ns)
+		}
+		return exitOK
+	case "usage":
+		var list []kludge.Usage
+		if name == "" {
+			list, err = connect().Usages()
+		} else if u, uerr := connect().NamespaceUsage(name); uerr == nil {
+			list = []kludge.Usage{*u}
+		} else {
+			err = uerr
+		}
+		if err != nil {
+			return fail("failed to get usage", err)
+		}
+		printUsage(list)
+		return exitOK
+	case "delete":
+		deleted, err = connect().DeleteNamespace(name)
+	case "clear":
+		deleted, err = connect().ClearNamespace(name)
+	default:
+		fmt.Fprintf(stderr, "[!] %s is not a namespace command\n", cmd)
+		return exitUsage
+	}
+	if err != nil {
+		return fail(cmd+" failed", err)
+	}
+	if output == outputJSON {
+		printJSON(map[string]int{"deleted": deleted})
+	} else {
+		fmt.Fprintf(stdout, "deleted %d keys\n", deleted)
+	}
+	return exitOK
+}
+
+// limitString formats a limit, of which zero is none.
+func limitString(limit int64) string {
+	if limit <= 0 {
+		return "-"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+func printUsage(list []kludge.Usage) {
+	if output == outputJSON {
+		printJSON(list)
+		return
+	}
+	fmt.Fprintf(stdout, "%-20s %10s %10s %12s %12s %8s\n", "namespace", "keys",
+		"max", "bytes", "max", "rate")
+	for _, u := range list {
+		rate := "-"
+		if u.Limits.MaxRate > 0 {
+			rate = strconv.FormatFloat(u.Limits.MaxRate, 'g', -1, 64)
+		}
+		fmt.Fprintf(stdout, "%-20s %10d %10s %12d %12s %8s\n", u.Name, u.Keys,
+			limitString(u.Limits.MaxKeys), u.Bytes,
+			limitString(u.Limits.MaxBytes), rate)
+	}
+}
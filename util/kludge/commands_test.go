@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gokyle/kludge/client/kludgetest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useServer points the commands at a test server.
+func useServer(srv *kludgetest.Server) {
+	disconnect()
+	addrs, namespace = srv.Addr(), ""
+}
+
+// disconnect closes the commands' connection, if they made one.
+func disconnect() {
+	if root != nil {
+		root.Close()
+	}
+	root, ds = nil, nil
+}
+
+// runCommand runs a command as the tool would, with the input given,
+// returning its exit code and what it wrote to standard output.
+func runCommand(input string, args ...string) (code int, out string) {
+	var outBuf, errBuf bytes.Buffer
+	stdin, stdout, stderr = strings.NewReader(input), &outBuf, &errBuf
+	output = outputText
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			code = cmd.run(args[1:])
+			return code, outBuf.String()
+		}
+	}
+	panic("no command " + args[0])
+}
+
+// A commandTest runs a command, checking its exit code and output. If
+// out is empty, the output is not checked.
+type commandTest struct {
+	args  []string
+	input string
+	code  int
+	out   string
+}
+
+func runCommandTests(t *testing.T, tests []commandTest) {
+	for _, test := range tests {
+		code, out := runCommand(test.input, test.args...)
+		if code != test.code {
+			fmt.Printf("[!] %v exited with %d, not %d (%s)\n", test.args,
+				code, test.code, stderr.(*bytes.Buffer).String())
+			t.FailNow()
+		}
+		if test.out != "" && out != test.out {
+			fmt.Printf("[!] %v printed %q, not %q\n", test.args, out, test.out)
+			t.FailNow()
+		}
+	}
+}
+
+func TestKeyCommands(t *testing.T) {
+	srv := kludgetest.NewServer()
+	defer srv.Close()
+	useServer(srv)
+	defer disconnect()
+	srv.Set("bin", []byte{0, 1, 'a'})
+
+	runCommandTests(t, []commandTest{
+		{args: []string{"set", "foo", "bar"}, out: "created foo\n"},
+		{args: []string{"set", "foo", "baz"}, out: "updated foo\n"},
+		{args: []string{"set", "-f", "-", "piped"}, input: "from stdin", out: "created piped\n"},
+		{args: []string{"set", "-json", "foo", "qux"}, out: `{"key":"foo","found":true}` + "\n"},
+		{args: []string{"get", "foo"}, out: "qux\n"},
+		{args: []string{"get", "piped"}, out: "from stdin\n"},
+		{args: []string{"get", "-raw", "foo"}, out: "qux"},
+		{args: []string{"get", "-hex", "foo"}, out: "717578\n"},
+		{args: []string{"get", "-base64", "foo"}, out: "cXV4\n"},
+		{args: []string{"get", "-json", "foo"}, out: `{"key":"foo","value":"cXV4","found":true}` + "\n"},
+		{args: []string{"get", "-raw", "bin"}, out: "\x00\x01a"},
+		{args: []string{"get", "-hex", "bin"}, out: "000161\n"},
+		{args: []string{"scan", "-prefix", "b"}, out: "bin\t\"\\x00\\x01a\"\n"},
+		{args: []string{"scan", "-hex", "-prefix", "b"}, out: "bin\t000161\n"},
+		{args: []string{"ls"}, out: "bin\nfoo\npiped\n"},
+		{args: []string{"ls", "-json", "p"}, out: `["piped"]` + "\n"},
+		{args: []string{"del", "foo"}, out: "deleted foo\n"},
+		{args: []string{"del", "-json", "piped"}, out: `{"key":"piped","found":true}` + "\n"},
+		{args: []string{"get", "foo"}, code: exitMissing},
+		{args: []string{"del", "foo"}, code: exitMissing},
+		{args: []string{"get", "-json", "foo"}, code: exitMissing, out: `{"key":"foo","found":false}` + "\n"},
+	})
+	if _, ok := srv.Get("foo"); ok {
+		fmt.Println("[!] deleted key is still present")
+		t.FailNow()
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	srv := kludgetest.NewServer()
+	defer srv.Close()
+	useServer(srv)
+	defer disconnect()
+
+	runCommandTests(t, []commandTest{
+		{args: []string{"get"}, code: exitUsage},
+		{args: []string{"get", "a", "b"}, code: exitUsage},
+		{args: []string{"get", "-bogus", "a"}, code: exitUsage},
+		{args: []string{"set", "-f", "file", "key", "value"}, code: exitUsage},
+		{args: []string{"del"}, code: exitUsage},
+		{args: []string{"scan", "extra"}, code: exitUsage},
+		{args: []string{"import", "-mode", "bogus"}, code: exitUsage},
+		{args: []string{"cluster", "bogus"}, code: exitUsage},
+		{args: []string{"ns", "create"}, code: exitUsage},
+		{args: []string{"diff"}, code: exitUsage},
+		{args: []string{"bench", "-reads", "101"}, code: exitUsage},
+		{args: []string{"get", "-h"}, code: exitOK},
+	})
+	if srv.Requests() != 0 {
+		fmt.Println("[!] usage errors made requests")
+		t.FailNow()
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	srv := kludgetest.NewServer()
+	defer srv.Close()
+	useServer(srv)
+	defer disconnect()
+	srv.Set("a", []byte("1"))
+	srv.Set("b", []byte("2"))
+
+	code, export := runCommand("", "export")
+	if code != exitOK || strings.Count(export, "\n") != 2 {
+		fmt.Printf("[!] export exited with %d, printing %q\n", code, export)
+		t.FailNow()
+	}
+	srv.Del("a")
+	srv.Set("b", []byte("changed"))
+
+	runCommandTests(t, []commandTest{
+		{args: []string{"import", "-mode", "skip"}, input: export, out: "imported 1 keys, skipped 1\n"},
+		{args: []string{"get", "b"}, out: "changed\n"},
+		{args: []string{"import", "-json"}, input: export, out: `{"written":2,"skipped":0}` + "\n"},
+		{args: []string{"get", "b"}, out: "2\n"},
+	})
+
+	dir, err := ioutil.TempDir("", "kludge")
+	if err != nil {
+		fmt.Println("[!] failed to create a temporary directory:", err.Error())
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "export.jsonl")
+	_, export = runCommand("", "export")
+	runCommandTests(t, []commandTest{
+		{args: []string{"export", "-o", path}},
+		{args: []string{"export", "-o", filepath.Join(dir, "missing", "export.jsonl")}, code: exitError},
+	})
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != export {
+		fmt.Printf("[!] export file holds %q (%v), not %q\n", data, err, export)
+		t.FailNow()
+	}
+
+	// A file that cannot be written fails the export.
+	if _, err = os.Stat("/dev/full"); err == nil {
+		runCommandTests(t, []commandTest{
+			{args: []string{"export", "-o", "/dev/full"}, code: exitError},
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	src := kludgetest.NewServer()
+	defer src.Close()
+	dst := kludgetest.NewServer()
+	defer dst.Close()
+	useServer(src)
+	defer disconnect()
+	src.Set("a", []byte("1"))
+	src.Set("b", []byte("2"))
+	src.Set("c", []byte("3"))
+	dst.Set("b", []byte("2"))
+	dst.Set("c", []byte("changed"))
+	dst.Set("d", []byte("4"))
+
+	runCommandTests(t, []commandTest{
+		{args: []string{"diff", dst.Addr()}, code: exitDiffer,
+			out: "missing a\nextra d\ndiffers c\n1 missing, 1 extra, 1 different\n"},
+		{args: []string{"diff", "-json", dst.Addr()}, code: exitDiffer,
+			out: `{"missing":["a"],"extra":["d"],"different":["c"]}` + "\n"},
+		{args: []string{"diff", "-prefix", "b", dst.Addr()}, out: "0 missing, 0 extra, 0 different\n"},
+		{args: []string{"diff", "-sync", dst.Addr()},
+			out: "missing a\nextra d\ndiffers c\n1 missing, 1 extra, 1 different\nwrote 2 keys, deleted 0\n"},
+		{args: []string{"diff", dst.Addr()}, code: exitDiffer, out: "extra d\n0 missing, 1 extra, 0 different\n"},
+		{args: []string{"diff", "-sync", "-delete", dst.Addr()},
+			out: "extra d\n0 missing, 1 extra, 0 different\nwrote 0 keys, deleted 1\n"},
+		{args: []string{"diff", dst.Addr()}, out: "0 missing, 0 extra, 0 different\n"},
+	})
+	if v, _ := dst.Get("c"); string(v) != "3" || strings.Join(dst.Keys(), ",") != "a,b,c" {
+		fmt.Printf("[!] sync left the target with %v, c=%q\n", dst.Keys(), v)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// errInterrupted is returned by readLine when the line is abandoned
+// with Ctrl-C.
+var errInterrupted = errors.New("interrupted")
+
+// A lineEditor reads lines from the terminal, with editing, a history
+// of the lines entered, and completion of the word before the cursor.
+// If its input is not a terminal, lines are read as they are.
+type lineEditor struct {
+	in      *bufio.Reader
+	out     io.Writer
+	fd      int
+	history []string
+
+	// complete returns the words that may replace the last word of
+	// the line, and the offset at which that word starts.
+	complete func(line string) (start int, candidates []string)
+}
+
+// newLineEditor returns an editor reading lines from in, which is
+// edited if it is a terminal, and echoing them to out.
+func newLineEditor(in io.Reader, out io.Writer) *lineEditor {
+	e := &lineEditor{in: bufio.NewReader(in), out: out, fd: -1}
+	if f, ok := in.(*os.File); ok {
+		e.fd = int(f.Fd())
+	}
+	return e
+}
+
+// addHistory adds a line to the history, unless it repeats the last.
+func (e *lineEditor) addHistory(line string) {
+	if n := len(e.history); line != "" && (n == 0 || e.history[n-1] != line) {
+		e.history = append(e.history, line)
+	}
+}
+
+// readLine reads a line, showing the prompt if the input is a
+// terminal.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	restore, err := rawMode(e.fd)
+	if err != nil {
+		line, err := e.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	defer restore()
+	return e.edit(prompt)
+}
+
+// edit reads a line in raw mode.
+func (e *lineEditor) edit(prompt string) (string, error) {
+	var buf []rune
+	pos := 0
+	hist := len(e.history)
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(buf))
+		if back := len(buf) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	setLine := func(line string) {
+		buf = []rune(line)
+		pos = len(buf)
+	}
+	redraw()
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(buf), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+		case 127, 8: // Backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(buf)
+		case 21: // Ctrl-U
+			buf, pos = buf[pos:], 0
+		case 11: // Ctrl-K
+			buf = buf[:pos]
+		case 16: // Ctrl-P
+			if hist > 0 {
+				hist--
+				setLine(e.history[hist])
+			}
+		case 14: // Ctrl-N
+			if hist < len(e.history) {
+				hist++
+				if hist == len(e.history) {
+					setLine("")
+				} else {
+					setLine(e.history[hist])
+				}
+			}
+		case '\t':
+			e.completeLine(&buf, &pos)
+		case 27: // an escape sequence, of which the arrows are handled
+			if b, _ := e.in.ReadByte(); b != '[' {
+				break
+			}
+			switch b, _ := e.in.ReadByte(); b {
+			case 'A':
+				if hist > 0 {
+					hist--
+					setLine(e.history[hist])
+				}
+			case 'B':
+				if hist < len(e.history) {
+					hist++
+					if hist == len(e.history) {
+						setLine("")
+					} else {
+						setLine(e.history[hist])
+					}
+				}
+			case 'C':
+				if pos < len(buf) {
+					pos++
+				}
+			case 'D':
+				if pos > 0 {
+					pos--
+				}
+			case '3': // Delete, sent as ESC [ 3 ~
+				e.in.ReadByte()
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+				}
+			}
+		default:
+			if r >= ' ' {
+				buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
+				pos++
+			}
+		}
+		redraw()
+	}
+}
+
+// completeLine completes the word before the cursor. A single
+// candidate replaces it; several extend it as far as they agree, or if
+// they agree no further, are listed.
+func (e *lineEditor) completeLine(buf *[]rune, pos *int) {
+	if e.complete == nil {
+		return
+	}
+	head := string((*buf)[:*pos])
+	tail := string((*buf)[*pos:])
+	start, candidates := e.complete(head)
+	if len(candidates) == 0 {
+		return
+	}
+	word := head[start:]
+
+	common := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(candidates) == 1 {
+		common += " "
+	} else if common == word {
+		fmt.Fprint(e.out, "\r\n")
+		fmt.Fprint(e.out, strings.Join(candidates, "  "))
+		fmt.Fprint(e.out, "\r\n")
+		return
+	}
+	*buf = []rune(head[:start] + common + tail)
+	*pos = len([]rune(head[:start] + common))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gokyle/kludge/client"
+	"io"
+	"os"
+	"strings"
+)
+
+// The exit codes. A command asked for a key that is not present exits
+// with exitMissing, and a diff that finds differences with exitDiffer,
+// so that scripts can tell them from a failure.
+const (
+	exitOK      = 0
+	exitError   = 1
+	exitUsage   = 2
+	exitMissing = 3
+	exitDiffer  = 4
+)
+
+// A command is a subcommand of the tool. Its function is given the
+// arguments after its name and returns the exit code.
+type command struct {
+	name string
+	args string
+	help string
+	run  func(args []string) int
+}
+
+var commands []*command
+
+// The connection to the datastore is root; ds is the connection the
+// commands use, which is in the namespace given with -ns, if any.
+var (
+	addrs     string
+	namespace string
+	root      *kludge.DataStore
+	ds        *kludge.DataStore
+)
+
+// The commands read from stdin and write to stdout and stderr, which
+// the tests replace.
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
+func init() {
+	commands = []*command{
+		{"get", "key", "print the value of a key", get},
+		{"set", "[-f file] key [value]", "set a key, from the value, a file or standard input", set},
+		{"del", "key", "delete a key", del},
+		{"ls", "[prefix]", "list the keys, or those beginning with a prefix", ls},
+		{"scan", "[-prefix p] [-after key] [-limit n]", "print keys with their values", scan},
+		{"export", "[-prefix p] [-o file]", "export keys as JSON Lines", export},
+		{"import", "[-mode overwrite|skip|fail] [file]", "import keys from JSON Lines", importKeys},
+		{"watch", "[-since version] [-prefix p | key]", "print changes to keys until interrupted", watch},
+		{"stats", "", "print the frontend's and nodes' counters", stats},
+		{"cluster", "[members|rebalance|cleanup]", "show the cluster or manage rebalancing", cluster},
+		{"repl", "[-pretty]", "start an interactive shell", repl},
+		{"bench", "[-c n] [-d duration] [-reads pct] [-keys n] [-dist uniform|zipfian] [-size n]",
+			"measure throughput and latency under a workload", bench},
+		{"diff", "[-prefix p] [-depth n] [-sync [-delete]] target",
+			"compare with the datastore at target, or make it match", diff},
+		{"ns", "[list | create | delete | clear | usage | limits [-keys n] [-bytes n] [-rate r]] [name]",
+			"manage namespaces, their keys and their limits", ns},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] command [arguments]\n\n",
+		os.Args[0])
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.args)
+		fmt.Fprintf(os.Stderr, "           %s\n", cmd.help)
+	}
+	fmt.Fprintln(os.Stderr, "\nOptions:")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "\nThe exit status is 0 on success, 1 on failure, 2 for a usage")
+	fmt.Fprintln(os.Stderr, "error, 3 if a key asked for is not present and 4 if diff finds")
+	fmt.Fprintln(os.Stderr, "differences.")
+}
+
+// addrList splits a comma-separated list of addresses, as given
+// with -a.
+func addrList(addrs string) []string {
+	var list []string
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			list = append(list, addr)
+		}
+	}
+	return list
+}
+
+// connect returns the connection to the datastore, making it on first
+// use.
+func connect() *kludge.DataStore {
+	if ds != nil {
+		return ds
+	}
+	var err error
+	root, err = kludge.ConnectCluster(addrList(addrs), nil)
+	if err != nil {
+		fmt.Fprintln(stderr, "[!] error connecting to datastore:", err.Error())
+		os.Exit(exitError)
+	}
+	ds = inNamespace(root)
+	return ds
+}
+
+// inNamespace returns a connection in the namespace given with -ns.
+func inNamespace(conn *kludge.DataStore) *kludge.DataStore {
+	if namespace == "" {
+		return conn
+	}
+	return conn.Namespace(namespace)
+}
+
+// fail reports an error, returning the exit code for it.
+func fail(what string, err error) int {
+	fmt.Fprintf(stderr, "[!] %s: %s\n", what, err.Error())
+	return exitError
+}
+
+// commandFlags returns the flag set for a command, which accepts the
+// output options as the tool itself does.
+func commandFlags(cmd string) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	outputFlags(fs)
+	return fs
+}
+
+func main() {
+	flag.StringVar(&addrs, "a", "127.0.0.1:8080",
+		"comma-separated list of Kludge API server addresses")
+	flag.StringVar(&namespace, "ns", "", "namespace to act in (default none)")
+	outputFlags(flag.CommandLine)
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	name := flag.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name == name {
+			code := cmd.run(flag.Args()[1:])
+			if root != nil {
+				root.Close()
+			}
+			os.Exit(code)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "[!] %s is not a supported command.\n", name)
+	usage()
+	os.Exit(exitUsage)
+}
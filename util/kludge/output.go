@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The output modes. Text is meant to be read; the others are meant
+// for scripts. In JSON mode, every result is printed as JSON, with
+// values base64-encoded as in an export. Raw, hex and base64 modes
+// change how values are printed: raw writes them as they are, with
+// nothing after them.
+const (
+	outputText   = "text"
+	outputJSON   = "json"
+	outputRaw    = "raw"
+	outputHex    = "hex"
+	outputBase64 = "base64"
+)
+
+var output = outputText
+
+// modeFlag is a boolean flag that selects an output mode when set.
+type modeFlag string
+
+func (m modeFlag) String() string { return "false" }
+
+func (m modeFlag) Set(s string) error {
+	set, err := strconv.ParseBool(s)
+	if err == nil && set {
+		output = string(m)
+	}
+	return err
+}
+
+func (m modeFlag) IsBoolFlag() bool { return true }
+
+// outputFlags adds the output mode flags to a flag set.
+func outputFlags(fs *flag.FlagSet) {
+	fs.Var(modeFlag(outputJSON), "json", "print results as JSON")
+	fs.Var(modeFlag(outputRaw), "raw", "print values as they are")
+	fs.Var(modeFlag(outputHex), "hex", "print values hex-encoded")
+	fs.Var(modeFlag(outputBase64), "base64", "print values base64-encoded")
+}
+
+// printable reports whether a value can be printed as text on a line
+// of its own.
+func printable(value []byte) bool {
+	if !utf8.Valid(value) {
+		return false
+	}
+	for _, r := range string(value) {
+		if !unicode.IsPrint(r) && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// formatValue returns a value as it is printed alongside other output.
+// In text mode, values that are not printable are quoted.
+func formatValue(value []byte) string {
+	switch output {
+	case outputHex:
+		return hex.EncodeToString(value)
+	case outputBase64, outputJSON:
+		return base64.StdEncoding.EncodeToString(value)
+	case outputRaw:
+		return string(value)
+	}
+	if printable(value) {
+		return string(value)
+	}
+	return strconv.Quote(string(value))
+}
+
+// printValue prints a value on its own: as it is in raw mode, and
+// otherwise as formatValue has it, on a line. Text values are printed
+// as they are, so that multi-line values read naturally.
+func printValue(value []byte) {
+	switch output {
+	case outputRaw:
+		stdout.Write(value)
+	case outputText:
+		stdout.Write(value)
+		if len(value) == 0 || value[len(value)-1] != '\n' {
+			fmt.Fprintln(stdout)
+		}
+	default:
+		fmt.Fprintln(stdout, formatValue(value))
+	}
+}
+
+// printJSON prints a result as a line of JSON.
+func printJSON(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		fail("failed to encode result", err)
+		return
+	}
+	fmt.Fprintln(stdout, string(data))
+}
+
+// printDocument prints JSON returned by the datastore: as it is in
+// JSON mode, and indented otherwise.
+func printDocument(doc json.RawMessage) {
+	if output == outputJSON {
+		fmt.Fprintln(stdout, string(doc))
+		return
+	}
+	var buf bytes.Buffer
+	if json.Indent(&buf, doc, "", "  ") != nil {
+		buf.Reset()
+		buf.Write(doc)
+	}
+	fmt.Fprintln(stdout, buf.String())
+}
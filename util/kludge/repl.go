@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	replPrompt = "kludge> "
+
+	// historyLines is the number of lines kept in the history file.
+	historyLines = 500
+
+	// completionLimit is the most keys offered for completion.
+	completionLimit = 50
+)
+
+// replCommands are the commands understood by the shell, in order.
+var replCommands = []string{"del", "exit", "get", "help", "ls", "pretty", "quit", "set"}
+
+// keyCommands are the shell commands whose argument is a key.
+var keyCommands = map[string]bool{"del": true, "get": true, "ls": true, "set": true}
+
+// A shell is an interactive session on one connection.
+type shell struct {
+	editor *lineEditor
+	out    io.Writer
+	pretty bool
+}
+
+// newShell returns a shell reading commands from in and writing to
+// out.
+func newShell(in io.Reader, out io.Writer) *shell {
+	sh := &shell{editor: newLineEditor(in, out), out: out}
+	sh.editor.complete = sh.complete
+	return sh
+}
+
+func historyPath() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".kludge_history")
+}
+
+func (sh *shell) loadHistory() {
+	path := historyPath()
+	if path == "" {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		sh.editor.addHistory(scanner.Text())
+	}
+}
+
+func (sh *shell) saveHistory() {
+	path := historyPath()
+	if path == "" {
+		return
+	}
+	history := sh.editor.history
+	if len(history) > historyLines {
+		history = history[len(history)-historyLines:]
+	}
+	var buf bytes.Buffer
+	for _, line := range history {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		fail("failed to save history", err)
+	}
+}
+
+// complete returns the completions of the last word of a line: command
+// names for the first word, and keys for the argument of a command
+// acting on a key. Keys are offered quoted as they must be typed.
+func (sh *shell) complete(line string) (start int, candidates []string) {
+	args, start, word, ok := partialArgs(line)
+	if !ok {
+		return 0, nil
+	}
+	if len(args) == 0 {
+		for _, cmd := range replCommands {
+			if strings.HasPrefix(cmd, word) {
+				candidates = append(candidates, cmd)
+			}
+		}
+		return start, candidates
+	}
+	if len(args) != 1 || !keyCommands[args[0]] {
+		return 0, nil
+	}
+	keys, _, err := ds.ScanKeys(word, "", completionLimit)
+	if err != nil {
+		return 0, nil
+	}
+	return start, quoteArgs(keys)
+}
+
+// partialArgs splits a line being typed into the arguments before its
+// last word and that word, which starts at the offset returned and may
+// be an unterminated quoted string. It returns false if the line
+// cannot be split.
+func partialArgs(line string) (args []string, start int, word string, ok bool) {
+	for {
+		rest := strings.TrimLeft(line[start:], " \t")
+		start = len(line) - len(rest)
+		if rest == "" {
+			return args, start, "", true
+		}
+		if !strings.HasPrefix(rest, "\"") {
+			i := strings.IndexAny(rest, " \t")
+			if i < 0 {
+				return args, start, rest, true
+			}
+			args = append(args, rest[:i])
+			start += i
+			continue
+		}
+		arg, after, err := nextArg(rest)
+		if err != nil {
+			word, err = strconv.Unquote(rest + "\"")
+			return args, start, word, err == nil
+		} else if after == "" && !strings.HasSuffix(rest, " ") && !strings.HasSuffix(rest, "\t") {
+			return args, start, arg, true
+		}
+		args = append(args, arg)
+		start = len(line) - len(after)
+	}
+}
+
+// quoteArgs returns arguments as they must be typed: if any of them
+// must be quoted, they all are, so that they share the prefix typed.
+func quoteArgs(args []string) []string {
+	quote := false
+	for _, arg := range args {
+		quote = quote || arg == "" || strings.HasPrefix(arg, "\"") ||
+			strings.IndexFunc(arg, func(r rune) bool {
+				return r == ' ' || r == '\t' || !strconv.IsPrint(r)
+			}) >= 0
+	}
+	if !quote {
+		return args
+	}
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = strconv.Quote(arg)
+	}
+	return quoted
+}
+
+// formatShellValue returns a value as the shell prints it, indenting
+// JSON values if pretty-printing is on.
+func (sh *shell) formatShellValue(value []byte) string {
+	if sh.pretty && json.Valid(value) {
+		var buf bytes.Buffer
+		if json.Indent(&buf, value, "", "  ") == nil {
+			return buf.String()
+		}
+	}
+	return formatValue(value)
+}
+
+func (sh *shell) help() {
+	fmt.Fprintln(sh.out, "get key           print the value of a key")
+	fmt.Fprintln(sh.out, "set key value     set a key; the value is the rest of the line")
+	fmt.Fprintln(sh.out, "del key           delete a key")
+	fmt.Fprintln(sh.out, "ls [prefix]       list the keys, or those beginning with a prefix")
+	fmt.Fprintln(sh.out, "pretty [on|off]   indent JSON values")
+	fmt.Fprintln(sh.out, "help              print this help")
+	fmt.Fprintln(sh.out, "exit, quit        leave the shell")
+	fmt.Fprintln(sh.out, "Keys and values may be quoted as Go strings, as in \"a key\\twith a tab\".")
+	fmt.Fprintln(sh.out, "Tab completes commands and keys.")
+}
+
+// nextArg splits the first argument from the rest of a line. An
+// argument is a word, or a string quoted as in Go, which may hold
+// spaces and escapes.
+func nextArg(line string) (arg, rest string, err error) {
+	line = strings.TrimLeft(line, " \t")
+	if !strings.HasPrefix(line, "\"") {
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			return line[:i], strings.TrimLeft(line[i:], " \t"), nil
+		}
+		return line, "", nil
+	}
+	end := 1
+	for end < len(line) && line[end] != '"' {
+		if line[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(line) {
+		return "", "", errors.New("unterminated quoted string")
+	}
+	end++
+	if end < len(line) && line[end] != ' ' && line[end] != '\t' {
+		return "", "", errors.New("a quoted string must end its argument")
+	}
+	if arg, err = strconv.Unquote(line[:end]); err != nil {
+		return "", "", err
+	}
+	return arg, strings.TrimLeft(line[end:], " \t"), nil
+}
+
+// splitArgs splits a line into its arguments.
+func splitArgs(line string) (args []string, err error) {
+	for line != "" {
+		var arg string
+		if arg, line, err = nextArg(line); err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// setArgs splits the arguments of set: a key, and a value that is the
+// rest of the line, unless it is a single quoted string.
+func setArgs(line string) (args []string, err error) {
+	key, value, err := nextArg(line)
+	if err != nil || key == "" {
+		return nil, err
+	} else if value == "" {
+		return []string{key}, nil
+	}
+	if strings.HasPrefix(value, "\"") {
+		if unquoted, rest, err := nextArg(value); err == nil && rest == "" {
+			value = unquoted
+		}
+	}
+	return []string{key, value}, nil
+}
+
+// run carries out a line, returning false when the shell should exit.
+func (sh *shell) run(line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return true
+	}
+	cmd, rest, _ := nextArg(line)
+	var args []string
+	var err error
+	if cmd == "set" {
+		args, err = setArgs(rest)
+	} else {
+		args, err = splitArgs(rest)
+	}
+	if err != nil {
+		fmt.Fprintln(sh.out, err.Error())
+		return true
+	}
+
+	switch cmd {
+	case "exit", "quit":
+		return false
+	case "help":
+		sh.help()
+	case "get":
+		if len(args) != 1 {
+			fmt.Fprintln(sh.out, "Usage: get key")
+			break
+		}
+		value, ok, err := ds.Get(args[0])
+		if err != nil {
+			fail("error getting value", err)
+		} else if !ok {
+			fmt.Fprintf(sh.out, "%s is not in the datastore\n", args[0])
+		} else {
+			fmt.Fprintln(sh.out, sh.formatShellValue(value))
+		}
+	case "set":
+		if len(args) != 2 {
+			fmt.Fprintln(sh.out, "Usage: set key value")
+			break
+		}
+		_, ok, err := ds.Set(args[0], []byte(args[1]))
+		if err != nil {
+			fail("error setting value", err)
+		} else if ok {
+			fmt.Fprintln(sh.out, "updated", args[0])
+		} else {
+			fmt.Fprintln(sh.out, "created", args[0])
+		}
+	case "del":
+		if len(args) != 1 {
+			fmt.Fprintln(sh.out, "Usage: del key")
+			break
+		}
+		_, ok, err := ds.Del(args[0])
+		if err != nil {
+			fail("error deleting key", err)
+		} else if !ok {
+			fmt.Fprintf(sh.out, "%s is not in the datastore\n", args[0])
+		} else {
+			fmt.Fprintln(sh.out, "deleted", args[0])
+		}
+	case "ls":
+		if len(args) > 1 {
+			fmt.Fprintln(sh.out, "Usage: ls [prefix]")
+			break
+		}
+		var prefix string
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		for next := ""; ; {
+			var keys []string
+			var err error
+			keys, next, err = ds.ScanKeys(prefix, next, 0)
+			if err != nil {
+				fail("failed to get keys", err)
+				break
+			}
+			for _, key := range keys {
+				fmt.Fprintln(sh.out, key)
+			}
+			if next == "" {
+				break
+			}
+		}
+	case "pretty":
+		switch {
+		case len(args) == 0:
+			sh.pretty = !sh.pretty
+		case len(args) == 1 && args[0] == "on":
+			sh.pretty = true
+		case len(args) == 1 && args[0] == "off":
+			sh.pretty = false
+		default:
+			fmt.Fprintln(sh.out, "Usage: pretty [on|off]")
+			return true
+		}
+		if sh.pretty {
+			fmt.Fprintln(sh.out, "pretty-printing JSON values")
+		} else {
+			fmt.Fprintln(sh.out, "printing values as they are")
+		}
+	default:
+		fmt.Fprintf(sh.out, "%s is not a shell command; try help\n", cmd)
+	}
+	return true
+}
+
+func repl(args []string) int {
+	fs := commandFlags("repl")
+	pretty := fs.Bool("pretty", false, "indent JSON values")
+	if code := parseArgs(fs, args, 0, 0); code >= 0 {
+		return code
+	}
+	connect()
+
+	sh := newShell(os.Stdin, stdout)
+	sh.pretty = *pretty
+	sh.loadHistory()
+	defer sh.saveHistory()
+	return sh.loop()
+}
+
+// loop reads and carries out commands until the input ends or the
+// shell is told to exit, returning the exit code.
+func (sh *shell) loop() int {
+	for {
+		line, err := sh.editor.readLine(replPrompt)
+		if err == errInterrupted {
+			continue
+		} else if err == io.EOF {
+			return exitOK
+		} else if err != nil {
+			return fail("failed to read command", err)
+		}
+		sh.editor.addHistory(strings.TrimSpace(line))
+		if !sh.run(line) {
+			return exitOK
+		}
+	}
+}
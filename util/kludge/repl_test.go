@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gokyle/kludge/client/kludgetest"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string
+		ok   bool
+	}{
+		{"", nil, true},
+		{"foo", []string{"foo"}, true},
+		{"  foo \t bar  ", []string{"foo", "bar"}, true},
+		{`"a key" b`, []string{"a key", "b"}, true},
+		{`"tab\there" "quote\"d" ""`, []string{"tab\there", `quote"d`, ""}, true},
+		{`"\x00é"`, []string{"\x00é"}, true},
+		{`no"quote`, []string{`no"quote`}, true},
+		{`"unterminated`, nil, false},
+		{`"ends\"`, nil, false},
+		{`"joined"word`, nil, false},
+		{`"bad \q escape"`, nil, false},
+	}
+	for _, test := range tests {
+		args, err := splitArgs(test.line)
+		if (err == nil) != test.ok {
+			fmt.Printf("[!] splitting %q returned %v\n", test.line, err)
+			t.FailNow()
+		}
+		if fmt.Sprintf("%q", args) != fmt.Sprintf("%q", test.args) {
+			fmt.Printf("[!] %q split into %q, not %q\n", test.line, args, test.args)
+			t.FailNow()
+		}
+	}
+}
+
+func TestSetArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string
+	}{
+		{"", nil},
+		{"key", []string{"key"}},
+		{"key hello  world", []string{"key", "hello  world"}},
+		{`key {"a": 1}`, []string{"key", `{"a": 1}`}},
+		{`"a key" "two\nlines"`, []string{"a key", "two\nlines"}},
+		{`key ""`, []string{"key", ""}},
+		{`key "a" "b"`, []string{"key", `"a" "b"`}},
+		{`key "unterminated`, []string{"key", `"unterminated`}},
+	}
+	for _, test := range tests {
+		args, err := setArgs(test.line)
+		if err != nil || fmt.Sprintf("%q", args) != fmt.Sprintf("%q", test.args) {
+			fmt.Printf("[!] set %q took %q (%v), not %q\n", test.line, args, err, test.args)
+			t.FailNow()
+		}
+	}
+}
+
+// runShell runs a shell session on the input, returning what it
+// printed.
+func runShell(t *testing.T, input string) string {
+	var out bytes.Buffer
+	sh := newShell(strings.NewReader(input), &out)
+	if code := sh.loop(); code != exitOK {
+		fmt.Println("[!] shell exited with", code)
+		t.FailNow()
+	}
+	return out.String()
+}
+
+func TestShell(t *testing.T) {
+	srv := kludgetest.NewServer()
+	defer srv.Close()
+	useServer(srv)
+	defer disconnect()
+	connect()
+	output = outputText
+
+	tests := []struct {
+		input string
+		out   string
+	}{
+		{"set foo bar baz\nget foo\n", "created foo\nbar baz\n"},
+		{"set foo  qux \n", "updated foo\n"},
+		{"set \"a key\" \"two\\nlines\"\nget \"a key\"\n", "created a key\n\"two\\nlines\"\n"},
+		{"ls\n", "a key\nfoo\n"},
+		{"ls f\nls \"a \"\n", "foo\na key\n"},
+		{"del \"a key\"\ndel \"a key\"\n", "deleted a key\na key is not in the datastore\n"},
+		{"get\nget a b\nset foo\ndel\nls a b\n", "Usage: get key\nUsage: get key\n" +
+			"Usage: set key value\nUsage: del key\nUsage: ls [prefix]\n"},
+		{"get \"foo\n", "unterminated quoted string\n"},
+		{"bogus\n", "bogus is not a shell command; try help\n"},
+		{"set j {\"a\":[1]}\npretty on\nget j\npretty\n", "created j\npretty-printing JSON values\n" +
+			"{\n  \"a\": [\n    1\n  ]\n}\nprinting values as they are\n"},
+		{"\n  \nexit\nget foo\n", ""},
+		{"quit", ""},
+	}
+	for _, test := range tests {
+		if out := runShell(t, test.input); out != test.out {
+			fmt.Printf("[!] %q printed %q, not %q\n", test.input, out, test.out)
+			t.FailNow()
+		}
+	}
+	if v, _ := srv.Get("foo"); string(v) != "qux" {
+		fmt.Printf("[!] the value set was %q, not the rest of the line\n", v)
+		t.FailNow()
+	}
+}
+
+func TestShellHistory(t *testing.T) {
+	sh := newShell(strings.NewReader("get a\n\nget a\nget b\n"), ioutil.Discard)
+	srv := kludgetest.NewServer()
+	defer srv.Close()
+	useServer(srv)
+	defer disconnect()
+	connect()
+
+	if code := sh.loop(); code != exitOK {
+		fmt.Println("[!] shell exited with", code)
+		t.FailNow()
+	}
+	if fmt.Sprint(sh.editor.history) != "[get a get b]" {
+		fmt.Println("[!] history is", sh.editor.history)
+		t.FailNow()
+	}
+}
+
+func TestLineEditor(t *testing.T) {
+	history := []string{"get foo", "set foo bar"}
+	tests := []struct {
+		keys string
+		line string
+		err  error
+	}{
+		{"get foo\r", "get foo", nil},
+		{"abc\x7f\x7fd\n", "ad", nil},
+		{"\x10\r", "set foo bar", nil},
+		{"\x10\x10\r", "get foo", nil},
+		{"\x10\x10\x10\r", "get foo", nil},
+		{"\x10\x10\x0e\r", "set foo bar", nil},
+		{"\x10\x0e\r", "", nil},
+		{"\x1b[A\x1b[A\r", "get foo", nil},
+		{"\x1b[A\x1b[A\x1b[B\r", "set foo bar", nil},
+		{"\x1b[A!\r", "set foo bar!", nil},
+		{"abc\x1b[D\x1b[DX\r", "aXbc", nil},
+		{"abc\x1b[D\x1b[D\x1b[CX\r", "abXc", nil},
+		{"abc\x01X\x05Y\r", "XabcY", nil},
+		{"abc\x1b[D\x15\r", "c", nil},
+		{"abc\x01\x1b[C\x0b\r", "a", nil},
+		{"abc\x01\x1b[3~\r", "bc", nil},
+		{"abc\x03", "", errInterrupted},
+		{"\x04", "", io.EOF},
+		{"a\x04\r", "a", nil},
+		{"abc", "", io.EOF},
+	}
+	for _, test := range tests {
+		e := newLineEditor(strings.NewReader(test.keys), ioutil.Discard)
+		e.history = history
+		line, err := e.edit("> ")
+		if line != test.line || err != test.err {
+			fmt.Printf("[!] %q read %q (%v), not %q (%v)\n", test.keys,
+				line, err, test.line, test.err)
+			t.FailNow()
+		}
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	complete := func(line string) (int, []string) {
+		start := strings.LastIndex(line, " ") + 1
+		var matched []string
+		for _, word := range []string{"get", "key1", "key2", "other"} {
+			if strings.HasPrefix(word, line[start:]) {
+				matched = append(matched, word)
+			}
+		}
+		return start, matched
+	}
+	tests := []struct {
+		keys  string
+		line  string
+		shown string
+	}{
+		{"g\t\r", "get ", ""},
+		{"get o\t\r", "get other ", ""},
+		{"get k\t\r", "get key", ""},
+		{"get key\t\r", "get key", "key1  key2"},
+		{"get x\t\r", "get x", ""},
+		{"ge\x01\t\r", "ge", ""},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		e := newLineEditor(strings.NewReader(test.keys), &out)
+		e.complete = complete
+		line, err := e.edit("> ")
+		if err != nil || line != test.line {
+			fmt.Printf("[!] %q completed to %q (%v), not %q\n", test.keys, line, err, test.line)
+			t.FailNow()
+		}
+		if test.shown != "" && !strings.Contains(out.String(), "\r\n"+test.shown+"\r\n") {
+			fmt.Printf("[!] %q did not list %q: %q\n", test.keys, test.shown, out.String())
+			t.FailNow()
+		}
+	}
+}
+
+func TestShellCompletion(t *testing.T) {
+	srv := kludgetest.NewServer()
+	defer srv.Close()
+	useServer(srv)
+	defer disconnect()
+	connect()
+	srv.Set("a key", []byte("1"))
+	srv.Set("ab", []byte("2"))
+	srv.Set("other", []byte("3"))
+
+	tests := []struct {
+		keys string
+		line string
+		args []string
+	}{
+		{"g\t\r", "get ", []string{"get"}},
+		{"get o\t\r", "get other ", []string{"get", "other"}},
+		{"get a\t\r", `get "a`, nil},
+		{"get a \t\r", "get a ", []string{"get", "a"}},
+		{"get \"a \t\r", `get "a key" `, []string{"get", "a key"}},
+		{"get \"a\t\t k\t\r", `get "a key" `, []string{"get", "a key"}},
+		{"get \"a key\"\t\r", `get "a key" `, []string{"get", "a key"}},
+		{"get \"ab\t\r", "get ab ", []string{"get", "ab"}},
+		{"ls a key\t\r", "ls a key", nil},
+	}
+	for _, test := range tests {
+		sh := newShell(strings.NewReader(test.keys), ioutil.Discard)
+		line, err := sh.editor.edit(replPrompt)
+		if err != nil || line != test.line {
+			fmt.Printf("[!] %q completed to %q (%v), not %q\n", test.keys, line, err, test.line)
+			t.FailNow()
+		}
+		if test.args == nil {
+			continue
+		}
+		if args, err := splitArgs(line); err != nil || fmt.Sprintf("%q", args) != fmt.Sprintf("%q", test.args) {
+			fmt.Printf("[!] %q split into %q (%v), not %q\n", line, args, err, test.args)
+			t.FailNow()
+		}
+	}
+}
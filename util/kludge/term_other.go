@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package main
+
+import "errors"
+
+// rawMode is not supported here; lines are read as the terminal
+// delivers them, without editing or completion.
+func rawMode(fd int) (restore func(), err error) {
+	return nil, errors.New("raw mode is not supported")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gokyle/kludge/client"
+	"github.com/gokyle/kludge/lincheck"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	addrs := flag.String("a", "127.0.0.1:8080",
+		"comma-separated list of frontend addresses")
+	flClients := flag.Int("c", 8, "number of concurrent clients")
+	flKeys := flag.Int("k", 4, "number of keys")
+	flOps := flag.Int("n", 100, "number of operations per client")
+	flSeed := flag.Int64("s", 0, "seed for the workload (0 uses the time)")
+	flVerbose := flag.Bool("v", false, "print the full history")
+	flag.Parse()
+
+	var frontends []*kludge.DataStore
+	for _, addr := range strings.Split(*addrs, ",") {
+		ds, err := kludge.Connect(strings.TrimSpace(addr), nil)
+		if err != nil {
+			fmt.Printf("[!] error connecting to %s: %s\n", addr, err.Error())
+			os.Exit(1)
+		}
+		frontends = append(frontends, ds)
+	}
+
+	var clients []lincheck.Client
+	for i := 0; i < *flClients; i++ {
+		clients = append(clients, frontends[i%len(frontends)])
+	}
+
+	now := time.Now().UnixNano()
+	if *flSeed == 0 {
+		*flSeed = now
+	}
+	w := lincheck.Workload{
+		Ops:    *flOps,
+		Keys:   *flKeys,
+		Prefix: fmt.Sprintf("lincheck-%d-", now),
+		Seed:   *flSeed,
+	}
+	fmt.Printf("[+] running %d clients for %d operations each (seed %d)\n",
+		len(clients), w.Ops, w.Seed)
+	ops := w.Run(clients).Ops()
+
+	failed := 0
+	for _, op := range ops {
+		if op.Failed() {
+			failed++
+		}
+		if *flVerbose {
+			fmt.Println("\t", op)
+		}
+	}
+	fmt.Printf("[+] recorded %d operations, %d failed\n", len(ops), failed)
+
+	res := lincheck.Check(ops)
+	if res.Linearizable {
+		fmt.Println("[+] history is linearizable")
+		return
+	}
+	fmt.Printf("[!] history of %s is not linearizable\n", res.Key)
+	fmt.Println("history:")
+	for _, op := range res.Ops {
+		fmt.Println("\t", op)
+	}
+	fmt.Println("longest linearization:")
+	for _, op := range res.Partial {
+		fmt.Println("\t", op)
+	}
+	os.Exit(1)
+}